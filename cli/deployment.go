@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -13,6 +14,7 @@ func init() {
 	register("deployment", runDeployments, `
 usage: flynn deployment
        flynn deployment timeout [<timeout>]
+       flynn deployment (pause|resume|promote|abort) [<id>]
 
 Manage app deployments
 
@@ -20,6 +22,26 @@ Commands:
     With no arguments, shows a list of deployments
 
 	timeout  gets or sets the number of seconds to wait for each job to start when deploying
+	pause    pauses the soak period of an in-progress canary deployment
+	resume   resumes the soak period of a paused canary deployment
+	promote  ends the soak period of a canary deployment and scales up the new release
+	abort    ends the soak period of a canary deployment and rolls it back
+
+	The pause, resume, promote and abort commands act on the app's
+	in-progress deployment unless a deployment ID is given.
+
+	Canary deployments are configured with the following app metadata:
+
+	    canary.count        number of jobs of each process type to start before the soak period (default 1)
+	    canary.soak_period  how long to watch the canary jobs for crashes, e.g. 10m (default 5m)
+	    canary.max_crashes  number of canary jobs which can crash before rolling back (default 0)
+
+	Blue-green deployments switch the app's HTTP routes to the new release
+	once all of its jobs are healthy, and keep the old release running so
+	that 'flynn release rollback' is instant. They are configured with the
+	following app metadata:
+
+	    blue_green.warm_period  how long to keep the old release running, e.g. 30m (default 10m)
 
 Examples:
 
@@ -34,6 +56,10 @@ Examples:
 
 	$ flynn deployment timeout
 	150
+
+	$ flynn deployment pause
+
+	$ flynn deployment promote
 `)
 }
 
@@ -44,6 +70,16 @@ func runDeployments(args *docopt.Args, client controller.Client) error {
 		}
 		return runGetDeployTimeout(args, client)
 	}
+	for _, action := range []ct.DeploymentAction{
+		ct.DeploymentActionPause,
+		ct.DeploymentActionResume,
+		ct.DeploymentActionPromote,
+		ct.DeploymentActionAbort,
+	} {
+		if args.Bool[string(action)] {
+			return runDeploymentAction(args, client, action)
+		}
+	}
 
 	deployments, err := client.DeploymentList(mustApp())
 	if err != nil {
@@ -79,3 +115,23 @@ func runSetDeployTimeout(args *docopt.Args, client controller.Client) error {
 		DeployTimeout: int32(timeout),
 	})
 }
+
+func runDeploymentAction(args *docopt.Args, client controller.Client, action ct.DeploymentAction) error {
+	id := args.String["<id>"]
+	if id == "" {
+		deployments, err := client.DeploymentList(mustApp())
+		if err != nil {
+			return err
+		}
+		for _, d := range deployments {
+			if d.FinishedAt == nil {
+				id = d.ID
+				break
+			}
+		}
+		if id == "" {
+			return errors.New("no deployment in progress")
+		}
+	}
+	return client.SetDeploymentAction(id, action)
+}
@@ -15,7 +15,7 @@ import (
 func init() {
 	register("env", runEnv, `
 usage: flynn env [-t <proc>]
-       flynn env set [-t <proc>] <var>=<val>...
+       flynn env set [-t <proc>] [--secret] <var>=<val>...
        flynn env unset [-t <proc>] <var>...
        flynn env get [-t <proc>] <var>
 
@@ -23,6 +23,7 @@ Manage app environment variables.
 
 Options:
 	-t, --process-type=<proc>  set or read env for specified process type
+	--secret                   encrypt the values at rest and hide them from output
 
 Commands:
 	With no arguments, shows a list of environment variables.
@@ -31,6 +32,11 @@ Commands:
 	unset  deletes one or more variables
 	get    returns the value of variable
 
+	Secret variables are only decrypted when starting the app's jobs, so
+	their values are hidden from the list of variables and can't be read
+	with get. Setting a secret variable again without --secret makes it a
+	normal variable. Secret variables can't be set for process types.
+
 Examples:
 
 	$ flynn env set FOO=bar BAZ=foobar
@@ -45,6 +51,13 @@ Examples:
 
 	$ flynn env unset FOO
 	Created release b1bbd9bc76d6436ea2fd245300bce72e.
+
+	$ flynn env set --secret DATABASE_PASSWORD=hunter2
+	Created release 8a5a3f3e0b2e4b3c9ad3bd3e4ba9c0f1.
+
+	$ flynn env
+	BAZ=foobar
+	DATABASE_PASSWORD=(secret)
 `)
 }
 
@@ -80,6 +93,9 @@ func runEnv(args *docopt.Args, client controller.Client) error {
 
 	vars := make([]string, 0, len(release.Env))
 	for k, v := range release.Env {
+		if ct.IsSecretEnvValue(v) {
+			v = "(secret)"
+		}
 		vars = append(vars, k+"="+v)
 	}
 	sort.Strings(vars)
@@ -100,7 +116,11 @@ func runEnvSet(args *docopt.Args, client controller.Client) error {
 		}
 		env[v[0]] = &v[1]
 	}
-	id, err := setEnv(client, envProc, env)
+	secret := args.Bool["--secret"]
+	if secret && envProc != "" {
+		return errors.New("secret variables can't be set for process types")
+	}
+	id, err := setEnv(client, envProc, env, secret)
 	if err != nil {
 		return err
 	}
@@ -114,7 +134,7 @@ func runEnvUnset(args *docopt.Args, client controller.Client) error {
 	for _, s := range vars {
 		env[s] = nil
 	}
-	id, err := setEnv(client, envProc, env)
+	id, err := setEnv(client, envProc, env, false)
 	if err != nil {
 		return err
 	}
@@ -137,6 +157,9 @@ func runEnvGet(args *docopt.Args, client controller.Client) error {
 	}
 
 	if v, ok := release.Env[arg]; ok {
+		if ct.IsSecretEnvValue(v) {
+			return fmt.Errorf("var %q is secret, so its value can't be read", arg)
+		}
 		fmt.Println(v)
 		return nil
 	}
@@ -148,7 +171,9 @@ func runEnvGet(args *docopt.Args, client controller.Client) error {
 	return fmt.Errorf("var %q not found in release %q", arg, release.ID)
 }
 
-func setEnv(client controller.Client, proc string, env map[string]*string) (string, error) {
+// setEnv creates and deploys a release with the given variables set, or unset
+// if their values are nil, encrypting the values at rest if secret is true
+func setEnv(client controller.Client, proc string, env map[string]*string, secret bool) (string, error) {
 	app, err := client.GetApp(mustApp())
 	if err != nil {
 		return "", err
@@ -188,6 +213,25 @@ func setEnv(client controller.Client, proc string, env map[string]*string) (stri
 			dest[k] = *v
 		}
 	}
+	if proc == "" {
+		// variables which are set or unset are only secret if set with
+		// secret, other variables stay secret as their values are
+		// already encrypted
+		secretEnv := make([]string, 0, len(release.SecretEnv)+len(env))
+		for _, k := range release.SecretEnv {
+			if _, ok := env[k]; !ok {
+				secretEnv = append(secretEnv, k)
+			}
+		}
+		if secret {
+			for k, v := range env {
+				if v != nil {
+					secretEnv = append(secretEnv, k)
+				}
+			}
+		}
+		release.SecretEnv = secretEnv
+	}
 
 	release.ID = ""
 	if err := client.CreateRelease(app.ID, release); err != nil {
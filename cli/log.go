@@ -44,6 +44,7 @@ func runLog(args *docopt.Args, client controller.Client) error {
 		StreamTypes: []logagg.StreamType{
 			logagg.StreamTypeStdout,
 			logagg.StreamTypeStderr,
+			logagg.StreamTypeRouter,
 		},
 	}
 	if ptype, ok := args.String["--process-type"]; ok {
@@ -86,7 +87,7 @@ func runLog(args *docopt.Args, client controller.Client) error {
 
 		var stream io.Writer
 		switch msg.Stream {
-		case logagg.StreamTypeStdout:
+		case logagg.StreamTypeStdout, logagg.StreamTypeRouter:
 			stream = os.Stdout
 		case logagg.StreamTypeStderr:
 			stream = stderr
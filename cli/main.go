@@ -60,6 +60,7 @@ Commands:
 	mongodb     manage mongodb database
 	redis       manage redis database
 	provider    manage resource providers
+	token       manage API tokens
 	docker      deploy Docker images to a Flynn cluster
 	remote      manage git remotes
 	resource    provision a new resource
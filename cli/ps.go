@@ -86,7 +86,11 @@ func runPs(args *docopt.Args, client controller.Client) error {
 		if j.CreatedAt != nil {
 			created = units.HumanDuration(time.Now().UTC().Sub(*j.CreatedAt)) + " ago"
 		}
-		fields := []interface{}{id, j.Type, j.State, created, j.ReleaseID}
+		state := string(j.State)
+		if j.State == ct.JobStatePending && j.PendingReason != nil {
+			state = fmt.Sprintf("%s (%s)", state, *j.PendingReason)
+		}
+		fields := []interface{}{id, j.Type, state, created, j.ReleaseID}
 		if args.Bool["--command"] {
 			fields = append(fields, strings.Join(j.Args, " "))
 		}
@@ -68,7 +68,7 @@ func runResourceAdd(args *docopt.Args, client controller.Client) error {
 		env[k] = &s
 	}
 
-	releaseID, err := setEnv(client, "", env)
+	releaseID, err := setEnv(client, "", env, false)
 	if err != nil {
 		return err
 	}
@@ -101,7 +101,7 @@ func runResourceRemove(args *docopt.Args, client controller.Client) error {
 		}
 	}
 
-	releaseID, err := setEnv(client, "", env)
+	releaseID, err := setEnv(client, "", env, false)
 	if err != nil {
 		return err
 	}
@@ -10,37 +10,108 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/docker/go-units"
 	"github.com/flynn/flynn/controller/client"
 	"github.com/flynn/flynn/router/types"
 	"github.com/flynn/go-docopt"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func init() {
 	register("route", runRoute, `
 usage: flynn route
-       flynn route add http [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] [--leader] [--no-leader] [--no-drain-backends] <domain>
-       flynn route add tcp [-s <service>] [-p <port>] [--leader] [--no-drain-backends]
-       flynn route update <id> [-s <service>] [-c <tls-cert> -k <tls-key>] [--sticky] [--no-sticky] [--leader] [--no-leader]
+       flynn route add http [-s <service>] [-w <weights>] [-c <tls-cert> -k <tls-key>] [--auto-tls] [--backend-protocol=<proto>] [--sticky] [--leader] [--no-leader] [--no-drain-backends] [--rate-limit=<rps>] [--rate-limit-burst=<n>] [--max-conns=<n>] [--health-check] [--health-check-path=<path>] [--health-check-interval=<interval>] [--health-check-timeout=<timeout>] [--unhealthy-threshold=<n>] [--healthy-threshold=<n>] [--access-log] [--access-log-sample-rate=<rate>] [--set-request-header=<header>...] [--add-request-header=<header>...] [--remove-request-header=<name>...] [--set-response-header=<header>...] [--add-response-header=<header>...] [--remove-response-header=<name>...] [--https-redirect] [--redirect=<domain>] [--redirect-status=<code>] [--strip-prefix] [--allow-ip=<ip>...] [--deny-ip=<ip>...] [--basic-auth=<credentials>...] [--basic-auth-realm=<realm>] [--cache] [--cache-max-memory=<size>] [--cache-max-disk=<size>] [--cache-max-object-size=<size>] [--compress] [--compress-min-size=<size>] [--compress-type=<type>...] [--upstream-timeout=<timeout>] [--circuit-breaker] [--circuit-breaker-failures=<n>] [--circuit-breaker-cooldown=<cooldown>] [--retry-budget] [--retry-budget-ratio=<ratio>] [--load-balancer=<algorithm>] [--hash-header=<header>] [--hash-cookie=<cookie>] [--mirror=<service>] [--mirror-percentage=<percentage>] <domain>
+       flynn route add tcp [-s <service>] [-p <port>] [--leader] [--no-drain-backends] [--rate-limit=<rps>] [--rate-limit-burst=<n>] [--max-conns=<n>] [--health-check] [--health-check-interval=<interval>] [--health-check-timeout=<timeout>] [--unhealthy-threshold=<n>] [--healthy-threshold=<n>] [--proxy-protocol=<version>]
+       flynn route add tls [-s <service>] [--leader] [--no-drain-backends] [--rate-limit=<rps>] [--rate-limit-burst=<n>] [--max-conns=<n>] [--health-check] [--health-check-interval=<interval>] [--health-check-timeout=<timeout>] [--unhealthy-threshold=<n>] [--healthy-threshold=<n>] <domain>
+       flynn route add udp [-s <service>] [-p <port>] [--leader] [--idle-timeout=<timeout>]
+       flynn route update <id> [-s <service>] [-w <weights>] [--no-weights] [-c <tls-cert> -k <tls-key>] [--auto-tls] [--no-auto-tls] [--backend-protocol=<proto>] [--sticky] [--no-sticky] [--leader] [--no-leader] [--rate-limit=<rps>] [--rate-limit-burst=<n>] [--max-conns=<n>] [--health-check] [--health-check-path=<path>] [--health-check-interval=<interval>] [--health-check-timeout=<timeout>] [--unhealthy-threshold=<n>] [--healthy-threshold=<n>] [--no-health-check] [--access-log] [--access-log-sample-rate=<rate>] [--no-access-log] [--set-request-header=<header>...] [--add-request-header=<header>...] [--remove-request-header=<name>...] [--set-response-header=<header>...] [--add-response-header=<header>...] [--remove-response-header=<name>...] [--no-header-rules] [--https-redirect] [--no-https-redirect] [--redirect=<domain>] [--redirect-status=<code>] [--no-redirect] [--strip-prefix] [--no-strip-prefix] [--allow-ip=<ip>...] [--deny-ip=<ip>...] [--basic-auth=<credentials>...] [--basic-auth-realm=<realm>] [--no-ip-lists] [--no-basic-auth] [--cache] [--cache-max-memory=<size>] [--cache-max-disk=<size>] [--cache-max-object-size=<size>] [--no-cache] [--compress] [--compress-min-size=<size>] [--compress-type=<type>...] [--no-compress] [--upstream-timeout=<timeout>] [--circuit-breaker] [--circuit-breaker-failures=<n>] [--circuit-breaker-cooldown=<cooldown>] [--no-circuit-breaker] [--retry-budget] [--retry-budget-ratio=<ratio>] [--no-retry-budget] [--load-balancer=<algorithm>] [--hash-header=<header>] [--hash-cookie=<cookie>] [--mirror=<service>] [--mirror-percentage=<percentage>] [--no-mirror] [--idle-timeout=<timeout>] [--proxy-protocol=<version>] [--no-proxy-protocol]
        flynn route remove <id>
 
 Manage routes for application.
 
 Options:
 	-s, --service=<service>    service name to route domain to (defaults to APPNAME-web)
+	-w, --weights=<weights>    comma separated SERVICE=WEIGHT pairs to split traffic between (http only)
+	--no-weights               stop splitting traffic between weighted services (update http only)
 	-c, --tls-cert=<tls-cert>  path to PEM encoded certificate for TLS, - for stdin (http only)
 	-k, --tls-key=<tls-key>    path to PEM encoded private key for TLS, - for stdin (http only)
+	--auto-tls                 automatically obtain and renew a TLS certificate using ACME (http only)
+	--no-auto-tls              stop automatically obtaining TLS certificates (update http only)
+	--backend-protocol=<proto> protocol to proxy requests to backends with, http1 or h2c for HTTP/2 backends such as gRPC servers (http only)
 	--sticky                   enable cookie-based sticky routing (http only)
 	--no-sticky                disable cookie-based sticky routing (update http only)
 	--leader                   enable leader-only routing mode
 	--no-leader                disable leader-only routing mode (update only)
-	-p, --port=<port>          port to accept traffic on (tcp only)
+	-p, --port=<port>          port to accept traffic on (tcp and udp only)
 	--no-drain-backends        don't wait for in-flight requests to complete before stopping backends
+	--rate-limit=<rps>         maximum requests (or connections for tcp) per second from each client IP, 0 for no limit
+	--rate-limit-burst=<n>     number of requests a client can make at once before the rate limit applies
+	--max-conns=<n>            maximum number of concurrent upstream connections, 0 for no limit
+	--health-check             actively health check backends, ejecting them while they fail
+	--health-check-path=<path>          path to request when health checking backends (http only, defaults to /)
+	--health-check-interval=<interval>  time between health checks (e.g. 10s, defaults to 5s)
+	--health-check-timeout=<timeout>    maximum duration of a health check (defaults to 2s)
+	--unhealthy-threshold=<n>  consecutive failed health checks before a backend is ejected (defaults to 2)
+	--healthy-threshold=<n>    consecutive passed health checks before a backend is restored (defaults to 2)
+	--no-health-check          stop health checking backends (update only)
+	--access-log               send access logs of proxied requests to the app's log (http only)
+	--access-log-sample-rate=<rate>     proportion of requests to log, between 0 and 1 (http only, defaults to 1)
+	--no-access-log            stop sending access logs to the app's log (update http only)
+	--set-request-header=<header>       set a request header sent to backends, formatted as NAME:VALUE (http only)
+	--add-request-header=<header>       add a request header sent to backends, formatted as NAME:VALUE (http only)
+	--remove-request-header=<name>      remove a request header before it is sent to backends (http only)
+	--set-response-header=<header>      set a response header sent to clients, formatted as NAME:VALUE (http only)
+	--add-response-header=<header>      add a response header sent to clients, formatted as NAME:VALUE (http only)
+	--remove-response-header=<name>     remove a response header before it is sent to clients (http only)
+	--no-header-rules          remove all request and response header rules (update http only)
+	--https-redirect           redirect requests made without TLS to HTTPS (http only)
+	--no-https-redirect        stop redirecting requests to HTTPS (update http only)
+	--redirect=<domain>        redirect requests to another domain rather than proxying them (http only)
+	--redirect-status=<code>   status code of redirects to another domain, 301 or 302 (http only, defaults to 301)
+	--no-redirect              stop redirecting requests to another domain (update http only)
+	--strip-prefix             remove the route's path from requests before proxying them (http only)
+	--no-strip-prefix          stop removing the route's path from requests (update http only)
+	--allow-ip=<ip>            only accept requests from this IP address or CIDR range, may be repeated (http only)
+	--deny-ip=<ip>             reject requests from this IP address or CIDR range, may be repeated (http only)
+	--no-ip-lists              remove the allowed and denied IP lists (update http only)
+	--basic-auth=<credentials>          require HTTP basic auth, with credentials formatted as USER:PASSWORD, may be repeated (http only)
+	--basic-auth-realm=<realm>          realm sent to clients when requesting basic auth (http only, defaults to Restricted)
+	--no-basic-auth            stop requiring HTTP basic auth (update http only)
+	--cache                    cache responses which allow it using their Cache-Control and Expires headers (http only)
+	--cache-max-memory=<size>  maximum size of responses cached in memory, e.g. 64m (http only, defaults to 32m)
+	--cache-max-disk=<size>    maximum size of responses cached on disk once memory is full, e.g. 1g (http only, defaults to none)
+	--cache-max-object-size=<size>      maximum size of a cached response (http only, defaults to 1m)
+	--no-cache                 stop caching responses (update http only)
+	--compress                 compress responses with gzip for clients which accept it (http only)
+	--compress-min-size=<size>          minimum size of compressed responses, e.g. 2k (http only, defaults to 1k)
+	--compress-type=<type>     content type to compress, e.g. text/* or application/json, may be repeated (http only, defaults to common text types)
+	--no-compress              stop compressing responses (update http only)
+	--upstream-timeout=<timeout>        maximum time to wait for response headers from a backend, e.g. 30s (http only, defaults to 10m)
+	--circuit-breaker          stop sending requests to backends which fail consecutive requests (http only)
+	--circuit-breaker-failures=<n>      consecutive failures which open a backend's circuit breaker (http only, defaults to 5)
+	--circuit-breaker-cooldown=<cooldown>  time a circuit breaker stays open before trying the backend again (http only, defaults to 30s)
+	--no-circuit-breaker       stop using circuit breakers (update http only)
+	--retry-budget             retry failed idempotent requests on other backends, limited to a proportion of requests (http only)
+	--retry-budget-ratio=<ratio>        maximum retries as a proportion of requests (http only, defaults to 0.2)
+	--no-retry-budget          stop retrying failed idempotent requests (update http only)
+	--load-balancer=<algorithm>         algorithm to choose backends with, random, round-robin, least-requests or hash (http only, defaults to random)
+	--hash-header=<header>     request header to hash with the hash load balancer (http only)
+	--hash-cookie=<cookie>     request cookie to hash with the hash load balancer (http only)
+	--mirror=<service>         send copies of requests to another service, discarding its responses (http only)
+	--mirror-percentage=<percentage>    percentage of requests to mirror, between 0 and 100 (http only, defaults to 100)
+	--no-mirror                stop mirroring requests (update http only)
+	--idle-timeout=<timeout>   time a client's session is kept after its last datagram, e.g. 30s (udp only, defaults to 1m)
+	--proxy-protocol=<version> send a PROXY protocol header (v1 or v2) so backends see the addresses of clients (tcp only)
+	--no-proxy-protocol        stop sending PROXY protocol headers (update tcp only)
 
 Commands:
 	With no arguments, shows a list of routes.
 
-	add     adds a route to an app
+	add     adds a route to an app, tls routes forward TLS connections to the
+	        HTTPS port with a matching server name to the service without
+	        terminating them
 	remove  removes a route
 
 Examples:
@@ -49,9 +120,45 @@ Examples:
 
 	$ flynn route add http example.com/path/
 
+	$ flynn route add http --auto-tls example.com
+
+	$ flynn route add http -s myapp-grpc --backend-protocol=h2c example.com/helloworld.Greeter/
+
+	$ flynn route add http -w myapp-web=9,myapp-next-web=1 example.com
+
 	$ flynn route add tcp
 
 	$ flynn route add tcp --leader
+
+	$ flynn route add tcp -s myapp-smtp --proxy-protocol=v2
+
+	$ flynn route add tls -s myapp-mtls secure.example.com
+
+	$ flynn route add udp -s myapp-dns -p 3053 --idle-timeout=10s
+
+	$ flynn route add http --rate-limit=10 --rate-limit-burst=20 --max-conns=100 example.com
+
+	$ flynn route add http --health-check-path=/status --health-check-interval=10s example.com
+
+	$ flynn route add http --access-log-sample-rate=0.1 example.com
+
+	$ flynn route add http --https-redirect --set-response-header="Strict-Transport-Security: max-age=31536000" example.com
+
+	$ flynn route add http --redirect=example.com --redirect-status=302 www.example.com
+
+	$ flynn route add http -s myapp-api --strip-prefix example.com/api/
+
+	$ flynn route add http --allow-ip=10.0.0.0/8 --basic-auth=staging:secret staging.example.com
+
+	$ flynn route add http --cache --cache-max-disk=1g example.com/assets/
+
+	$ flynn route add http --compress --compress-type=text/* --compress-type=application/json example.com
+
+	$ flynn route add http --upstream-timeout=30s --circuit-breaker --retry-budget example.com
+
+	$ flynn route add http --load-balancer=hash --hash-cookie=session example.com
+
+	$ flynn route add http --mirror=myapp-next-web --mirror-percentage=10 example.com
 `)
 }
 
@@ -62,6 +169,10 @@ func runRoute(args *docopt.Args, client controller.Client) error {
 			return runRouteAddHTTP(args, client)
 		case args.Bool["tcp"]:
 			return runRouteAddTCP(args, client)
+		case args.Bool["tls"]:
+			return runRouteAddTLS(args, client)
+		case args.Bool["udp"]:
+			return runRouteAddUDP(args, client)
 		default:
 			return fmt.Errorf("Route type %s not supported.", args.String["-t"])
 		}
@@ -72,6 +183,10 @@ func runRoute(args *docopt.Args, client controller.Client) error {
 			return runRouteUpdateHTTP(args, client)
 		case "tcp":
 			return runRouteUpdateTCP(args, client)
+		case "tls":
+			return runRouteUpdateTLS(args, client)
+		case "udp":
+			return runRouteUpdateUDP(args, client)
 		default:
 			return fmt.Errorf("Route type %s not supported.", typ)
 		}
@@ -95,6 +210,14 @@ func runRoute(args *docopt.Args, client controller.Client) error {
 			protocol = "tcp"
 			route = strconv.Itoa(k.TCPRoute().Port)
 			service = k.TCPRoute().Service
+		case "tls":
+			protocol = "tls"
+			route = k.TLSRoute().Domain
+			service = k.TLSRoute().Service
+		case "udp":
+			protocol = "udp"
+			route = strconv.Itoa(k.UDPRoute().Port)
+			service = k.UDPRoute().Service
 		case "http":
 			route = k.HTTPRoute().Domain
 			service = k.TCPRoute().Service
@@ -104,6 +227,9 @@ func runRoute(args *docopt.Args, client controller.Client) error {
 			} else {
 				protocol = "https"
 			}
+			if len(k.Services) > 0 {
+				service = formatWeightedServices(k.Services)
+			}
 			sticky = fmt.Sprintf("%t", k.Sticky)
 			path = k.HTTPRoute().Path
 		}
@@ -135,6 +261,13 @@ func runRouteAddTCP(args *docopt.Args, client controller.Client) error {
 	}
 
 	r := hr.ToRoute()
+	if _, err := parseRouteLimits(args, r); err != nil {
+		return err
+	}
+	if _, err := parseHealthCheck(args, r); err != nil {
+		return err
+	}
+	parseProxyProtocol(args, r)
 	if err := client.CreateRoute(mustApp(), r); err != nil {
 		return err
 	}
@@ -143,6 +276,96 @@ func runRouteAddTCP(args *docopt.Args, client controller.Client) error {
 	return nil
 }
 
+// parseProxyProtocol sets the version of the PROXY protocol the route sends to
+// its backends from the given args, returning whether it was changed
+func parseProxyProtocol(args *docopt.Args, r *router.Route) bool {
+	if args.Bool["--no-proxy-protocol"] {
+		r.ProxyProtocol = ""
+		return true
+	}
+	if version := args.String["--proxy-protocol"]; version != "" {
+		r.ProxyProtocol = version
+		return true
+	}
+	return false
+}
+
+func runRouteAddTLS(args *docopt.Args, client controller.Client) error {
+	service := args.String["--service"]
+	if service == "" {
+		service = mustApp() + "-web"
+	}
+
+	hr := &router.TLSRoute{
+		Service:       service,
+		Domain:        args.String["<domain>"],
+		Leader:        args.Bool["--leader"],
+		DrainBackends: !args.Bool["--no-drain-backends"],
+	}
+
+	r := hr.ToRoute()
+	if _, err := parseRouteLimits(args, r); err != nil {
+		return err
+	}
+	if _, err := parseHealthCheck(args, r); err != nil {
+		return err
+	}
+	if err := client.CreateRoute(mustApp(), r); err != nil {
+		return err
+	}
+	hr = r.TLSRoute()
+	fmt.Printf("%s forwarding TLS connections for %s\n", hr.FormattedID(), hr.Domain)
+	return nil
+}
+
+func runRouteAddUDP(args *docopt.Args, client controller.Client) error {
+	service := args.String["--service"]
+	if service == "" {
+		service = mustApp() + "-web"
+	}
+
+	port := 0
+	if args.String["--port"] != "" {
+		p, err := strconv.Atoi(args.String["--port"])
+		if err != nil {
+			return err
+		}
+		port = p
+	}
+
+	ur := &router.UDPRoute{
+		Service: service,
+		Port:    port,
+		Leader:  args.Bool["--leader"],
+	}
+
+	r := ur.ToRoute()
+	if _, err := parseIdleTimeout(args, r); err != nil {
+		return err
+	}
+	if err := client.CreateRoute(mustApp(), r); err != nil {
+		return err
+	}
+	ur = r.UDPRoute()
+	fmt.Printf("%s listening on port %d\n", ur.FormattedID(), ur.Port)
+	return nil
+}
+
+// parseIdleTimeout sets the session idle timeout of a UDP route, returning
+// whether it was given
+func parseIdleTimeout(args *docopt.Args, r *router.Route) (bool, error) {
+	s := args.String["--idle-timeout"]
+	if s == "" {
+		return false, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil {
+		return false, fmt.Errorf("Invalid idle timeout %q: %s", s, err)
+	}
+	r.IdleTimeout = timeout
+	return true, nil
+}
+
 func runRouteAddHTTP(args *docopt.Args, client controller.Client) error {
 	service := args.String["--service"]
 	if service == "" {
@@ -159,8 +382,17 @@ func runRouteAddHTTP(args *docopt.Args, client controller.Client) error {
 		return fmt.Errorf("Failed to parse %s as URL", args.String["<domain>"])
 	}
 
+	services, err := parseWeightedServices(args.String["--weights"])
+	if err != nil {
+		return err
+	}
+	if len(services) > 0 && args.String["--service"] == "" {
+		service = services[0].Service
+	}
+
 	hr := &router.HTTPRoute{
 		Service:       service,
+		Services:      services,
 		Domain:        u.Host,
 		LegacyTLSCert: tlsCert,
 		LegacyTLSKey:  tlsKey,
@@ -168,8 +400,39 @@ func runRouteAddHTTP(args *docopt.Args, client controller.Client) error {
 		Leader:        args.Bool["--leader"],
 		Path:          u.Path,
 		DrainBackends: !args.Bool["--no-drain-backends"],
+		AutoTLS:       args.Bool["--auto-tls"],
+
+		BackendProtocol: args.String["--backend-protocol"],
 	}
 	route := hr.ToRoute()
+	if _, err := parseRouteLimits(args, route); err != nil {
+		return err
+	}
+	if _, err := parseHealthCheck(args, route); err != nil {
+		return err
+	}
+	if err := parseAccessLog(args, route); err != nil {
+		return err
+	}
+	if err := parseRewrites(args, route); err != nil {
+		return err
+	}
+	if err := parseAccessControl(args, route); err != nil {
+		return err
+	}
+	if err := parseCache(args, route); err != nil {
+		return err
+	}
+	if err := parseCompression(args, route); err != nil {
+		return err
+	}
+	if err := parseResilience(args, route); err != nil {
+		return err
+	}
+	parseLoadBalancer(args, route)
+	if err := parseMirror(args, route); err != nil {
+		return err
+	}
 	if err := client.CreateRoute(mustApp(), route); err != nil {
 		return err
 	}
@@ -186,11 +449,21 @@ func runRouteUpdateTCP(args *docopt.Args, client controller.Client) error {
 		return err
 	}
 
-	service := args.String["--service"]
-	if service == "" {
+	limits, err := parseRouteLimits(args, route)
+	if err != nil {
+		return err
+	}
+	healthCheck, err := parseHealthCheck(args, route)
+	if err != nil {
+		return err
+	}
+	proxyProtocol := parseProxyProtocol(args, route)
+
+	if service := args.String["--service"]; service != "" {
+		route.Service = service
+	} else if !limits && !healthCheck && !proxyProtocol {
 		return errors.New("No service name given")
 	}
-	route.Service = service
 
 	if args.Bool["--leader"] {
 		route.Leader = true
@@ -206,6 +479,78 @@ func runRouteUpdateTCP(args *docopt.Args, client controller.Client) error {
 	return nil
 }
 
+func runRouteUpdateTLS(args *docopt.Args, client controller.Client) error {
+	id := args.String["<id>"]
+	appName := mustApp()
+
+	route, err := client.GetRoute(appName, id)
+	if err != nil {
+		return err
+	}
+
+	limits, err := parseRouteLimits(args, route)
+	if err != nil {
+		return err
+	}
+	healthCheck, err := parseHealthCheck(args, route)
+	if err != nil {
+		return err
+	}
+
+	if service := args.String["--service"]; service != "" {
+		route.Service = service
+	} else if !limits && !healthCheck && !args.Bool["--leader"] && !args.Bool["--no-leader"] {
+		return errors.New("No service name given")
+	}
+
+	if args.Bool["--leader"] {
+		route.Leader = true
+	} else if args.Bool["--no-leader"] {
+		route.Leader = false
+	}
+
+	if err := client.UpdateRoute(appName, id, route); err != nil {
+		return err
+	}
+	hr := route.TLSRoute()
+	fmt.Printf("%s forwarding TLS connections for %s\n", hr.FormattedID(), hr.Domain)
+	return nil
+}
+
+func runRouteUpdateUDP(args *docopt.Args, client controller.Client) error {
+	id := args.String["<id>"]
+	appName := mustApp()
+
+	route, err := client.GetRoute(appName, id)
+	if err != nil {
+		return err
+	}
+
+	idleTimeout, err := parseIdleTimeout(args, route)
+	if err != nil {
+		return err
+	}
+
+	if service := args.String["--service"]; service != "" {
+		route.Service = service
+	} else if !idleTimeout && !args.Bool["--leader"] && !args.Bool["--no-leader"] {
+		return errors.New("No service name given")
+	}
+
+	if args.Bool["--leader"] {
+		route.Leader = true
+	} else if args.Bool["--no-leader"] {
+		route.Leader = false
+	}
+
+	if err := client.UpdateRoute(appName, id, route); err != nil {
+		return err
+	}
+	ur := route.UDPRoute()
+	fmt.Printf("%s listening on port %d\n", ur.FormattedID(), ur.Port)
+	return nil
+}
+
 func runRouteUpdateHTTP(args *docopt.Args, client controller.Client) error {
 	id := args.String["<id>"]
 	appName := mustApp()
@@ -219,6 +564,44 @@ func runRouteUpdateHTTP(args *docopt.Args, client controller.Client) error {
 		route.Service = service
 	}
 
+	if _, err := parseRouteLimits(args, route); err != nil {
+		return err
+	}
+	if _, err := parseHealthCheck(args, route); err != nil {
+		return err
+	}
+	if err := parseAccessLog(args, route); err != nil {
+		return err
+	}
+	if err := parseRewrites(args, route); err != nil {
+		return err
+	}
+	if err := parseAccessControl(args, route); err != nil {
+		return err
+	}
+	if err := parseCache(args, route); err != nil {
+		return err
+	}
+	if err := parseCompression(args, route); err != nil {
+		return err
+	}
+	if err := parseResilience(args, route); err != nil {
+		return err
+	}
+	parseLoadBalancer(args, route)
+	if err := parseMirror(args, route); err != nil {
+		return err
+	}
+
+	if args.Bool["--no-weights"] {
+		route.Services = nil
+	} else if weights := args.String["--weights"]; weights != "" {
+		route.Services, err = parseWeightedServices(weights)
+		if err != nil {
+			return err
+		}
+	}
+
 	route.Certificate = nil
 	route.LegacyTLSCert, route.LegacyTLSKey, err = parseTLSCert(args)
 	if err != nil {
@@ -231,6 +614,16 @@ func runRouteUpdateHTTP(args *docopt.Args, client controller.Client) error {
 		route.Sticky = false
 	}
 
+	if args.Bool["--auto-tls"] {
+		route.AutoTLS = true
+	} else if args.Bool["--no-auto-tls"] {
+		route.AutoTLS = false
+	}
+
+	if proto := args.String["--backend-protocol"]; proto != "" {
+		route.BackendProtocol = proto
+	}
+
 	if args.Bool["--leader"] {
 		route.Leader = true
 	} else if args.Bool["--no-leader"] {
@@ -244,6 +637,466 @@ func runRouteUpdateHTTP(args *docopt.Args, client controller.Client) error {
 	return nil
 }
 
+// parseWeightedServices parses a comma separated list of SERVICE=WEIGHT pairs
+func parseWeightedServices(s string) ([]*router.WeightedService, error) {
+	if s == "" {
+		return nil, nil
+	}
+	pairs := strings.Split(s, ",")
+	services := make([]*router.WeightedService, len(pairs))
+	for i, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid weighted service %q, expected SERVICE=WEIGHT", pair)
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("Invalid weight for service %q, must be a positive integer", kv[0])
+		}
+		services[i] = &router.WeightedService{Service: kv[0], Weight: weight}
+	}
+	return services, nil
+}
+
+// parseRouteLimits sets the rate and connection limits of the route from the
+// given arguments, returning whether any were set
+func parseRouteLimits(args *docopt.Args, route *router.Route) (bool, error) {
+	var set bool
+	if s := args.String["--rate-limit"]; s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate < 0 {
+			return false, fmt.Errorf("Invalid rate limit %q, must be a non-negative number", s)
+		}
+		route.RateLimit = rate
+		set = true
+	}
+	if s := args.String["--rate-limit-burst"]; s != "" {
+		burst, err := strconv.Atoi(s)
+		if err != nil || burst < 0 {
+			return false, fmt.Errorf("Invalid rate limit burst %q, must be a non-negative integer", s)
+		}
+		route.RateLimitBurst = burst
+		set = true
+	}
+	if s := args.String["--max-conns"]; s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return false, fmt.Errorf("Invalid max connections %q, must be a non-negative integer", s)
+		}
+		route.MaxConns = n
+		set = true
+	}
+	if route.RateLimit == 0 {
+		if args.String["--rate-limit-burst"] != "" {
+			return false, errors.New("Cannot set --rate-limit-burst without a rate limit, use --rate-limit")
+		}
+		route.RateLimitBurst = 0
+	}
+	return set, nil
+}
+
+// parseHealthCheck sets the active health check of the route from the given
+// arguments, returning whether it was changed
+func parseHealthCheck(args *docopt.Args, route *router.Route) (bool, error) {
+	if args.Bool["--no-health-check"] {
+		route.HealthCheck = nil
+		return true, nil
+	}
+	set := args.Bool["--health-check"]
+	hc := route.HealthCheck
+	if hc == nil {
+		hc = &router.HealthCheck{}
+	}
+	if path := args.String["--health-check-path"]; path != "" {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		hc.Path = path
+		set = true
+	}
+	for flag, d := range map[string]*time.Duration{
+		"--health-check-interval": &hc.Interval,
+		"--health-check-timeout":  &hc.Timeout,
+	} {
+		if s := args.String[flag]; s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				return false, fmt.Errorf("Invalid %s %q, must be a positive duration", flag, s)
+			}
+			*d = v
+			set = true
+		}
+	}
+	for flag, n := range map[string]*int{
+		"--unhealthy-threshold": &hc.UnhealthyThreshold,
+		"--healthy-threshold":   &hc.HealthyThreshold,
+	} {
+		if s := args.String[flag]; s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 {
+				return false, fmt.Errorf("Invalid %s %q, must be a positive integer", flag, s)
+			}
+			*n = v
+			set = true
+		}
+	}
+	if set {
+		route.HealthCheck = hc
+	}
+	return set, nil
+}
+
+// parseAccessLog sets the access log configuration of the route from the
+// given arguments
+func parseAccessLog(args *docopt.Args, route *router.Route) error {
+	if args.Bool["--no-access-log"] {
+		route.AccessLog = nil
+		return nil
+	}
+	set := args.Bool["--access-log"]
+	al := route.AccessLog
+	if al == nil {
+		al = &router.AccessLog{}
+	}
+	if s := args.String["--access-log-sample-rate"]; s != "" {
+		rate, err := strconv.ParseFloat(s, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return fmt.Errorf("Invalid access log sample rate %q, must be greater than 0 and at most 1", s)
+		}
+		al.SampleRate = rate
+		set = true
+	}
+	if set {
+		route.AccessLog = al
+	}
+	return nil
+}
+
+// parseRewrites sets the header rules, redirects and prefix stripping of the
+// route from the given arguments
+func parseRewrites(args *docopt.Args, route *router.Route) (err error) {
+	if args.Bool["--no-header-rules"] {
+		route.RequestHeaders = nil
+		route.ResponseHeaders = nil
+	}
+	if route.RequestHeaders, err = parseHeaderRules(args, "request", route.RequestHeaders); err != nil {
+		return err
+	}
+	if route.ResponseHeaders, err = parseHeaderRules(args, "response", route.ResponseHeaders); err != nil {
+		return err
+	}
+
+	if args.Bool["--https-redirect"] {
+		route.HTTPSRedirect = true
+	} else if args.Bool["--no-https-redirect"] {
+		route.HTTPSRedirect = false
+	}
+
+	if args.Bool["--no-redirect"] {
+		route.Redirect = nil
+	} else if domain := args.String["--redirect"]; domain != "" {
+		route.Redirect = &router.Redirect{Domain: domain}
+	}
+	if s := args.String["--redirect-status"]; s != "" {
+		if route.Redirect == nil {
+			return errors.New("--redirect-status requires --redirect")
+		}
+		status, err := strconv.Atoi(s)
+		if err != nil || (status != 301 && status != 302) {
+			return fmt.Errorf("Invalid redirect status %q, must be 301 or 302", s)
+		}
+		route.Redirect.Status = status
+	}
+
+	if args.Bool["--strip-prefix"] {
+		route.StripPrefix = true
+	} else if args.Bool["--no-strip-prefix"] {
+		route.StripPrefix = false
+	}
+	return nil
+}
+
+// parseAccessControl sets the IP lists and basic auth of the route from the
+// given arguments, hashing basic auth passwords so that they are not sent to
+// the controller in plain text
+func parseAccessControl(args *docopt.Args, route *router.Route) error {
+	if args.Bool["--no-ip-lists"] {
+		route.AllowIPs = nil
+		route.DenyIPs = nil
+	}
+	if ips, _ := args.All["--allow-ip"].([]string); len(ips) > 0 {
+		route.AllowIPs = ips
+	}
+	if ips, _ := args.All["--deny-ip"].([]string); len(ips) > 0 {
+		route.DenyIPs = ips
+	}
+
+	if args.Bool["--no-basic-auth"] {
+		route.BasicAuth = nil
+	}
+	credentials, _ := args.All["--basic-auth"].([]string)
+	realm := args.String["--basic-auth-realm"]
+	if len(credentials) == 0 && realm == "" {
+		return nil
+	}
+	if route.BasicAuth == nil {
+		route.BasicAuth = &router.BasicAuth{}
+	}
+	if route.BasicAuth.Users == nil {
+		route.BasicAuth.Users = make(map[string]string, len(credentials))
+	}
+	for _, c := range credentials {
+		kv := strings.SplitN(c, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid basic auth credentials %q, expected USER:PASSWORD", c)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(kv[1]), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		route.BasicAuth.Users[kv[0]] = string(hash)
+	}
+	if realm != "" {
+		route.BasicAuth.Realm = realm
+	}
+	return nil
+}
+
+// parseCache sets the response cache configuration of the route from the
+// given arguments
+func parseCache(args *docopt.Args, route *router.Route) error {
+	if args.Bool["--no-cache"] {
+		route.Cache = nil
+		return nil
+	}
+	set := args.Bool["--cache"]
+	cache := route.Cache
+	if cache == nil {
+		cache = &router.Cache{}
+	}
+	for flag, size := range map[string]*int64{
+		"--cache-max-memory":      &cache.MaxMemory,
+		"--cache-max-disk":        &cache.MaxDisk,
+		"--cache-max-object-size": &cache.MaxObjectSize,
+	} {
+		s := args.String[flag]
+		if s == "" {
+			continue
+		}
+		n, err := units.RAMInBytes(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid %s %q", strings.TrimPrefix(flag, "--"), s)
+		}
+		*size = n
+		set = true
+	}
+	if set {
+		route.Cache = cache
+	}
+	return nil
+}
+
+// parseCompression sets the response compression configuration of the route
+// from the given arguments
+func parseCompression(args *docopt.Args, route *router.Route) error {
+	if args.Bool["--no-compress"] {
+		route.Compression = nil
+		return nil
+	}
+	set := args.Bool["--compress"]
+	compression := route.Compression
+	if compression == nil {
+		compression = &router.Compression{}
+	}
+	if s := args.String["--compress-min-size"]; s != "" {
+		n, err := units.RAMInBytes(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid compress-min-size %q", s)
+		}
+		compression.MinSize = n
+		set = true
+	}
+	if types, _ := args.All["--compress-type"].([]string); len(types) > 0 {
+		compression.Types = types
+		set = true
+	}
+	if set {
+		route.Compression = compression
+	}
+	return nil
+}
+
+// parseResilience sets the upstream timeout, circuit breaker and retry budget
+// of the route from the given arguments
+func parseResilience(args *docopt.Args, route *router.Route) error {
+	if s := args.String["--upstream-timeout"]; s != "" {
+		v, err := time.ParseDuration(s)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("Invalid --upstream-timeout %q, must be a positive duration", s)
+		}
+		route.UpstreamTimeout = v
+	}
+
+	if args.Bool["--no-circuit-breaker"] {
+		route.CircuitBreaker = nil
+	} else {
+		set := args.Bool["--circuit-breaker"]
+		cb := route.CircuitBreaker
+		if cb == nil {
+			cb = &router.CircuitBreaker{}
+		}
+		if s := args.String["--circuit-breaker-failures"]; s != "" {
+			v, err := strconv.Atoi(s)
+			if err != nil || v < 1 {
+				return fmt.Errorf("Invalid --circuit-breaker-failures %q, must be a positive integer", s)
+			}
+			cb.ConsecutiveFailures = v
+			set = true
+		}
+		if s := args.String["--circuit-breaker-cooldown"]; s != "" {
+			v, err := time.ParseDuration(s)
+			if err != nil || v <= 0 {
+				return fmt.Errorf("Invalid --circuit-breaker-cooldown %q, must be a positive duration", s)
+			}
+			cb.Cooldown = v
+			set = true
+		}
+		if set {
+			route.CircuitBreaker = cb
+		}
+	}
+
+	if args.Bool["--no-retry-budget"] {
+		route.RetryBudget = nil
+	} else {
+		set := args.Bool["--retry-budget"]
+		rb := route.RetryBudget
+		if rb == nil {
+			rb = &router.RetryBudget{}
+		}
+		if s := args.String["--retry-budget-ratio"]; s != "" {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil || v <= 0 {
+				return fmt.Errorf("Invalid --retry-budget-ratio %q, must be a positive number", s)
+			}
+			rb.Ratio = v
+			set = true
+		}
+		if set {
+			route.RetryBudget = rb
+		}
+	}
+	return nil
+}
+
+// parseLoadBalancer sets the load balancing algorithm of the route from the
+// given arguments
+func parseLoadBalancer(args *docopt.Args, route *router.Route) {
+	algorithm := args.String["--load-balancer"]
+	header := args.String["--hash-header"]
+	cookie := args.String["--hash-cookie"]
+	if algorithm == "" && header == "" && cookie == "" {
+		return
+	}
+	lb := route.LoadBalancer
+	if lb == nil {
+		lb = &router.LoadBalancer{Algorithm: router.LoadBalancerRandom}
+	}
+	if algorithm != "" {
+		lb.Algorithm = algorithm
+	}
+	if header != "" || cookie != "" {
+		lb.Algorithm = router.LoadBalancerHash
+		lb.HashHeader = header
+		lb.HashCookie = cookie
+	} else if lb.Algorithm != router.LoadBalancerHash {
+		lb.HashHeader = ""
+		lb.HashCookie = ""
+	}
+	route.LoadBalancer = lb
+}
+
+// parseMirror sets the service which requests to the route are mirrored to
+// from the given arguments
+func parseMirror(args *docopt.Args, route *router.Route) error {
+	if args.Bool["--no-mirror"] {
+		route.Mirror = nil
+		return nil
+	}
+	m := route.Mirror
+	if service := args.String["--mirror"]; service != "" {
+		if m == nil {
+			m = &router.Mirror{}
+		}
+		m.Service = service
+	}
+	if s := args.String["--mirror-percentage"]; s != "" {
+		if m == nil {
+			return errors.New("--mirror-percentage requires --mirror")
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 || v > 100 {
+			return fmt.Errorf("Invalid --mirror-percentage %q, must be between 0 and 100", s)
+		}
+		m.Percentage = v
+	}
+	route.Mirror = m
+	return nil
+}
+
+// parseHeaderRules adds the header rules given by the --set-<typ>-header,
+// --add-<typ>-header and --remove-<typ>-header arguments to rules
+func parseHeaderRules(args *docopt.Args, typ string, rules *router.HeaderRules) (*router.HeaderRules, error) {
+	set, _ := args.All["--set-"+typ+"-header"].([]string)
+	add, _ := args.All["--add-"+typ+"-header"].([]string)
+	remove, _ := args.All["--remove-"+typ+"-header"].([]string)
+	if len(set) == 0 && len(add) == 0 && len(remove) == 0 {
+		return rules, nil
+	}
+	if rules == nil {
+		rules = &router.HeaderRules{}
+	}
+	for _, header := range set {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if rules.Set == nil {
+			rules.Set = make(map[string]string)
+		}
+		rules.Set[name] = value
+	}
+	for _, header := range add {
+		name, value, err := parseHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if rules.Add == nil {
+			rules.Add = make(map[string]string)
+		}
+		rules.Add[name] = value
+	}
+	rules.Remove = append(rules.Remove, remove...)
+	return rules, nil
+}
+
+// parseHeader parses a header formatted as NAME:VALUE
+func parseHeader(s string) (string, string, error) {
+	kv := strings.SplitN(s, ":", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return "", "", fmt.Errorf("Invalid header %q, expected NAME:VALUE", s)
+	}
+	return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]), nil
+}
+
+func formatWeightedServices(services []*router.WeightedService) string {
+	pairs := make([]string, len(services))
+	for i, s := range services {
+		pairs[i] = fmt.Sprintf("%s=%d", s.Service, s.Weight)
+	}
+	return strings.Join(pairs, ",")
+}
+
 func parseTLSCert(args *docopt.Args) (string, string, error) {
 	tlsCertPath := args.String["--tls-cert"]
 	tlsKeyPath := args.String["--tls-key"]
@@ -29,6 +29,9 @@ db=3,disk=ssd,mem=high # 3 db processes, distributed amongst hosts tagged with
 
 Ommitting the arguments will show the current scale.
 
+Jobs which cannot be placed in the cluster, for example if a process type's
+spread rule cannot be satisfied, are shown as pending along with the reason.
+
 Options:
 	-n, --no-wait            don't wait for the scaling events to happen
 	-r, --release=<release>  id of release to scale (defaults to current app release)
@@ -191,7 +194,13 @@ func runScale(args *docopt.Args, client controller.Client) error {
 		if id == "" {
 			id = job.UUID
 		}
-		fmt.Printf("%s ==> %s %s %s\n", time.Now().Format("15:04:05.000"), job.Type, id, job.State)
+		state := string(job.State)
+		if job.State == ct.JobStatePending && job.PendingReason != nil {
+			// the job cannot currently be placed (e.g. a spread rule
+			// cannot be satisfied), so show why
+			state = fmt.Sprintf("%s (%s)", state, *job.PendingReason)
+		}
+		fmt.Printf("%s ==> %s %s %s\n", time.Now().Format("15:04:05.000"), job.Type, id, state)
 		return nil
 	})
 
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/go-docopt"
+)
+
+func init() {
+	register("token", runToken, `
+usage: flynn token
+       flynn token add [-s <scope>...] [--app=<app>...] <name>
+       flynn token remove <id>
+
+Manage API tokens.
+
+Tokens can be used in place of the cluster's key, with each request limited
+to the token's scopes and, if any are given, its apps.
+
+Options:
+	-s, --scope=<scope>  scope of the token, may be repeated (defaults to read-only)
+	--app=<app>          only permit requests which act on this app, may be repeated
+
+Scopes:
+	read-only  read apps, releases, formations, jobs, logs and events
+	deploy     create artifacts and releases, deploy them and run jobs
+	scale      change formations and kill jobs
+	admin      make any request
+
+	Every scope permits reading.
+
+Commands:
+	With no arguments, shows a list of tokens.
+
+	add     creates a token and prints its key, which can't be shown again
+	remove  revokes a token
+
+Examples:
+
+	$ flynn token add -s deploy --app=myapp ci
+	Created token ci (2aa7b1ed-3aa6-4bfa-9f5b-8a1b0e1a8a52) with key:
+	3c5ed0a2e7c9b8bd4e8a3a8e5d41f2f5c39b6e1c4c1d7a4f0e6b2d9a1c3e5f70
+
+	$ flynn token
+	ID                                    NAME  SCOPES  APPS   LAST USED      CREATED
+	2aa7b1ed-3aa6-4bfa-9f5b-8a1b0e1a8a52  ci    deploy  myapp  2 minutes ago  5 minutes ago
+
+	$ flynn token remove 2aa7b1ed-3aa6-4bfa-9f5b-8a1b0e1a8a52
+`)
+}
+
+func runToken(args *docopt.Args, client controller.Client) error {
+	if args.Bool["add"] {
+		return runTokenAdd(args, client)
+	} else if args.Bool["remove"] {
+		return runTokenRemove(args, client)
+	}
+
+	tokens, err := client.ListTokens()
+	if err != nil {
+		return err
+	}
+	apps, err := client.AppList()
+	if err != nil {
+		return err
+	}
+	appNames := make(map[string]string, len(apps))
+	for _, app := range apps {
+		appNames[app.ID] = app.Name
+	}
+
+	w := tabWriter()
+	defer w.Flush()
+
+	listRec(w, "ID", "NAME", "SCOPES", "APPS", "LAST USED", "CREATED")
+	for _, t := range tokens {
+		scopes := make([]string, len(t.Scopes))
+		for i, s := range t.Scopes {
+			scopes[i] = string(s)
+		}
+		names := make([]string, len(t.AppIDs))
+		for i, id := range t.AppIDs {
+			if name, ok := appNames[id]; ok {
+				names[i] = name
+			} else {
+				names[i] = id
+			}
+		}
+		listRec(w, t.ID, t.Name, strings.Join(scopes, ","), strings.Join(names, ","), humanTime(t.LastUsedAt), humanTime(t.CreatedAt))
+	}
+	return nil
+}
+
+func runTokenAdd(args *docopt.Args, client controller.Client) error {
+	token := &ct.Token{Name: args.String["<name>"]}
+	scopes, _ := args.All["--scope"].([]string)
+	for _, s := range scopes {
+		token.Scopes = append(token.Scopes, ct.TokenScope(s))
+	}
+	if len(token.Scopes) == 0 {
+		token.Scopes = []ct.TokenScope{ct.TokenScopeReadOnly}
+	}
+	apps, _ := args.All["--app"].([]string)
+	for _, name := range apps {
+		app, err := client.GetApp(name)
+		if err != nil {
+			return fmt.Errorf("Error getting app %q: %s", name, err)
+		}
+		token.AppIDs = append(token.AppIDs, app.ID)
+	}
+
+	if err := client.CreateToken(token); err != nil {
+		return err
+	}
+
+	log.Printf("Created token %s (%s) with key:", token.Name, token.ID)
+	fmt.Println(token.Key)
+	return nil
+}
+
+func runTokenRemove(args *docopt.Args, client controller.Client) error {
+	token, err := client.DeleteToken(args.String["<id>"])
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Revoked token %s (%s).", token.Name, token.ID)
+	return nil
+}
@@ -42,6 +42,9 @@ func NewAppRepo(db *postgres.DB, defaultDomain string, router routerc.Client) *A
 
 func (r *AppRepo) Add(data interface{}) error {
 	app := data.(*ct.App)
+	if err := validateAutoscale(app.Autoscale); err != nil {
+		return err
+	}
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
@@ -74,7 +77,7 @@ func (r *AppRepo) Add(data interface{}) error {
 		app.Meta["gc.max_inactive_slug_releases"] = "10"
 	}
 
-	if err := tx.QueryRow("app_insert", app.ID, app.Name, app.Meta, app.Strategy, app.DeployTimeout).Scan(&app.CreatedAt, &app.UpdatedAt); err != nil {
+	if err := tx.QueryRow("app_insert", app.ID, app.Name, app.Meta, app.Strategy, app.DeployTimeout, app.Autoscale).Scan(&app.CreatedAt, &app.UpdatedAt); err != nil {
 		tx.Rollback()
 		if postgres.IsUniquenessError(err, "apps_name_idx") {
 			return httphelper.ObjectExistsErr(fmt.Sprintf("application %q already exists", app.Name))
@@ -107,10 +110,21 @@ func (r *AppRepo) Add(data interface{}) error {
 	return nil
 }
 
+// validateAutoscale checks that the bounds of the given autoscale policies are
+// consistent (other constraints are checked by the JSON schema)
+func validateAutoscale(autoscale map[string]*ct.AutoscalePolicy) error {
+	for typ, policy := range autoscale {
+		if policy.Min > policy.Max {
+			return ct.ValidationError{Field: "autoscale." + typ, Message: "min must not be greater than max"}
+		}
+	}
+	return nil
+}
+
 func scanApp(s postgres.Scanner) (*ct.App, error) {
 	app := &ct.App{}
 	var releaseID *string
-	err := s.Scan(&app.ID, &app.Name, &app.Meta, &app.Strategy, &releaseID, &app.DeployTimeout, &app.CreatedAt, &app.UpdatedAt)
+	err := s.Scan(&app.ID, &app.Name, &app.Meta, &app.Strategy, &releaseID, &app.DeployTimeout, &app.Autoscale, &app.CreatedAt, &app.UpdatedAt)
 	if err == pgx.ErrNoRows {
 		return nil, ErrNotFound
 	} else if err != nil {
@@ -209,6 +223,28 @@ func (r *AppRepo) Update(id string, data map[string]interface{}) (interface{}, e
 				tx.Rollback()
 				return nil, err
 			}
+		case "autoscale":
+			// re-encode the policies to decode them into their
+			// typed representation
+			data, err := json.Marshal(v)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			var autoscale map[string]*ct.AutoscalePolicy
+			if err := json.Unmarshal(data, &autoscale); err != nil {
+				tx.Rollback()
+				return nil, fmt.Errorf("controller: unable to decode autoscale policies: %s", err)
+			}
+			if err := validateAutoscale(autoscale); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			app.Autoscale = autoscale
+			if err := tx.Exec("app_update_autoscale", app.ID, app.Autoscale); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
 		}
 	}
 
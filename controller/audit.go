@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/sse"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+const (
+	// maxAuditBodySize is the maximum size of request bodies which are
+	// summarised in the audit log
+	maxAuditBodySize = 1 << 20
+
+	// maxAuditStringLength is the length strings in payload summaries are
+	// truncated to
+	maxAuditStringLength = 100
+)
+
+type AuditRepo struct {
+	db *postgres.DB
+}
+
+func NewAuditRepo(db *postgres.DB) *AuditRepo {
+	return &AuditRepo{db: db}
+}
+
+func (r *AuditRepo) Add(e *ct.AuditEntry) error {
+	return r.db.QueryRow(
+		"audit_insert",
+		e.TokenID,
+		e.TokenName,
+		e.SourceIP,
+		e.RequestID,
+		e.Method,
+		e.Path,
+		e.AppID,
+		e.Status,
+		e.Payload,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+func (r *AuditRepo) Get(id int64) (*ct.AuditEntry, error) {
+	row := r.db.QueryRow("audit_select", id)
+	return scanAuditEntry(row)
+}
+
+func (r *AuditRepo) List(opts *ct.ListAuditOptions) ([]*ct.AuditEntry, error) {
+	query := "SELECT audit_id, token_id, token_name, source_ip, request_id, method, path, app_id, status, payload, created_at FROM audit_log"
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if opts.BeforeID != nil {
+		addCondition("audit_id < $%d", *opts.BeforeID)
+	}
+	if opts.SinceID != nil {
+		addCondition("audit_id > $%d", *opts.SinceID)
+	}
+	if opts.AppID != "" {
+		addCondition("app_id = $%d", opts.AppID)
+	}
+	if opts.TokenID != "" {
+		addCondition("token_id = $%d", opts.TokenID)
+	}
+	if opts.SourceIP != "" {
+		addCondition("source_ip = $%d", opts.SourceIP)
+	}
+	if opts.Method != "" {
+		addCondition("method = $%d", opts.Method)
+	}
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY audit_id DESC"
+	if opts.Count > 0 {
+		args = append(args, opts.Count)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*ct.AuditEntry
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func scanAuditEntry(s postgres.Scanner) (*ct.AuditEntry, error) {
+	var entry ct.AuditEntry
+	var tokenID, tokenName, requestID, appID *string
+	var payload []byte
+	err := s.Scan(&entry.ID, &tokenID, &tokenName, &entry.SourceIP, &requestID, &entry.Method, &entry.Path, &appID, &entry.Status, &payload, &entry.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	if tokenID != nil {
+		entry.TokenID = *tokenID
+	}
+	if tokenName != nil {
+		entry.TokenName = *tokenName
+	}
+	if requestID != nil {
+		entry.RequestID = *requestID
+	}
+	if appID != nil {
+		entry.AppID = *appID
+	}
+	if len(payload) > 0 && string(payload) != "null" {
+		entry.Payload = json.RawMessage(payload)
+	}
+	return &entry, nil
+}
+
+// auditLogger records requests which change the state of the cluster in the
+// audit log
+type auditLogger struct {
+	repo *AuditRepo
+	auth *tokenAuthorizer
+}
+
+// isMutating returns whether requests with the given method change the state
+// of the cluster
+func isMutating(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// newEntry returns an audit log entry for the request made with the given
+// token, which is nil if the request was made with an auth key. It must be
+// called before the request is handled, so that the request's app can be
+// found even if the request deletes it.
+func (a *auditLogger) newEntry(w http.ResponseWriter, req *http.Request, token *ct.Token) *ct.AuditEntry {
+	entry := &ct.AuditEntry{
+		SourceIP: httphelper.ClientIP(req),
+		Method:   req.Method,
+		Path:     req.URL.Path,
+	}
+	if token != nil {
+		entry.TokenID = token.ID
+		entry.TokenName = token.Name
+	}
+	if rw, ok := w.(*httphelper.ResponseWriter); ok {
+		entry.RequestID, _ = ctxhelper.RequestIDFromContext(rw.Context())
+	}
+	if req.Body != nil && req.ContentLength > 0 && req.ContentLength <= maxAuditBodySize {
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if err == nil {
+			entry.Payload = summarizePayload(data)
+		}
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if app, err := a.auth.requestApp(req, parts); err == nil && app != nil {
+		entry.AppID = app.ID
+	}
+	return entry
+}
+
+// record adds the entry to the audit log with the status of the response
+// written to w
+func (a *auditLogger) record(w http.ResponseWriter, entry *ct.AuditEntry) {
+	entry.Status = http.StatusOK
+	if rw, ok := w.(*httphelper.ResponseWriter); ok && rw.Written() {
+		entry.Status = rw.Status()
+	}
+	if err := a.repo.Add(entry); err != nil {
+		logger.Error("error adding audit log entry", "req_id", entry.RequestID, "err", err)
+	}
+}
+
+// summarizePayload returns a summary of a JSON request body, which keeps the
+// top-level fields of objects but replaces nested objects with their keys,
+// arrays with their length, long strings with their prefix and the values of
+// fields which may be secret with "[redacted]"
+func summarizePayload(data []byte) json.RawMessage {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		summary, _ := json.Marshal(map[string]int{"size": len(data)})
+		return summary
+	}
+	var summary interface{}
+	if fields, ok := body.(map[string]interface{}); ok {
+		s := make(map[string]interface{}, len(fields))
+		for k, v := range fields {
+			if isSecretField(k) {
+				s[k] = "[redacted]"
+			} else {
+				s[k] = summarizeValue(v)
+			}
+		}
+		summary = s
+	} else {
+		summary = summarizeValue(body)
+	}
+	res, _ := json.Marshal(summary)
+	return res
+}
+
+func summarizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	case []interface{}:
+		return fmt.Sprintf("[%d items]", len(v))
+	case string:
+		if len(v) > maxAuditStringLength {
+			return v[:maxAuditStringLength] + "..."
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"key", "password", "secret", "token", "credential"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *controllerAPI) maybeStartAuditListener() (*AuditListener, error) {
+	c.auditListenerMtx.Lock()
+	defer c.auditListenerMtx.Unlock()
+	if c.auditListener != nil && !c.auditListener.IsClosed() {
+		return c.auditListener, nil
+	}
+	c.auditListener = newAuditListener(c.auditRepo)
+	return c.auditListener, c.auditListener.Listen()
+}
+
+// Audit lists or streams the audit log
+func (c *controllerAPI) Audit(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	l, _ := ctxhelper.LoggerFromContext(ctx)
+	log := l.New("fn", "Audit")
+
+	var appID string
+	if id := req.FormValue("app_id"); id != "" {
+		data, err := c.appRepo.Get(id)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		appID = data.(*ct.App).ID
+	}
+
+	if req.Header.Get("Accept") == "application/json" {
+		if err := c.listAudit(w, req, appID); err != nil {
+			log.Error("error listing audit log", "err", err)
+			respondWithError(w, err)
+		}
+		return
+	}
+
+	auditListener, err := c.maybeStartAuditListener()
+	if err != nil {
+		log.Error("error starting audit listener", "err", err)
+		respondWithError(w, err)
+		return
+	}
+	if err := c.streamAudit(ctx, w, req, auditListener, appID); err != nil {
+		log.Error("error streaming audit log", "err", err)
+		respondWithError(w, err)
+	}
+}
+
+func (c *controllerAPI) listAudit(w http.ResponseWriter, req *http.Request, appID string) (err error) {
+	opts := &ct.ListAuditOptions{
+		AppID:    appID,
+		TokenID:  req.FormValue("token_id"),
+		SourceIP: req.FormValue("source_ip"),
+		Method:   req.FormValue("method"),
+	}
+	if s := req.FormValue("before_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ct.ValidationError{Field: "before_id", Message: "is invalid"}
+		}
+		opts.BeforeID = &id
+	}
+	if s := req.FormValue("since_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ct.ValidationError{Field: "since_id", Message: "is invalid"}
+		}
+		opts.SinceID = &id
+	}
+	if s := req.FormValue("count"); s != "" {
+		opts.Count, err = strconv.Atoi(s)
+		if err != nil {
+			return ct.ValidationError{Field: "count", Message: "is invalid"}
+		}
+	}
+	if opts.TokenID != "" && !idPattern.MatchString(opts.TokenID) {
+		return ct.ValidationError{Field: "token_id", Message: "is invalid"}
+	}
+
+	list, err := c.auditRepo.List(opts)
+	if err != nil {
+		return err
+	}
+	httphelper.JSON(w, 200, list)
+	return nil
+}
+
+func (c *controllerAPI) streamAudit(ctx context.Context, w http.ResponseWriter, req *http.Request, auditListener *AuditListener, appID string) (err error) {
+	opts := &ct.ListAuditOptions{
+		AppID:    appID,
+		TokenID:  req.FormValue("token_id"),
+		SourceIP: req.FormValue("source_ip"),
+		Method:   req.FormValue("method"),
+	}
+	if opts.TokenID != "" && !idPattern.MatchString(opts.TokenID) {
+		return ct.ValidationError{Field: "token_id", Message: "is invalid"}
+	}
+
+	var lastID int64
+	if req.Header.Get("Last-Event-Id") != "" {
+		lastID, err = strconv.ParseInt(req.Header.Get("Last-Event-Id"), 10, 64)
+		if err != nil {
+			return ct.ValidationError{Field: "Last-Event-Id", Message: "is invalid"}
+		}
+	}
+	if req.FormValue("count") != "" {
+		opts.Count, err = strconv.Atoi(req.FormValue("count"))
+		if err != nil {
+			return ct.ValidationError{Field: "count", Message: "is invalid"}
+		}
+	}
+
+	l, _ := ctxhelper.LoggerFromContext(ctx)
+	ch := make(chan *ct.AuditEntry)
+	s := sse.NewStream(w, ch, l.New("fn", "streamAudit"))
+	s.Serve()
+	defer func() {
+		if err == nil {
+			s.Close()
+		} else {
+			s.CloseWithError(err)
+		}
+	}()
+
+	sub, err := auditListener.Subscribe(opts)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	var currID int64
+	if req.FormValue("past") == "true" || lastID > 0 {
+		opts.SinceID = &lastID
+		list, err := c.auditRepo.List(opts)
+		if err != nil {
+			return err
+		}
+		// entries are in ID DESC order, so iterate in reverse
+		for i := len(list) - 1; i >= 0; i-- {
+			select {
+			case <-s.Done:
+				return nil
+			case ch <- list[i]:
+				currID = list[i].ID
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-s.Done:
+			return nil
+		case entry, ok := <-sub.Entries:
+			if !ok {
+				return sub.Err
+			}
+			if entry.ID <= currID {
+				continue
+			}
+			select {
+			case <-s.Done:
+				return nil
+			case ch <- entry:
+			}
+		}
+	}
+}
+
+// AuditSubscriber receives the audit log entries of an AuditListener which
+// match its filters and forwards them to the Entries channel.
+type AuditSubscriber struct {
+	Entries chan *ct.AuditEntry
+	Err     error
+
+	sub *notifySubscriber
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// loop forwards entries to the Entries channel until the subscriber is closed.
+func (s *AuditSubscriber) loop() {
+	defer close(s.Entries)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case entry, ok := <-s.sub.C:
+			if !ok {
+				s.Err = s.sub.Err
+				return
+			}
+			select {
+			case s.Entries <- entry.(*ct.AuditEntry):
+			case <-s.stop:
+				return
+			}
+		}
+	}
+}
+
+// Close unsubscribes from the AuditListener and stops the loop.
+func (s *AuditSubscriber) Close() {
+	s.sub.Close()
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+func newAuditListener(r *AuditRepo) *AuditListener {
+	return &AuditListener{newNotifyListener(r.db, "audit", func(payload string) (interface{}, error) {
+		id, err := strconv.ParseInt(payload, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return r.Get(id)
+	})}
+}
+
+// AuditListener creates a postgres Listener for audit log entries and
+// forwards them to subscribers.
+type AuditListener struct {
+	*notifyListener
+}
+
+// Subscribe creates and returns an AuditSubscriber which receives entries
+// matching the app, token, source IP and method of the given options, with
+// empty values matching every entry
+func (l *AuditListener) Subscribe(opts *ct.ListAuditOptions) (*AuditSubscriber, error) {
+	sub, err := l.subscribe(func(obj interface{}) bool {
+		entry := obj.(*ct.AuditEntry)
+		return (opts.AppID == "" || opts.AppID == entry.AppID) &&
+			(opts.TokenID == "" || opts.TokenID == entry.TokenID) &&
+			(opts.SourceIP == "" || opts.SourceIP == entry.SourceIP) &&
+			(opts.Method == "" || opts.Method == entry.Method)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &AuditSubscriber{
+		Entries: make(chan *ct.AuditEntry),
+		sub:     sub,
+		stop:    make(chan struct{}),
+	}
+	go s.loop()
+	return s, nil
+}
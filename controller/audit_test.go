@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestAuditLog(c *C) {
+	app := s.createTestApp(c, &ct.App{})
+	c.Assert(s.c.UpdateApp(&ct.App{ID: app.ID, Strategy: "one-by-one"}), IsNil)
+
+	// changes made with the cluster key are recorded without a token
+	entries, err := s.c.ListAudit(ct.ListAuditOptions{AppID: app.ID})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	entry := entries[0]
+	c.Assert(entry.ID, Not(Equals), int64(0))
+	c.Assert(entry.TokenID, Equals, "")
+	c.Assert(entry.SourceIP, Equals, "127.0.0.1")
+	c.Assert(entry.RequestID, Not(Equals), "")
+	c.Assert(entry.Method, Equals, "POST")
+	c.Assert(entry.Path, Equals, fmt.Sprintf("/apps/%s", app.ID))
+	c.Assert(entry.AppID, Equals, app.ID)
+	c.Assert(entry.Status, Equals, 200)
+	c.Assert(entry.CreatedAt, NotNil)
+
+	// changes made with tokens are recorded with the token, including
+	// forbidden ones, but reads are not recorded
+	token, client := s.createTestToken(c, &ct.Token{
+		Name:   "TestAuditLog",
+		Scopes: []ct.TokenScope{ct.TokenScopeDeploy},
+	})
+	_, err = client.GetApp(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(isForbiddenError(client.UpdateApp(&ct.App{ID: app.ID, Strategy: "all-at-once"})), Equals, true)
+	entries, err = s.c.ListAudit(ct.ListAuditOptions{TokenID: token.ID})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].TokenName, Equals, token.Name)
+	c.Assert(entries[0].AppID, Equals, app.ID)
+	c.Assert(entries[0].Status, Equals, 403)
+
+	// entries are listed newest first
+	entries, err = s.c.ListAudit(ct.ListAuditOptions{AppID: app.ID, Method: "POST"})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 2)
+	c.Assert(entries[0].TokenID, Equals, token.ID)
+	c.Assert(entries[1].ID, Equals, entry.ID)
+	entries, err = s.c.ListAudit(ct.ListAuditOptions{AppID: app.ID, SinceID: &entry.ID})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].TokenID, Equals, token.ID)
+	entries, err = s.c.ListAudit(ct.ListAuditOptions{AppID: app.ID, Method: "DELETE"})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+
+	// only admin tokens can read the audit log
+	_, err = client.ListAudit(ct.ListAuditOptions{})
+	c.Assert(isForbiddenError(err), Equals, true)
+}
+
+func (s *S) TestAuditLogPayload(c *C) {
+	app := s.createTestApp(c, &ct.App{})
+	c.Assert(s.c.UpdateApp(&ct.App{
+		ID:   app.ID,
+		Meta: map[string]string{"foo": "bar"},
+	}), IsNil)
+
+	entries, err := s.c.ListAudit(ct.ListAuditOptions{AppID: app.ID})
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 1)
+	var payload map[string]interface{}
+	c.Assert(json.Unmarshal(entries[0].Payload, &payload), IsNil)
+	c.Assert(payload["id"], Equals, app.ID)
+	c.Assert(payload["meta"], DeepEquals, []interface{}{"foo"})
+
+	for _, t := range []struct {
+		body    string
+		summary string
+	}{
+		{
+			body:    `{"name":"foo","api_key":"bar","nested":{"b":{"c":1},"a":"x"},"list":[1,2,3],"count":2}`,
+			summary: `{"api_key":"[redacted]","count":2,"list":"[3 items]","name":"foo","nested":["a","b"]}`,
+		},
+		{
+			body:    `[1,2]`,
+			summary: `"[2 items]"`,
+		},
+		{
+			body:    `not json`,
+			summary: `{"size":8}`,
+		},
+	} {
+		c.Assert(string(summarizePayload([]byte(t.body))), Equals, t.summary)
+	}
+}
+
+func (s *S) TestStreamAuditLog(c *C) {
+	app := s.createTestApp(c, &ct.App{})
+	c.Assert(s.c.UpdateApp(&ct.App{ID: app.ID, Strategy: "one-by-one"}), IsNil)
+
+	entries := make(chan *ct.AuditEntry)
+	stream, err := s.c.StreamAudit(ct.StreamAuditOptions{AppID: app.ID, Past: true}, entries)
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	otherApp := s.createTestApp(c, &ct.App{})
+	c.Assert(s.c.UpdateApp(&ct.App{ID: otherApp.ID, Strategy: "one-by-one"}), IsNil)
+	c.Assert(s.c.UpdateApp(&ct.App{ID: app.ID, Strategy: "all-at-once"}), IsNil)
+
+	// the past entry is followed by the new one, skipping the other app
+	var lastID int64
+	for i := 0; i < 2; i++ {
+		select {
+		case e, ok := <-entries:
+			if !ok {
+				c.Fatalf("unexpected close of audit stream: %s", stream.Err())
+			}
+			c.Assert(e.AppID, Equals, app.ID)
+			c.Assert(e.ID > lastID, Equals, true)
+			lastID = e.ID
+		case <-time.After(10 * time.Second):
+			c.Fatalf("timed out waiting for audit entry %d", i)
+		}
+	}
+}
@@ -27,6 +27,7 @@ type Client interface {
 	PutDomain(dm *ct.DomainMigration) error
 	CreateArtifact(artifact *ct.Artifact) error
 	CreateRelease(appID string, release *ct.Release) error
+	RotateSecretEnv() (*ct.SecretEnvRotation, error)
 	CreateApp(app *ct.App) error
 	UpdateApp(app *ct.App) error
 	UpdateAppMeta(app *ct.App) error
@@ -65,6 +66,7 @@ type Client interface {
 	GetDeployment(deploymentID string) (*ct.Deployment, error)
 	CreateDeployment(appID, releaseID string) (*ct.Deployment, error)
 	DeploymentList(appID string) ([]*ct.Deployment, error)
+	SetDeploymentAction(deploymentID string, action ct.DeploymentAction) error
 	StreamDeployment(d *ct.Deployment, output chan *ct.DeploymentEvent) (stream.Stream, error)
 	DeployAppRelease(appID, releaseID string, stopWait <-chan struct{}) error
 	StreamJobEvents(appID string, output chan *ct.Job) (stream.Stream, error)
@@ -93,6 +95,12 @@ type Client interface {
 	DeleteSink(sinkID string) (*ct.Sink, error)
 	ListSinks() ([]*ct.Sink, error)
 	StreamSinks(since *time.Time, output chan *ct.Sink) (stream.Stream, error)
+	CreateToken(token *ct.Token) error
+	GetToken(tokenID string) (*ct.Token, error)
+	DeleteToken(tokenID string) (*ct.Token, error)
+	ListTokens() ([]*ct.Token, error)
+	ListAudit(opts ct.ListAuditOptions) ([]*ct.AuditEntry, error)
+	StreamAudit(opts ct.StreamAuditOptions, output chan *ct.AuditEntry) (stream.Stream, error)
 }
 
 type Config struct {
@@ -155,6 +155,13 @@ func (c *Client) CreateRelease(appID string, release *ct.Release) error {
 	return c.Post("/releases", release, release)
 }
 
+// RotateSecretEnv re-encrypts the secret env vars of releases encrypted with a
+// previous secret env key with the current key.
+func (c *Client) RotateSecretEnv() (*ct.SecretEnvRotation, error) {
+	rotation := &ct.SecretEnvRotation{}
+	return rotation, c.Post("/secret-env/rotate", nil, rotation)
+}
+
 // CreateApp creates a new app.
 func (c *Client) CreateApp(app *ct.App) error {
 	return c.Post("/apps", app, app)
@@ -439,6 +446,15 @@ func (c *Client) DeploymentList(appID string) ([]*ct.Deployment, error) {
 	return deployments, c.Get(fmt.Sprintf("/apps/%s/deployments", appID), &deployments)
 }
 
+// SetDeploymentAction requests that an in-progress canary deployment be
+// paused, resumed, promoted or aborted.
+func (c *Client) SetDeploymentAction(deploymentID string, action ct.DeploymentAction) error {
+	data := struct {
+		Action ct.DeploymentAction `json:"action"`
+	}{action}
+	return c.Put(fmt.Sprintf("/deployments/%s/action", deploymentID), data, nil)
+}
+
 func convertEvents(appEvents chan *ct.Event, outputCh interface{}) {
 	outValue := reflect.ValueOf(outputCh)
 	msgType := outValue.Type().Elem().Elem()
@@ -780,6 +796,81 @@ func (c *Client) StreamSinks(since *time.Time, output chan *ct.Sink) (stream.Str
 	return c.Stream("GET", "/sinks?since="+t, nil, output)
 }
 
+// CreateToken creates an API token, setting its key which is only returned
+// when it is created
+func (c *Client) CreateToken(token *ct.Token) error {
+	return c.Post("/tokens", token, token)
+}
+
+// GetToken gets an API token
+func (c *Client) GetToken(tokenID string) (*ct.Token, error) {
+	token := &ct.Token{}
+	return token, c.Get(fmt.Sprintf("/tokens/%s", tokenID), token)
+}
+
+// DeleteToken revokes an API token
+func (c *Client) DeleteToken(tokenID string) (*ct.Token, error) {
+	token := &ct.Token{}
+	return token, c.Delete(fmt.Sprintf("/tokens/%s", tokenID), token)
+}
+
+// ListTokens returns all API tokens
+func (c *Client) ListTokens() ([]*ct.Token, error) {
+	var tokens []*ct.Token
+	return tokens, c.Get("/tokens", &tokens)
+}
+
+func auditQuery(appID, tokenID, sourceIP, method string, count int) url.Values {
+	q := make(url.Values)
+	if appID != "" {
+		q.Set("app_id", appID)
+	}
+	if tokenID != "" {
+		q.Set("token_id", tokenID)
+	}
+	if sourceIP != "" {
+		q.Set("source_ip", sourceIP)
+	}
+	if method != "" {
+		q.Set("method", method)
+	}
+	if count > 0 {
+		q.Set("count", strconv.Itoa(count))
+	}
+	return q
+}
+
+// ListAudit returns audit log entries matching the given options, newest
+// first.
+func (c *Client) ListAudit(opts ct.ListAuditOptions) ([]*ct.AuditEntry, error) {
+	var entries []*ct.AuditEntry
+	q := auditQuery(opts.AppID, opts.TokenID, opts.SourceIP, opts.Method, opts.Count)
+	if opts.BeforeID != nil {
+		q.Set("before_id", strconv.FormatInt(*opts.BeforeID, 10))
+	}
+	if opts.SinceID != nil {
+		q.Set("since_id", strconv.FormatInt(*opts.SinceID, 10))
+	}
+	h := make(http.Header)
+	h.Set("Accept", "application/json")
+	res, err := c.RawReq("GET", "/audit?"+q.Encode(), h, nil, &entries)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	return entries, nil
+}
+
+// StreamAudit streams audit log entries matching the given options to the
+// output channel as they are recorded.
+func (c *Client) StreamAudit(opts ct.StreamAuditOptions, output chan *ct.AuditEntry) (stream.Stream, error) {
+	q := auditQuery(opts.AppID, opts.TokenID, opts.SourceIP, opts.Method, opts.Count)
+	if opts.Past {
+		q.Set("past", "true")
+	}
+	return c.ResumingStream("GET", "/audit?"+q.Encode(), output)
+}
+
 func (c *Client) Put(path string, in, out interface{}) error {
 	return c.send("PUT", path, in, out)
 }
@@ -15,6 +15,7 @@ import (
 
 	"github.com/flynn/flynn/controller/name"
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secretenv"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
 	"github.com/flynn/flynn/discoverd/client"
@@ -58,6 +59,11 @@ func main() {
 		name.SetSeed(s)
 	}
 
+	secretKeys, err := secretenv.LoadKeys()
+	if err != nil {
+		log.Fatalln("error loading secret env keys:", err)
+	}
+
 	db := postgres.Wait(nil, nil)
 
 	if err := migrateDB(db); err != nil {
@@ -103,12 +109,13 @@ func main() {
 	})
 
 	handler := appHandler(handlerConfig{
-		db:     db,
-		cc:     utils.ClusterClientWrapper(cluster.NewClient()),
-		lc:     lc,
-		rc:     rc,
-		keys:   strings.Split(os.Getenv("AUTH_KEY"), ","),
-		caCert: []byte(os.Getenv("CA_CERT")),
+		db:         db,
+		cc:         utils.ClusterClientWrapper(cluster.NewClient()),
+		lc:         lc,
+		rc:         rc,
+		keys:       strings.Split(os.Getenv("AUTH_KEY"), ","),
+		caCert:     []byte(os.Getenv("CA_CERT")),
+		secretKeys: secretKeys,
 	})
 	shutdown.Fatal(http.ListenAndServe(addr, handler))
 }
@@ -175,12 +182,13 @@ type logClient interface {
 }
 
 type handlerConfig struct {
-	db     *postgres.DB
-	cc     utils.ClusterClient
-	lc     logClient
-	rc     routerc.Client
-	keys   []string
-	caCert []byte
+	db         *postgres.DB
+	cc         utils.ClusterClient
+	lc         logClient
+	rc         routerc.Client
+	keys       []string
+	caCert     []byte
+	secretKeys *secretenv.Keys
 }
 
 // NOTE: this is temporary until httphelper supports custom errors
@@ -209,7 +217,7 @@ func appHandler(c handlerConfig) http.Handler {
 	resourceRepo := NewResourceRepo(c.db)
 	appRepo := NewAppRepo(c.db, os.Getenv("DEFAULT_ROUTE_DOMAIN"), c.rc)
 	artifactRepo := NewArtifactRepo(c.db)
-	releaseRepo := NewReleaseRepo(c.db, artifactRepo, q)
+	releaseRepo := NewReleaseRepo(c.db, artifactRepo, q, c.secretKeys)
 	jobRepo := NewJobRepo(c.db)
 	formationRepo := NewFormationRepo(c.db, appRepo, releaseRepo, artifactRepo)
 	releaseRepo.formations = formationRepo
@@ -217,6 +225,8 @@ func appHandler(c handlerConfig) http.Handler {
 	eventRepo := NewEventRepo(c.db)
 	backupRepo := NewBackupRepo(c.db)
 	sinkRepo := NewSinkRepo(c.db)
+	tokenRepo := NewTokenRepo(c.db)
+	auditRepo := NewAuditRepo(c.db)
 
 	api := controllerAPI{
 		domainMigrationRepo: domainMigrationRepo,
@@ -231,6 +241,8 @@ func appHandler(c handlerConfig) http.Handler {
 		eventRepo:           eventRepo,
 		backupRepo:          backupRepo,
 		sinkRepo:            sinkRepo,
+		tokenRepo:           tokenRepo,
+		auditRepo:           auditRepo,
 		clusterClient:       c.cc,
 		logaggc:             c.lc,
 		routerc:             c.rc,
@@ -283,6 +295,7 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.POST("/apps/:apps_id/deploy", httphelper.WrapHandler(api.appLookup(api.CreateDeployment)))
 	httpRouter.GET("/apps/:apps_id/deployments", httphelper.WrapHandler(api.appLookup(api.ListDeployments)))
 	httpRouter.GET("/deployments/:deployment_id", httphelper.WrapHandler(api.GetDeployment))
+	httpRouter.PUT("/deployments/:deployment_id/action", httphelper.WrapHandler(api.UpdateDeploymentAction))
 
 	httpRouter.PUT("/apps/:apps_id/release", httphelper.WrapHandler(api.appLookup(api.SetAppRelease)))
 	httpRouter.GET("/apps/:apps_id/release", httphelper.WrapHandler(api.appLookup(api.GetAppRelease)))
@@ -314,11 +327,28 @@ func appHandler(c handlerConfig) http.Handler {
 	httpRouter.GET("/sinks/:sink_id", httphelper.WrapHandler(api.GetSink))
 	httpRouter.DELETE("/sinks/:sink_id", httphelper.WrapHandler(api.DeleteSink))
 
+	httpRouter.POST("/tokens", httphelper.WrapHandler(api.CreateToken))
+	httpRouter.GET("/tokens", httphelper.WrapHandler(api.GetTokens))
+	httpRouter.GET("/tokens/:token_id", httphelper.WrapHandler(api.GetToken))
+	httpRouter.DELETE("/tokens/:token_id", httphelper.WrapHandler(api.DeleteToken))
+
+	httpRouter.GET("/audit", httphelper.WrapHandler(api.Audit))
+
+	httpRouter.POST("/secret-env/rotate", httphelper.WrapHandler(api.RotateSecretEnv))
+
+	auth := &tokenAuthorizer{
+		tokens:      tokenRepo,
+		apps:        appRepo,
+		releases:    releaseRepo,
+		deployments: deploymentRepo,
+		events:      eventRepo,
+	}
+	audit := &auditLogger{repo: auditRepo, auth: auth}
 	return httphelper.ContextInjector("controller",
-		httphelper.NewRequestLogger(muxHandler(httpRouter, c.keys)))
+		httphelper.NewRequestLogger(muxHandler(httpRouter, c.keys, auth, audit)))
 }
 
-func muxHandler(main http.Handler, authKeys []string) http.Handler {
+func muxHandler(main http.Handler, authKeys []string, auth *tokenAuthorizer, audit *auditLogger) http.Handler {
 	return httphelper.CORSAllowAll.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if shutdown.IsActive() {
 			httphelper.ServiceUnavailableError(w, ErrShutdown.Error())
@@ -344,11 +374,40 @@ func muxHandler(main http.Handler, authKeys []string) http.Handler {
 				break
 			}
 		}
+		var token *ct.Token
+		if !authed && password != "" {
+			// keys which aren't auth keys may be tokens
+			var err error
+			token, err = auth.Authorize(password, r)
+			switch err {
+			case nil:
+				authed = true
+			case ErrNotFound:
+			case ErrForbidden:
+				// forbidden attempts to change the cluster are still
+				// recorded in the audit log
+				if isMutating(r.Method) {
+					entry := audit.newEntry(w, r, token)
+					defer audit.record(w, entry)
+				}
+				httphelper.ForbiddenError(w, err.Error())
+				return
+			default:
+				httphelper.Error(w, err)
+				return
+			}
+		}
 		if !authed {
 			w.WriteHeader(401)
 			return
 		}
+		if !isMutating(r.Method) {
+			main.ServeHTTP(w, r)
+			return
+		}
+		entry := audit.newEntry(w, r, token)
 		main.ServeHTTP(w, r)
+		audit.record(w, entry)
 	}))
 }
 
@@ -365,6 +424,8 @@ type controllerAPI struct {
 	eventRepo           *EventRepo
 	backupRepo          *BackupRepo
 	sinkRepo            *SinkRepo
+	tokenRepo           *TokenRepo
+	auditRepo           *AuditRepo
 	clusterClient       utils.ClusterClient
 	logaggc             logClient
 	routerc             routerc.Client
@@ -374,6 +435,9 @@ type controllerAPI struct {
 
 	eventListener    *EventListener
 	eventListenerMtx sync.Mutex
+
+	auditListener    *AuditListener
+	auditListenerMtx sync.Mutex
 }
 
 func (c *controllerAPI) getApp(ctx context.Context) *ct.App {
@@ -465,4 +529,7 @@ func (c *controllerAPI) Shutdown() {
 	if c.eventListener != nil {
 		c.eventListener.CloseWithError(ErrShutdown)
 	}
+	if c.auditListener != nil {
+		c.auditListener.CloseWithError(ErrShutdown)
+	}
 }
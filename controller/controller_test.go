@@ -12,6 +12,7 @@ import (
 
 	"github.com/flynn/flynn/controller/client"
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secretenv"
 	tu "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
@@ -34,18 +35,24 @@ func init() {
 func Test(t *testing.T) { TestingT(t) }
 
 type S struct {
-	cc     *tu.FakeCluster
-	srv    *httptest.Server
-	hc     handlerConfig
-	c      controller.Client
-	flac   *fakeLogAggregatorClient
-	caCert []byte
+	cc         *tu.FakeCluster
+	srv        *httptest.Server
+	hc         handlerConfig
+	c          controller.Client
+	flac       *fakeLogAggregatorClient
+	caCert     []byte
+	secretKeys *secretenv.Keys
 }
 
 var _ = Suite(&S{})
 
 var authKey = "test"
 
+var (
+	testSecretEnvKey         = "E6LWKuMUp4g/lhNAs3jduHLxTVNR9QCLyUxY7ks9ZOg="
+	testPreviousSecretEnvKey = "h5XiT7rW27htuE42xUkc9XyyJa8grIHN3AxVeX2zQG4="
+)
+
 func setupTestDB(c *C, dbname string) *postgres.DB {
 	if err := pgtestutils.SetupPostgres(dbname); err != nil {
 		c.Fatal(err)
@@ -91,13 +98,19 @@ func (s *S) SetUpSuite(c *C) {
 
 	s.flac = newFakeLogAggregatorClient()
 	s.cc = tu.NewFakeCluster()
+	s.secretKeys, err = secretenv.NewKeys(testSecretEnvKey, testPreviousSecretEnvKey)
+	if err != nil {
+		c.Fatal(err)
+	}
+
 	s.hc = handlerConfig{
-		db:     db,
-		cc:     s.cc,
-		lc:     s.flac,
-		rc:     newFakeRouter(),
-		keys:   []string{authKey},
-		caCert: s.caCert,
+		db:         db,
+		cc:         s.cc,
+		lc:         s.flac,
+		rc:         newFakeRouter(),
+		keys:       []string{authKey},
+		caCert:     s.caCert,
+		secretKeys: s.secretKeys,
 	}
 	handler := appHandler(s.hc)
 	s.srv = httptest.NewServer(handler)
@@ -338,6 +351,79 @@ func (s *S) TestCreateRelease(c *C) {
 	}
 }
 
+func (s *S) TestReleaseSecretEnv(c *C) {
+	release := s.createTestRelease(c, "", &ct.Release{
+		Env:       map[string]string{"PUBLIC": "foo", "PASSWORD": "hunter2"},
+		SecretEnv: []string{"PASSWORD"},
+	})
+
+	// secret values are only returned encrypted
+	c.Assert(release.Env["PUBLIC"], Equals, "foo")
+	c.Assert(ct.IsSecretEnvValue(release.Env["PASSWORD"]), Equals, true)
+	c.Assert(release.SecretEnv, DeepEquals, []string{"PASSWORD"})
+	value, err := s.secretKeys.Decrypt("PASSWORD", release.Env["PASSWORD"])
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "hunter2")
+	gotRelease, err := s.c.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease, DeepEquals, release)
+
+	// including in the formations streamed to the scheduler
+	c.Assert(s.c.PutFormation(&ct.Formation{AppID: release.AppID, ReleaseID: release.ID}), IsNil)
+	formation, err := s.c.GetExpandedFormation(release.AppID, release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(formation.Release.Env, DeepEquals, release.Env)
+	c.Assert(formation.Release.SecretEnv, DeepEquals, release.SecretEnv)
+
+	// encrypted values can be copied to new releases of the same variable
+	copied := s.createTestRelease(c, release.AppID, &ct.Release{
+		ArtifactIDs: release.ArtifactIDs,
+		Env:         map[string]string{"PASSWORD": release.Env["PASSWORD"]},
+	})
+	c.Assert(copied.Env["PASSWORD"], Equals, release.Env["PASSWORD"])
+	c.Assert(copied.SecretEnv, DeepEquals, []string{"PASSWORD"})
+
+	for _, r := range []*ct.Release{
+		{Env: map[string]string{"OTHER": release.Env["PASSWORD"]}},
+		{Env: map[string]string{"PASSWORD": ct.SecretEnvPrefix + "invalid"}},
+		{Env: map[string]string{"PUBLIC": "foo"}, SecretEnv: []string{"PASSWORD"}},
+	} {
+		r.ArtifactIDs = release.ArtifactIDs
+		c.Assert(hh.IsValidationError(s.c.CreateRelease(release.AppID, r)), Equals, true)
+	}
+}
+
+func (s *S) TestRotateSecretEnv(c *C) {
+	// create a release with a value encrypted with the previous key
+	previousKeys, err := secretenv.NewKeys(testPreviousSecretEnvKey)
+	c.Assert(err, IsNil)
+	encrypted, err := previousKeys.Encrypt("PASSWORD", "hunter2")
+	c.Assert(err, IsNil)
+	release := s.createTestRelease(c, "", &ct.Release{
+		Env: map[string]string{"PASSWORD": encrypted},
+	})
+	c.Assert(release.Env["PASSWORD"], Equals, encrypted)
+
+	rotation, err := s.c.RotateSecretEnv()
+	c.Assert(err, IsNil)
+	c.Assert(rotation.Releases > 0, Equals, true)
+
+	// the value is re-encrypted with the current key
+	release, err = s.c.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(release.Env["PASSWORD"], Not(Equals), encrypted)
+	_, err = previousKeys.Decrypt("PASSWORD", release.Env["PASSWORD"])
+	c.Assert(err, Equals, secretenv.ErrUnknownKey)
+	value, err := s.secretKeys.Decrypt("PASSWORD", release.Env["PASSWORD"])
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "hunter2")
+
+	// rotating again leaves it as it is
+	rotation, err = s.c.RotateSecretEnv()
+	c.Assert(err, IsNil)
+	c.Assert(rotation.Releases, Equals, 0)
+}
+
 func (s *S) TestCreateFormation(c *C) {
 	for i, useName := range []bool{false, true} {
 		release := s.createTestRelease(c, "", &ct.Release{
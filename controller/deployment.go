@@ -114,7 +114,8 @@ func scanDeployment(s postgres.Scanner) (*ct.Deployment, error) {
 	d := &ct.Deployment{}
 	var oldReleaseID *string
 	var status *string
-	err := s.Scan(&d.ID, &d.AppID, &oldReleaseID, &d.NewReleaseID, &d.Strategy, &status, &d.Processes, &d.Tags, &d.DeployTimeout, &d.CreatedAt, &d.FinishedAt)
+	var action *string
+	err := s.Scan(&d.ID, &d.AppID, &oldReleaseID, &d.NewReleaseID, &d.Strategy, &status, &d.Processes, &d.Tags, &d.DeployTimeout, &d.CreatedAt, &d.FinishedAt, &action)
 	if err == pgx.ErrNoRows {
 		err = ErrNotFound
 	}
@@ -124,9 +125,23 @@ func scanDeployment(s postgres.Scanner) (*ct.Deployment, error) {
 	if status != nil {
 		d.Status = *status
 	}
+	if action != nil {
+		d.Action = ct.DeploymentAction(*action)
+	}
 	return d, err
 }
 
+// SetAction sets the action of an in-progress deployment, returning
+// ErrNotFound if there is no such deployment
+func (r *DeploymentRepo) SetAction(id string, action ct.DeploymentAction) error {
+	var deploymentID string
+	err := r.db.QueryRow("deployment_update_action", id, string(action)).Scan(&deploymentID)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return err
+}
+
 func (c *controllerAPI) GetDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	params, _ := ctxhelper.ParamsFromContext(ctx)
 	deployment, err := c.deploymentRepo.Get(params.ByName("deployment_id"))
@@ -137,6 +152,47 @@ func (c *controllerAPI) GetDeployment(ctx context.Context, w http.ResponseWriter
 	httphelper.JSON(w, 200, deployment)
 }
 
+type deploymentAction struct {
+	Action ct.DeploymentAction `json:"action"`
+}
+
+func (c *controllerAPI) UpdateDeploymentAction(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	var data deploymentAction
+	if err := httphelper.DecodeJSON(req, &data); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	switch data.Action {
+	case ct.DeploymentActionPause, ct.DeploymentActionResume, ct.DeploymentActionPromote, ct.DeploymentActionAbort:
+	default:
+		httphelper.ValidationError(w, "action", "must be one of pause, resume, promote or abort")
+		return
+	}
+
+	deployment, err := c.deploymentRepo.Get(params.ByName("deployment_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	if deployment.Strategy != "canary" {
+		httphelper.ValidationError(w, "action", "is only supported by canary deployments")
+		return
+	}
+	if deployment.FinishedAt != nil {
+		httphelper.ValidationError(w, "action", "deployment has already finished")
+		return
+	}
+
+	if err := c.deploymentRepo.SetAction(deployment.ID, data.Action); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	deployment.Action = data.Action
+	httphelper.JSON(w, 200, deployment)
+}
+
 func (c *controllerAPI) CreateDeployment(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var rid releaseID
 	if err := httphelper.DecodeJSON(req, &rid); err != nil {
@@ -156,6 +212,10 @@ func (c *controllerAPI) CreateDeployment(ctx context.Context, w http.ResponseWri
 	}
 	release := rel.(*ct.Release)
 	app := c.getApp(ctx)
+	if err := validateReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
 
 	// TODO: wrap all of this in a transaction
 	oldRelease, err := c.appRepo.GetRelease(app.ID)
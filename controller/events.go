@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -299,225 +298,92 @@ func streamEvents(ctx context.Context, w http.ResponseWriter, req *http.Request,
 	}
 }
 
-// ErrEventBufferOverflow is returned to clients when the in-memory event
-// buffer is full due to clients not reading events quickly enough.
-var ErrEventBufferOverflow = errors.New("event stream buffer overflow")
-
-// eventBufferSize is the amount of events to buffer in memory.
-const eventBufferSize = 1000
-
-// EventSubscriber receives events from the EventListener loop and maintains
-// it's own loop to forward those events to the Events channel.
+// EventSubscriber receives the events of an EventListener which match its
+// filters and forwards them to the Events channel.
 type EventSubscriber struct {
-	Events  chan *ct.Event
-	Err     error
-	errOnce sync.Once
+	Events chan *ct.Event
+	Err    error
 
-	l           *EventListener
-	queue       chan *ct.Event
-	appID       string
-	objectTypes []string
-	objectID    string
+	sub *notifySubscriber
 
 	stop     chan struct{}
 	stopOnce sync.Once
 }
 
-// Notify filters the event based on it's type and objectID and then pushes
-// it to the event queue.
-func (e *EventSubscriber) Notify(event *ct.Event) {
-	if len(e.objectTypes) > 0 {
-		foundType := false
-		for _, typ := range e.objectTypes {
-			if typ == string(event.ObjectType) {
-				foundType = true
-				break
-			}
-		}
-		if !foundType {
-			return
-		}
-	}
-	if e.objectID != "" && e.objectID != event.ObjectID {
-		return
-	}
-	select {
-	case e.queue <- event:
-	default:
-		// Run in a goroutine to avoid deadlock with Notify
-		go e.CloseWithError(ErrEventBufferOverflow)
-	}
-}
-
-// loop pops events off the queue and sends them to the Events channel.
+// loop forwards events to the Events channel until the subscriber is closed.
 func (e *EventSubscriber) loop() {
 	defer close(e.Events)
 	for {
 		select {
 		case <-e.stop:
 			return
-		case event := <-e.queue:
-			e.Events <- event
+		case event, ok := <-e.sub.C:
+			if !ok {
+				e.Err = e.sub.Err
+				return
+			}
+			select {
+			case e.Events <- event.(*ct.Event):
+			case <-e.stop:
+				return
+			}
 		}
 	}
 }
 
 // Close unsubscribes from the EventListener and stops the loop.
 func (e *EventSubscriber) Close() {
-	e.l.Unsubscribe(e)
+	e.sub.Close()
 	e.stopOnce.Do(func() { close(e.stop) })
 }
 
-// CloseWithError sets the Err field and then closes the subscriber.
-func (e *EventSubscriber) CloseWithError(err error) {
-	e.errOnce.Do(func() { e.Err = err })
-	e.Close()
-}
-
 func newEventListener(r *EventRepo) *EventListener {
-	return &EventListener{
-		eventRepo:   r,
-		subscribers: make(map[string]map[*EventSubscriber]struct{}),
-		doneCh:      make(chan struct{}),
-	}
+	return &EventListener{newNotifyListener(r.db, "events", func(payload string) (interface{}, error) {
+		idApp := strings.SplitN(payload, ":", 2)
+		id, err := strconv.ParseInt(idApp[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return r.GetEvent(id)
+	})}
 }
 
 // EventListener creates a postgres Listener for events and forwards them
 // to subscribers.
 type EventListener struct {
-	eventRepo *EventRepo
-
-	subscribers map[string]map[*EventSubscriber]struct{}
-	subMtx      sync.RWMutex
-
-	closed    bool
-	closedMtx sync.RWMutex
-	doneCh    chan struct{}
+	*notifyListener
 }
 
 // Subscribe creates and returns an EventSubscriber for the given app, type and object.
 // Using an empty string for appID subscribes to all apps
 func (e *EventListener) Subscribe(appID string, objectTypes []string, objectID string) (*EventSubscriber, error) {
-	e.subMtx.Lock()
-	defer e.subMtx.Unlock()
-	if e.IsClosed() {
-		return nil, errors.New("event listener closed")
-	}
-	s := &EventSubscriber{
-		Events:      make(chan *ct.Event),
-		l:           e,
-		queue:       make(chan *ct.Event, eventBufferSize),
-		stop:        make(chan struct{}),
-		appID:       appID,
-		objectTypes: objectTypes,
-		objectID:    objectID,
-	}
-	go s.loop()
-	if _, ok := e.subscribers[appID]; !ok {
-		e.subscribers[appID] = make(map[*EventSubscriber]struct{})
-	}
-	e.subscribers[appID][s] = struct{}{}
-	return s, nil
-}
-
-// Unsubscribe unsubscribes the given subscriber.
-func (e *EventListener) Unsubscribe(s *EventSubscriber) {
-	e.subMtx.Lock()
-	defer e.subMtx.Unlock()
-	if subs, ok := e.subscribers[s.appID]; ok {
-		delete(subs, s)
-		if len(subs) == 0 {
-			delete(e.subscribers, s.appID)
+	sub, err := e.subscribe(func(obj interface{}) bool {
+		event := obj.(*ct.Event)
+		if appID != "" && appID != event.AppID {
+			return false
 		}
-	}
-}
-
-// Listen creates a postgres listener for events and starts a goroutine to
-// forward the events to subscribers.
-func (e *EventListener) Listen() error {
-	log := logger.New("fn", "EventListener.Listen")
-	listener, err := e.eventRepo.db.Listen("events", log)
-	if err != nil {
-		e.CloseWithError(err)
-		return err
-	}
-	go func() {
-		for {
-			select {
-			case n, ok := <-listener.Notify:
-				if !ok {
-					e.CloseWithError(listener.Err)
-					return
+		if len(objectTypes) > 0 {
+			foundType := false
+			for _, typ := range objectTypes {
+				if typ == string(event.ObjectType) {
+					foundType = true
+					break
 				}
-				idApp := strings.SplitN(n.Payload, ":", 2)
-				if len(idApp) < 1 {
-					log.Error(fmt.Sprintf("invalid event notification: %q", n.Payload))
-					continue
-				}
-				id, err := strconv.ParseInt(idApp[0], 10, 64)
-				if err != nil {
-					log.Error(fmt.Sprintf("invalid event notification: %q", n.Payload), "err", err)
-					continue
-				}
-				event, err := e.eventRepo.GetEvent(id)
-				if err != nil {
-					log.Error(fmt.Sprintf("invalid event notification: %q", n.Payload), "err", err)
-					continue
-				}
-				e.Notify(event)
-			case <-e.doneCh:
-				listener.Close()
-				return
 			}
-		}
-	}()
-	return nil
-}
-
-// Notify notifies all sbscribers of the given event.
-func (e *EventListener) Notify(event *ct.Event) {
-	e.subMtx.RLock()
-	defer e.subMtx.RUnlock()
-	if subs, ok := e.subscribers[event.AppID]; ok {
-		for sub := range subs {
-			sub.Notify(event)
-		}
-	}
-	if event.AppID != "" {
-		// Ensure subscribers not filtering by app get the event
-		if subs, ok := e.subscribers[""]; ok {
-			for sub := range subs {
-				sub.Notify(event)
+			if !foundType {
+				return false
 			}
 		}
+		return objectID == "" || objectID == event.ObjectID
+	})
+	if err != nil {
+		return nil, err
 	}
-}
-
-// IsClosed returns whether or not the listener is closed.
-func (e *EventListener) IsClosed() bool {
-	e.closedMtx.RLock()
-	defer e.closedMtx.RUnlock()
-	return e.closed
-}
-
-// CloseWithError marks the listener as closed and closes all subscribers
-// with the given error.
-func (e *EventListener) CloseWithError(err error) {
-	e.closedMtx.Lock()
-	if e.closed {
-		e.closedMtx.Unlock()
-		return
-	}
-	e.closed = true
-	e.closedMtx.Unlock()
-
-	e.subMtx.RLock()
-	defer e.subMtx.RUnlock()
-	subscribers := e.subscribers
-	for _, subs := range subscribers {
-		for sub := range subs {
-			go sub.CloseWithError(err)
-		}
+	s := &EventSubscriber{
+		Events: make(chan *ct.Event),
+		sub:    sub,
+		stop:   make(chan struct{}),
 	}
-	close(e.doneCh)
+	go s.loop()
+	return s, nil
 }
@@ -75,6 +75,107 @@ func (s *S) TestEvents(c *C) {
 	assertJobEvents(sub3, jobs[4:6])
 }
 
+func (s *S) TestEventListenerFilters(c *C) {
+	listener := newEventListener(&EventRepo{})
+	events := []*ct.Event{
+		{ID: 1, AppID: "app1", ObjectType: ct.EventTypeJob, ObjectID: "job1"},
+		{ID: 2, AppID: "app1", ObjectType: ct.EventTypeJob, ObjectID: "job2"},
+		{ID: 3, AppID: "app1", ObjectType: ct.EventTypeRelease, ObjectID: "release1"},
+		{ID: 4, AppID: "app2", ObjectType: ct.EventTypeJob, ObjectID: "job3"},
+	}
+
+	for _, t := range []struct {
+		appID       string
+		objectTypes []string
+		objectID    string
+		expected    []int64
+	}{
+		{"", nil, "", []int64{1, 2, 3, 4}},
+		{"app1", nil, "", []int64{1, 2, 3}},
+		{"app1", []string{string(ct.EventTypeJob)}, "", []int64{1, 2}},
+		{"app1", []string{string(ct.EventTypeJob), string(ct.EventTypeRelease)}, "", []int64{1, 2, 3}},
+		{"", []string{string(ct.EventTypeJob)}, "", []int64{1, 2, 4}},
+		{"app1", []string{string(ct.EventTypeJob)}, "job2", []int64{2}},
+		{"app2", []string{string(ct.EventTypeRelease)}, "", nil},
+	} {
+		sub, err := listener.Subscribe(t.appID, t.objectTypes, t.objectID)
+		c.Assert(err, IsNil)
+		for _, e := range events {
+			listener.Notify(e)
+		}
+		// closing the subscriber before reading would drop buffered
+		// events, so notify a final event which every subscriber
+		// matches to know when the matching events have been read
+		sentinel := &ct.Event{ID: 5, AppID: t.appID, ObjectID: t.objectID}
+		if len(t.objectTypes) > 0 {
+			sentinel.ObjectType = ct.EventType(t.objectTypes[0])
+		}
+		listener.Notify(sentinel)
+		var ids []int64
+	loop:
+		for {
+			select {
+			case e := <-sub.Events:
+				if e.ID == sentinel.ID {
+					break loop
+				}
+				ids = append(ids, e.ID)
+			case <-time.After(10 * time.Second):
+				c.Fatal("timed out waiting for event")
+			}
+		}
+		c.Assert(ids, DeepEquals, t.expected, Commentf("app=%q types=%v object=%q", t.appID, t.objectTypes, t.objectID))
+		sub.Close()
+	}
+}
+
+func (s *S) TestEventListenerOverflow(c *C) {
+	listener := newEventListener(&EventRepo{})
+	slow, err := listener.Subscribe("", nil, "")
+	c.Assert(err, IsNil)
+	defer slow.Close()
+	other, err := listener.Subscribe("app2", nil, "")
+	c.Assert(err, IsNil)
+	defer other.Close()
+
+	// wait for the subscriber's loop to receive an event which it then
+	// waits to send, after which eventBufferSize events fill its buffer
+	// and the next one overflows it
+	listener.Notify(&ct.Event{ID: 0, AppID: "app1"})
+	for len(slow.sub.C) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i < eventBufferSize+2; i++ {
+		listener.Notify(&ct.Event{ID: int64(i), AppID: "app1"})
+	}
+	var count int
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case _, ok := <-slow.Events:
+			if ok {
+				count++
+				continue
+			}
+		case <-timeout:
+			c.Fatal("timed out waiting for event stream to close")
+		}
+		break
+	}
+	c.Assert(count, Equals, eventBufferSize+1)
+	c.Assert(slow.Err, Equals, ErrEventBufferOverflow)
+
+	// other subscribers and the listener are unaffected
+	c.Assert(listener.IsClosed(), Equals, false)
+	listener.Notify(&ct.Event{ID: 1, AppID: "app2"})
+	select {
+	case e := <-other.Events:
+		c.Assert(e.ID, Equals, int64(1))
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for event")
+	}
+}
+
 func (s *S) TestStreamAppLifeCycleEvents(c *C) {
 	events := make(chan *ct.Event)
 	stream, err := s.c.StreamEvents(ct.StreamEventsOptions{}, events)
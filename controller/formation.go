@@ -58,6 +58,7 @@ func (r *FormationRepo) Add(f *ct.Formation) error {
 	scale := &ct.Scale{
 		Processes: f.Processes,
 		ReleaseID: f.ReleaseID,
+		Reason:    f.ScaleReason,
 	}
 	prevFormation, _ := r.Get(f.AppID, f.ReleaseID)
 	if prevFormation != nil {
@@ -122,6 +123,7 @@ func scanExpandedFormation(s postgres.Scanner) (*ct.ExpandedFormation, error) {
 		&f.App.Strategy,
 		&appReleaseID,
 		&f.App.DeployTimeout,
+		&f.App.Autoscale,
 		&f.App.CreatedAt,
 		&f.App.UpdatedAt,
 		&f.Release.ID,
@@ -141,6 +143,7 @@ func scanExpandedFormation(s postgres.Scanner) (*ct.ExpandedFormation, error) {
 		}
 		return nil, err
 	}
+	f.Release.SecretEnv = secretEnvNames(f.Release.Env)
 	if appReleaseID != nil {
 		f.App.ReleaseID = *appReleaseID
 	}
@@ -285,6 +288,10 @@ func (c *controllerAPI) PutFormation(ctx context.Context, w http.ResponseWriter,
 		respondWithError(w, err)
 		return
 	}
+	if err := validateReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
 
 	var formation ct.Formation
 	if err = httphelper.DecodeJSON(req, &formation); err != nil {
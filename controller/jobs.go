@@ -61,6 +61,7 @@ func (r *JobRepo) Add(job *ct.Job) error {
 		job.RunAt,
 		job.Restarts,
 		job.Args,
+		job.PendingReason,
 	).Scan(&job.CreatedAt, &job.UpdatedAt)
 	if postgres.IsPostgresCode(err, postgres.CheckViolation) {
 		return ct.ValidationError{Field: "state", Message: err.Error()}
@@ -94,6 +95,7 @@ func scanJob(s postgres.Scanner) (*ct.Job, error) {
 		&job.CreatedAt,
 		&job.UpdatedAt,
 		&job.Args,
+		&job.PendingReason,
 	)
 	if err != nil {
 		if err == pgx.ErrNoRows {
@@ -164,6 +166,9 @@ func (c *controllerAPI) GetJob(ctx context.Context, w http.ResponseWriter, req *
 	if err != nil {
 		respondWithError(w, err)
 		return
+	} else if job.AppID != c.getApp(ctx).ID {
+		respondWithError(w, ErrNotFound)
+		return
 	}
 	httphelper.JSON(w, 200, job)
 }
@@ -197,6 +202,9 @@ func (c *controllerAPI) KillJob(ctx context.Context, w http.ResponseWriter, req
 	if err != nil {
 		respondWithError(w, err)
 		return
+	} else if job.AppID != c.getApp(ctx).ID {
+		respondWithError(w, ErrNotFound)
+		return
 	} else if job.HostID == "" {
 		httphelper.ValidationError(w, "", "cannot kill a job which has not been placed on a host")
 		return
@@ -240,6 +248,10 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		return
 	}
 	release := data.(*ct.Release)
+	if err := validateReleaseApp(release, c.getApp(ctx)); err != nil {
+		respondWithError(w, err)
+		return
+	}
 	var artifactIDs []string
 	if len(newJob.ArtifactIDs) > 0 {
 		artifactIDs = newJob.ArtifactIDs
@@ -291,7 +303,12 @@ func (c *controllerAPI) RunJob(ctx context.Context, w http.ResponseWriter, req *
 		env[k] = v
 	}
 	if newJob.ReleaseEnv {
-		for k, v := range release.Env {
+		releaseEnv, err := c.config.secretKeys.DecryptEnv(release.Env)
+		if err != nil {
+			respondWithError(w, err)
+			return
+		}
+		for k, v := range releaseEnv {
 			env[k] = v
 		}
 	}
@@ -145,7 +145,8 @@ func (s *S) TestRunJobDetached(c *C) {
 
 	release := s.createTestRelease(c, app.ID, &ct.Release{
 		ArtifactIDs: []string{artifact.ID},
-		Env:         map[string]string{"RELEASE": "true", "FOO": "bar"},
+		Env:         map[string]string{"RELEASE": "true", "FOO": "bar", "SECRET": "shh"},
+		SecretEnv:   []string{"SECRET"},
 	})
 
 	args := []string{"foo", "bar"}
@@ -183,6 +184,7 @@ func (s *S) TestRunJobDetached(c *C) {
 			"FOO":                "baz",
 			"JOB":                "true",
 			"RELEASE":            "true",
+			"SECRET":             "shh",
 		})
 		c.Assert(job.Config.Stdin, Equals, false)
 	}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/flynn/flynn/pkg/postgres"
+)
+
+// ErrEventBufferOverflow is returned to clients when the in-memory event
+// buffer is full due to clients not reading events quickly enough.
+var ErrEventBufferOverflow = errors.New("event stream buffer overflow")
+
+// eventBufferSize is the amount of events to buffer in memory.
+const eventBufferSize = 1000
+
+// notifyListener creates a postgres Listener for a notification channel and
+// forwards the objects which the notifications refer to to subscribers.
+//
+// It is used by the EventListener and AuditListener, which wrap it with
+// subscribers of their own types.
+type notifyListener struct {
+	db      *postgres.DB
+	channel string
+
+	// get returns the object the payload of a notification refers to
+	get func(payload string) (interface{}, error)
+
+	subscribers map[*notifySubscriber]struct{}
+	closed      bool
+	mtx         sync.Mutex
+
+	doneCh chan struct{}
+}
+
+func newNotifyListener(db *postgres.DB, channel string, get func(string) (interface{}, error)) *notifyListener {
+	return &notifyListener{
+		db:          db,
+		channel:     channel,
+		get:         get,
+		subscribers: make(map[*notifySubscriber]struct{}),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+// notifySubscriber receives the objects of a notifyListener which it matches.
+type notifySubscriber struct {
+	// C receives the matching objects, and is closed with Err set once
+	// the subscriber is closed
+	C   chan interface{}
+	Err error
+
+	l      *notifyListener
+	match  func(interface{}) bool
+	closed bool
+}
+
+// Close unsubscribes from the listener and closes the C channel.
+func (s *notifySubscriber) Close() {
+	s.l.closeSubscriber(s, nil)
+}
+
+// subscribe creates and returns a subscriber which receives the objects
+// which the given function matches
+func (l *notifyListener) subscribe(match func(interface{}) bool) (*notifySubscriber, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return nil, fmt.Errorf("%s listener closed", l.channel)
+	}
+	s := &notifySubscriber{
+		C:     make(chan interface{}, eventBufferSize),
+		l:     l,
+		match: match,
+	}
+	l.subscribers[s] = struct{}{}
+	return s, nil
+}
+
+func (l *notifyListener) closeSubscriber(s *notifySubscriber, err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.closeSubscriberLocked(s, err)
+}
+
+func (l *notifyListener) closeSubscriberLocked(s *notifySubscriber, err error) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.Err = err
+	delete(l.subscribers, s)
+	close(s.C)
+}
+
+// Listen creates a postgres listener for the notification channel and starts
+// a goroutine to forward the objects to subscribers.
+func (l *notifyListener) Listen() error {
+	log := logger.New("fn", "notifyListener.Listen", "channel", l.channel)
+	listener, err := l.db.Listen(l.channel, log)
+	if err != nil {
+		l.CloseWithError(err)
+		return err
+	}
+	go func() {
+		for {
+			select {
+			case n, ok := <-listener.Notify:
+				if !ok {
+					l.CloseWithError(listener.Err)
+					return
+				}
+				obj, err := l.get(n.Payload)
+				if err != nil {
+					log.Error(fmt.Sprintf("invalid %s notification: %q", l.channel, n.Payload), "err", err)
+					continue
+				}
+				l.Notify(obj)
+			case <-l.doneCh:
+				listener.Close()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Notify sends the object to the subscribers it matches, closing those which
+// aren't reading objects quickly enough.
+func (l *notifyListener) Notify(obj interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for s := range l.subscribers {
+		if !s.match(obj) {
+			continue
+		}
+		select {
+		case s.C <- obj:
+		default:
+			l.closeSubscriberLocked(s, ErrEventBufferOverflow)
+		}
+	}
+}
+
+// IsClosed returns whether or not the listener is closed.
+func (l *notifyListener) IsClosed() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.closed
+}
+
+// CloseWithError marks the listener as closed and closes all subscribers
+// with the given error.
+func (l *notifyListener) CloseWithError(err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	for s := range l.subscribers {
+		l.closeSubscriberLocked(s, err)
+	}
+	close(l.doneCh)
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"time"
 
+	"github.com/docker/go-units"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/pkg/typeconv"
 
 	. "github.com/flynn/go-check"
 )
@@ -510,3 +513,44 @@ func (MigrateSuite) TestMigrateReleaseAppID(c *C) {
 		}
 	}
 }
+
+func (MigrateSuite) TestMigrateResourceRequests(c *C) {
+	db := setupTestDB(c, "controllertest_migrate_resource_requests")
+	m := &testMigrator{c: c, db: db}
+
+	// start from ID 35
+	m.migrateTo(35)
+
+	// create a release with defaulted and explicit requests
+	appID := random.UUID()
+	releaseID := random.UUID()
+	c.Assert(db.Exec(`INSERT INTO apps (app_id, name) VALUES ($1, $2)`, appID, "migrate-resource-requests"), IsNil)
+	procs := map[string]resource.Resources{
+		"web": {
+			resource.TypeMemory: {Request: typeconv.Int64Ptr(1 * units.GiB), Limit: typeconv.Int64Ptr(1 * units.GiB)},
+			resource.TypeCPU:    {Request: typeconv.Int64Ptr(1000), Limit: typeconv.Int64Ptr(1000)},
+			resource.TypeMaxFD:  {Request: typeconv.Int64Ptr(10000), Limit: typeconv.Int64Ptr(10000)},
+		},
+		"worker": {
+			resource.TypeMemory: {Request: typeconv.Int64Ptr(256 * units.MiB), Limit: typeconv.Int64Ptr(1 * units.GiB)},
+		},
+	}
+	processes := make(map[string]map[string]resource.Resources, len(procs))
+	for typ, r := range procs {
+		processes[typ] = map[string]resource.Resources{"resources": r}
+	}
+	c.Assert(db.Exec(`INSERT INTO releases (release_id, app_id, processes) VALUES ($1, $2, $3)`, releaseID, appID, processes), IsNil)
+
+	// migrate to 36 and check only the defaulted memory and CPU requests
+	// were removed
+	m.migrateTo(36)
+	var newProcesses map[string]map[string]resource.Resources
+	c.Assert(db.QueryRow(`SELECT processes FROM releases WHERE release_id = $1`, releaseID).Scan(&newProcesses), IsNil)
+	web := newProcesses["web"]["resources"]
+	c.Assert(web[resource.TypeMemory].Request, IsNil)
+	c.Assert(*web[resource.TypeMemory].Limit, Equals, int64(1*units.GiB))
+	c.Assert(web[resource.TypeCPU].Request, IsNil)
+	c.Assert(*web[resource.TypeMaxFD].Request, Equals, int64(10000))
+	worker := newProcesses["worker"]["resources"]
+	c.Assert(*worker[resource.TypeMemory].Request, Equals, int64(256*units.MiB))
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/flynn/flynn/controller/schema"
+	"github.com/flynn/flynn/controller/secretenv"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/pkg/httphelper"
@@ -21,13 +23,15 @@ type ReleaseRepo struct {
 	artifacts  *ArtifactRepo
 	formations *FormationRepo
 	que        *que.Client
+	secretKeys *secretenv.Keys
 }
 
-func NewReleaseRepo(db *postgres.DB, artifacts *ArtifactRepo, que *que.Client) *ReleaseRepo {
+func NewReleaseRepo(db *postgres.DB, artifacts *ArtifactRepo, que *que.Client, secretKeys *secretenv.Keys) *ReleaseRepo {
 	return &ReleaseRepo{
-		db:        db,
-		artifacts: artifacts,
-		que:       que,
+		db:         db,
+		artifacts:  artifacts,
+		que:        que,
+		secretKeys: secretKeys,
 	}
 }
 
@@ -47,9 +51,127 @@ func scanRelease(s postgres.Scanner) (*ct.Release, error) {
 	if len(release.ArtifactIDs) > 0 {
 		release.LegacyArtifactID = release.ArtifactIDs[0]
 	}
+	release.SecretEnv = secretEnvNames(release.Env)
 	return release, err
 }
 
+// secretEnvNames returns the names of the variables in env which have
+// encrypted values
+func secretEnvNames(env map[string]string) []string {
+	var names []string
+	for name, value := range env {
+		if ct.IsSecretEnvValue(value) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encryptSecretEnv encrypts the values of the release's secret variables,
+// leaving values which are already encrypted (i.e. those copied from a
+// previous release) as they are once it is checked they can be decrypted
+func (r *ReleaseRepo) encryptSecretEnv(release *ct.Release) error {
+	secret := make(map[string]struct{}, len(release.SecretEnv))
+	for _, name := range release.SecretEnv {
+		if _, ok := release.Env[name]; !ok {
+			return ct.ValidationError{
+				Field:   "secret_env",
+				Message: fmt.Sprintf("%q is not set in env", name),
+			}
+		}
+		secret[name] = struct{}{}
+	}
+	if len(secret) > 0 && r.secretKeys == nil {
+		return ct.ValidationError{
+			Field:   "secret_env",
+			Message: "secret env vars require the controller to be configured with a secret env key",
+		}
+	}
+
+	for name, value := range release.Env {
+		if ct.IsSecretEnvValue(value) {
+			if _, err := r.secretKeys.Decrypt(name, value); err != nil {
+				return ct.ValidationError{
+					Field:   "env",
+					Message: fmt.Sprintf("%s has an invalid encrypted value: %s", name, err),
+				}
+			}
+			continue
+		}
+		if _, ok := secret[name]; !ok {
+			continue
+		}
+		encrypted, err := r.secretKeys.Encrypt(name, value)
+		if err != nil {
+			return err
+		}
+		release.Env[name] = encrypted
+	}
+	release.SecretEnv = secretEnvNames(release.Env)
+	return nil
+}
+
+// RotateSecretEnv re-encrypts the secret variables of releases which were
+// encrypted with a previous key with the current key, returning the number of
+// releases which were re-encrypted
+func (r *ReleaseRepo) RotateSecretEnv() (int, error) {
+	if r.secretKeys == nil {
+		return 0, secretenv.ErrNoKey
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query("release_secret_env_list")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	envs := make(map[string]map[string]string)
+	for rows.Next() {
+		var id string
+		var env map[string]string
+		if err := rows.Scan(&id, &env); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		envs[id] = env
+	}
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var count int
+	for id, env := range envs {
+		var changed bool
+		for name, value := range env {
+			if !ct.IsSecretEnvValue(value) {
+				continue
+			}
+			encrypted, reencrypted, err := r.secretKeys.Reencrypt(name, value)
+			if err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("error re-encrypting %s in release %s: %s", name, id, err)
+			}
+			env[name] = encrypted
+			changed = changed || reencrypted
+		}
+		if !changed {
+			continue
+		}
+		if err := tx.Exec("release_env_update", id, env); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		count++
+	}
+	return count, tx.Commit()
+}
+
 func (r *ReleaseRepo) Add(data interface{}) error {
 	release := data.(*ct.Release)
 
@@ -84,6 +206,10 @@ func (r *ReleaseRepo) Add(data interface{}) error {
 		}
 	}
 
+	if err := r.encryptSecretEnv(release); err != nil {
+		return err
+	}
+
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
@@ -311,6 +437,18 @@ type releaseID struct {
 	ID string `json:"id"`
 }
 
+// validateReleaseApp returns a validation error if the release was created
+// for an app other than the given one
+func validateReleaseApp(release *ct.Release, app *ct.App) error {
+	if release.AppID != "" && release.AppID != app.ID {
+		return ct.ValidationError{
+			Field:   "release",
+			Message: fmt.Sprintf("release %s does not belong to app %s", release.ID, app.ID),
+		}
+	}
+	return nil
+}
+
 func (c *controllerAPI) GetAppReleases(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	list, err := c.releaseRepo.AppList(c.getApp(ctx).ID)
 	if err != nil {
@@ -345,6 +483,10 @@ func (c *controllerAPI) SetAppRelease(ctx context.Context, w http.ResponseWriter
 	}
 
 	app := c.getApp(ctx)
+	if err := validateReleaseApp(release, app); err != nil {
+		respondWithError(w, err)
+		return
+	}
 	c.appRepo.SetRelease(app, release.ID)
 	httphelper.JSON(w, 200, release)
 }
@@ -376,3 +518,16 @@ func (c *controllerAPI) DeleteRelease(ctx context.Context, w http.ResponseWriter
 	}
 	w.WriteHeader(200)
 }
+
+// Re-encrypt secret env vars with the current secret env key
+func (c *controllerAPI) RotateSecretEnv(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	count, err := c.releaseRepo.RotateSecretEnv()
+	if err == secretenv.ErrNoKey {
+		respondWithError(w, ct.ValidationError{Message: "the controller is not configured with a secret env key"})
+		return
+	} else if err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &ct.SecretEnvRotation{Releases: count})
+}
@@ -73,6 +73,18 @@ func (r *fakeRouter) StreamEvents(opts *router.StreamEventsOptions, output chan
 	return &fakeStream{}, nil
 }
 
+func (r *fakeRouter) GetServiceRequests(service string) (map[string]int64, error) {
+	return nil, nil
+}
+
+func (r *fakeRouter) PurgeCache(id, prefix string) error {
+	return nil
+}
+
+func (r *fakeRouter) GetCircuitBreakers(id string) ([]*router.CircuitBreakerState, error) {
+	return nil, nil
+}
+
 func (r *fakeRouter) CreateCert(cert *router.Certificate) error {
 	return nil
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	routerc "github.com/flynn/flynn/router/client"
+)
+
+const autoscaleInterval = 30 * time.Second
+
+func (s *Scheduler) tickAutoscale(d time.Duration) {
+	s.logger.Info("starting autoscale ticker", "duration", d)
+	go func() {
+		for range time.Tick(d) {
+			s.triggerAutoscale()
+		}
+	}()
+}
+
+func (s *Scheduler) triggerAutoscale() {
+	select {
+	case s.autoscale <- struct{}{}:
+	default:
+	}
+}
+
+// autoscaleFormation is a copy of a formation which has autoscale policies,
+// along with the router service of each autoscaled process type
+type autoscaleFormation struct {
+	Formation *ct.Formation
+	Policies  map[string]*ct.AutoscalePolicy
+	Services  map[string]string
+}
+
+// Autoscale determines which formations have autoscale policies and starts a
+// goroutine to scale them based on the number of in-flight router requests
+// (the router API requests are made outside of the main loop so they don't
+// block it)
+func (s *Scheduler) Autoscale() {
+	if !s.IsLeader() || len(s.routers) == 0 {
+		return
+	}
+
+	var formations []*autoscaleFormation
+	for _, f := range s.formations {
+		// only autoscale the formation of the app's current release so
+		// we don't interfere with deployments
+		if len(f.App.Autoscale) == 0 || f.App.ReleaseID != f.Release.ID {
+			continue
+		}
+		af := &autoscaleFormation{
+			Policies: make(map[string]*ct.AutoscalePolicy, len(f.App.Autoscale)),
+			Services: make(map[string]string, len(f.App.Autoscale)),
+		}
+		for typ, policy := range f.App.Autoscale {
+			proc, ok := f.Release.Processes[typ]
+			if !ok || proc.Omni {
+				continue
+			}
+			if service := processService(proc); service != "" {
+				af.Policies[typ] = policy
+				af.Services[typ] = service
+			}
+		}
+		if len(af.Policies) == 0 {
+			continue
+		}
+		procs := make(map[string]int, len(f.OriginalProcesses))
+		for typ, count := range f.OriginalProcesses {
+			procs[typ] = count
+		}
+		af.Formation = &ct.Formation{
+			AppID:     f.App.ID,
+			ReleaseID: f.Release.ID,
+			Processes: procs,
+			Tags:      f.Tags,
+		}
+		formations = append(formations, af)
+	}
+	if len(formations) == 0 {
+		return
+	}
+
+	routers := make([]routerc.Client, 0, len(s.routers))
+	for _, r := range s.routers {
+		routers = append(routers, r.client)
+	}
+	go s.autoscaleFormations(formations, routers)
+}
+
+// autoscaleFormations scales the given formations based on the total number
+// of in-flight requests to their services across all routers, updating each
+// formation in the controller with the reason for the scale
+func (s *Scheduler) autoscaleFormations(formations []*autoscaleFormation, routers []routerc.Client) {
+	log := s.logger.New("fn", "autoscaleFormations")
+
+	requests := make(map[string]int64)
+	getRequests := func(service string) (int64, error) {
+		if total, ok := requests[service]; ok {
+			return total, nil
+		}
+		var total int64
+		for _, r := range routers {
+			backends, err := r.GetServiceRequests(service)
+			if err != nil {
+				return 0, err
+			}
+			for _, n := range backends {
+				total += n
+			}
+		}
+		requests[service] = total
+		return total, nil
+	}
+
+	for _, af := range formations {
+		f := af.Formation
+		var reasons []string
+		for typ, policy := range af.Policies {
+			service := af.Services[typ]
+			total, err := getRequests(service)
+			if err != nil {
+				// don't scale based on partial request counts
+				log.Error("error getting router service requests", "service", service, "err", err)
+				continue
+			}
+			current := f.Processes[typ]
+			count := autoscaleCount(policy, current, total)
+			if count == current {
+				continue
+			}
+			f.Processes[typ] = count
+			reasons = append(reasons, fmt.Sprintf(
+				"%s: %d=>%d (%d in-flight requests, target %d per process, min %d, max %d)",
+				typ, current, count, total, policy.TargetRequests, policy.Min, policy.Max,
+			))
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		sort.Strings(reasons)
+		f.ScaleReason = "autoscale " + strings.Join(reasons, ", ")
+		log.Info("autoscaling formation", "app.id", f.AppID, "release.id", f.ReleaseID, "reason", f.ScaleReason)
+		if err := s.PutFormation(f); err != nil {
+			log.Error("error autoscaling formation", "app.id", f.AppID, "release.id", f.ReleaseID, "err", err)
+		}
+	}
+}
+
+// autoscaleCount returns the number of processes to scale a process type to
+// given the current count and the total number of in-flight requests, scaling
+// up straight to the desired count but down by at most one process at a time
+// so that bursty traffic doesn't cause the formation to thrash
+func autoscaleCount(policy *ct.AutoscalePolicy, current int, requests int64) int {
+	if policy.TargetRequests < 1 {
+		return current
+	}
+	count := int((requests + policy.TargetRequests - 1) / policy.TargetRequests)
+	if count < current-1 {
+		count = current - 1
+	}
+	if count < policy.Min {
+		count = policy.Min
+	}
+	if count > policy.Max {
+		count = policy.Max
+	}
+	return count
+}
+
+// processService returns the name of the service which routes send requests
+// to for the given process type
+func processService(proc ct.ProcessType) string {
+	for _, port := range proc.Ports {
+		if port.Service != nil && port.Service.Name != "" {
+			return port.Service.Name
+		}
+	}
+	return ""
+}
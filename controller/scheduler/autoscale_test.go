@@ -0,0 +1,62 @@
+package main
+
+import (
+	ct "github.com/flynn/flynn/controller/types"
+	. "github.com/flynn/go-check"
+)
+
+func (TestSuite) TestAutoscaleCount(c *C) {
+	policy := &ct.AutoscalePolicy{Min: 2, Max: 10, TargetRequests: 5}
+	type test struct {
+		desc     string
+		current  int
+		requests int64
+		count    int
+	}
+	for _, t := range []test{
+		{
+			desc:     "no change",
+			current:  4,
+			requests: 20,
+			count:    4,
+		},
+		{
+			desc:     "scale up to desired count",
+			current:  2,
+			requests: 21,
+			count:    5,
+		},
+		{
+			desc:     "scale up capped at max",
+			current:  4,
+			requests: 100,
+			count:    10,
+		},
+		{
+			desc:     "scale down one at a time",
+			current:  6,
+			requests: 0,
+			count:    5,
+		},
+		{
+			desc:     "scale down capped at min",
+			current:  2,
+			requests: 0,
+			count:    2,
+		},
+		{
+			desc:     "scale up to min",
+			current:  0,
+			requests: 0,
+			count:    2,
+		},
+		{
+			desc:     "scale down to max",
+			current:  20,
+			requests: 100,
+			count:    10,
+		},
+	} {
+		c.Assert(autoscaleCount(policy, t.current, t.requests), Equals, t.count, Commentf(t.desc))
+	}
+}
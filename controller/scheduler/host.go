@@ -8,6 +8,7 @@ import (
 	"github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/stream"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -20,6 +21,10 @@ type Host struct {
 	Checks   int               `json:"checks"`
 	Shutdown bool              `json:"shutdown"`
 
+	// Resources is the total amount of each resource the host has
+	// available for jobs, and is nil if the host doesn't report it
+	Resources resource.Resources `json:"resources,omitempty"`
+
 	client   utils.HostClient
 	stop     chan struct{}
 	stopOnce sync.Once
@@ -6,6 +6,7 @@ import (
 
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/pkg/typeconv"
 )
 
@@ -99,6 +100,16 @@ type Job struct {
 
 	// hostError is the error from the host if the job fails to start
 	hostError *string
+
+	// pendingReason is the reason the job could not be placed in the
+	// cluster, and is cleared once the job is placed
+	pendingReason *string
+
+	// resources are the resources of the cluster job, assigned whenever a
+	// host event is received for the job, and are used when calculating
+	// host resource usage for jobs which aren't part of the formation
+	// (e.g. one-off jobs)
+	resources resource.Resources
 }
 
 // Tags returns the tags for the job's process type from the formation
@@ -117,6 +128,69 @@ func (j *Job) TagsMatchHost(host *Host) bool {
 	return true
 }
 
+// Resources returns the resources requested by the job, either from the
+// job's process type, or from the cluster job if the job's process type is
+// not part of the formation.
+//
+// The process type is preferred as the resources of jobs which were started
+// before their release's resources were migrated may include requests which
+// are no longer set.
+func (j *Job) Resources() resource.Resources {
+	if j.Formation != nil {
+		if proc, ok := j.Formation.Release.Processes[j.Type]; ok {
+			return proc.Resources
+		}
+	}
+	return j.resources
+}
+
+// HasResources checks whether the job's resource requests fit on the given
+// host alongside the resources already requested by jobs on that host
+func (j *Job) HasResources(host *Host, used map[resource.Type]int64) bool {
+	for typ, capacity := range host.Resources {
+		if capacity.Limit == nil {
+			continue
+		}
+		spec, ok := j.Resources()[typ]
+		if !ok || spec.Request == nil {
+			continue
+		}
+		if used[typ]+*spec.Request > *capacity.Limit {
+			return false
+		}
+	}
+	return true
+}
+
+// Spread returns the spread rule for the job's process type from the
+// formation
+func (j *Job) Spread() *ct.SpreadRule {
+	if j.Formation == nil {
+		return nil
+	}
+	return j.Formation.Release.Processes[j.Type].Spread
+}
+
+// SpreadAllowsHost checks whether placing the job on the given host satisfies
+// the job's spread rule, given the number of jobs of the same type already on
+// the host and the number of those jobs per value of the rule's tag
+func (j *Job) SpreadAllowsHost(host *Host, hostCount int, tagCounts map[string]int) bool {
+	spread := j.Spread()
+	if spread == nil {
+		return true
+	}
+	if spread.UniqueHost && hostCount > 0 {
+		return false
+	}
+	if spread.Tag != "" {
+		val, ok := host.Tags[spread.Tag]
+		if !ok || tagCounts[val] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (j *Job) Volumes() []ct.VolumeReq {
 	proc := j.Formation.Release.Processes[j.Type]
 	if len(proc.Volumes) > 0 {
@@ -141,16 +215,17 @@ func (j *Job) IsInApp(appID string) bool {
 
 func (j *Job) ControllerJob() *ct.Job {
 	job := &ct.Job{
-		ID:        j.JobID,
-		UUID:      j.ID,
-		HostID:    j.HostID,
-		AppID:     j.AppID,
-		ReleaseID: j.ReleaseID,
-		Type:      j.Type,
-		Meta:      utils.JobMetaFromMetadata(j.metadata),
-		HostError: j.hostError,
-		RunAt:     j.RunAt,
-		Args:      j.Args,
+		ID:            j.JobID,
+		UUID:          j.ID,
+		HostID:        j.HostID,
+		AppID:         j.AppID,
+		ReleaseID:     j.ReleaseID,
+		Type:          j.Type,
+		Meta:          utils.JobMetaFromMetadata(j.metadata),
+		HostError:     j.hostError,
+		RunAt:         j.RunAt,
+		Args:          j.Args,
+		PendingReason: j.pendingReason,
 	}
 
 	switch j.State {
@@ -211,6 +286,28 @@ func (j Jobs) GetHostJobCounts(key utils.FormationKey, typ string) map[string]in
 	return counts
 }
 
+// GetHostResources returns the sum of the resources requested by jobs which
+// have been placed on each host and are not yet stopped
+func (js Jobs) GetHostResources() map[string]map[resource.Type]int64 {
+	used := make(map[string]map[resource.Type]int64)
+	for _, j := range js {
+		if j.HostID == "" || j.State == JobStateStopped {
+			continue
+		}
+		hostUsed, ok := used[j.HostID]
+		if !ok {
+			hostUsed = make(map[resource.Type]int64)
+			used[j.HostID] = hostUsed
+		}
+		for typ, spec := range j.Resources() {
+			if spec.Request != nil {
+				hostUsed[typ] += *spec.Request
+			}
+		}
+	}
+	return used
+}
+
 func (js Jobs) GetProcesses(key utils.FormationKey) Processes {
 	procs := make(Processes)
 	for _, j := range js {
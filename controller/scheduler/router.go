@@ -14,6 +14,10 @@ type RouterBackend struct {
 	Backend *router.Backend
 	Routers map[string]struct{}
 	Drained chan struct{}
+
+	// Ejected is the set of routers which have ejected the backend
+	// because it is failing a route's active health check
+	Ejected map[string]struct{}
 }
 
 func NewRouterBackend(backend *router.Backend) *RouterBackend {
@@ -21,6 +25,7 @@ func NewRouterBackend(backend *router.Backend) *RouterBackend {
 		Backend: backend,
 		Routers: make(map[string]struct{}),
 		Drained: make(chan struct{}),
+		Ejected: make(map[string]struct{}),
 	}
 }
 
@@ -63,6 +68,8 @@ func (r *Router) watchBackends() {
 			EventTypes: []router.EventType{
 				router.EventTypeBackendUp,
 				router.EventTypeBackendDrained,
+				router.EventTypeBackendEjected,
+				router.EventTypeBackendRestored,
 			},
 		}
 		stream, err = r.client.StreamEvents(opts, events)
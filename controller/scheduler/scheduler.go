@@ -12,6 +12,7 @@ import (
 	"time"
 
 	controller "github.com/flynn/flynn/controller/client"
+	"github.com/flynn/flynn/controller/secretenv"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
 	discoverd "github.com/flynn/flynn/discoverd/client"
@@ -39,6 +40,10 @@ var (
 	ErrNoHosts          = errors.New("no hosts found")
 	ErrJobNotPending    = errors.New("job is no longer pending")
 	ErrNoHostsMatchTags = errors.New("no hosts found matching job tags")
+
+	ErrInsufficientResources = errors.New("insufficient resources to place job")
+
+	ErrSpreadUnsatisfiable = errors.New("no hosts satisfy the job's spread rule")
 )
 
 type Scheduler struct {
@@ -70,6 +75,7 @@ type Scheduler struct {
 	hostChecks            chan struct{}
 	rectify               chan struct{}
 	sendTelemetry         chan struct{}
+	autoscale             chan struct{}
 	hostEvents            chan *discoverd.Event
 	routerServiceEvents   chan *discoverd.Event
 	routerBackendEvents   chan *RouterEvent
@@ -93,6 +99,12 @@ type Scheduler struct {
 	// jobs when host tags change
 	pendingTagJobs map[string]*Job
 
+	// pendingPlacementJobs is a map of jobs which are currently pending
+	// due to no hosts either having sufficient resources to run them or
+	// satisfying their spread rule, and is used to try and place the jobs
+	// when the cluster changes (i.e. when jobs stop or hosts are added)
+	pendingPlacementJobs map[string]*Job
+
 	// pause and resume are used by tests to control the main loop
 	pause  chan struct{}
 	resume chan struct{}
@@ -102,6 +114,10 @@ type Scheduler struct {
 	generateJobUUID func() string
 
 	routerBackends map[string]*RouterBackend
+
+	// secretKeys decrypts the values of secret release env vars when
+	// building the config of placed jobs
+	secretKeys *secretenv.Keys
 }
 
 func NewScheduler(cluster utils.ClusterClient, cc utils.ControllerClient, disc Discoverd, l log15.Logger) *Scheduler {
@@ -126,6 +142,7 @@ func NewScheduler(cluster utils.ClusterClient, cc utils.ControllerClient, disc D
 		rectifyBatch:          make(map[utils.FormationKey]struct{}),
 		rectify:               make(chan struct{}, 1),
 		sendTelemetry:         make(chan struct{}, 1),
+		autoscale:             make(chan struct{}, 1),
 		formationEvents:       make(chan *ct.ExpandedFormation, eventBufferSize),
 		hostEvents:            make(chan *discoverd.Event, eventBufferSize),
 		routerServiceEvents:   make(chan *discoverd.Event, eventBufferSize),
@@ -136,6 +153,7 @@ func NewScheduler(cluster utils.ClusterClient, cc utils.ControllerClient, disc D
 		internalStateRequests: make(chan *InternalStateRequest, eventBufferSize),
 		formationlessJobs:     make(map[utils.FormationKey]map[string]*Job),
 		pendingTagJobs:        make(map[string]*Job),
+		pendingPlacementJobs:  make(map[string]*Job),
 		pause:                 make(chan struct{}),
 		resume:                make(chan struct{}),
 		generateJobUUID:       random.UUID,
@@ -168,7 +186,14 @@ func main() {
 		shutdown.Fatal(err)
 	}
 
+	secretKeys, err := secretenv.LoadKeys()
+	if err != nil {
+		log.Error("error loading secret env keys", "err", err)
+		shutdown.Fatal(err)
+	}
+
 	s := NewScheduler(clusterClient, controllerClient, newDiscoverdWrapper(logger), logger)
+	s.secretKeys = secretKeys
 	log.Info("started scheduler")
 
 	go s.startHTTPServer(os.Getenv("PORT"))
@@ -390,6 +415,7 @@ func (s *Scheduler) Run() {
 	s.tickSyncSinks(time.Minute)
 	s.tickSyncHosts(10 * time.Second)
 	s.tickSendTelemetry()
+	s.tickAutoscale(autoscaleInterval)
 
 	for {
 		select {
@@ -481,6 +507,8 @@ func (s *Scheduler) Run() {
 			s.SyncHosts()
 		case <-s.sendTelemetry:
 			s.SendTelemetry()
+		case <-s.autoscale:
+			s.Autoscale()
 		case <-s.syncSinks:
 			s.SyncSinks()
 		case <-s.pause:
@@ -716,6 +744,7 @@ func (s *Scheduler) SyncHosts() (err error) {
 		if err == nil {
 			// make sure no jobs are pending which needn't be
 			s.maybeStartPendingTagJobs(h)
+			s.maybeStartPendingPlacementJobs()
 		} else {
 			log.Error("error following host", "host.id", host.ID(), "err", err)
 			// finish the sync before returning the error
@@ -771,6 +800,10 @@ func (s *Scheduler) RectifyFormation(key utils.FormationKey) {
 	// them on hosts with matching tags
 	s.stopJobsWithMismatchedTags(formation)
 
+	// stop jobs which break spread rules in case we need to reschedule
+	// them on hosts which satisfy the rules
+	s.stopJobsBreakingSpreadRules(formation)
+
 	diff := s.formationDiff(formation)
 	if diff.IsEmpty() {
 		return
@@ -857,6 +890,59 @@ func (s *Scheduler) maybeStartPendingTagJobs(host *Host) {
 	}
 }
 
+// maybeStartPendingPlacementJobs starts any jobs which are pending due to
+// insufficient resources or unsatisfiable spread rules if there is now a host
+// they can be placed on, which is expected to be called when either a job has
+// stopped, a host has been added or a host's tags have changed
+func (s *Scheduler) maybeStartPendingPlacementJobs() {
+	for id, job := range s.pendingPlacementJobs {
+		if job.State != JobStatePending {
+			delete(s.pendingPlacementJobs, id)
+			continue
+		}
+		if _, err := s.findHost(job); err == nil {
+			delete(s.pendingPlacementJobs, id)
+			go s.StartJob(job)
+		}
+	}
+}
+
+// stopJobsBreakingSpreadRules stops any running jobs which break the spread
+// rule of their process type (possible after a host's tags are updated), so
+// that they get rescheduled on hosts which satisfy the rule, keeping the
+// oldest jobs running
+func (s *Scheduler) stopJobsBreakingSpreadRules(formation *Formation) {
+	log := s.logger.New("fn", "stopJobsBreakingSpreadRules")
+	for typ, proc := range formation.Release.Processes {
+		spread := proc.Spread
+		if spread == nil {
+			continue
+		}
+		jobs := s.jobs.WithFormationAndType(formation, typ)
+		jobs.SortReverse()
+		hostCounts := make(map[string]int)
+		tagCounts := make(map[string]int)
+		for _, job := range jobs {
+			if !job.IsRunning() {
+				continue
+			}
+			host, ok := s.hosts[job.HostID]
+			if !ok {
+				continue
+			}
+			if !job.SpreadAllowsHost(host, hostCounts[host.ID], tagCounts) {
+				log.Info("job breaks spread rule, stopping", "job.id", job.ID, "job.type", typ, "host.id", host.ID, "host.tags", host.Tags)
+				s.stopJob(job)
+				continue
+			}
+			hostCounts[host.ID]++
+			if spread.Tag != "" {
+				tagCounts[host.Tags[spread.Tag]]++
+			}
+		}
+	}
+}
+
 func (s *Scheduler) formationDiff(formation *Formation) Processes {
 	if formation == nil {
 		return nil
@@ -909,46 +995,117 @@ func (s *Scheduler) HandlePlacementRequest(req *PlacementRequest) {
 	// start
 	req.Job.HostID = ""
 
-	formation := req.Job.Formation
-	counts := s.jobs.GetHostJobCounts(formation.key(), req.Job.Type)
+	// if we can't find a host, either the job's tags don't match any hosts
+	// or none of the matching hosts satisfy the job's spread rule or have
+	// sufficient resources, so add it to either s.pendingTagJobs or
+	// s.pendingPlacementJobs and return an error to cause the StartJob
+	// goroutine to stop trying to place the job
+	host, err := s.findHost(req.Job)
+	if err != nil {
+		log.Warn("unable to find a host for job", "job.resources", req.Job.Resources(), "job.spread", req.Job.Spread(), "err", err)
+		if err == ErrNoHostsMatchTags {
+			s.pendingTagJobs[req.Job.ID] = req.Job
+		} else {
+			s.pendingPlacementJobs[req.Job.ID] = req.Job
+		}
+		s.setPendingReason(req.Job, err)
+		req.Error(err)
+		return
+	}
+	req.Host = host
+	req.Job.pendingReason = nil
+
+	if len(req.Job.Tags()) == 0 {
+		log.Info(fmt.Sprintf("placed job on host with least %s jobs", req.Job.Type), "host.id", req.Host.ID)
+	} else {
+		log.Info(fmt.Sprintf("placed job on host with matching tags and least %s jobs", req.Job.Type), "host.id", req.Host.ID, "host.tags", req.Host.Tags)
+	}
+
+	config := jobConfig(req.Job, req.Host.ID)
+
+	// secret env vars are only decrypted once the job has been placed,
+	// so that their values are only sent to the host running the job
+	env, err := s.secretKeys.DecryptEnv(config.Config.Env)
+	if err != nil {
+		log.Error("error decrypting secret env", "err", err)
+		req.Error(err)
+		return
+	}
+	config.Config.Env = env
+
+	req.Config = config
+	req.Job.JobID = req.Config.ID
+	req.Job.HostID = req.Host.ID
+	req.Error(nil)
+}
+
+// findHost finds a host to place the given job on, picking the host with the
+// least jobs of the same type out of those which match the job's tags, satisfy
+// the job's spread rule and have sufficient resources, and returns an error
+// explaining why the job cannot be placed if there are no such hosts
+func (s *Scheduler) findHost(job *Job) (*Host, error) {
+	counts := s.jobs.GetHostJobCounts(job.Formation.key(), job.Type)
+	used := s.jobs.GetHostResources()
+
+	// count the jobs per value of the spread rule's tag
+	var tagCounts map[string]int
+	if spread := job.Spread(); spread != nil && spread.Tag != "" {
+		tagCounts = make(map[string]int)
+		for id, count := range counts {
+			if h, ok := s.hosts[id]; ok {
+				if val, ok := h.Tags[spread.Tag]; ok {
+					tagCounts[val] += count
+				}
+			}
+		}
+	}
+
+	// err is the reason the most suitable host was rejected, with hosts
+	// rejected due to resources being more suitable than those rejected
+	// due to spread rules
+	var host *Host
 	var minCount int = math.MaxInt32
+	err := ErrNoHostsMatchTags
 	for _, h := range s.ShuffledHosts() {
 		if h.Shutdown {
 			continue
 		}
-		if !req.Job.TagsMatchHost(h) {
+		if !job.TagsMatchHost(h) {
 			continue
 		}
-		count, ok := counts[h.ID]
-		if !ok || count == 0 {
-			req.Host = h
-			break
+		count := counts[h.ID]
+		if !job.SpreadAllowsHost(h, count, tagCounts) {
+			if err == ErrNoHostsMatchTags {
+				err = ErrSpreadUnsatisfiable
+			}
+			continue
+		}
+		if !job.HasResources(h, used[h.ID]) {
+			err = ErrInsufficientResources
+			continue
+		}
+		if count == 0 {
+			return h, nil
 		}
 		if count < minCount {
 			minCount = count
-			req.Host = h
+			host = h
 		}
 	}
-
-	// if we didn't pick a host, the job's tags don't match any hosts so
-	// add it to s.pendingTagJobs and return an error to cause the
-	// StartJob goroutine to stop trying to place the job
-	if req.Host == nil {
-		s.pendingTagJobs[req.Job.ID] = req.Job
-		req.Error(ErrNoHostsMatchTags)
-		return
+	if host == nil {
+		return nil, err
 	}
+	return host, nil
+}
 
-	if len(req.Job.Tags()) == 0 {
-		log.Info(fmt.Sprintf("placed job on host with least %s jobs", req.Job.Type), "host.id", req.Host.ID)
-	} else {
-		log.Info(fmt.Sprintf("placed job on host with matching tags and least %s jobs", req.Job.Type), "host.id", req.Host.ID, "host.tags", req.Host.Tags)
+// setPendingReason sets the reason why a job is still pending, persisting the
+// job if the reason has changed
+func (s *Scheduler) setPendingReason(job *Job, err error) {
+	if job.pendingReason != nil && *job.pendingReason == err.Error() {
+		return
 	}
-
-	req.Config = jobConfig(req.Job, req.Host.ID)
-	req.Job.JobID = req.Config.ID
-	req.Job.HostID = req.Host.ID
-	req.Error(nil)
+	job.pendingReason = typeconv.StringPtr(err.Error())
+	s.persistJob(job)
 }
 
 type InternalState struct {
@@ -1212,6 +1369,12 @@ outer:
 		} else if err == ErrNoHostsMatchTags {
 			log.Warn("unable to place job as tags don't match any hosts")
 			return
+		} else if err == ErrInsufficientResources {
+			log.Warn("unable to place job as no hosts have sufficient resources")
+			return
+		} else if err == ErrSpreadUnsatisfiable {
+			log.Warn("unable to place job as no hosts satisfy its spread rule")
+			return
 		} else if err == ErrJobNotPending {
 			log.Warn("unable to place job as it is no longer pending")
 			return
@@ -1266,6 +1429,16 @@ func (s *Scheduler) followHost(h utils.HostClient) (*Host, error) {
 	}
 
 	host := NewHost(h, s.logger)
+
+	// get the resources of the host so that jobs are only placed on it if
+	// they fit (hosts which don't report resources have no resource
+	// requests checked)
+	if status, err := h.GetStatus(); err == nil {
+		host.Resources = status.Resources
+	} else {
+		s.logger.Warn("error getting host status, not checking resources", "host.id", host.ID, "err", err)
+	}
+
 	jobs, err := host.StreamEventsTo(s.jobEvents)
 	if err != nil {
 		return nil, err
@@ -1359,6 +1532,7 @@ func (s *Scheduler) HandleHostEvent(e *discoverd.Event) {
 			host.Tags = tags
 			s.rectifyAll()
 			s.maybeStartPendingTagJobs(host)
+			s.maybeStartPendingPlacementJobs()
 		}
 	case discoverd.EventKindDown:
 		id := e.Instance.Meta["id"]
@@ -1424,6 +1598,20 @@ func (s *Scheduler) HandleRouterBackendEvent(e *RouterEvent) {
 			close(backend.Drained)
 			delete(s.routerBackends, e.Backend.JobID)
 		}
+	case router.EventTypeBackendEjected:
+		backend, ok := s.routerBackends[e.Backend.JobID]
+		if !ok {
+			return
+		}
+		backend.Ejected[e.RouterID] = struct{}{}
+		log.Warn("router backend ejected by active health check", "job.addr", e.Backend.Addr, "ejected.count", len(backend.Ejected))
+	case router.EventTypeBackendRestored:
+		backend, ok := s.routerBackends[e.Backend.JobID]
+		if !ok {
+			return
+		}
+		delete(backend.Ejected, e.RouterID)
+		log.Info("router backend restored by active health check", "job.addr", e.Backend.Addr, "ejected.count", len(backend.Ejected))
 	}
 }
 
@@ -1443,9 +1631,10 @@ func (s *Scheduler) handleNewHost(id string) {
 		return
 	}
 
-	// we have a new host which may now match the tags of some pending jobs
-	// so try to start them
+	// we have a new host which may now match the tags or have enough
+	// resources for some pending jobs so try to start them
 	s.maybeStartPendingTagJobs(host)
+	s.maybeStartPendingPlacementJobs()
 }
 
 // activeHostCount returns the number of active hosts (i.e. all hosts which
@@ -1564,6 +1753,7 @@ func (s *Scheduler) handleActiveJob(activeJob *host.ActiveJob) *Job {
 
 	job.StartedAt = activeJob.StartedAt
 	job.metadata = hostJob.Metadata
+	job.resources = hostJob.Resources
 	job.exitStatus = activeJob.ExitStatus
 	job.hostError = activeJob.Error
 
@@ -1601,6 +1791,12 @@ func (s *Scheduler) handleJobStatus(job *Job, status host.JobStatus) {
 		s.persistJob(job)
 	}
 
+	// if the job has just stopped, it no longer uses any resources so try
+	// to start jobs which are pending due to insufficient resources
+	if previousState != JobStateStopped && job.State == JobStateStopped && s.IsLeader() {
+		s.maybeStartPendingPlacementJobs()
+	}
+
 	// ensure jobs started as part of a formation change have a known formation
 	if job.metadata["flynn-controller.formation"] == "true" && job.Formation == nil {
 		formation := s.formations.Get(job.AppID, job.ReleaseID)
@@ -1698,6 +1894,9 @@ func (s *Scheduler) handleFormation(ef *ct.ExpandedFormation) (formation *Format
 		}
 		formation.UpdatedAt = ef.UpdatedAt
 
+		// keep the app up to date as it includes autoscale policies
+		formation.App = ef.App
+
 		diff := Processes(ef.Processes).Diff(formation.OriginalProcesses)
 		if diff.IsEmpty() && utils.FormationTagsEqual(formation.Tags, ef.Tags) {
 			return
@@ -7,9 +7,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/docker/go-units"
 	. "github.com/flynn/flynn/controller/testutils"
 	ct "github.com/flynn/flynn/controller/types"
 	"github.com/flynn/flynn/controller/utils"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/pkg/cluster"
 	"github.com/flynn/flynn/pkg/random"
@@ -766,6 +768,169 @@ func (TestSuite) TestJobPlacementTags(c *C) {
 	}
 }
 
+func (TestSuite) TestJobPlacementResources(c *C) {
+	// create a scheduler with hosts which have 2GiB and 3GiB of memory
+	memory := func(size int64) resource.Resources {
+		return resource.Resources{resource.TypeMemory: {Request: typeconv.Int64Ptr(size), Limit: typeconv.Int64Ptr(size)}}
+	}
+	s := &Scheduler{
+		isLeader: typeconv.BoolPtr(true),
+		jobs:     make(Jobs),
+		hosts: map[string]*Host{
+			"host1": {ID: "host1", Resources: memory(2 * units.GiB)},
+			"host2": {ID: "host2", Resources: memory(3 * units.GiB)},
+		},
+		pendingPlacementJobs: make(map[string]*Job),
+		putJobs:              make(chan *ct.Job, 10),
+		logger:               log15.New(),
+	}
+
+	// use a formation with a process type which requests 1GiB of memory
+	formation := NewFormation(&ct.ExpandedFormation{
+		App: &ct.App{ID: "app"},
+		Release: &ct.Release{ID: "release", Processes: map[string]ct.ProcessType{
+			"web": {Resources: memory(1 * units.GiB)},
+		}},
+		Artifacts: []*ct.Artifact{{}},
+	})
+
+	// check the first 5 jobs are placed on hosts with enough memory
+	hosts := make(map[string]int, 2)
+	for i := 0; i < 5; i++ {
+		job := s.jobs.Add(&Job{ID: fmt.Sprintf("job-%d", i), Formation: formation, Type: "web", State: JobStatePending})
+		req := &PlacementRequest{Job: job, Err: make(chan error, 1)}
+		s.HandlePlacementRequest(req)
+		c.Assert(<-req.Err, IsNil, Commentf("placing job %d", i))
+		hosts[req.Host.ID]++
+		job.HostID = req.Host.ID
+	}
+	c.Assert(hosts, DeepEquals, map[string]int{"host1": 2, "host2": 3})
+
+	// check the next job is left pending with a reason
+	job := s.jobs.Add(&Job{ID: "job-5", Formation: formation, Type: "web", State: JobStatePending})
+	req := &PlacementRequest{Job: job, Err: make(chan error, 1)}
+	s.HandlePlacementRequest(req)
+	c.Assert(<-req.Err, Equals, ErrInsufficientResources)
+	c.Assert(s.pendingPlacementJobs["job-5"], Equals, job)
+	c.Assert(job.pendingReason, NotNil)
+	c.Assert(*job.pendingReason, Equals, ErrInsufficientResources.Error())
+	c.Assert((<-s.putJobs).PendingReason, NotNil)
+
+	// check the job can be placed once another job has stopped
+	s.jobs["job-0"].State = JobStateStopped
+	req = &PlacementRequest{Job: job, Err: make(chan error, 1)}
+	s.HandlePlacementRequest(req)
+	c.Assert(<-req.Err, IsNil)
+	c.Assert(req.Host.ID, Equals, s.jobs["job-0"].HostID)
+	c.Assert(job.pendingReason, IsNil)
+}
+
+func (TestSuite) TestJobPlacementDefaultResources(c *C) {
+	// create a scheduler with a single host which has 2GiB of memory
+	s := &Scheduler{
+		isLeader: typeconv.BoolPtr(true),
+		jobs:     make(Jobs),
+		hosts: map[string]*Host{
+			"host1": {ID: "host1", Resources: resource.Resources{
+				resource.TypeMemory: {Limit: typeconv.Int64Ptr(2 * units.GiB)},
+				resource.TypeCPU:    {Limit: typeconv.Int64Ptr(2000)},
+			}},
+		},
+		pendingPlacementJobs: make(map[string]*Job),
+		putJobs:              make(chan *ct.Job, 50),
+		logger:               log15.New(),
+	}
+
+	// use a formation with a process type which has the default resources
+	formation := NewFormation(&ct.ExpandedFormation{
+		App: &ct.App{ID: "app"},
+		Release: &ct.Release{ID: "release", Processes: map[string]ct.ProcessType{
+			"web": {Resources: resource.Defaults()},
+		}},
+		Artifacts: []*ct.Artifact{{}},
+	})
+
+	// check that jobs which don't explicitly request memory or CPU are
+	// all placed, even though their limits exceed the host's resources
+	for i := 0; i < 30; i++ {
+		job := s.jobs.Add(&Job{ID: fmt.Sprintf("job-%d", i), Formation: formation, Type: "web", State: JobStatePending})
+		req := &PlacementRequest{Job: job, Err: make(chan error, 1)}
+		s.HandlePlacementRequest(req)
+		c.Assert(<-req.Err, IsNil, Commentf("placing job %d", i))
+		c.Assert(req.Host.ID, Equals, "host1")
+		job.HostID = req.Host.ID
+	}
+}
+
+func (TestSuite) TestJobPlacementSpread(c *C) {
+	// create a scheduler with hosts in two zones
+	s := &Scheduler{
+		isLeader: typeconv.BoolPtr(true),
+		jobs:     make(Jobs),
+		hosts: map[string]*Host{
+			"host1": {ID: "host1", Tags: map[string]string{"zone": "a"}},
+			"host2": {ID: "host2", Tags: map[string]string{"zone": "a"}},
+			"host3": {ID: "host3", Tags: map[string]string{"zone": "b"}},
+			"host4": {ID: "host4"},
+		},
+		pendingPlacementJobs: make(map[string]*Job),
+		putJobs:              make(chan *ct.Job, 10),
+		logger:               log15.New(),
+	}
+
+	// use a formation with process types which have spread rules
+	formation := NewFormation(&ct.ExpandedFormation{
+		App: &ct.App{ID: "app"},
+		Release: &ct.Release{ID: "release", Processes: map[string]ct.ProcessType{
+			"web": {Spread: &ct.SpreadRule{UniqueHost: true}},
+			"db":  {Spread: &ct.SpreadRule{Tag: "zone"}},
+		}},
+		Artifacts: []*ct.Artifact{{}},
+	})
+
+	// check jobs are placed until the rule can't be satisfied
+	type test struct {
+		typ   string
+		hosts map[string]int
+		zones map[string]int
+	}
+	for _, t := range []*test{
+		{
+			typ:   "web",
+			hosts: map[string]int{"host1": 1, "host2": 1, "host3": 1, "host4": 1},
+		},
+		{
+			typ:   "db",
+			zones: map[string]int{"a": 1, "b": 1},
+		},
+	} {
+		hosts := make(map[string]int)
+		zones := make(map[string]int)
+		for i := 0; ; i++ {
+			job := s.jobs.Add(&Job{ID: fmt.Sprintf("job-%s-%d", t.typ, i), Formation: formation, Type: t.typ, State: JobStatePending})
+			req := &PlacementRequest{Job: job, Err: make(chan error, 1)}
+			s.HandlePlacementRequest(req)
+			if err := <-req.Err; err != nil {
+				c.Assert(err, Equals, ErrSpreadUnsatisfiable)
+				c.Assert(s.pendingPlacementJobs[job.ID], Equals, job)
+				<-s.putJobs
+				break
+			}
+			job.HostID = req.Host.ID
+			hosts[req.Host.ID]++
+			if zone, ok := req.Host.Tags["zone"]; ok {
+				zones[zone]++
+			}
+		}
+		if t.hosts != nil {
+			c.Assert(hosts, DeepEquals, t.hosts, Commentf("placing %s jobs", t.typ))
+		}
+		if t.zones != nil {
+			c.Assert(zones, DeepEquals, t.zones, Commentf("placing %s jobs", t.typ))
+		}
+	}
+}
+
 func (TestSuite) TestScaleCriticalApp(c *C) {
 	s := runTestScheduler(c, nil, true)
 	defer s.Stop()
@@ -487,6 +487,63 @@ $$ LANGUAGE plpgsql`,
 	migrations.Add(29,
 		`ALTER TABLE deployments ADD COLUMN tags jsonb`,
 	)
+	migrations.Add(30,
+		`ALTER TABLE job_cache ADD COLUMN pending_reason text`,
+	)
+	migrations.Add(31,
+		`ALTER TABLE apps ADD COLUMN autoscale jsonb`,
+	)
+	migrations.Add(32,
+		`INSERT INTO deployment_strategies (name) VALUES ('canary')`,
+		`ALTER TABLE deployments ADD COLUMN action text`,
+	)
+	migrations.Add(33,
+		`INSERT INTO deployment_strategies (name) VALUES ('blue-green')`,
+	)
+	migrations.Add(34,
+		`CREATE TABLE tokens (
+			token_id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+			name text NOT NULL,
+			key_hash text NOT NULL,
+			scopes jsonb NOT NULL,
+			app_ids jsonb,
+			last_used_at timestamptz,
+			created_at timestamptz NOT NULL DEFAULT now(),
+			deleted_at timestamptz
+		)`,
+		`CREATE UNIQUE INDEX tokens_name_idx ON tokens (name) WHERE deleted_at IS NULL`,
+		`CREATE UNIQUE INDEX ON tokens (key_hash)`,
+	)
+	migrations.Add(35,
+		`CREATE SEQUENCE audit_log_ids`,
+		`CREATE TABLE audit_log (
+			audit_id bigint PRIMARY KEY DEFAULT nextval('audit_log_ids'),
+			token_id uuid,
+			token_name text,
+			source_ip text NOT NULL,
+			request_id text,
+			method text NOT NULL,
+			path text NOT NULL,
+			app_id uuid,
+			status integer NOT NULL,
+			payload jsonb,
+			created_at timestamptz NOT NULL DEFAULT now()
+		)`,
+		`CREATE INDEX ON audit_log (app_id)`,
+		`CREATE INDEX ON audit_log (token_id)`,
+		`CREATE FUNCTION notify_audit() RETURNS TRIGGER AS $$
+	BEGIN
+		PERFORM pg_notify('audit', NEW.audit_id::text);
+		RETURN NULL;
+	END;
+$$ LANGUAGE plpgsql`,
+		`CREATE TRIGGER notify_audit
+	AFTER INSERT ON audit_log
+	FOR EACH ROW EXECUTE PROCEDURE notify_audit()`,
+	)
+	migrations.AddSteps(36,
+		migrateResourceRequests,
+	)
 }
 
 func migrateDB(db *postgres.DB) error {
@@ -635,3 +692,61 @@ func migrateProcessData(tx *postgres.DBTx) error {
 	}
 	return nil
 }
+
+// migrateResourceRequests removes the memory and CPU requests which were
+// defaulted to their limits, as the scheduler now reserves requested resources
+// on hosts. Requests were not previously used, so requests which are equal to
+// limits are assumed to have been defaulted.
+func migrateResourceRequests(tx *postgres.DBTx) error {
+	type Release struct {
+		ID string
+
+		// use map[string]interface{} for process types so we can just
+		// update Resources and leave other fields untouched
+		Processes map[string]map[string]interface{}
+	}
+
+	var releases []Release
+	rows, err := tx.Query("SELECT release_id, processes FROM releases")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var release Release
+		if err := rows.Scan(&release.ID, &release.Processes); err != nil {
+			return err
+		}
+		releases = append(releases, release)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, release := range releases {
+		var changed bool
+		for _, proc := range release.Processes {
+			resources, ok := proc["resources"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			for _, typ := range []string{"memory", "cpu"} {
+				spec, ok := resources[typ].(map[string]interface{})
+				if !ok || spec["request"] == nil || spec["request"] != spec["limit"] {
+					continue
+				}
+				delete(spec, "request")
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		// save the processes back to the db
+		if err := tx.Exec("UPDATE releases SET processes = $1 WHERE release_id = $2", release.Processes, release.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,6 +17,7 @@ var preparedStatements = map[string]string{
 	"app_update_meta":                       appUpdateMetaQuery,
 	"app_update_release":                    appUpdateReleaseQuery,
 	"app_update_deploy_timeout":             appUpdateDeployTimeoutQuery,
+	"app_update_autoscale":                  appUpdateAutoscaleQuery,
 	"app_delete":                            appDeleteQuery,
 	"app_next_name_id":                      appNextNameIDQuery,
 	"app_get_release":                       appGetReleaseQuery,
@@ -27,6 +28,8 @@ var preparedStatements = map[string]string{
 	"release_artifacts_insert":              releaseArtifactsInsertQuery,
 	"release_artifacts_delete":              releaseArtifactsDeleteQuery,
 	"release_delete":                        releaseDeleteQuery,
+	"release_secret_env_list":               releaseSecretEnvListQuery,
+	"release_env_update":                    releaseEnvUpdateQuery,
 	"artifact_list":                         artifactListQuery,
 	"artifact_list_ids":                     artifactListIDsQuery,
 	"artifact_select":                       artifactSelectQuery,
@@ -39,6 +42,7 @@ var preparedStatements = map[string]string{
 	"deployment_insert":                     deploymentInsertQuery,
 	"deployment_update_finished_at":         deploymentUpdateFinishedAtQuery,
 	"deployment_update_finished_at_now":     deploymentUpdateFinishedAtNowQuery,
+	"deployment_update_action":              deploymentUpdateActionQuery,
 	"deployment_delete":                     deploymentDeleteQuery,
 	"event_select":                          eventSelectQuery,
 	"event_insert":                          eventInsertQuery,
@@ -79,6 +83,14 @@ var preparedStatements = map[string]string{
 	"sink_select":                           sinkSelectQuery,
 	"sink_insert":                           sinkInsertQuery,
 	"sink_delete":                           sinkDeleteQuery,
+	"token_list":                            tokenListQuery,
+	"token_select":                          tokenSelectQuery,
+	"token_select_by_key_hash":              tokenSelectByKeyHashQuery,
+	"token_insert":                          tokenInsertQuery,
+	"token_update_last_used":                tokenUpdateLastUsedQuery,
+	"token_delete":                          tokenDeleteQuery,
+	"audit_select":                          auditSelectQuery,
+	"audit_insert":                          auditInsertQuery,
 }
 
 func PrepareStatements(conn *pgx.Conn) error {
@@ -98,22 +110,22 @@ const (
 	pingQuery = `SELECT 1`
 	// apps
 	appListQuery = `
-SELECT app_id, name, meta, strategy, release_id, deploy_timeout, created_at, updated_at
+SELECT app_id, name, meta, strategy, release_id, deploy_timeout, autoscale, created_at, updated_at
 FROM apps WHERE deleted_at IS NULL ORDER BY created_at DESC`
 	appSelectByNameQuery = `
-SELECT app_id, name, meta, strategy, release_id, deploy_timeout, created_at, updated_at
+SELECT app_id, name, meta, strategy, release_id, deploy_timeout, autoscale, created_at, updated_at
 FROM apps WHERE deleted_at IS NULL AND name = $1`
 	appSelectByNameForUpdateQuery = `
-SELECT app_id, name, meta, strategy, release_id, deploy_timeout, created_at, updated_at
+SELECT app_id, name, meta, strategy, release_id, deploy_timeout, autoscale, created_at, updated_at
 FROM apps WHERE deleted_at IS NULL AND name = $1 FOR UPDATE`
 	appSelectByNameOrIDQuery = `
-SELECT app_id, name, meta, strategy, release_id, deploy_timeout, created_at, updated_at
+SELECT app_id, name, meta, strategy, release_id, deploy_timeout, autoscale, created_at, updated_at
 FROM apps WHERE deleted_at IS NULL AND (app_id = $1 OR name = $2) LIMIT 1`
 	appSelectByNameOrIDForUpdateQuery = `
-SELECT app_id, name, meta, strategy, release_id, deploy_timeout, created_at, updated_at
+SELECT app_id, name, meta, strategy, release_id, deploy_timeout, autoscale, created_at, updated_at
 FROM apps WHERE deleted_at IS NULL AND (app_id = $1 OR name = $2) LIMIT 1 FOR UPDATE`
 	appInsertQuery = `
-INSERT INTO apps (app_id, name, meta, strategy, deploy_timeout) VALUES ($1, $2, $3, $4, $5) RETURNING created_at, updated_at`
+INSERT INTO apps (app_id, name, meta, strategy, deploy_timeout, autoscale) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at, updated_at`
 	appUpdateStrategyQuery = `
 UPDATE apps SET strategy = $2, updated_at = now() WHERE app_id = $1`
 	appUpdateMetaQuery = `
@@ -122,6 +134,8 @@ UPDATE apps SET meta = $2, updated_at = now() WHERE app_id = $1`
 UPDATE apps SET release_id = $2, updated_at = now() WHERE app_id = $1`
 	appUpdateDeployTimeoutQuery = `
 UPDATE apps SET deploy_timeout = $2, updated_at = now() WHERE app_id = $1`
+	appUpdateAutoscaleQuery = `
+UPDATE apps SET autoscale = $2, updated_at = now() WHERE app_id = $1`
 	appDeleteQuery = `
 UPDATE apps SET deleted_at = now() WHERE app_id = $1 AND deleted_at IS NULL`
 	appNextNameIDQuery = `
@@ -172,6 +186,11 @@ INSERT INTO release_artifacts (release_id, artifact_id, index) VALUES ($1, $2, $
 UPDATE release_artifacts SET deleted_at = now() WHERE release_id = $1 AND artifact_id = $2 AND deleted_at IS NULL`
 	releaseDeleteQuery = `
 UPDATE releases SET deleted_at = now() WHERE release_id = $1 AND deleted_at IS NULL`
+	releaseSecretEnvListQuery = `
+SELECT release_id, env FROM releases
+WHERE env::text LIKE '%"flynn-secret:%'`
+	releaseEnvUpdateQuery = `
+UPDATE releases SET env = $2 WHERE release_id = $1`
 	artifactListQuery = `
 SELECT artifact_id, type, uri, meta, manifest, hashes, size, layer_url_template, created_at FROM artifacts
 WHERE deleted_at IS NULL ORDER BY created_at DESC`
@@ -196,13 +215,15 @@ VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING created_at`
 UPDATE deployments SET finished_at = $2 WHERE deployment_id = $1`
 	deploymentUpdateFinishedAtNowQuery = `
 UPDATE deployments SET finished_at = now() WHERE deployment_id = $1`
+	deploymentUpdateActionQuery = `
+UPDATE deployments SET action = $2 WHERE deployment_id = $1 AND finished_at IS NULL RETURNING deployment_id`
 	deploymentDeleteQuery = `
 DELETE FROM deployments WHERE deployment_id = $1`
 	deploymentSelectQuery = `
 WITH deployment_events AS (SELECT * FROM events WHERE object_type = 'deployment')
 SELECT d.deployment_id, d.app_id, d.old_release_id, d.new_release_id,
   strategy, e1.data->>'status' AS status,
-  processes, tags, deploy_timeout, d.created_at, d.finished_at
+  processes, tags, deploy_timeout, d.created_at, d.finished_at, action
 FROM deployments d
 LEFT JOIN deployment_events e1
   ON d.deployment_id = e1.object_id::uuid
@@ -213,7 +234,7 @@ WHERE e2.created_at IS NULL AND d.deployment_id = $1`
 WITH deployment_events AS (SELECT * FROM events WHERE object_type = 'deployment')
 SELECT d.deployment_id, d.app_id, d.old_release_id, d.new_release_id,
   strategy, e1.data->>'status' AS status,
-  processes, tags, deploy_timeout, d.created_at, d.finished_at
+  processes, tags, deploy_timeout, d.created_at, d.finished_at, action
 FROM deployments d
 LEFT JOIN deployment_events e1
   ON d.deployment_id = e1.object_id::uuid
@@ -238,7 +259,7 @@ FROM formations WHERE release_id = $1 AND deleted_at IS NULL ORDER BY created_at
 	formationListActiveQuery = `
 SELECT
   apps.app_id, apps.name, apps.meta, apps.strategy, apps.release_id,
-  apps.deploy_timeout, apps.created_at, apps.updated_at,
+  apps.deploy_timeout, apps.autoscale, apps.created_at, apps.updated_at,
   releases.release_id,
   ARRAY(
 	SELECT r.artifact_id
@@ -263,7 +284,7 @@ ORDER BY formations.updated_at DESC`
 	formationListSinceQuery = `
 SELECT
   apps.app_id, apps.name, apps.meta, apps.strategy, apps.release_id,
-  apps.deploy_timeout, apps.created_at, apps.updated_at,
+  apps.deploy_timeout, apps.autoscale, apps.created_at, apps.updated_at,
   releases.release_id,
   ARRAY(
 	SELECT r.artifact_id
@@ -284,7 +305,7 @@ FROM formations WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL`
 	formationSelectExpandedQuery = `
 SELECT
   apps.app_id, apps.name, apps.meta, apps.strategy, apps.release_id,
-  apps.deploy_timeout, apps.created_at, apps.updated_at,
+  apps.deploy_timeout, apps.autoscale, apps.created_at, apps.updated_at,
   releases.release_id,
   ARRAY(
 	SELECT a.artifact_id
@@ -311,18 +332,18 @@ WHERE app_id = $1 AND release_id = $2 AND deleted_at IS NULL`
 UPDATE formations SET deleted_at = now(), processes = NULL, updated_at = now()
 WHERE app_id = $1 AND deleted_at IS NULL`
 	jobListQuery = `
-SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args
+SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args, pending_reason
 FROM job_cache WHERE app_id = $1 ORDER BY created_at DESC`
 	jobListActiveQuery = `
-SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args
+SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args, pending_reason
 FROM job_cache WHERE state = 'pending' OR state = 'starting' OR state = 'up' OR state = 'stopping' ORDER BY updated_at DESC`
 	jobSelectQuery = `
-SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args
+SELECT cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, created_at, updated_at, args, pending_reason
 FROM job_cache WHERE job_id = $1`
 	jobInsertQuery = `
-INSERT INTO job_cache (cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, args)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) ON CONFLICT (job_id) DO UPDATE
-SET cluster_id = $1, host_id = $3, state = $7, exit_status = $9, host_error = $10, run_at = $11, restarts = $12, args = $13, updated_at = now()
+INSERT INTO job_cache (cluster_id, job_id, host_id, app_id, release_id, process_type, state, meta, exit_status, host_error, run_at, restarts, args, pending_reason)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) ON CONFLICT (job_id) DO UPDATE
+SET cluster_id = $1, host_id = $3, state = $7, exit_status = $9, host_error = $10, run_at = $11, restarts = $12, args = $13, pending_reason = $14, updated_at = now()
 RETURNING created_at, updated_at`
 	providerListQuery = `
 SELECT provider_id, name, url, created_at, updated_at
@@ -415,4 +436,20 @@ SELECT sink_id, kind, config, created_at, updated_at FROM sinks WHERE sink_id =
 INSERT INTO sinks (sink_id, kind, config) VALUES ($1, $2, $3) RETURNING created_at, updated_at`
 	sinkDeleteQuery = `
 UPDATE sinks SET deleted_at = now() WHERE sink_id = $1 AND deleted_at IS NULL`
+	tokenListQuery = `
+SELECT token_id, name, scopes, app_ids, last_used_at, created_at FROM tokens WHERE deleted_at IS NULL ORDER BY created_at DESC`
+	tokenSelectQuery = `
+SELECT token_id, name, scopes, app_ids, last_used_at, created_at FROM tokens WHERE token_id = $1 AND deleted_at IS NULL`
+	tokenSelectByKeyHashQuery = `
+SELECT token_id, name, scopes, app_ids, last_used_at, created_at FROM tokens WHERE key_hash = $1 AND deleted_at IS NULL`
+	tokenInsertQuery = `
+INSERT INTO tokens (token_id, name, key_hash, scopes, app_ids) VALUES ($1, $2, $3, $4, $5) RETURNING created_at`
+	tokenUpdateLastUsedQuery = `
+UPDATE tokens SET last_used_at = now() WHERE token_id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute') RETURNING last_used_at`
+	tokenDeleteQuery = `
+UPDATE tokens SET deleted_at = now() WHERE token_id = $1 AND deleted_at IS NULL`
+	auditSelectQuery = `
+SELECT audit_id, token_id, token_name, source_ip, request_id, method, path, app_id, status, payload, created_at FROM audit_log WHERE audit_id = $1`
+	auditInsertQuery = `
+INSERT INTO audit_log (token_id, token_name, source_ip, request_id, method, path, app_id, status, payload) VALUES (NULLIF($1, '')::uuid, NULLIF($2, ''), $3, NULLIF($4, ''), $5, $6, NULLIF($7, '')::uuid, $8, $9) RETURNING audit_id, created_at`
 )
@@ -0,0 +1,212 @@
+// Package secretenv encrypts the values of secret release environment
+// variables with the cluster's secret env key, which is read from a file
+// provided by the host rather than from the controller's release.
+//
+// Encrypted values have the form "flynn-secret:<key id>:<data>", where the key
+// id identifies the key the value was encrypted with (so that values can be
+// decrypted with previous keys after the key is rotated) and the data is the
+// base64 encoded nonce and AES-GCM ciphertext, sealed with the variable's
+// name as additional data so that values can't be moved between variables.
+package secretenv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	ct "github.com/flynn/flynn/controller/types"
+)
+
+var (
+	ErrNoKey       = errors.New("secretenv: no secret env key is configured")
+	ErrUnknownKey  = errors.New("secretenv: value was encrypted with an unknown key")
+	ErrInvalidData = errors.New("secretenv: invalid encrypted value")
+)
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+func newKey(encoded string) (*key, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secretenv: error decoding key: %s", err)
+	}
+	if len(data) != 32 {
+		return nil, fmt.Errorf("secretenv: decoded %d bytes from key, expected 32", len(data))
+	}
+	block, err := aes.NewCipher(data)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return &key{id: hex.EncodeToString(hash[:4]), aead: aead}, nil
+}
+
+// Keys encrypts values with the current key, and decrypts values encrypted
+// with either the current key or a previous one. A nil *Keys has no keys, and
+// so can only be used with environments which contain no secret values.
+type Keys struct {
+	current *key
+	keys    map[string]*key
+}
+
+// NewKeys returns Keys which encrypt values with the given base64 encoded
+// 32 byte key, and also decrypt values encrypted with the given previous keys.
+func NewKeys(current string, previous ...string) (*Keys, error) {
+	k := &Keys{keys: make(map[string]*key, len(previous)+1)}
+	for i, encoded := range append([]string{current}, previous...) {
+		key, err := newKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			k.current = key
+		}
+		k.keys[key.id] = key
+	}
+	return k, nil
+}
+
+// DefaultKeyFile is the path of the file the secret env keys are read from
+// if SECRET_ENV_KEY_FILE is not set. The file is bind-mounted from the host so
+// that the keys are never stored in the controller's database alongside the
+// values they encrypt.
+const DefaultKeyFile = "/etc/flynn/secrets/secret-env.key"
+
+// LoadKeys returns Keys read from the file at SECRET_ENV_KEY_FILE, or at
+// DefaultKeyFile if it is not set, or nil if the file does not exist.
+func LoadKeys() (*Keys, error) {
+	path := os.Getenv("SECRET_ENV_KEY_FILE")
+	if path == "" {
+		path = DefaultKeyFile
+	}
+	return KeysFromFile(path)
+}
+
+// KeysFromFile returns Keys using the first line of the given file as the
+// current key and any following lines as previous keys, or nil if the file
+// does not exist.
+func KeysFromFile(path string) (*Keys, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = append(keys, line)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("secretenv: no keys in %s", path)
+	}
+	return NewKeys(keys[0], keys[1:]...)
+}
+
+// Encrypt encrypts the value of the named variable with the current key.
+func (k *Keys) Encrypt(name, value string) (string, error) {
+	if k == nil {
+		return "", ErrNoKey
+	}
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	data := k.current.aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return ct.SecretEnvPrefix + k.current.id + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt decrypts the encrypted value of the named variable.
+func (k *Keys) Decrypt(name, value string) (string, error) {
+	if k == nil {
+		return "", ErrNoKey
+	}
+	key, data, err := k.parse(value)
+	if err != nil {
+		return "", err
+	}
+	size := key.aead.NonceSize()
+	if len(data) < size {
+		return "", ErrInvalidData
+	}
+	plaintext, err := key.aead.Open(nil, data[:size], data[size:], []byte(name))
+	if err != nil {
+		return "", ErrInvalidData
+	}
+	return string(plaintext), nil
+}
+
+func (k *Keys) parse(value string) (*key, []byte, error) {
+	if !ct.IsSecretEnvValue(value) {
+		return nil, nil, ErrInvalidData
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, ct.SecretEnvPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, nil, ErrInvalidData
+	}
+	key, ok := k.keys[parts[0]]
+	if !ok {
+		return nil, nil, ErrUnknownKey
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidData
+	}
+	return key, data, nil
+}
+
+// Reencrypt re-encrypts the encrypted value of the named variable with the
+// current key, returning whether it was encrypted with a previous key and so
+// has changed.
+func (k *Keys) Reencrypt(name, value string) (string, bool, error) {
+	if k == nil {
+		return "", false, ErrNoKey
+	}
+	key, _, err := k.parse(value)
+	if err != nil {
+		return "", false, err
+	}
+	if key == k.current {
+		return value, false, nil
+	}
+	plaintext, err := k.Decrypt(name, value)
+	if err != nil {
+		return "", false, err
+	}
+	value, err = k.Encrypt(name, plaintext)
+	return value, true, err
+}
+
+// DecryptEnv returns a copy of env with the values of secret variables
+// decrypted.
+func (k *Keys) DecryptEnv(env map[string]string) (map[string]string, error) {
+	res := make(map[string]string, len(env))
+	for name, value := range env {
+		if ct.IsSecretEnvValue(value) {
+			var err error
+			value, err = k.Decrypt(name, value)
+			if err != nil {
+				return nil, fmt.Errorf("error decrypting %s: %s", name, err)
+			}
+		}
+		res[name] = value
+	}
+	return res, nil
+}
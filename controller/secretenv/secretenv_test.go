@@ -0,0 +1,152 @@
+package secretenv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ct "github.com/flynn/flynn/controller/types"
+	. "github.com/flynn/go-check"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+const (
+	testKey         = "E6LWKuMUp4g/lhNAs3jduHLxTVNR9QCLyUxY7ks9ZOg="
+	testPreviousKey = "h5XiT7rW27htuE42xUkc9XyyJa8grIHN3AxVeX2zQG4="
+)
+
+func (S) TestEncryptDecrypt(c *C) {
+	keys, err := NewKeys(testKey)
+	c.Assert(err, IsNil)
+
+	encrypted, err := keys.Encrypt("FOO", "bar")
+	c.Assert(err, IsNil)
+	c.Assert(ct.IsSecretEnvValue(encrypted), Equals, true)
+	value, err := keys.Decrypt("FOO", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "bar")
+
+	// values are encrypted with random nonces
+	other, err := keys.Encrypt("FOO", "bar")
+	c.Assert(err, IsNil)
+	c.Assert(other, Not(Equals), encrypted)
+
+	// values can't be decrypted as other variables or once modified
+	_, err = keys.Decrypt("BAZ", encrypted)
+	c.Assert(err, Equals, ErrInvalidData)
+	_, err = keys.Decrypt("FOO", encrypted[:len(encrypted)-4]+"AAAA")
+	c.Assert(err, Equals, ErrInvalidData)
+	_, err = keys.Decrypt("FOO", "bar")
+	c.Assert(err, Equals, ErrInvalidData)
+
+	// nor without the key
+	otherKeys, err := NewKeys(testPreviousKey)
+	c.Assert(err, IsNil)
+	_, err = otherKeys.Decrypt("FOO", encrypted)
+	c.Assert(err, Equals, ErrUnknownKey)
+	var noKeys *Keys
+	_, err = noKeys.Decrypt("FOO", encrypted)
+	c.Assert(err, Equals, ErrNoKey)
+	_, err = noKeys.Encrypt("FOO", "bar")
+	c.Assert(err, Equals, ErrNoKey)
+}
+
+func (S) TestInvalidKeys(c *C) {
+	for _, key := range []string{"", "not base64", "c2hvcnQ="} {
+		_, err := NewKeys(key)
+		c.Assert(err, NotNil)
+	}
+	_, err := NewKeys(testKey, "c2hvcnQ=")
+	c.Assert(err, NotNil)
+}
+
+func (S) TestReencrypt(c *C) {
+	previousKeys, err := NewKeys(testPreviousKey)
+	c.Assert(err, IsNil)
+	encrypted, err := previousKeys.Encrypt("FOO", "bar")
+	c.Assert(err, IsNil)
+
+	keys, err := NewKeys(testKey, testPreviousKey)
+	c.Assert(err, IsNil)
+	value, err := keys.Decrypt("FOO", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "bar")
+
+	reencrypted, changed, err := keys.Reencrypt("FOO", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, true)
+	_, err = previousKeys.Decrypt("FOO", reencrypted)
+	c.Assert(err, Equals, ErrUnknownKey)
+	value, err = keys.Decrypt("FOO", reencrypted)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "bar")
+
+	// values encrypted with the current key are left as they are
+	same, changed, err := keys.Reencrypt("FOO", reencrypted)
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, false)
+	c.Assert(same, Equals, reencrypted)
+}
+
+func (S) TestDecryptEnv(c *C) {
+	keys, err := NewKeys(testKey)
+	c.Assert(err, IsNil)
+	encrypted, err := keys.Encrypt("SECRET", "shh")
+	c.Assert(err, IsNil)
+
+	env := map[string]string{"PUBLIC": "foo", "SECRET": encrypted}
+	decrypted, err := keys.DecryptEnv(env)
+	c.Assert(err, IsNil)
+	c.Assert(decrypted, DeepEquals, map[string]string{"PUBLIC": "foo", "SECRET": "shh"})
+	c.Assert(env["SECRET"], Equals, encrypted)
+
+	// environments without secrets don't need keys
+	var noKeys *Keys
+	decrypted, err = noKeys.DecryptEnv(map[string]string{"PUBLIC": "foo"})
+	c.Assert(err, IsNil)
+	c.Assert(decrypted, DeepEquals, map[string]string{"PUBLIC": "foo"})
+	_, err = noKeys.DecryptEnv(env)
+	c.Assert(err, NotNil)
+}
+
+func (S) TestKeysFromFile(c *C) {
+	dir, err := ioutil.TempDir("", "secretenv")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret-env.key")
+
+	// a missing file means there are no keys
+	keys, err := KeysFromFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(keys, IsNil)
+
+	// the first line is the current key, and the rest are previous keys
+	previousKeys, err := NewKeys(testPreviousKey)
+	c.Assert(err, IsNil)
+	encrypted, err := previousKeys.Encrypt("FOO", "bar")
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(path, []byte(testKey+"\n"+testPreviousKey+"\n"), 0600), IsNil)
+	keys, err = KeysFromFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(keys, NotNil)
+	value, err := keys.Decrypt("FOO", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "bar")
+	reencrypted, changed, err := keys.Reencrypt("FOO", encrypted)
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, true)
+	_, err = previousKeys.Decrypt("FOO", reencrypted)
+	c.Assert(err, Equals, ErrUnknownKey)
+
+	// files without keys are invalid
+	c.Assert(ioutil.WriteFile(path, []byte("\n"), 0600), IsNil)
+	_, err = KeysFromFile(path)
+	c.Assert(err, NotNil)
+}
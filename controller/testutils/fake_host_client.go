@@ -7,6 +7,7 @@ import (
 	"time"
 
 	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/pkg/cluster"
@@ -40,6 +41,7 @@ type FakeHostClient struct {
 	eventChannels    map[chan<- *host.Event]struct{}
 	jobsMtx          sync.RWMutex
 	Healthy          bool
+	Resources        resource.Resources
 	TestEventHook    chan struct{}
 }
 
@@ -221,7 +223,7 @@ func (c *FakeHostClient) GetStatus() (*host.HostStatus, error) {
 	if !c.Healthy {
 		return nil, errors.New("unhealthy")
 	}
-	return &host.HostStatus{ID: c.ID()}, nil
+	return &host.HostStatus{ID: c.ID(), Resources: c.Resources}, nil
 }
 
 func (c *FakeHostClient) GetSinks() ([]*ct.Sink, error) {
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flynn/flynn/controller/schema"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/pkg/ctxhelper"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/jackc/pgx"
+	"golang.org/x/net/context"
+)
+
+var ErrForbidden = errors.New("controller: token does not permit request")
+
+type TokenRepo struct {
+	db *postgres.DB
+}
+
+func NewTokenRepo(db *postgres.DB) *TokenRepo {
+	return &TokenRepo{
+		db: db,
+	}
+}
+
+// hashTokenKey returns the hash of a token's key which is stored in place of
+// the key
+func hashTokenKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Add stores the token, generating its key
+func (r *TokenRepo) Add(t *ct.Token) error {
+	if t.ID == "" {
+		t.ID = random.UUID()
+	}
+	t.Key = random.Hex(32)
+	err := r.db.QueryRow("token_insert", t.ID, t.Name, hashTokenKey(t.Key), t.Scopes, t.AppIDs).Scan(&t.CreatedAt)
+	if postgres.IsUniquenessError(err, "tokens_name_idx") {
+		return httphelper.ObjectExistsErr(fmt.Sprintf("token %q already exists", t.Name))
+	}
+	return err
+}
+
+func scanToken(s postgres.Scanner) (*ct.Token, error) {
+	token := &ct.Token{}
+	err := s.Scan(&token.ID, &token.Name, &token.Scopes, &token.AppIDs, &token.LastUsedAt, &token.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			err = ErrNotFound
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *TokenRepo) Get(id string) (*ct.Token, error) {
+	row := r.db.QueryRow("token_select", id)
+	return scanToken(row)
+}
+
+func (r *TokenRepo) List() ([]*ct.Token, error) {
+	rows, err := r.db.Query("token_list")
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*ct.Token
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Authenticate returns the token with the given key, recording that it was
+// used, or ErrNotFound if there is no such token
+func (r *TokenRepo) Authenticate(key string) (*ct.Token, error) {
+	token, err := scanToken(r.db.QueryRow("token_select_by_key_hash", hashTokenKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	// the last use is only updated once a minute to avoid writing to the
+	// database on every request
+	err = r.db.QueryRow("token_update_last_used", token.ID).Scan(&token.LastUsedAt)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (r *TokenRepo) Remove(id string) error {
+	return r.db.Exec("token_delete", id)
+}
+
+// tokenAuthorizer authenticates requests made with tokens, and checks that
+// their scopes and apps permit the requests
+type tokenAuthorizer struct {
+	tokens      *TokenRepo
+	apps        *AppRepo
+	releases    *ReleaseRepo
+	deployments *DeploymentRepo
+	events      *EventRepo
+}
+
+// Authorize returns the token with the given key if it permits the request,
+// ErrNotFound if there is no such token, or the token and ErrForbidden if it
+// does not permit the request
+func (a *tokenAuthorizer) Authorize(key string, req *http.Request) (*ct.Token, error) {
+	token, err := a.tokens.Authenticate(key)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if !token.HasScope(requiredScope(req.Method, parts)) {
+		return token, ErrForbidden
+	}
+	admin := token.HasScope(ct.TokenScopeAdmin)
+	if admin && len(token.AppIDs) == 0 {
+		return token, nil
+	}
+
+	// uploading and reading artifacts is permitted for any app, as
+	// artifacts don't belong to apps
+	if parts[0] == "artifacts" && (req.Method == "POST" || len(parts) > 1) {
+		return token, nil
+	}
+	app, err := a.requestApp(req, parts)
+	if err == ErrNotFound {
+		if len(token.AppIDs) > 0 {
+			return token, ErrForbidden
+		}
+		// let the handler respond with the not found error
+		return token, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the releases and resources of system apps contain cluster
+	// credentials (e.g. the controller's auth key), so only admin tokens
+	// may act on system apps or read the releases or resources of every app
+	if !admin && (app != nil && app.System() || app == nil && readsAllApps(parts)) {
+		return token, ErrForbidden
+	}
+
+	// tokens limited to apps may only make requests which act on those
+	// apps
+	if len(token.AppIDs) == 0 {
+		return token, nil
+	}
+	if app == nil {
+		return token, ErrForbidden
+	}
+	for _, id := range token.AppIDs {
+		if id == app.ID {
+			return token, nil
+		}
+	}
+	return token, ErrForbidden
+}
+
+// requiredScope returns the scope a token needs to make a request with the
+// given method and path segments
+func requiredScope(method string, parts []string) ct.TokenScope {
+	if method == "GET" || method == "HEAD" {
+		switch parts[0] {
+		case "audit", "backup", "tokens":
+			return ct.TokenScopeAdmin
+		}
+		return ct.TokenScopeReadOnly
+	}
+
+	if parts[0] == "apps" && len(parts) > 2 {
+		switch {
+		case parts[2] == "formations":
+			return ct.TokenScopeScale
+		case parts[2] == "jobs" && method == "DELETE":
+			return ct.TokenScopeScale
+		case parts[2] == "jobs" && method == "POST" && len(parts) == 3:
+			return ct.TokenScopeDeploy
+		case parts[2] == "deploy" && method == "POST":
+			return ct.TokenScopeDeploy
+		case parts[2] == "release" && method == "PUT":
+			return ct.TokenScopeDeploy
+		}
+		return ct.TokenScopeAdmin
+	}
+
+	switch {
+	case len(parts) == 1 && method == "POST" && (parts[0] == "artifacts" || parts[0] == "releases"):
+		return ct.TokenScopeDeploy
+	case len(parts) == 3 && method == "PUT" && parts[0] == "deployments" && parts[2] == "action":
+		return ct.TokenScopeDeploy
+	}
+	return ct.TokenScopeAdmin
+}
+
+// readsAllApps returns whether a request which doesn't act on a single app
+// returns the releases or resources of every app
+func readsAllApps(parts []string) bool {
+	switch parts[0] {
+	case "formations", "events", "resources", "providers":
+		return true
+	}
+	return false
+}
+
+// requestApp returns the app the request acts on, or nil if it does not act
+// on a single app
+func (a *tokenAuthorizer) requestApp(req *http.Request, parts []string) (*ct.App, error) {
+	var appID string
+	switch parts[0] {
+	case "apps":
+		if len(parts) > 1 {
+			appID = parts[1]
+		}
+	case "events":
+		if len(parts) > 1 {
+			id, err := strconv.ParseInt(parts[1], 10, 64)
+			if err != nil {
+				return nil, ErrNotFound
+			}
+			event, err := a.events.GetEvent(id)
+			if err != nil {
+				return nil, err
+			}
+			appID = event.AppID
+		} else {
+			appID = req.URL.Query().Get("app_id")
+		}
+	case "audit":
+		if len(parts) == 1 {
+			appID = req.URL.Query().Get("app_id")
+		}
+	case "releases":
+		if len(parts) > 1 {
+			release, err := a.releases.Get(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			appID = release.(*ct.Release).AppID
+		} else if req.Method == "POST" {
+			var err error
+			appID, err = requestBodyAppID(req)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "deployments":
+		if len(parts) > 1 {
+			deployment, err := a.deployments.Get(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			appID = deployment.AppID
+		}
+	}
+	if appID == "" {
+		return nil, nil
+	}
+	app, err := a.apps.Get(appID)
+	if err != nil {
+		return nil, err
+	}
+	return app.(*ct.App), nil
+}
+
+// requestBodyAppID returns the app_id field of the request's JSON body,
+// leaving the body to be read again by the handler
+func requestBodyAppID(req *http.Request) (string, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	var body struct {
+		AppID string `json:"app_id"`
+	}
+	json.Unmarshal(data, &body)
+	return body.AppID, nil
+}
+
+// Create a new token
+func (c *controllerAPI) CreateToken(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	var token ct.Token
+	if err := httphelper.DecodeJSON(req, &token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	token.Key = ""
+
+	if err := schema.Validate(&token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	for _, id := range token.AppIDs {
+		if _, err := c.appRepo.Get(id); err == ErrNotFound {
+			respondWithError(w, ct.ValidationError{Field: "app_ids", Message: fmt.Sprintf("app %q not found", id)})
+			return
+		} else if err != nil {
+			respondWithError(w, err)
+			return
+		}
+	}
+
+	if err := c.tokenRepo.Add(&token); err != nil {
+		respondWithError(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, &token)
+}
+
+// Get a token
+func (c *controllerAPI) GetToken(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	token, err := c.tokenRepo.Get(params.ByName("token_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	httphelper.JSON(w, 200, token)
+}
+
+// List tokens
+func (c *controllerAPI) GetTokens(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	list, err := c.tokenRepo.List()
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	httphelper.JSON(w, 200, list)
+}
+
+// Revoke a token
+func (c *controllerAPI) DeleteToken(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	token, err := c.tokenRepo.Get(params.ByName("token_id"))
+	if err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	if err := c.tokenRepo.Remove(token.ID); err != nil {
+		respondWithError(w, err)
+		return
+	}
+
+	httphelper.JSON(w, 200, token)
+}
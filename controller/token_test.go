@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/controller/client"
+	tu "github.com/flynn/flynn/controller/testutils"
+	ct "github.com/flynn/flynn/controller/types"
+	host "github.com/flynn/flynn/host/types"
+	"github.com/flynn/flynn/pkg/cluster"
+	hh "github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/random"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) createTestToken(c *C, in *ct.Token) (*ct.Token, controller.Client) {
+	c.Assert(s.c.CreateToken(in), IsNil)
+	c.Assert(in.Key, Not(Equals), "")
+	client, err := controller.NewClient(s.srv.URL, in.Key)
+	c.Assert(err, IsNil)
+	return in, client
+}
+
+func isForbiddenError(err error) bool {
+	e, ok := err.(hh.JSONError)
+	return ok && e.Code == hh.ForbiddenErrorCode
+}
+
+func (s *S) TestCreateToken(c *C) {
+	app := s.createTestApp(c, &ct.App{})
+	token, _ := s.createTestToken(c, &ct.Token{
+		Name:   "TestCreateToken",
+		Scopes: []ct.TokenScope{ct.TokenScopeDeploy},
+		AppIDs: []string{app.ID},
+	})
+	c.Assert(token.ID, Not(Equals), "")
+
+	// the key is not returned again
+	out, err := s.c.GetToken(token.ID)
+	c.Assert(err, IsNil)
+	c.Assert(out.Name, Equals, token.Name)
+	c.Assert(out.Scopes, DeepEquals, token.Scopes)
+	c.Assert(out.AppIDs, DeepEquals, token.AppIDs)
+	c.Assert(out.Key, Equals, "")
+
+	list, err := s.c.ListTokens()
+	c.Assert(err, IsNil)
+	var found bool
+	for _, t := range list {
+		if t.ID == token.ID {
+			found = true
+			c.Assert(t.Key, Equals, "")
+		}
+	}
+	c.Assert(found, Equals, true)
+
+	// names are unique
+	err = s.c.CreateToken(&ct.Token{Name: token.Name, Scopes: []ct.TokenScope{ct.TokenScopeAdmin}})
+	c.Assert(hh.IsObjectExistsError(err), Equals, true)
+
+	// scopes and apps are validated
+	for _, t := range []*ct.Token{
+		{Name: "TestCreateTokenInvalid"},
+		{Name: "TestCreateTokenInvalid", Scopes: []ct.TokenScope{"superuser"}},
+		{Name: "TestCreateTokenInvalid", Scopes: []ct.TokenScope{ct.TokenScopeAdmin}, AppIDs: []string{"00000000-0000-0000-0000-000000000000"}},
+	} {
+		c.Assert(hh.IsValidationError(s.c.CreateToken(t)), Equals, true)
+	}
+}
+
+func (s *S) TestTokenScopes(c *C) {
+	release := s.createTestRelease(c, "", &ct.Release{})
+
+	// read-only tokens can read but not change anything
+	token, client := s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenScopesReadOnly",
+		Scopes: []ct.TokenScope{ct.TokenScopeReadOnly},
+	})
+	c.Assert(token.LastUsedAt, IsNil)
+	_, err := client.GetApp(release.AppID)
+	c.Assert(err, IsNil)
+	_, err = client.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+	c.Assert(isForbiddenError(client.SetAppRelease(release.AppID, release.ID)), Equals, true)
+	c.Assert(isForbiddenError(client.CreateApp(&ct.App{})), Equals, true)
+	_, err = client.ListTokens()
+	c.Assert(isForbiddenError(err), Equals, true)
+
+	// the last use is recorded
+	token, err = s.c.GetToken(token.ID)
+	c.Assert(err, IsNil)
+	c.Assert(token.LastUsedAt, NotNil)
+
+	// deploy tokens can set the release but not scale it
+	_, client = s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenScopesDeploy",
+		Scopes: []ct.TokenScope{ct.TokenScopeDeploy},
+	})
+	c.Assert(client.SetAppRelease(release.AppID, release.ID), IsNil)
+	formation := &ct.Formation{AppID: release.AppID, ReleaseID: release.ID}
+	c.Assert(isForbiddenError(client.PutFormation(formation)), Equals, true)
+	c.Assert(isForbiddenError(client.CreateApp(&ct.App{})), Equals, true)
+
+	// scale tokens can scale the release
+	_, client = s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenScopesScale",
+		Scopes: []ct.TokenScope{ct.TokenScopeScale},
+	})
+	c.Assert(client.PutFormation(formation), IsNil)
+	c.Assert(isForbiddenError(client.SetAppRelease(release.AppID, release.ID)), Equals, true)
+
+	// admin tokens can do anything
+	_, client = s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenScopesAdmin",
+		Scopes: []ct.TokenScope{ct.TokenScopeAdmin},
+	})
+	c.Assert(client.CreateApp(&ct.App{}), IsNil)
+	_, err = client.ListTokens()
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestTokenApps(c *C) {
+	app := s.createTestApp(c, &ct.App{})
+	otherApp := s.createTestApp(c, &ct.App{})
+	_, client := s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenApps",
+		Scopes: []ct.TokenScope{ct.TokenScopeDeploy, ct.TokenScopeScale},
+		AppIDs: []string{app.ID},
+	})
+
+	// the token can deploy its app, referring to it by name or ID
+	artifact := &ct.Artifact{
+		Type:        ct.ArtifactTypeFlynn,
+		RawManifest: ct.ImageManifest{Type: ct.ImageManifestTypeV1}.RawManifest(),
+		URI:         fmt.Sprintf("https://example.com/%s", random.String(8)),
+	}
+	c.Assert(client.CreateArtifact(artifact), IsNil)
+	release := &ct.Release{ArtifactIDs: []string{artifact.ID}}
+	c.Assert(client.CreateRelease(app.ID, release), IsNil)
+	c.Assert(client.SetAppRelease(app.Name, release.ID), IsNil)
+	_, err := client.GetRelease(release.ID)
+	c.Assert(err, IsNil)
+
+	// but not other apps
+	_, err = client.GetApp(otherApp.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+	otherRelease := &ct.Release{ArtifactIDs: []string{artifact.ID}}
+	c.Assert(isForbiddenError(client.CreateRelease(otherApp.ID, otherRelease)), Equals, true)
+	otherRelease = s.createTestRelease(c, otherApp.ID, &ct.Release{})
+	_, err = client.GetRelease(otherRelease.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+
+	// nor use other apps' releases with its app
+	c.Assert(hh.IsValidationError(client.SetAppRelease(app.ID, otherRelease.ID)), Equals, true)
+	_, err = client.CreateDeployment(app.ID, otherRelease.ID)
+	c.Assert(hh.IsValidationError(err), Equals, true)
+	_, err = client.RunJobDetached(app.ID, &ct.NewJob{ReleaseID: otherRelease.ID, ReleaseEnv: true})
+	c.Assert(hh.IsValidationError(err), Equals, true)
+	err = client.PutFormation(&ct.Formation{AppID: app.ID, ReleaseID: otherRelease.ID})
+	c.Assert(hh.IsValidationError(err), Equals, true)
+
+	// nor read or kill other apps' jobs via its app
+	hostID := fakeHostID()
+	uuid := random.UUID()
+	jobID := cluster.GenerateJobID(hostID, uuid)
+	s.createTestJob(c, &ct.Job{
+		ID:        jobID,
+		UUID:      uuid,
+		HostID:    hostID,
+		AppID:     otherApp.ID,
+		ReleaseID: otherRelease.ID,
+		Type:      "web",
+		State:     ct.JobStateUp,
+	})
+	hc := tu.NewFakeHostClient(hostID, false)
+	hc.AddJob(&host.Job{ID: jobID})
+	s.cc.AddHost(hc)
+	_, err = client.GetJob(app.ID, jobID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+	c.Assert(client.DeleteJob(app.ID, jobID), Equals, controller.ErrNotFound)
+	c.Assert(hc.IsStopped(jobID), Equals, false)
+
+	// nor list every app
+	_, err = client.AppList()
+	c.Assert(isForbiddenError(err), Equals, true)
+}
+
+func (s *S) TestTokenSystemApps(c *C) {
+	app := s.createTestApp(c, &ct.App{Meta: map[string]string{"flynn-system-app": "true"}})
+	release := s.createTestRelease(c, app.ID, &ct.Release{Env: map[string]string{"AUTH_KEY": "secret"}})
+	s.setAppRelease(c, app.ID, release.ID)
+
+	// non-admin tokens can't read or change system apps, nor read the
+	// releases or resources of every app
+	_, client := s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenSystemAppsDeploy",
+		Scopes: []ct.TokenScope{ct.TokenScopeDeploy},
+	})
+	_, err := client.GetApp(app.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+	_, err = client.GetAppRelease(app.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+	_, err = client.GetRelease(release.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+	c.Assert(isForbiddenError(client.SetAppRelease(app.ID, release.ID)), Equals, true)
+	_, err = client.FormationListActive()
+	c.Assert(isForbiddenError(err), Equals, true)
+	_, err = client.ResourceListAll()
+	c.Assert(isForbiddenError(err), Equals, true)
+	provider := s.createTestProvider(c, &ct.Provider{URL: "https://example.com", Name: "token-" + random.String(8)})
+	_, err = client.ResourceList(provider.ID)
+	c.Assert(isForbiddenError(err), Equals, true)
+
+	// but can still read other apps
+	other := s.createTestRelease(c, "", &ct.Release{})
+	_, err = client.GetRelease(other.ID)
+	c.Assert(err, IsNil)
+
+	// admin tokens can read system apps
+	_, client = s.createTestToken(c, &ct.Token{
+		Name:   "TestTokenSystemAppsAdmin",
+		Scopes: []ct.TokenScope{ct.TokenScopeAdmin},
+	})
+	gotRelease, err := client.GetAppRelease(app.ID)
+	c.Assert(err, IsNil)
+	c.Assert(gotRelease.ID, Equals, release.ID)
+}
+
+func (s *S) TestRevokeToken(c *C) {
+	token, client := s.createTestToken(c, &ct.Token{
+		Name:   "TestRevokeToken",
+		Scopes: []ct.TokenScope{ct.TokenScopeAdmin},
+	})
+	_, err := client.AppList()
+	c.Assert(err, IsNil)
+
+	_, err = s.c.DeleteToken(token.ID)
+	c.Assert(err, IsNil)
+	_, err = s.c.GetToken(token.ID)
+	c.Assert(err, Equals, controller.ErrNotFound)
+
+	// the key no longer authenticates
+	_, err = client.AppList()
+	c.Assert(err, NotNil)
+	c.Assert(isForbiddenError(err), Equals, false)
+
+	// and the name can be reused
+	s.createTestToken(c, &ct.Token{
+		Name:   "TestRevokeToken",
+		Scopes: []ct.TokenScope{ct.TokenScopeReadOnly},
+	})
+}
@@ -55,6 +55,19 @@ type App struct {
 	DeployTimeout int32             `json:"deploy_timeout,omitempty"`
 	CreatedAt     *time.Time        `json:"created_at,omitempty"`
 	UpdatedAt     *time.Time        `json:"updated_at,omitempty"`
+
+	// Autoscale maps process types to policies which the scheduler uses
+	// to automatically scale the formation of the app's current release
+	Autoscale map[string]*AutoscalePolicy `json:"autoscale,omitempty"`
+}
+
+// AutoscalePolicy configures the scheduler to scale a process type between
+// Min and Max jobs based on the number of in-flight router requests to the
+// process type's service, aiming for TargetRequests in-flight requests per job
+type AutoscalePolicy struct {
+	Min            int   `json:"min"`
+	Max            int   `json:"max"`
+	TargetRequests int64 `json:"target_requests"`
 }
 
 func (a *App) System() bool {
@@ -81,11 +94,33 @@ type Release struct {
 	Processes   map[string]ProcessType `json:"processes,omitempty"`
 	CreatedAt   *time.Time             `json:"created_at,omitempty"`
 
+	// SecretEnv is the names of the variables in Env which are secret.
+	// Their values are encrypted when the release is created, and are
+	// only returned in their encrypted form.
+	SecretEnv []string `json:"secret_env,omitempty"`
+
 	// LegacyArtifactID is to support old clients which expect releases
 	// to have a single ArtifactID
 	LegacyArtifactID string `json:"artifact,omitempty"`
 }
 
+// SecretEnvPrefix prefixes the encrypted values of secret environment
+// variables
+const SecretEnvPrefix = "flynn-secret:"
+
+// IsSecretEnvValue returns whether the environment variable value is the
+// encrypted value of a secret variable
+func IsSecretEnvValue(v string) bool {
+	return strings.HasPrefix(v, SecretEnvPrefix)
+}
+
+// SecretEnvRotation is the result of re-encrypting secret environment
+// variables with the current secret env key
+type SecretEnvRotation struct {
+	// Releases is the number of releases which were re-encrypted
+	Releases int `json:"releases"`
+}
+
 func (r *Release) IsGitDeploy() bool {
 	return r.Meta["git"] == "true"
 }
@@ -109,6 +144,7 @@ type ProcessType struct {
 	LinuxCapabilities []string           `json:"linux_capabilities,omitempty"`
 	AllowedDevices    []*configs.Device  `json:"allowed_devices,omitempty"`
 	WriteableCgroups  bool               `json:"writeable_cgroups,omitempty"`
+	Spread            *SpreadRule        `json:"spread,omitempty"`
 
 	// Entrypoint and Cmd are DEPRECATED: use Args instead
 	DeprecatedCmd        []string `json:"cmd,omitempty"`
@@ -118,6 +154,21 @@ type ProcessType struct {
 	DeprecatedData bool `json:"data,omitempty"`
 }
 
+// SpreadRule constrains how the jobs of a process type are spread across
+// hosts, with jobs left pending if they cannot be placed without breaking the
+// rule. The rule applies to jobs in the same formation (i.e. the same app and
+// release) so that deploys can start new jobs before stopping old ones.
+type SpreadRule struct {
+	// UniqueHost prevents more than one job of the process type from
+	// running on the same host
+	UniqueHost bool `json:"unique_host,omitempty"`
+
+	// Tag prevents more than one job of the process type from running on
+	// hosts with the same value of the given host tag (e.g. "zone"), and
+	// prevents jobs from running on hosts without the tag
+	Tag string `json:"tag,omitempty"`
+}
+
 type Port struct {
 	Port    int           `json:"port"`
 	Proto   string        `json:"proto"`
@@ -193,6 +244,10 @@ type Formation struct {
 	Tags      map[string]map[string]string `json:"tags,omitempty"`
 	CreatedAt *time.Time                   `json:"created_at,omitempty"`
 	UpdatedAt *time.Time                   `json:"updated_at,omitempty"`
+
+	// ScaleReason is not persisted, but is included in the scale event
+	// created when the formation is updated to explain why it was scaled
+	ScaleReason string `json:"scale_reason,omitempty"`
 }
 
 type Job struct {
@@ -220,6 +275,10 @@ type Job struct {
 	Restarts   *int32            `json:"restarts,omitempty"`
 	CreatedAt  *time.Time        `json:"created_at,omitempty"`
 	UpdatedAt  *time.Time        `json:"updated_at,omitempty"`
+
+	// PendingReason is set by the scheduler if it is unable to place a
+	// pending job in the cluster, explaining why the job is still pending
+	PendingReason *string `json:"pending_reason,omitempty"`
 }
 
 type JobState string
@@ -332,8 +391,32 @@ type Deployment struct {
 	DeployTimeout int32                        `json:"deploy_timeout,omitempty"`
 	CreatedAt     *time.Time                   `json:"created_at,omitempty"`
 	FinishedAt    *time.Time                   `json:"finished_at,omitempty"`
+
+	// Action is the most recent action requested for an in-progress
+	// deployment (currently only used by the canary strategy)
+	Action DeploymentAction `json:"action,omitempty"`
 }
 
+// DeploymentAction is an action which controls an in-progress canary
+// deployment
+type DeploymentAction string
+
+const (
+	// DeploymentActionPause pauses the canary soak period
+	DeploymentActionPause DeploymentAction = "pause"
+
+	// DeploymentActionResume resumes a paused canary soak period
+	DeploymentActionResume DeploymentAction = "resume"
+
+	// DeploymentActionPromote ends the canary soak period and scales up
+	// the new release
+	DeploymentActionPromote DeploymentAction = "promote"
+
+	// DeploymentActionAbort ends the canary soak period and rolls back
+	// the deployment
+	DeploymentActionAbort DeploymentAction = "abort"
+)
+
 type DeployID struct {
 	ID string
 }
@@ -346,6 +429,10 @@ type DeploymentEvent struct {
 	JobType      string   `json:"job_type,omitempty"`
 	JobState     JobState `json:"job_state,omitempty"`
 	Error        string   `json:"error,omitempty"`
+
+	// Phase is the phase of the deployment the event was emitted in,
+	// which is currently only set by the canary strategy
+	Phase string `json:"phase,omitempty"`
 }
 
 func (e *DeploymentEvent) Err() error {
@@ -442,6 +529,7 @@ type Scale struct {
 	PrevProcesses map[string]int `json:"prev_processes,omitempty"`
 	Processes     map[string]int `json:"processes"`
 	ReleaseID     string         `json:"release"`
+	Reason        string         `json:"reason,omitempty"`
 }
 
 type AppRelease struct {
@@ -517,6 +605,48 @@ type StreamEventsOptions struct {
 	Count       int
 }
 
+// AuditEntry records a request which changed the state of the cluster
+type AuditEntry struct {
+	ID int64 `json:"id,omitempty"`
+
+	// TokenID and TokenName identify the token the request was made with,
+	// and are empty if it was made with one of the cluster's auth keys
+	TokenID   string `json:"token_id,omitempty"`
+	TokenName string `json:"token_name,omitempty"`
+
+	SourceIP  string `json:"source_ip,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Method    string `json:"method,omitempty"`
+	Path      string `json:"path,omitempty"`
+	AppID     string `json:"app,omitempty"`
+	Status    int    `json:"status,omitempty"`
+
+	// Payload summarises the request body, with nested objects replaced by
+	// their keys, arrays by their length and secrets redacted
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+type ListAuditOptions struct {
+	AppID    string
+	TokenID  string
+	SourceIP string
+	Method   string
+	BeforeID *int64
+	SinceID  *int64
+	Count    int
+}
+
+type StreamAuditOptions struct {
+	AppID    string
+	TokenID  string
+	SourceIP string
+	Method   string
+	Past     bool
+	Count    int
+}
+
 type AppGarbageCollection struct {
 	AppID           string   `json:"app_id"`
 	DeletedReleases []string `json:"deleted_releases"`
@@ -637,3 +767,47 @@ type SyslogSinkConfig struct {
 type LogAggregatorSinkConfig struct {
 	Addr string `json:"addr"`
 }
+
+type TokenScope string
+
+const (
+	// TokenScopeReadOnly permits reading but not changing resources
+	TokenScopeReadOnly TokenScope = "read-only"
+
+	// TokenScopeDeploy permits creating artifacts and releases, deploying
+	// them and running jobs
+	TokenScopeDeploy TokenScope = "deploy"
+
+	// TokenScopeScale permits changing formations and killing jobs
+	TokenScopeScale TokenScope = "scale"
+
+	// TokenScopeAdmin permits every request, as the cluster's auth keys do
+	TokenScopeAdmin TokenScope = "admin"
+)
+
+// Token is a named API key with a set of scopes, which every scope includes
+// reading resources. Tokens with AppIDs may only access those apps.
+type Token struct {
+	ID     string       `json:"id,omitempty"`
+	Name   string       `json:"name,omitempty"`
+	Scopes []TokenScope `json:"scopes,omitempty"`
+	AppIDs []string     `json:"app_ids,omitempty"`
+
+	// Key is only set in the response to creating the token, only a hash
+	// of it being stored
+	Key string `json:"key,omitempty"`
+
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+}
+
+// HasScope returns whether the token permits requests which need the given
+// scope
+func (t *Token) HasScope(scope TokenScope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == TokenScopeAdmin {
+			return true
+		}
+	}
+	return scope == TokenScopeReadOnly && len(t.Scopes) > 0
+}
@@ -0,0 +1,184 @@
+package blue_green_cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/worker/types"
+	"github.com/flynn/flynn/pkg/postgres"
+	"github.com/flynn/que-go"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var ErrDeploymentInProgress = errors.New("blue_green_cleanup: deployment in progress")
+
+type context struct {
+	db     *postgres.DB
+	client controller.Client
+	logger log15.Logger
+}
+
+func JobHandler(db *postgres.DB, client controller.Client, logger log15.Logger) func(*que.Job) error {
+	return (&context{db, client, logger}).HandleBlueGreenCleanup
+}
+
+// HandleBlueGreenCleanup scales down the old release of a blue/green
+// deployment once its warm period has passed, then removes the release
+// restriction from the app's routes so that they go back to sending traffic
+// to all instances of their service.
+//
+// If the app has since been rolled back to the old release, nothing is done,
+// and if a deployment is in progress the job is retried later so that routes
+// which the deployment has restricted are not changed. Routes restricted to a
+// running release are left restricted whilst another release is still
+// running (for example another old release which is still warm).
+func (c *context) HandleBlueGreenCleanup(job *que.Job) error {
+	log := c.logger.New("fn", "HandleBlueGreenCleanup")
+	log.Info("handling blue-green cleanup", "job_id", job.ID, "error_count", job.ErrorCount)
+
+	var args worker.BlueGreenCleanup
+	if err := json.Unmarshal(job.Args, &args); err != nil {
+		log.Error("error unmarshaling job", "err", err)
+		return err
+	}
+	log = log.New("app.id", args.AppID, "release.id", args.ReleaseID)
+
+	log.Info("getting app")
+	app, err := c.client.GetApp(args.AppID)
+	if err == controller.ErrNotFound {
+		log.Info("app has been deleted, skipping cleanup")
+		return nil
+	} else if err != nil {
+		log.Error("error getting app", "err", err)
+		return err
+	}
+	if app.ReleaseID == args.ReleaseID {
+		log.Info("app has been rolled back to the release, skipping cleanup")
+		return nil
+	}
+
+	log.Info("checking for in-progress deployments")
+	deployments, err := c.client.DeploymentList(app.ID)
+	if err != nil {
+		log.Error("error listing deployments", "err", err)
+		return err
+	}
+	for _, d := range deployments {
+		if d.FinishedAt == nil {
+			log.Info("deployment in progress, retrying cleanup later", "deployment.id", d.ID)
+			return ErrDeploymentInProgress
+		}
+	}
+
+	if err := c.scaleDown(app.ID, args.ReleaseID, log); err != nil {
+		return err
+	}
+
+	// find the releases which are still running, which includes other
+	// old releases which are still warm (they will have their own cleanup
+	// jobs)
+	formations, err := c.client.FormationList(app.ID)
+	if err != nil {
+		log.Error("error listing formations", "err", err)
+		return err
+	}
+	running := make(map[string]struct{}, len(formations))
+	for _, f := range formations {
+		if f.ReleaseID == args.ReleaseID {
+			continue
+		}
+		for _, n := range f.Processes {
+			if n > 0 {
+				running[f.ReleaseID] = struct{}{}
+				break
+			}
+		}
+	}
+
+	routes, err := c.client.RouteList(app.ID)
+	if err != nil {
+		log.Error("error listing routes", "err", err)
+		return err
+	}
+	for _, route := range routes {
+		if route.Type != "http" || route.ReleaseID == "" {
+			continue
+		}
+		// leave the restriction if it still separates the traffic of
+		// a running release from other running releases, but remove it
+		// if the release is the only one running or is no longer
+		// running at all (for example if the routes were restricted by
+		// a blue-green deployment followed by a deployment using
+		// another strategy), which would leave the route without
+		// backends
+		if _, ok := running[route.ReleaseID]; ok && len(running) > 1 {
+			log.Info("another release is still running, leaving route restricted", "route.id", route.FormattedID(), "route.release_id", route.ReleaseID)
+			continue
+		}
+		log.Info("removing release restriction from route", "route.id", route.FormattedID(), "route.release_id", route.ReleaseID)
+		route.ReleaseID = ""
+		if err := c.client.UpdateRoute(app.ID, route.FormattedID(), route); err != nil {
+			log.Error("error updating route", "route.id", route.FormattedID(), "err", err)
+			return err
+		}
+	}
+
+	log.Info("blue-green cleanup complete")
+	return nil
+}
+
+// scaleDown scales the formation of the given release to zero and waits for
+// its jobs to stop so they no longer receive traffic once the routes are no
+// longer restricted to the current release
+func (c *context) scaleDown(appID, releaseID string, log log15.Logger) error {
+	formation, err := c.client.GetFormation(appID, releaseID)
+	if err == controller.ErrNotFound {
+		return nil
+	} else if err != nil {
+		log.Error("error getting formation", "err", err)
+		return err
+	}
+
+	log.Info("creating job watcher")
+	watcher, err := c.client.WatchJobEvents(appID, releaseID)
+	if err != nil {
+		log.Error("error opening job event stream", "err", err)
+		return err
+	}
+	defer watcher.Close()
+	jobs, err := c.client.JobList(appID)
+	if err != nil {
+		log.Error("error listing jobs", "err", err)
+		return err
+	}
+	running := make(map[string]int)
+	for _, job := range jobs {
+		if job.ReleaseID == releaseID && job.State == ct.JobStateUp {
+			running[job.Type]++
+		}
+	}
+	expected := make(ct.JobEvents, len(running))
+	for typ, n := range running {
+		expected[typ] = ct.JobDownEvents(n)
+	}
+
+	log.Info("scaling formation to zero")
+	formation.Processes = nil
+	if err := c.client.PutFormation(formation); err != nil {
+		log.Error("error scaling formation to zero", "err", err)
+		return err
+	}
+
+	if expected.Count() > 0 {
+		log.Info("waiting for job events", "expected", expected)
+		if err := watcher.WaitFor(expected, 60*time.Second, nil); err != nil {
+			// the scheduler will still stop the jobs, so just log
+			// the error
+			log.Error("error waiting for job events", "err", err)
+		}
+	}
+	return nil
+}
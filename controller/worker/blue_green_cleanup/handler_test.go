@@ -0,0 +1,167 @@
+package blue_green_cleanup
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/worker/types"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"github.com/flynn/que-go"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+// fakeClient is a controller client for an app with the given formations,
+// deployments and routes, which records the route updates
+type fakeClient struct {
+	controller.Client
+
+	app         *ct.App
+	formations  map[string]map[string]int
+	deployments []*ct.Deployment
+	routes      []*router.Route
+	updates     map[string]string
+}
+
+func newFakeClient(releaseID string, formations map[string]map[string]int, routes ...*router.Route) *fakeClient {
+	return &fakeClient{
+		app:        &ct.App{ID: "app", ReleaseID: releaseID},
+		formations: formations,
+		routes:     routes,
+		updates:    make(map[string]string),
+	}
+}
+
+func (f *fakeClient) GetApp(id string) (*ct.App, error) {
+	return f.app, nil
+}
+
+func (f *fakeClient) DeploymentList(appID string) ([]*ct.Deployment, error) {
+	return f.deployments, nil
+}
+
+func (f *fakeClient) GetFormation(appID, releaseID string) (*ct.Formation, error) {
+	procs, ok := f.formations[releaseID]
+	if !ok {
+		return nil, controller.ErrNotFound
+	}
+	return &ct.Formation{AppID: appID, ReleaseID: releaseID, Processes: procs}, nil
+}
+
+func (f *fakeClient) FormationList(appID string) ([]*ct.Formation, error) {
+	formations := make([]*ct.Formation, 0, len(f.formations))
+	for releaseID, procs := range f.formations {
+		formations = append(formations, &ct.Formation{AppID: appID, ReleaseID: releaseID, Processes: procs})
+	}
+	return formations, nil
+}
+
+func (f *fakeClient) PutFormation(formation *ct.Formation) error {
+	f.formations[formation.ReleaseID] = formation.Processes
+	return nil
+}
+
+func (f *fakeClient) WatchJobEvents(appID, releaseID string) (ct.JobWatcher, error) {
+	return fakeWatcher{}, nil
+}
+
+func (f *fakeClient) JobList(appID string) ([]*ct.Job, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) RouteList(appID string) ([]*router.Route, error) {
+	return f.routes, nil
+}
+
+func (f *fakeClient) UpdateRoute(appID, id string, route *router.Route) error {
+	f.updates[id] = route.ReleaseID
+	return nil
+}
+
+type fakeWatcher struct{}
+
+func (fakeWatcher) WaitFor(ct.JobEvents, time.Duration, func(*ct.Job) error) error { return nil }
+func (fakeWatcher) Close() error                                                   { return nil }
+
+// runCleanup runs a cleanup job for the given release of the client's app
+func runCleanup(c *C, client *fakeClient, releaseID string) error {
+	args, err := json.Marshal(&worker.BlueGreenCleanup{AppID: client.app.ID, ReleaseID: releaseID})
+	c.Assert(err, IsNil)
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+	return JobHandler(nil, client, logger)(&que.Job{Args: args})
+}
+
+func (S) TestCleanup(c *C) {
+	client := newFakeClient("B", map[string]map[string]int{
+		"A": {"web": 2},
+		"B": {"web": 2},
+	},
+		&router.Route{Type: "http", ID: "web", ReleaseID: "B"},
+		&router.Route{Type: "http", ID: "unrestricted"},
+		&router.Route{Type: "tcp", ID: "tcp", ReleaseID: "B"},
+	)
+	c.Assert(runCleanup(c, client, "A"), IsNil)
+
+	// the old release is scaled down and the restriction removed
+	c.Assert(client.formations["A"], HasLen, 0)
+	c.Assert(client.updates, DeepEquals, map[string]string{"http/web": ""})
+}
+
+func (S) TestCleanupRolledBack(c *C) {
+	client := newFakeClient("A", map[string]map[string]int{
+		"A": {"web": 2},
+		"B": {"web": 2},
+	}, &router.Route{Type: "http", ID: "web", ReleaseID: "A"})
+	c.Assert(runCleanup(c, client, "A"), IsNil)
+	c.Assert(client.formations["A"], DeepEquals, map[string]int{"web": 2})
+	c.Assert(client.updates, HasLen, 0)
+}
+
+func (S) TestCleanupDeploymentInProgress(c *C) {
+	client := newFakeClient("B", map[string]map[string]int{
+		"A": {"web": 2},
+		"B": {"web": 2},
+	}, &router.Route{Type: "http", ID: "web", ReleaseID: "C"})
+	client.deployments = []*ct.Deployment{{ID: "deployment", NewReleaseID: "C"}}
+	c.Assert(runCleanup(c, client, "A"), Equals, ErrDeploymentInProgress)
+	c.Assert(client.formations["A"], DeepEquals, map[string]int{"web": 2})
+	c.Assert(client.updates, HasLen, 0)
+}
+
+func (S) TestCleanupOtherReleaseWarm(c *C) {
+	// A -> B -> C blue-green deployments, with B still warm when A is
+	// cleaned up
+	client := newFakeClient("C", map[string]map[string]int{
+		"A": {"web": 2},
+		"B": {"web": 2},
+		"C": {"web": 2},
+	}, &router.Route{Type: "http", ID: "web", ReleaseID: "C"})
+	c.Assert(runCleanup(c, client, "A"), IsNil)
+	c.Assert(client.formations["A"], HasLen, 0)
+	c.Assert(client.updates, HasLen, 0)
+}
+
+func (S) TestCleanupStaleRestriction(c *C) {
+	// A -> B blue-green deployment followed by an all-at-once deployment
+	// of C which scaled B down whilst A is still warm, leaving the route
+	// restricted to B which has no running instances
+	client := newFakeClient("C", map[string]map[string]int{
+		"A": {"web": 2},
+		"B": {"web": 0},
+		"C": {"web": 2},
+	}, &router.Route{Type: "http", ID: "web", ReleaseID: "B"})
+	c.Assert(runCleanup(c, client, "A"), IsNil)
+	c.Assert(client.formations["A"], HasLen, 0)
+	c.Assert(client.updates, DeepEquals, map[string]string{"http/web": ""})
+}
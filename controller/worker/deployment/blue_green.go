@@ -0,0 +1,343 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/worker/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/types"
+	"github.com/flynn/que-go"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// blue/green deployment phases which are set on emitted deployment events
+const (
+	BlueGreenPhaseScale       = "scale"
+	BlueGreenPhaseHealthCheck = "health-check"
+	BlueGreenPhaseSwitch      = "switch"
+	BlueGreenPhaseRollback    = "rollback"
+)
+
+// defaultBlueGreenWarmPeriod is how long the old release is kept running
+// after traffic has been switched to the new release if the app does not
+// set the blue_green.warm_period meta key
+const defaultBlueGreenWarmPeriod = 10 * time.Minute
+
+// watchService watches the instances of the given service, and is a variable
+// so that tests can send their own service events
+var watchService = func(service string, events chan *discoverd.Event) (stream.Stream, error) {
+	return discoverd.NewService(service).Watch(events)
+}
+
+func blueGreenWarmPeriodFromMeta(meta map[string]string) (time.Duration, error) {
+	v, ok := meta["blue_green.warm_period"]
+	if !ok {
+		return defaultBlueGreenWarmPeriod, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("deployer: invalid blue_green.warm_period %q", v)
+	}
+	return d, nil
+}
+
+// deployBlueGreen fully scales up the new release whilst the app's HTTP
+// routes only send traffic to the old release, then once all the new jobs
+// are up and registered with the routes' services (and so passing their
+// health checks) switches the routes to the new release.
+//
+// The old release is not scaled down as part of the deployment, it is kept
+// running for the app's warm period so that rolling back to it is instant,
+// after which a blue_green_cleanup job scales it down.
+func (d *DeployJob) deployBlueGreen() error {
+	log := d.logger.New("fn", "deployBlueGreen")
+	log.Info("starting blue-green deployment")
+
+	app, err := d.client.GetApp(d.AppID)
+	if err != nil {
+		log.Error("error getting app", "err", err)
+		return err
+	}
+	warmPeriod, err := blueGreenWarmPeriodFromMeta(app.Meta)
+	if err != nil {
+		log.Error("error parsing blue-green config", "err", err)
+		return err
+	}
+
+	routes, err := d.blueGreenRoutes()
+	if err != nil {
+		log.Error("error getting app routes", "err", err)
+		return err
+	}
+
+	// restrict the routes to the old release before starting any new jobs
+	// so they don't receive traffic until they are all up
+	original := make(map[*router.Route]string, len(routes))
+	for _, route := range routes {
+		original[route] = route.ReleaseID
+	}
+	log.Info("restricting routes to the old release", "release_id", d.OldReleaseID, "routes", len(routes))
+	if err := d.setRoutesRelease(routes, d.OldReleaseID, log); err != nil {
+		d.restoreRoutes(original, log)
+		return err
+	}
+
+	d.emitBlueGreenEvent(BlueGreenPhaseScale)
+	expected := make(ct.JobEvents)
+	newProcs := make(map[string]int, len(d.Processes))
+	for typ, n := range d.Processes {
+		// ignore processes which no longer exist in the new
+		// release
+		if _, ok := d.newRelease.Processes[typ]; !ok {
+			continue
+		}
+		newProcs[typ] = n
+		total := n
+		if d.isOmni(typ) {
+			total *= d.hostCount
+		}
+		existing := d.newReleaseState[typ]
+		if total > existing {
+			expected[typ] = ct.JobUpEvents(total - existing)
+		}
+	}
+	if expected.Count() > 0 {
+		log := log.New("release_id", d.NewReleaseID)
+		log.Info("creating new formation", "processes", newProcs)
+		if err := d.client.PutFormation(&ct.Formation{
+			AppID:     d.AppID,
+			ReleaseID: d.NewReleaseID,
+			Processes: newProcs,
+			Tags:      d.Tags,
+		}); err != nil {
+			log.Error("error creating new formation", "err", err)
+			d.restoreRoutes(original, log)
+			return err
+		}
+
+		log.Info("waiting for job events", "expected", expected)
+		if err := d.waitForJobEvents(d.NewReleaseID, expected, log); err != nil {
+			log.Error("error waiting for job events", "err", err)
+			if err != worker.ErrStopped {
+				d.emitBlueGreenEvent(BlueGreenPhaseRollback)
+				d.restoreRoutes(original, log)
+			}
+			return err
+		}
+	}
+
+	d.emitBlueGreenEvent(BlueGreenPhaseHealthCheck)
+	for service, count := range d.blueGreenServiceCounts(routes, newProcs) {
+		log.Info("waiting for healthy service instances", "service", service, "count", count)
+		if err := d.waitForHealthyInstances(service, count); err != nil {
+			log.Error("error waiting for healthy service instances", "service", service, "err", err)
+			if err != worker.ErrStopped {
+				d.emitBlueGreenEvent(BlueGreenPhaseRollback)
+				d.restoreRoutes(original, log)
+			}
+			return err
+		}
+	}
+
+	log.Info("switching routes to the new release", "release_id", d.NewReleaseID)
+	d.emitBlueGreenEvent(BlueGreenPhaseSwitch)
+	if err := d.setRoutesRelease(routes, d.NewReleaseID, log); err != nil {
+		d.emitBlueGreenEvent(BlueGreenPhaseRollback)
+		d.restoreRoutes(original, log)
+		return err
+	}
+
+	log.Info("scheduling cleanup of the old release", "release_id", d.OldReleaseID, "warm_period", warmPeriod)
+	if err := d.scheduleBlueGreenCleanup(warmPeriod); err != nil {
+		// traffic is now being served by the new release, so don't
+		// roll back just because the old one won't be scaled down
+		log.Error("error scheduling cleanup of the old release", "err", err)
+		return ErrSkipRollback{err.Error()}
+	}
+
+	log.Info("finished blue-green deployment")
+	return nil
+}
+
+// blueGreenRoutes returns the app's HTTP routes which send traffic to
+// services of the new release
+func (d *DeployJob) blueGreenRoutes() ([]*router.Route, error) {
+	services := make(map[string]struct{})
+	for _, proc := range d.newRelease.Processes {
+		if proc.Service != "" {
+			services[proc.Service] = struct{}{}
+		}
+		for _, port := range proc.Ports {
+			if port.Service != nil && port.Service.Name != "" {
+				services[port.Service.Name] = struct{}{}
+			}
+		}
+	}
+	routes, err := d.client.RouteList(d.AppID)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make([]*router.Route, 0, len(routes))
+	for _, route := range routes {
+		if route.Type != "http" || route.Leader {
+			continue
+		}
+		if _, ok := services[route.Service]; !ok {
+			continue
+		}
+		filtered = append(filtered, route)
+	}
+	return filtered, nil
+}
+
+// blueGreenServiceCounts returns the number of instances of the new release
+// expected to be registered with each of the given routes' services
+func (d *DeployJob) blueGreenServiceCounts(routes []*router.Route, procs map[string]int) map[string]int {
+	counts := make(map[string]int, len(routes))
+	for _, route := range routes {
+		counts[route.Service] = 0
+	}
+	for typ, n := range procs {
+		if d.isOmni(typ) {
+			n *= d.hostCount
+		}
+		proc := d.newRelease.Processes[typ]
+		services := make(map[string]struct{})
+		if proc.Service != "" {
+			services[proc.Service] = struct{}{}
+		}
+		for _, port := range proc.Ports {
+			if port.Service != nil && port.Service.Name != "" {
+				services[port.Service.Name] = struct{}{}
+			}
+		}
+		for service := range services {
+			if _, ok := counts[service]; ok {
+				counts[service] += n
+			}
+		}
+	}
+	return counts
+}
+
+// waitForHealthyInstances waits for the given number of instances of the new
+// release to be registered with the given service, which only happens once
+// they are passing their health checks
+func (d *DeployJob) waitForHealthyInstances(service string, count int) error {
+	if count == 0 {
+		return nil
+	}
+	events := make(chan *discoverd.Event)
+	stream, err := watchService(service, events)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	up := make(map[string]struct{}, count)
+	timeout := time.After(time.Duration(d.DeployTimeout) * time.Second)
+	for {
+		select {
+		case <-d.stop:
+			return worker.ErrStopped
+		case event, ok := <-events:
+			if !ok {
+				return fmt.Errorf("deployer: unexpected close of %s service event stream", service)
+			}
+			if event.Instance == nil || event.Instance.Meta["FLYNN_RELEASE_ID"] != d.NewReleaseID {
+				continue
+			}
+			switch event.Kind {
+			case discoverd.EventKindUp, discoverd.EventKindUpdate:
+				up[event.Instance.ID] = struct{}{}
+			case discoverd.EventKindDown:
+				delete(up, event.Instance.ID)
+			}
+			if len(up) >= count {
+				return nil
+			}
+		case <-timeout:
+			return fmt.Errorf("deployer: timed out waiting for %d healthy %s instances, got %d", count, service, len(up))
+		}
+	}
+}
+
+// setRoutesRelease updates the given routes to only send traffic to the given
+// release
+func (d *DeployJob) setRoutesRelease(routes []*router.Route, releaseID string, log log15.Logger) error {
+	for _, route := range routes {
+		if route.ReleaseID == releaseID {
+			continue
+		}
+		prev := route.ReleaseID
+		route.ReleaseID = releaseID
+		if err := d.client.UpdateRoute(d.AppID, route.FormattedID(), route); err != nil {
+			log.Error("error updating route", "route.id", route.FormattedID(), "err", err)
+			route.ReleaseID = prev
+			return err
+		}
+	}
+	return nil
+}
+
+// clearRoutesRelease removes the release restriction from the app's HTTP
+// routes so they send traffic to all instances of their service
+func (d *DeployJob) clearRoutesRelease(log log15.Logger) error {
+	routes, err := d.client.RouteList(d.AppID)
+	if err != nil {
+		log.Error("error listing routes", "err", err)
+		return err
+	}
+	for _, route := range routes {
+		if route.Type != "http" || route.ReleaseID == "" {
+			continue
+		}
+		log.Info("removing release restriction from route", "route.id", route.FormattedID(), "route.release_id", route.ReleaseID)
+		route.ReleaseID = ""
+		if err := d.client.UpdateRoute(d.AppID, route.FormattedID(), route); err != nil {
+			log.Error("error updating route", "route.id", route.FormattedID(), "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreRoutes sets the release IDs of routes which have been changed back
+// to their original values
+func (d *DeployJob) restoreRoutes(original map[*router.Route]string, log log15.Logger) {
+	for route, releaseID := range original {
+		if route.ReleaseID == releaseID {
+			continue
+		}
+		route.ReleaseID = releaseID
+		if err := d.client.UpdateRoute(d.AppID, route.FormattedID(), route); err != nil {
+			log.Error("error restoring route", "route.id", route.FormattedID(), "err", err)
+		}
+	}
+}
+
+func (d *DeployJob) scheduleBlueGreenCleanup(warmPeriod time.Duration) error {
+	args, err := json.Marshal(&worker.BlueGreenCleanup{
+		AppID:     d.AppID,
+		ReleaseID: d.OldReleaseID,
+	})
+	if err != nil {
+		return err
+	}
+	return d.que.Enqueue(&que.Job{
+		Type:  "blue_green_cleanup",
+		Args:  args,
+		RunAt: time.Now().Add(warmPeriod),
+	})
+}
+
+func (d *DeployJob) emitBlueGreenEvent(phase string) {
+	d.deployEvents <- ct.DeploymentEvent{
+		ReleaseID: d.NewReleaseID,
+		Phase:     phase,
+	}
+}
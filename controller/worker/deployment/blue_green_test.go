@@ -0,0 +1,234 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/worker/types"
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"github.com/flynn/que-go"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+type BlueGreenSuite struct{}
+
+var _ = Suite(&BlueGreenSuite{})
+
+// blueGreenClient is a controller client which stores routes and records the
+// release IDs they are updated with
+type blueGreenClient struct {
+	controller.Client
+
+	routes []*router.Route
+
+	// onPutFormation is called with formations which are put
+	onPutFormation func(*ct.Formation) error
+
+	mtx     sync.Mutex
+	updates map[string][]string
+}
+
+func (f *blueGreenClient) GetApp(id string) (*ct.App, error) {
+	return &ct.App{ID: id}, nil
+}
+
+func (f *blueGreenClient) RouteList(appID string) ([]*router.Route, error) {
+	routes := make([]*router.Route, len(f.routes))
+	for i, r := range f.routes {
+		route := *r
+		routes[i] = &route
+	}
+	return routes, nil
+}
+
+func (f *blueGreenClient) UpdateRoute(appID, id string, route *router.Route) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.updates[id] = append(f.updates[id], route.ReleaseID)
+	return nil
+}
+
+func (f *blueGreenClient) PutFormation(formation *ct.Formation) error {
+	if f.onPutFormation != nil {
+		return f.onPutFormation(formation)
+	}
+	return nil
+}
+
+// fakeQueue records the jobs which are enqueued
+type fakeQueue struct {
+	jobs []*que.Job
+}
+
+func (q *fakeQueue) Enqueue(job *que.Job) error {
+	q.jobs = append(q.jobs, job)
+	return nil
+}
+
+type fakeStream struct{}
+
+func (fakeStream) Close() error { return nil }
+func (fakeStream) Err() error   { return nil }
+
+// watchInstances sets watchService to send up events for the given number of
+// instances of the given release, returning a function which restores it
+func watchInstances(releaseID string, count int) func() {
+	prev := watchService
+	watchService = func(service string, events chan *discoverd.Event) (stream.Stream, error) {
+		go func() {
+			for i := 0; i < count; i++ {
+				events <- &discoverd.Event{
+					Service: service,
+					Kind:    discoverd.EventKindUp,
+					Instance: &discoverd.Instance{
+						ID:   fmt.Sprintf("%s-%d", service, i),
+						Meta: map[string]string{"FLYNN_RELEASE_ID": releaseID},
+					},
+				}
+			}
+		}()
+		return fakeStream{}, nil
+	}
+	return func() { watchService = prev }
+}
+
+// newBlueGreenDeployJob returns a blue-green deploy job for an app with a web
+// process serving an HTTP route, a TCP route and an HTTP route of another
+// service
+func newBlueGreenDeployJob() (*DeployJob, *blueGreenClient, *fakeQueue, chan ct.DeploymentEvent) {
+	client := &blueGreenClient{
+		routes: []*router.Route{
+			{Type: "http", ID: "web", Service: "app-web"},
+			{Type: "tcp", ID: "tcp", Service: "app-web"},
+			{Type: "http", ID: "other", Service: "other-web"},
+		},
+		updates: make(map[string][]string),
+	}
+	queue := &fakeQueue{}
+	events := make(chan ct.DeploymentEvent, 100)
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+	d := &DeployJob{
+		Deployment: &ct.Deployment{
+			ID:            "deployment",
+			AppID:         "app",
+			OldReleaseID:  "old-release",
+			NewReleaseID:  "new-release",
+			Strategy:      "blue-green",
+			Processes:     map[string]int{"web": 2},
+			DeployTimeout: 5,
+		},
+		client:       client,
+		que:          queue,
+		deployEvents: events,
+		jobEvents:    make(map[string]chan *JobEvent),
+		logger:       logger,
+		newRelease: &ct.Release{ID: "new-release", Processes: map[string]ct.ProcessType{
+			"web": {Service: "app-web"},
+		}},
+		newReleaseState: make(map[string]int),
+		useJobEvents:    map[string]struct{}{"web": {}},
+		knownJobStates:  make(map[jobIDState]struct{}),
+		hostCount:       1,
+		stop:            make(chan struct{}),
+	}
+	return d, client, queue, events
+}
+
+// sendJobEvent sends a controller event for a web job of the new release
+func sendJobEvent(d *DeployJob, job *ct.Job) {
+	job.Type = "web"
+	job.ReleaseID = d.NewReleaseID
+	d.ReleaseJobEvents(d.NewReleaseID) <- &JobEvent{
+		Type:     JobEventTypeController,
+		JobEvent: job,
+	}
+}
+
+func (BlueGreenSuite) TestWarmPeriodFromMeta(c *C) {
+	d, err := blueGreenWarmPeriodFromMeta(nil)
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, defaultBlueGreenWarmPeriod)
+
+	d, err = blueGreenWarmPeriodFromMeta(map[string]string{"blue_green.warm_period": "30s"})
+	c.Assert(err, IsNil)
+	c.Assert(d, Equals, 30*time.Second)
+
+	for _, v := range []string{"x", "-1s"} {
+		_, err := blueGreenWarmPeriodFromMeta(map[string]string{"blue_green.warm_period": v})
+		c.Assert(err, NotNil)
+	}
+}
+
+func (BlueGreenSuite) TestSwitch(c *C) {
+	defer watchInstances("new-release", 2)()
+	d, client, queue, events := newBlueGreenDeployJob()
+	client.onPutFormation = func(f *ct.Formation) error {
+		c.Assert(f.ReleaseID, Equals, d.NewReleaseID)
+		c.Assert(f.Processes, DeepEquals, map[string]int{"web": 2})
+
+		// the new jobs start whilst the routes are restricted to
+		// the old release
+		c.Assert(client.updates["http/web"], DeepEquals, []string{"old-release"})
+		sendJobEvent(d, &ct.Job{ID: "job1", State: ct.JobStateUp})
+		sendJobEvent(d, &ct.Job{ID: "job2", State: ct.JobStateUp})
+		return nil
+	}
+
+	start := time.Now()
+	c.Assert(d.deployBlueGreen(), IsNil)
+	c.Assert(phases(events), DeepEquals, []string{BlueGreenPhaseScale, BlueGreenPhaseHealthCheck, BlueGreenPhaseSwitch})
+
+	// only the HTTP route of the new release's service is switched
+	c.Assert(client.updates, DeepEquals, map[string][]string{
+		"http/web": {"old-release", "new-release"},
+	})
+
+	// the old release is cleaned up after the warm period
+	c.Assert(queue.jobs, HasLen, 1)
+	job := queue.jobs[0]
+	c.Assert(job.Type, Equals, "blue_green_cleanup")
+	c.Assert(job.RunAt.After(start.Add(defaultBlueGreenWarmPeriod-time.Second)), Equals, true)
+	var args worker.BlueGreenCleanup
+	c.Assert(json.Unmarshal(job.Args, &args), IsNil)
+	c.Assert(args, DeepEquals, worker.BlueGreenCleanup{AppID: "app", ReleaseID: "old-release"})
+}
+
+func (BlueGreenSuite) TestRollback(c *C) {
+	defer watchInstances("new-release", 2)()
+	d, client, queue, events := newBlueGreenDeployJob()
+	client.onPutFormation = func(f *ct.Formation) error {
+		hostErr := "out of memory"
+		sendJobEvent(d, &ct.Job{ID: "job1", State: ct.JobStateUp})
+		sendJobEvent(d, &ct.Job{ID: "job2", State: ct.JobStateDown, HostError: &hostErr})
+		return nil
+	}
+
+	c.Assert(d.deployBlueGreen(), NotNil)
+	c.Assert(phases(events), DeepEquals, []string{BlueGreenPhaseScale, BlueGreenPhaseRollback})
+
+	// the route is restored and never switched to the new release
+	c.Assert(client.updates, DeepEquals, map[string][]string{
+		"http/web": {"old-release", ""},
+	})
+	c.Assert(queue.jobs, HasLen, 0)
+}
+
+func (BlueGreenSuite) TestClearRoutesRelease(c *C) {
+	d, client, _, _ := newBlueGreenDeployJob()
+	client.routes[0].ReleaseID = "old-release"
+	client.routes[1].ReleaseID = "old-release"
+	c.Assert(d.clearRoutesRelease(d.logger), IsNil)
+
+	// only HTTP routes which are restricted are updated
+	c.Assert(client.updates, DeepEquals, map[string][]string{
+		"http/web": {""},
+	})
+}
@@ -0,0 +1,246 @@
+package deployment
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	"github.com/flynn/flynn/controller/worker/types"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// canary deployment phases which are set on emitted deployment events
+const (
+	CanaryPhaseStart    = "canary"
+	CanaryPhaseSoak     = "soak"
+	CanaryPhasePaused   = "paused"
+	CanaryPhasePromote  = "promote"
+	CanaryPhaseRollback = "rollback"
+)
+
+// canaryActionPollInterval is how often the deployment is polled during the
+// soak period to check for pause, resume, promote or abort actions
+var canaryActionPollInterval = 2 * time.Second
+
+var ErrCanaryAborted = errors.New("canary deployment aborted")
+
+// canaryConfig is the configuration of a canary deployment, read from the
+// app's canary.count, canary.soak_period and canary.max_crashes meta keys
+type canaryConfig struct {
+	// Count is the number of jobs of each process type to start before
+	// the soak period
+	Count int
+
+	// SoakPeriod is how long to watch the canary jobs for crashes before
+	// promoting the deployment
+	SoakPeriod time.Duration
+
+	// MaxCrashes is the number of canary jobs which can crash during the
+	// soak period before the deployment is rolled back
+	MaxCrashes int
+}
+
+func canaryConfigFromMeta(meta map[string]string) (*canaryConfig, error) {
+	config := &canaryConfig{
+		Count:      1,
+		SoakPeriod: 5 * time.Minute,
+		MaxCrashes: 0,
+	}
+	if v, ok := meta["canary.count"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("deployer: invalid canary.count %q", v)
+		}
+		config.Count = n
+	}
+	if v, ok := meta["canary.soak_period"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("deployer: invalid canary.soak_period %q", v)
+		}
+		config.SoakPeriod = d
+	}
+	if v, ok := meta["canary.max_crashes"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("deployer: invalid canary.max_crashes %q", v)
+		}
+		config.MaxCrashes = n
+	}
+	return config, nil
+}
+
+// deployCanary starts a small number of jobs of the new release alongside
+// the old ones, watches them for crashes during a soak period, then either
+// promotes the new release by scaling it up and the old one down, or rolls
+// back if too many canary jobs crash or the deployment is aborted
+func (d *DeployJob) deployCanary() error {
+	log := d.logger.New("fn", "deployCanary")
+	log.Info("starting canary deployment")
+
+	app, err := d.client.GetApp(d.AppID)
+	if err != nil {
+		log.Error("error getting app", "err", err)
+		return err
+	}
+	config, err := canaryConfigFromMeta(app.Meta)
+	if err != nil {
+		log.Error("error parsing canary config", "err", err)
+		return err
+	}
+
+	// omni process types are not started as canaries since they run on
+	// every host, so they are started when the deployment is promoted
+	expected := make(ct.JobEvents)
+	canaryProcs := make(map[string]int, len(d.Processes))
+	for typ, n := range d.Processes {
+		if _, ok := d.newRelease.Processes[typ]; !ok || d.isOmni(typ) {
+			continue
+		}
+		count := config.Count
+		if count > n {
+			count = n
+		}
+		canaryProcs[typ] = count
+		if existing := d.newReleaseState[typ]; count > existing {
+			expected[typ] = ct.JobUpEvents(count - existing)
+		}
+	}
+
+	nlog := log.New("release_id", d.NewReleaseID)
+	d.emitCanaryEvent(CanaryPhaseStart)
+	if expected.Count() > 0 {
+		nlog.Info("starting canary jobs", "processes", canaryProcs)
+		if err := d.client.PutFormation(&ct.Formation{
+			AppID:     d.AppID,
+			ReleaseID: d.NewReleaseID,
+			Processes: canaryProcs,
+			Tags:      d.Tags,
+		}); err != nil {
+			nlog.Error("error starting canary jobs", "err", err)
+			return err
+		}
+		nlog.Info("waiting for job events", "expected", expected)
+		if err := d.waitForJobEvents(d.NewReleaseID, expected, nlog); err != nil {
+			nlog.Error("error waiting for job events", "err", err)
+			d.emitCanaryEvent(CanaryPhaseRollback)
+			return err
+		}
+	}
+	for typ, count := range canaryProcs {
+		if d.newReleaseState[typ] < count {
+			d.newReleaseState[typ] = count
+		}
+	}
+
+	if err := d.soakCanary(config, nlog); err != nil {
+		if err != worker.ErrStopped {
+			d.emitCanaryEvent(CanaryPhaseRollback)
+		}
+		return err
+	}
+
+	log.Info("promoting canary deployment")
+	d.emitCanaryEvent(CanaryPhasePromote)
+	return d.deployAllAtOnce()
+}
+
+// soakCanary watches the canary jobs for crashes for the configured soak
+// period, returning an error if too many crash or the deployment is aborted,
+// and handling requests to pause, resume or promote the deployment
+func (d *DeployJob) soakCanary(config *canaryConfig, log log15.Logger) error {
+	log.Info("starting canary soak period", "duration", config.SoakPeriod, "max_crashes", config.MaxCrashes)
+	d.emitCanaryEvent(CanaryPhaseSoak)
+
+	timer := time.NewTimer(config.SoakPeriod)
+	defer timer.Stop()
+	poll := time.NewTicker(canaryActionPollInterval)
+	defer poll.Stop()
+
+	// remaining tracks how much of the soak period is left when paused
+	remaining := config.SoakPeriod
+	resumedAt := time.Now()
+	paused := false
+
+	crashes := make(map[string]struct{})
+	jobEvents := d.ReleaseJobEvents(d.NewReleaseID)
+	for {
+		select {
+		case <-d.stop:
+			return worker.ErrStopped
+		case e := <-jobEvents:
+			switch e.Type {
+			case JobEventTypeController:
+				job := e.JobEvent
+				if !job.IsDown() {
+					continue
+				}
+				if _, ok := crashes[job.UUID]; ok {
+					continue
+				}
+				crashes[job.UUID] = struct{}{}
+				log.Warn("canary job crashed", "job.id", job.ID, "job.type", job.Type, "job.state", job.State, "crashes", len(crashes))
+				d.deployEvents <- ct.DeploymentEvent{
+					ReleaseID: d.NewReleaseID,
+					JobType:   job.Type,
+					JobState:  job.State,
+					Phase:     CanaryPhaseSoak,
+				}
+				if len(crashes) > config.MaxCrashes {
+					return fmt.Errorf("deployer: %d canary job(s) crashed during the soak period (max %d)", len(crashes), config.MaxCrashes)
+				}
+			case JobEventTypeError:
+				return e.Error
+			}
+		case <-timer.C:
+			log.Info("canary soak period complete")
+			return nil
+		case <-poll.C:
+			deployment, err := d.client.GetDeployment(d.ID)
+			if err != nil {
+				log.Error("error getting deployment action", "err", err)
+				continue
+			}
+			switch deployment.Action {
+			case ct.DeploymentActionAbort:
+				log.Info("canary deployment aborted")
+				return ErrCanaryAborted
+			case ct.DeploymentActionPromote:
+				log.Info("canary deployment promoted")
+				return nil
+			case ct.DeploymentActionPause:
+				if paused {
+					continue
+				}
+				paused = true
+				// drain the timer if it fired before it was
+				// stopped so that the soak period doesn't
+				// complete whilst paused
+				if !timer.Stop() {
+					<-timer.C
+				}
+				remaining -= time.Since(resumedAt)
+				log.Info("canary soak period paused", "remaining", remaining)
+				d.emitCanaryEvent(CanaryPhasePaused)
+			default:
+				if !paused {
+					continue
+				}
+				paused = false
+				timer.Reset(remaining)
+				resumedAt = time.Now()
+				log.Info("canary soak period resumed", "remaining", remaining)
+				d.emitCanaryEvent(CanaryPhaseSoak)
+			}
+		}
+	}
+}
+
+func (d *DeployJob) emitCanaryEvent(phase string) {
+	d.deployEvents <- ct.DeploymentEvent{
+		ReleaseID: d.NewReleaseID,
+		Phase:     phase,
+	}
+}
@@ -0,0 +1,223 @@
+package deployment
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/flynn/controller/client"
+	ct "github.com/flynn/flynn/controller/types"
+	. "github.com/flynn/go-check"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Hook gocheck up to the "go test" runner
+func Test(t *testing.T) { TestingT(t) }
+
+type CanarySuite struct{}
+
+var _ = Suite(&CanarySuite{})
+
+func (CanarySuite) SetUpSuite(c *C) {
+	canaryActionPollInterval = 10 * time.Millisecond
+}
+
+// fakeClient is a controller client which returns a fixed app and the
+// deployment action which was last set
+type fakeClient struct {
+	controller.Client
+
+	app *ct.App
+
+	mtx    sync.Mutex
+	action ct.DeploymentAction
+}
+
+func (f *fakeClient) GetApp(id string) (*ct.App, error) {
+	return f.app, nil
+}
+
+func (f *fakeClient) GetDeployment(id string) (*ct.Deployment, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return &ct.Deployment{ID: id, Action: f.action}, nil
+}
+
+func (f *fakeClient) setAction(action ct.DeploymentAction) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.action = action
+}
+
+// newTestDeployJob returns a canary deploy job whose canary job is already
+// running, so that it goes straight to the soak period
+func newTestDeployJob(meta map[string]string) (*DeployJob, *fakeClient, chan ct.DeploymentEvent) {
+	client := &fakeClient{app: &ct.App{ID: "app", Meta: meta}}
+	events := make(chan ct.DeploymentEvent, 100)
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+	d := &DeployJob{
+		Deployment: &ct.Deployment{
+			ID:           "deployment",
+			AppID:        "app",
+			NewReleaseID: "new-release",
+			Strategy:     "canary",
+			Processes:    map[string]int{"web": 2},
+		},
+		client:          client,
+		deployEvents:    events,
+		jobEvents:       make(map[string]chan *JobEvent),
+		logger:          logger,
+		newRelease:      &ct.Release{ID: "new-release", Processes: map[string]ct.ProcessType{"web": {}}},
+		newReleaseState: map[string]int{"web": 1},
+		stop:            make(chan struct{}),
+	}
+	return d, client, events
+}
+
+// sendCrash sends a controller event for the given job having crashed
+func sendCrash(d *DeployJob, jobID string) {
+	d.ReleaseJobEvents(d.NewReleaseID) <- &JobEvent{
+		Type:     JobEventTypeController,
+		JobEvent: &ct.Job{UUID: jobID, Type: "web", State: ct.JobStateCrashed},
+	}
+}
+
+// phases returns the phases of the deployment events which have been sent
+func phases(events chan ct.DeploymentEvent) []string {
+	var phases []string
+	for {
+		select {
+		case e := <-events:
+			if e.JobType == "" {
+				phases = append(phases, e.Phase)
+			}
+		default:
+			return phases
+		}
+	}
+}
+
+// soak runs soakCanary in a goroutine, returning a channel which receives
+// its result
+func soak(d *DeployJob, config *canaryConfig) chan error {
+	done := make(chan error, 1)
+	go func() { done <- d.soakCanary(config, d.logger) }()
+	return done
+}
+
+func waitForSoak(c *C, done chan error) error {
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for soak period to end")
+	}
+	return nil
+}
+
+func (CanarySuite) TestConfigFromMeta(c *C) {
+	config, err := canaryConfigFromMeta(nil)
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &canaryConfig{Count: 1, SoakPeriod: 5 * time.Minute})
+
+	config, err = canaryConfigFromMeta(map[string]string{
+		"canary.count":       "2",
+		"canary.soak_period": "30s",
+		"canary.max_crashes": "3",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(config, DeepEquals, &canaryConfig{Count: 2, SoakPeriod: 30 * time.Second, MaxCrashes: 3})
+
+	for _, meta := range []map[string]string{
+		{"canary.count": "0"},
+		{"canary.soak_period": "-1s"},
+		{"canary.max_crashes": "x"},
+	} {
+		_, err := canaryConfigFromMeta(meta)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (CanarySuite) TestSoakComplete(c *C) {
+	d, _, events := newTestDeployJob(nil)
+	err := waitForSoak(c, soak(d, &canaryConfig{SoakPeriod: 50 * time.Millisecond}))
+	c.Assert(err, IsNil)
+	c.Assert(phases(events), DeepEquals, []string{CanaryPhaseSoak})
+}
+
+func (CanarySuite) TestSoakCrashThreshold(c *C) {
+	d, _, events := newTestDeployJob(nil)
+
+	// repeated events for the same job are only counted once, so the
+	// soak period only fails once a second job crashes
+	sendCrash(d, "job1")
+	sendCrash(d, "job1")
+	done := soak(d, &canaryConfig{SoakPeriod: time.Minute, MaxCrashes: 1})
+	select {
+	case err := <-done:
+		c.Fatalf("unexpected end of soak period: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	sendCrash(d, "job2")
+	err := waitForSoak(c, done)
+	c.Assert(err, NotNil)
+	c.Assert(strings.Contains(err.Error(), "2 canary job(s) crashed"), Equals, true)
+
+	var crashes int
+	for {
+		select {
+		case e := <-events:
+			if e.JobType != "" {
+				c.Assert(e.JobState, Equals, ct.JobStateCrashed)
+				crashes++
+			}
+			continue
+		default:
+		}
+		break
+	}
+	c.Assert(crashes, Equals, 2)
+}
+
+func (CanarySuite) TestRollback(c *C) {
+	d, _, events := newTestDeployJob(map[string]string{"canary.soak_period": "1m"})
+	sendCrash(d, "job1")
+	err := d.deployCanary()
+	c.Assert(err, NotNil)
+	c.Assert(phases(events), DeepEquals, []string{CanaryPhaseStart, CanaryPhaseSoak, CanaryPhaseRollback})
+}
+
+func (CanarySuite) TestAbort(c *C) {
+	d, client, events := newTestDeployJob(map[string]string{"canary.soak_period": "1m"})
+	client.setAction(ct.DeploymentActionAbort)
+	c.Assert(d.deployCanary(), Equals, ErrCanaryAborted)
+	c.Assert(phases(events), DeepEquals, []string{CanaryPhaseStart, CanaryPhaseSoak, CanaryPhaseRollback})
+}
+
+func (CanarySuite) TestPromote(c *C) {
+	d, client, _ := newTestDeployJob(nil)
+	client.setAction(ct.DeploymentActionPromote)
+	err := waitForSoak(c, soak(d, &canaryConfig{SoakPeriod: time.Minute}))
+	c.Assert(err, IsNil)
+}
+
+func (CanarySuite) TestPauseResume(c *C) {
+	d, client, events := newTestDeployJob(nil)
+	client.setAction(ct.DeploymentActionPause)
+	done := soak(d, &canaryConfig{SoakPeriod: 100 * time.Millisecond})
+
+	// the soak period doesn't complete whilst paused
+	select {
+	case err := <-done:
+		c.Fatalf("unexpected end of soak period: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	c.Assert(phases(events), DeepEquals, []string{CanaryPhaseSoak, CanaryPhasePaused})
+
+	// but completes once resumed
+	client.setAction(ct.DeploymentActionResume)
+	c.Assert(waitForSoak(c, done), IsNil)
+	c.Assert(phases(events), DeepEquals, []string{CanaryPhaseSoak})
+}
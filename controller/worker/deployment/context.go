@@ -58,7 +58,7 @@ func (c *context) HandleDeployment(job *que.Job) (e error) {
 	go func() {
 		log.Info("watching deployment events")
 		for ev := range events {
-			log.Info("received deployment event", "status", ev.Status, "type", ev.JobType, "state", ev.JobState)
+			log.Info("received deployment event", "status", ev.Status, "phase", ev.Phase, "type", ev.JobType, "state", ev.JobState)
 			ev.AppID = deployment.AppID
 			ev.DeploymentID = deployment.ID
 			if err := c.createDeploymentEvent(ev); err != nil {
@@ -99,6 +99,7 @@ func (c *context) HandleDeployment(job *que.Job) (e error) {
 	j := &DeployJob{
 		Deployment:      deployment,
 		client:          c.client,
+		que:             que.NewClient(c.db.ConnPool),
 		deployEvents:    events,
 		serviceNames:    make(map[string]string),
 		jobEvents:       make(map[string]chan *JobEvent),
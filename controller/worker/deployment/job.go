@@ -11,6 +11,7 @@ import (
 	"github.com/flynn/flynn/controller/worker/types"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/cluster"
+	"github.com/flynn/que-go"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -37,9 +38,16 @@ type JobEvent struct {
 	Error          error
 }
 
+// enqueuer is implemented by *que.Client and used to schedule jobs which
+// follow up on a deployment
+type enqueuer interface {
+	Enqueue(*que.Job) error
+}
+
 type DeployJob struct {
 	*ct.Deployment
 	client       controller.Client
+	que          enqueuer
 	deployEvents chan<- ct.DeploymentEvent
 
 	// jobEvents is a map of release IDs to channels which receive job
@@ -115,6 +123,10 @@ func (d *DeployJob) Perform() error {
 		deployFunc = d.deploySirenia
 	case "discoverd-meta":
 		deployFunc = d.deployDiscoverdMeta
+	case "canary":
+		deployFunc = d.deployCanary
+	case "blue-green":
+		deployFunc = d.deployBlueGreen
 	default:
 		err := UnknownStrategyError{d.Strategy}
 		log.Error("error validating deployment strategy", "err", err)
@@ -278,6 +290,14 @@ func (d *DeployJob) Perform() error {
 		"old_release", d.oldReleaseState,
 		"new_release", d.newReleaseState,
 	)
+
+	// other strategies scale down the release which a previous
+	// blue-green deployment restricted the app's routes to
+	if d.Strategy != "blue-green" {
+		if err := d.clearRoutesRelease(log); err != nil {
+			return err
+		}
+	}
 	return deployFunc()
 }
 
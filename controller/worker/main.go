@@ -9,6 +9,7 @@ import (
 	"github.com/flynn/flynn/controller/schema"
 	"github.com/flynn/flynn/controller/worker/app_deletion"
 	"github.com/flynn/flynn/controller/worker/app_garbage_collection"
+	"github.com/flynn/flynn/controller/worker/blue_green_cleanup"
 	"github.com/flynn/flynn/controller/worker/deployment"
 	"github.com/flynn/flynn/controller/worker/domain_migration"
 	"github.com/flynn/flynn/controller/worker/release_cleanup"
@@ -64,6 +65,7 @@ func main() {
 			"domain_migration":       domain_migration.JobHandler(db, client, logger),
 			"release_cleanup":        release_cleanup.JobHandler(db, client, logger),
 			"app_garbage_collection": app_garbage_collection.JobHandler(db, client, logger),
+			"blue_green_cleanup":     blue_green_cleanup.JobHandler(db, client, logger),
 		},
 		workerCount,
 	)
@@ -3,3 +3,11 @@ package worker
 import "errors"
 
 var ErrStopped = errors.New("worker stopped")
+
+// BlueGreenCleanup is the argument of a blue_green_cleanup job, which scales
+// down the old release of a blue/green deployment once its warm period has
+// passed
+type BlueGreenCleanup struct {
+	AppID     string `json:"app_id"`
+	ReleaseID string `json:"release_id"`
+}
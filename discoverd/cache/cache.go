@@ -109,6 +109,31 @@ func (d *ServiceCache) Addrs() []string {
 	return res
 }
 
+// AddrsWithMeta returns the addresses of instances which have the given meta
+// key set to the given value
+func (d *ServiceCache) AddrsWithMeta(key, value string) []string {
+	d.RLock()
+	defer d.RUnlock()
+	res := make([]string, 0, len(d.instances))
+	for _, inst := range d.instances {
+		if inst.Meta[key] == value {
+			res = append(res, inst.Addr)
+		}
+	}
+	return res
+}
+
+// Instances returns the current instances of the service
+func (d *ServiceCache) Instances() []*discoverd.Instance {
+	d.RLock()
+	defer d.RUnlock()
+	res := make([]*discoverd.Instance, 0, len(d.instances))
+	for _, inst := range d.instances {
+		res = append(res, inst)
+	}
+	return res
+}
+
 func (d *ServiceCache) LeaderAddr() []string {
 	d.RLock()
 	defer d.RUnlock()
@@ -2,8 +2,12 @@ package cli
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/flynn/flynn/bootstrap/discovery"
+	"github.com/flynn/flynn/controller/secretenv"
 	"github.com/flynn/flynn/host/config"
 	"github.com/flynn/go-docopt"
 )
@@ -13,11 +17,13 @@ func init() {
 usage: flynn-host init [options]
 
 options:
-  --init-discovery    create and join a discovery token
-  --discovery=TOKEN   join cluster with discovery token
-  --peer-ips=IPLIST   join cluster using host IPs (must be already bootstrapped)
-  --external-ip=IP    external IP address of host, defaults to the first IPv4 address of eth0
-  --file=NAME         file to write to [default: /etc/flynn/host.json]
+  --init-discovery              create and join a discovery token
+  --discovery=TOKEN             join cluster with discovery token
+  --peer-ips=IPLIST             join cluster using host IPs (must be already bootstrapped)
+  --external-ip=IP              external IP address of host, defaults to the first IPv4 address of eth0
+  --file=NAME                   file to write to [default: /etc/flynn/host.json]
+  --secret-env-key=KEY          base64 encoded 32 byte key used by the controller to encrypt secret env vars (must be the same on every host)
+  --secret-env-key-file=NAME    file to write the secret env key to [default: /etc/flynn/secrets/secret-env.key]
   `)
 }
 
@@ -43,5 +49,24 @@ func runInit(args *docopt.Args) error {
 		c.Args = append(c.Args, "--peer-ips", ips)
 	}
 
+	if key := args.String["--secret-env-key"]; key != "" {
+		if err := writeSecretEnvKey(args.String["--secret-env-key-file"], key); err != nil {
+			return err
+		}
+	}
+
 	return c.WriteTo(args.String["--file"])
 }
+
+// writeSecretEnvKey writes the secret env key to the given file, which is
+// bind-mounted into the controller so that the key is not stored in the
+// controller's database
+func writeSecretEnvKey(path, key string) error {
+	if _, err := secretenv.NewKeys(key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(key+"\n"), 0600)
+}
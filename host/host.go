@@ -20,12 +20,14 @@ import (
 	"github.com/flynn/flynn/host/cli"
 	"github.com/flynn/flynn/host/config"
 	"github.com/flynn/flynn/host/logmux"
+	"github.com/flynn/flynn/host/resource"
 	"github.com/flynn/flynn/host/types"
 	"github.com/flynn/flynn/host/volume"
 	"github.com/flynn/flynn/host/volume/api"
 	"github.com/flynn/flynn/host/volume/manager"
 	zfsVolume "github.com/flynn/flynn/host/volume/zfs"
 	"github.com/flynn/flynn/pkg/shutdown"
+	"github.com/flynn/flynn/pkg/typeconv"
 	"github.com/flynn/flynn/pkg/version"
 	"github.com/flynn/go-docopt"
 	"github.com/opencontainers/runc/libcontainer"
@@ -363,6 +365,7 @@ func runDaemon(args *docopt.Args) {
 	if len(os.Args) > 2 {
 		host.status.Flags = os.Args[2:]
 	}
+	host.status.Resources = hostResources(volPath, log)
 
 	log.Info("creating HTTP listener")
 	l, err := newHTTPListener(net.JoinHostPort(listenIP, httpPort))
@@ -539,6 +542,33 @@ func runDaemon(args *docopt.Args) {
 	<-make(chan struct{})
 }
 
+// hostResources returns the total memory, CPU and temporary disk available on
+// the host, which the scheduler uses to avoid placing more jobs on the host
+// than it can fit.
+//
+// Temporary disks are created as volumes, so the temp_disk capacity is the
+// size of the filesystem containing the volume path.
+func hostResources(volPath string, log log15.Logger) resource.Resources {
+	r := make(resource.Resources, 3)
+	r[resource.TypeCPU] = resource.Spec{Limit: typeconv.Int64Ptr(int64(runtime.NumCPU()) * 1000)}
+
+	var info syscall.Sysinfo_t
+	if err := syscall.Sysinfo(&info); err == nil {
+		r[resource.TypeMemory] = resource.Spec{Limit: typeconv.Int64Ptr(int64(info.Totalram) * int64(info.Unit))}
+	} else {
+		log.Error("error determining host memory", "err", err)
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(volPath, &fs); err == nil {
+		r[resource.TypeTempDisk] = resource.Spec{Limit: typeconv.Int64Ptr(int64(fs.Blocks) * fs.Bsize)}
+	} else {
+		log.Error("error determining host disk size", "path", volPath, "err", err)
+	}
+
+	return r
+}
+
 func parseTagArgs(args string) map[string]string {
 	tags := make(map[string]string)
 	for _, s := range strings.Split(args, ",") {
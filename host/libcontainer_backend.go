@@ -289,6 +289,12 @@ func (l *LibcontainerBackend) ConfigureNetworking(config *host.NetworkConfig) er
 	}
 	l.resolvConf = "/etc/flynn/resolv.conf"
 
+	// Create the directory for cluster secrets which are bind-mounted into
+	// system jobs (e.g. the controller's secret env key)
+	if err := os.MkdirAll("/etc/flynn/secrets", 0700); err != nil {
+		return err
+	}
+
 	// Allocate IPs for running jobs
 	l.containersMtx.Lock()
 	defer l.containersMtx.Unlock()
@@ -49,7 +49,7 @@ const (
 )
 
 var defaults = Resources{
-	TypeMemory:   {Request: typeconv.Int64Ptr(1 * units.GiB), Limit: typeconv.Int64Ptr(1 * units.GiB)},
+	TypeMemory:   {Limit: typeconv.Int64Ptr(1 * units.GiB)},
 	TypeCPU:      {Limit: typeconv.Int64Ptr(1000)}, // results in Linux default of 1024 shares
 	TypeTempDisk: {Request: typeconv.Int64Ptr(DefaultTempDiskSize), Limit: typeconv.Int64Ptr(DefaultTempDiskSize)},
 	TypeMaxFD:    {Request: typeconv.Int64Ptr(10000), Limit: typeconv.Int64Ptr(10000)},
@@ -67,6 +67,13 @@ func Defaults() Resources {
 	return r
 }
 
+// SetDefaults sets the default limit of any resources without a limit, and
+// the request of any resources without a request to their limit, other than
+// memory and CPU.
+//
+// Memory and CPU requests are only set explicitly, as the scheduler reserves
+// the requested amount on the host a job is placed on, and defaulting them to
+// the limit would reserve far more than most jobs use.
 func SetDefaults(r *Resources) {
 	if *r == nil {
 		*r = make(Resources, len(defaults))
@@ -76,7 +83,7 @@ func SetDefaults(r *Resources) {
 		if spec.Limit == nil {
 			spec.Limit = typeconv.Int64Ptr(*s.Limit)
 		}
-		if spec.Request == nil {
+		if spec.Request == nil && typ != TypeMemory && typ != TypeCPU {
 			spec.Request = spec.Limit
 		}
 		(*r)[typ] = spec
@@ -43,12 +43,27 @@ func (S) TestSetDefaultsEmpty(c *C) {
 
 func (S) TestSetDefaultsRequest(c *C) {
 	// not specifying Request should default it to the value of Limit
-	r := Resources{TypeMemory: Spec{Limit: typeconv.Int64Ptr(512 * units.MiB)}}
+	r := Resources{TypeMaxFD: Spec{Limit: typeconv.Int64Ptr(20000)}}
 	SetDefaults(&r)
-	assertDefault(c, r, TypeMaxFD)
-	mem, ok := r[TypeMemory]
+	assertDefault(c, r, TypeMemory)
+	fd, ok := r[TypeMaxFD]
 	if !ok {
-		c.Fatal("memory resource not set")
+		c.Fatal("max_fd resource not set")
 	}
-	c.Assert(*mem.Request, Equals, *mem.Limit)
+	c.Assert(*fd.Request, Equals, *fd.Limit)
+}
+
+func (S) TestSetDefaultsMemoryCPURequest(c *C) {
+	// memory and CPU requests should only be set explicitly
+	r := Resources{
+		TypeMemory: Spec{Limit: typeconv.Int64Ptr(512 * units.MiB)},
+		TypeCPU:    Spec{Request: typeconv.Int64Ptr(250), Limit: typeconv.Int64Ptr(500)},
+	}
+	SetDefaults(&r)
+	c.Assert(r[TypeMemory].Request, IsNil)
+	c.Assert(*r[TypeMemory].Limit, Equals, int64(512*units.MiB))
+	c.Assert(*r[TypeCPU].Request, Equals, int64(250))
+	r = Defaults()
+	c.Assert(r[TypeMemory].Request, IsNil)
+	c.Assert(r[TypeCPU].Request, IsNil)
 }
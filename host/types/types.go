@@ -313,6 +313,11 @@ type HostStatus struct {
 	Network   *NetworkConfig    `json:"network,omitempty"`
 	Version   string            `json:"version"`
 	Flags     []string          `json:"flags"`
+
+	// Resources is the total amount of each resource the host has
+	// available for running jobs, with the Limit of each Spec set to the
+	// host's capacity
+	Resources resource.Resources `json:"resources,omitempty"`
 }
 
 type JobEventType string
@@ -207,6 +207,22 @@ func (s *LogAggregatorTestSuite) TestNewMessageFromSyslog(c *C) {
 	c.Assert(m.Timestamp, Equals, timestamp)
 }
 
+func (s *LogAggregatorTestSuite) TestNewMessageFromSyslogRouter(c *C) {
+	m := NewMessageFromSyslog(rfc5424.NewMessage(
+		&rfc5424.Header{
+			Hostname: []byte("router-abcd1234"),
+			ProcID:   []byte("router.flynn-abcd1234"),
+			MsgID:    []byte("ID4"),
+		},
+		[]byte("method=GET status=200"),
+	))
+
+	c.Assert(m.JobID, Equals, "flynn-abcd1234")
+	c.Assert(m.ProcessType, Equals, "router")
+	c.Assert(m.Source, Equals, "router")
+	c.Assert(m.Stream, Equals, logagg.StreamTypeRouter)
+}
+
 func (s *LogAggregatorTestSuite) TestMessageMarshalJSON(c *C) {
 	timestamp, err := time.Parse(time.RFC3339Nano, "2009-11-10T23:00:00.123450789Z")
 	c.Assert(err, IsNil)
@@ -48,6 +48,7 @@ const (
 	StreamTypeStdout  StreamType = "stdout"
 	StreamTypeStderr  StreamType = "stderr"
 	StreamTypeInit    StreamType = "init"
+	StreamTypeRouter  StreamType = "router"
 	StreamTypeUnknown StreamType = "unknown"
 )
 
@@ -57,4 +58,5 @@ const (
 	MsgIDStdout MsgID = "ID1"
 	MsgIDStderr MsgID = "ID2"
 	MsgIDInit   MsgID = "ID3"
+	MsgIDRouter MsgID = "ID4"
 )
@@ -63,6 +63,8 @@ func StreamType(msg *rfc5424.Message) logagg.StreamType {
 		return logagg.StreamTypeStderr
 	case logagg.MsgIDInit:
 		return logagg.StreamTypeInit
+	case logagg.MsgIDRouter:
+		return logagg.StreamTypeRouter
 	default:
 		return logagg.StreamTypeUnknown
 	}
@@ -32,6 +32,7 @@ const (
 	ValidationErrorCode         ErrorCode = "validation_error"
 	PreconditionFailedErrorCode ErrorCode = "precondition_failed"
 	UnauthorizedErrorCode       ErrorCode = "unauthorized"
+	ForbiddenErrorCode          ErrorCode = "forbidden"
 	UnknownErrorCode            ErrorCode = "unknown_error"
 	RatelimitedErrorCode        ErrorCode = "ratelimited"
 	ServiceUnavailableErrorCode ErrorCode = "service_unavailable"
@@ -46,6 +47,7 @@ var errorResponseCodes = map[ErrorCode]int{
 	SyntaxErrorCode:             400,
 	ValidationErrorCode:         400,
 	UnauthorizedErrorCode:       401,
+	ForbiddenErrorCode:          403,
 	UnknownErrorCode:            500,
 	RatelimitedErrorCode:        429,
 	ServiceUnavailableErrorCode: 503,
@@ -227,6 +229,10 @@ func PreconditionFailedErr(message string) error {
 	return JSONError{Code: PreconditionFailedErrorCode, Message: message}
 }
 
+func ForbiddenError(w http.ResponseWriter, message string) {
+	Error(w, JSONError{Code: ForbiddenErrorCode, Message: message})
+}
+
 func ServiceUnavailableError(w http.ResponseWriter, message string) {
 	Error(w, JSONError{Code: ServiceUnavailableErrorCode, Message: message, Retry: true})
 }
@@ -36,15 +36,20 @@ func newRequestLogger(handler http.Handler, loggerFn RequestLoggerFn) http.Handl
 		logger := log.New(log.Ctx{"component": componentName, "req_id": reqID})
 		rw.ctx = ctxhelper.NewContextLogger(rw.Context(), logger)
 
-		var clientIP string
-		clientIPs := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
-		if len(clientIPs) > 0 {
-			clientIP = strings.TrimSpace(clientIPs[len(clientIPs)-1])
-		}
-		if clientIP == "" {
-			clientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
-		}
-
-		loggerFn(handler, logger, clientIP, rw, req)
+		loggerFn(handler, logger, ClientIP(req), rw, req)
 	})
 }
+
+// ClientIP returns the IP address of the client which made the request, which
+// is the last address in the X-Forwarded-For header if it was proxied
+func ClientIP(req *http.Request) string {
+	var clientIP string
+	clientIPs := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+	if len(clientIPs) > 0 {
+		clientIP = strings.TrimSpace(clientIPs[len(clientIPs)-1])
+	}
+	if clientIP == "" {
+		clientIP, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	return clientIP
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	defaultBasicAuthRealm = "Restricted"
+
+	// basicAuthCacheSize is the maximum number of verified credentials
+	// cached by a route, with the cache being cleared when it is full
+	basicAuthCacheSize = 1000
+)
+
+// routeAccessControl enforces the IP allow and deny lists and the basic auth
+// of a route.
+//
+// Verifying a bcrypt hash is deliberately slow, so credentials which have
+// been verified are cached (keyed by a SHA-256 hash rather than in plain
+// text) to avoid verifying them on every request.
+//
+// A nil *routeAccessControl allows everything.
+type routeAccessControl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	realm string
+	users map[string][]byte
+
+	// dummyHash is compared with the passwords of unknown users so that
+	// they take as long to reject as known users with the wrong password,
+	// which would otherwise reveal which users exist
+	dummyHash []byte
+
+	mtx      sync.Mutex
+	verified map[[sha256.Size]byte]struct{}
+}
+
+// newRouteAccessControl returns the access control of the given route, or nil
+// if the route does not restrict access
+func newRouteAccessControl(r *router.HTTPRoute) (*routeAccessControl, error) {
+	if len(r.AllowIPs) == 0 && len(r.DenyIPs) == 0 && r.BasicAuth == nil {
+		return nil, nil
+	}
+	a := &routeAccessControl{}
+	var err error
+	if a.allow, err = parseIPNets(r.AllowIPs); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseIPNets(r.DenyIPs); err != nil {
+		return nil, err
+	}
+	if r.BasicAuth != nil {
+		a.realm = r.BasicAuth.Realm
+		if a.realm == "" {
+			a.realm = defaultBasicAuthRealm
+		}
+		a.users = make(map[string][]byte, len(r.BasicAuth.Users))
+		cost := bcrypt.DefaultCost
+		for user, hash := range r.BasicAuth.Users {
+			a.users[user] = []byte(hash)
+			if c, err := bcrypt.Cost([]byte(hash)); err == nil {
+				cost = c
+			}
+		}
+		if a.dummyHash, err = dummyHash(cost); err != nil {
+			return nil, err
+		}
+		a.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	return a, nil
+}
+
+var dummyHashes = struct {
+	sync.Mutex
+	m map[int][]byte
+}{m: make(map[int][]byte)}
+
+// dummyHash returns a bcrypt hash of a random password with the given cost,
+// generating hashes once per cost as generating them is slow
+func dummyHash(cost int) ([]byte, error) {
+	dummyHashes.Lock()
+	defer dummyHashes.Unlock()
+	if hash, ok := dummyHashes.m[cost]; ok {
+		return hash, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(random.String(32)), cost)
+	if err != nil {
+		return nil, err
+	}
+	dummyHashes.m[cost] = hash
+	return hash, nil
+}
+
+// parseIPNets parses a list of IP addresses and CIDR ranges, treating IP
+// addresses as ranges containing just that address
+func parseIPNets(ips []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(ips))
+	for _, s := range ips {
+		if strings.Contains(s, "/") {
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR range %q", s)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %q", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// Check checks that the request is allowed, responding with an error and
+// returning its status code if it is not, or returning zero if it is. The
+// Authorization header of allowed requests is removed so that basic auth
+// credentials are not sent to backends.
+func (a *routeAccessControl) Check(w http.ResponseWriter, req *http.Request) int {
+	if a == nil {
+		return 0
+	}
+	if !a.allowIP(req.RemoteAddr) {
+		fail(w, http.StatusForbidden)
+		return http.StatusForbidden
+	}
+	if a.users == nil {
+		return 0
+	}
+	user, password, ok := req.BasicAuth()
+	if !ok || !a.verify(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+		fail(w, http.StatusUnauthorized)
+		return http.StatusUnauthorized
+	}
+	req.Header.Del("Authorization")
+	return 0
+}
+
+func (a *routeAccessControl) allowIP(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *routeAccessControl) verify(user, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.dummyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + password))
+	a.mtx.Lock()
+	_, verified := a.verified[key]
+	a.mtx.Unlock()
+	if verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mtx.Lock()
+	if len(a.verified) >= basicAuthCacheSize {
+		a.verified = make(map[[sha256.Size]byte]struct{})
+	}
+	a.verified[key] = struct{}{}
+	a.mtx.Unlock()
+	return true
+}
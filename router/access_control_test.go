@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func (s *S) TestRouteAccessControlIPs(c *C) {
+	a, err := newRouteAccessControl(&router.HTTPRoute{
+		AllowIPs: []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"},
+		DenyIPs:  []string{"10.0.0.5"},
+	})
+	c.Assert(err, IsNil)
+
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3:1234":       true,
+		"10.0.0.5:1234":       false,
+		"192.168.1.1:1234":    true,
+		"192.168.1.2:1234":    false,
+		"[2001:db8::1]:1234":  true,
+		"[2001:db9::1]:1234":  false,
+		"not-an-ip-address:1": false,
+	} {
+		c.Assert(a.allowIP(addr), Equals, allowed, Commentf("addr = %s", addr))
+	}
+
+	// a nil access control allows everything
+	a, err = newRouteAccessControl(&router.HTTPRoute{})
+	c.Assert(err, IsNil)
+	c.Assert(a, IsNil)
+	c.Assert(a.Check(httptest.NewRecorder(), &http.Request{RemoteAddr: "10.0.0.5:1234"}), Equals, 0)
+}
+
+func (s *S) TestRouteAccessControlBasicAuth(c *C) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	a, err := newRouteAccessControl(&router.HTTPRoute{
+		BasicAuth: &router.BasicAuth{Users: map[string]string{"user": string(hash)}},
+	})
+	c.Assert(err, IsNil)
+
+	for _, t := range []struct {
+		user, password string
+		status         int
+	}{
+		{"user", "secret", 0},
+		{"user", "secret", 0}, // cached
+		{"user", "wrong", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.SetBasicAuth(t.user, t.password)
+		rec := httptest.NewRecorder()
+		c.Assert(a.Check(rec, req), Equals, t.status)
+		if t.status == 0 {
+			c.Assert(req.Header.Get("Authorization"), Equals, "")
+		} else {
+			c.Assert(rec.Code, Equals, t.status)
+			c.Assert(rec.Header().Get("WWW-Authenticate"), Equals, `Basic realm="Restricted"`)
+		}
+	}
+	c.Assert(a.verified, HasLen, 1)
+
+	// unknown users are compared with a dummy hash of the same cost
+	cost, err := bcrypt.Cost(a.dummyHash)
+	c.Assert(err, IsNil)
+	c.Assert(cost, Equals, bcrypt.MinCost)
+}
+
+func (s *S) TestHTTPRouteAccessControl(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	addRoute(c, l, router.HTTPRoute{
+		Domain:    "example.com",
+		Service:   "test",
+		BasicAuth: &router.BasicAuth{Realm: "staging", Users: map[string]string{"user": string(hash)}},
+	}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "denied.example.com",
+		Service: "test",
+		DenyIPs: []string{"127.0.0.0/8"},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(res.Header.Get("WWW-Authenticate"), Equals, `Basic realm="staging"`)
+
+	// credentials are not sent to the backend
+	req := newReq("http://"+l.Addr, "example.com")
+	req.SetBasicAuth("user", "secret")
+	res, err = httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.ContentLength, Equals, int64(0))
+
+	res, err = httpClient.Do(newReq("http://"+l.Addr, "denied.example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *S) TestAccessControlValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, r := range []router.HTTPRoute{
+		{Domain: "example.com", Service: "test", AllowIPs: []string{"10.0.0.0/33"}},
+		{Domain: "example.com", Service: "test", DenyIPs: []string{"example.com"}},
+		{Domain: "example.com", Service: "test", BasicAuth: &router.BasicAuth{}},
+		{Domain: "example.com", Service: "test", BasicAuth: &router.BasicAuth{Users: map[string]string{"user": "secret"}}},
+	} {
+		err := l.AddRoute(r.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ct "github.com/flynn/flynn/controller/types"
+	logagg "github.com/flynn/flynn/logaggregator/types"
+	"github.com/flynn/flynn/pkg/syslog/rfc5424"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	// accessLogBufferSize is the number of access log messages which are
+	// buffered while being sent to the log aggregators, with further
+	// messages being dropped so that logging never delays requests
+	accessLogBufferSize = 1000
+
+	accessLogDialTimeout  = time.Second
+	accessLogWriteTimeout = 5 * time.Second
+
+	// accessLogRetryInterval is how long to wait before reconnecting to a
+	// log aggregator after failing to connect to it
+	accessLogRetryInterval = 10 * time.Second
+)
+
+var errAccessLogRetry = errors.New("router: waiting to reconnect to log aggregator")
+
+// accessLogger sends a line for each request proxied by routes with access
+// logs enabled to the log aggregators as RFC5424 messages belonging to the
+// app which owns the route, so that they appear in the app's log alongside
+// the output of its jobs.
+//
+// Messages use the router's job ID as their hostname rather than the host ID
+// since the log aggregator tracks a cursor per hostname which is used to
+// resume streaming a host's logs, and the router's messages are sequenced
+// independently of the host's.
+type accessLogger struct {
+	hostname string
+	procID   string
+
+	// addrs returns the syslog addresses of the log aggregators, all of
+	// which are sent every message
+	addrs func() []string
+
+	msgs     chan *rfc5424.Message
+	seq      uint64
+	conns    map[string]net.Conn
+	failures map[string]time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newAccessLogger(jobID string, addrs func() []string) *accessLogger {
+	return &accessLogger{
+		hostname: jobID,
+		procID:   "router." + jobID,
+		addrs:    addrs,
+		msgs:     make(chan *rfc5424.Message, accessLogBufferSize),
+		conns:    make(map[string]net.Conn),
+		failures: make(map[string]time.Time),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start starts sending messages in a goroutine (Start and Stop are safe to
+// call on a nil accessLogger so that routers without access logs configured
+// can call them unconditionally)
+func (l *accessLogger) Start() {
+	if l == nil {
+		return
+	}
+	go l.run()
+}
+
+func (l *accessLogger) Stop() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// Route returns the routeAccessLog used to log the requests of the given
+// route, or nil if access logs are not enabled for the route or the route
+// does not belong to an app
+func (l *accessLogger) Route(r *router.Route) *routeAccessLog {
+	if l == nil || r.AccessLog == nil || !strings.HasPrefix(r.ParentRef, ct.RouteParentRefPrefix) {
+		return nil
+	}
+	sampleRate := r.AccessLog.SampleRate
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+	return &routeAccessLog{
+		l:          l,
+		appID:      strings.TrimPrefix(r.ParentRef, ct.RouteParentRefPrefix),
+		sampleRate: sampleRate,
+	}
+}
+
+// Log queues the given line to be sent to the log of the given app, dropping
+// it if the buffer is full
+func (l *accessLogger) Log(appID string, line []byte) {
+	msg := rfc5424.NewMessage(&rfc5424.Header{
+		Hostname: []byte(l.hostname),
+		AppName:  []byte(appID),
+		ProcID:   []byte(l.procID),
+		MsgID:    []byte(logagg.MsgIDRouter),
+	}, line)
+	select {
+	case l.msgs <- msg:
+	default:
+	}
+}
+
+func (l *accessLogger) run() {
+	sd := &rfc5424.StructuredData{
+		ID:     []byte("flynn"),
+		Params: []rfc5424.StructuredDataParam{{Name: []byte("seq")}},
+	}
+	for {
+		select {
+		case <-l.stop:
+			for addr, conn := range l.conns {
+				conn.Close()
+				delete(l.conns, addr)
+			}
+			return
+		case msg := <-l.msgs:
+			l.seq++
+			sd.Params[0].Value = strconv.AppendUint(nil, l.seq, 10)
+			var buf bytes.Buffer
+			sd.Encode(&buf)
+			msg.StructuredData = buf.Bytes()
+			l.send(rfc6587.Bytes(msg))
+		}
+	}
+}
+
+// send writes the given framed message to all the log aggregators, closing
+// connections to aggregators which are no longer registered
+func (l *accessLogger) send(data []byte) {
+	addrs := l.addrs()
+	current := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		current[addr] = struct{}{}
+		conn, err := l.conn(addr)
+		if err != nil {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(accessLogWriteTimeout))
+		if _, err := conn.Write(data); err != nil {
+			logger.Error("error sending access log", "fn", "accessLogger.send", "addr", addr, "err", err)
+			conn.Close()
+			delete(l.conns, addr)
+		}
+	}
+	for addr, conn := range l.conns {
+		if _, ok := current[addr]; !ok {
+			conn.Close()
+			delete(l.conns, addr)
+		}
+	}
+}
+
+func (l *accessLogger) conn(addr string) (net.Conn, error) {
+	if conn, ok := l.conns[addr]; ok {
+		return conn, nil
+	}
+	if t, ok := l.failures[addr]; ok && time.Since(t) < accessLogRetryInterval {
+		return nil, errAccessLogRetry
+	}
+	conn, err := net.DialTimeout("tcp", addr, accessLogDialTimeout)
+	if err != nil {
+		logger.Error("error connecting to log aggregator", "fn", "accessLogger.conn", "addr", addr, "err", err)
+		l.failures[addr] = time.Now()
+		return nil, err
+	}
+	delete(l.failures, addr)
+	l.conns[addr] = conn
+	return conn, nil
+}
+
+// routeAccessLog logs a sample of the requests of a route, implementing
+// proxy.Observer.
+//
+// A nil *routeAccessLog logs nothing.
+type routeAccessLog struct {
+	l          *accessLogger
+	appID      string
+	sampleRate float64
+}
+
+func (r *routeAccessLog) ObserveRequest(req *http.Request, backend string, status int, duration time.Duration, bytesIn, bytesOut int64) {
+	if r == nil {
+		return
+	}
+	if r.sampleRate < 1 && rand.Float64() >= r.sampleRate {
+		return
+	}
+	r.l.Log(r.appID, formatAccessLog(req, backend, status, duration, bytesIn, bytesOut))
+}
+
+func (r *routeAccessLog) ObserveConn(backend string, bytesIn, bytesOut int64) {}
+
+func (r *routeAccessLog) ObserveDialError(backend string) {}
+
+// formatAccessLog formats an access log line for the given request as
+// space separated key=value pairs
+func formatAccessLog(req *http.Request, backend string, status int, duration time.Duration, bytesIn, bytesOut int64) []byte {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	var buf bytes.Buffer
+	for i, field := range [][2]string{
+		{"method", req.Method},
+		{"host", req.Host},
+		{"path", req.URL.Path},
+		{"status", strconv.Itoa(status)},
+		{"duration", duration.String()},
+		{"bytes_in", strconv.FormatInt(bytesIn, 10)},
+		{"bytes_out", strconv.FormatInt(bytesOut, 10)},
+		{"client_ip", clientIP},
+		{"backend", backend},
+		{"request_id", req.Header.Get("X-Request-Id")},
+	} {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(field[0])
+		buf.WriteByte('=')
+		buf.WriteString(formatAccessLogValue(field[1]))
+	}
+	return buf.Bytes()
+}
+
+// formatAccessLogValue quotes values which are empty or would otherwise be
+// ambiguous
+func formatAccessLogValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == 0x7f
+	}) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
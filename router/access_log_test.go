@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	logagg "github.com/flynn/flynn/logaggregator/types"
+	"github.com/flynn/flynn/logaggregator/utils"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/syslog/rfc6587"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestFormatAccessLog(c *C) {
+	req, err := http.NewRequest("GET", "http://example.com/foo%20bar?baz=1", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "10.0.0.1:52000"
+	req.Header.Set("X-Request-Id", "abcd")
+
+	line := formatAccessLog(req, "10.0.0.2:8080", 200, 1500*time.Millisecond, 10, 100)
+	c.Assert(string(line), Equals, `method=GET host=example.com path="/foo bar" status=200 duration=1.5s bytes_in=10 bytes_out=100 client_ip=10.0.0.1 backend=10.0.0.2:8080 request_id=abcd`)
+
+	line = formatAccessLog(req, "", 429, 0, 0, 0)
+	c.Assert(strings.Contains(string(line), ` backend="" `), Equals, true)
+}
+
+func (s *S) TestAccessLogValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute(router.HTTPRoute{
+		Domain:    "example.com",
+		Service:   "test",
+		AccessLog: &router.AccessLog{SampleRate: 1.5},
+	}.ToRoute())
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+}
+
+func (s *S) TestHTTPRouteAccessLog(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	// start a fake log aggregator
+	aggregator, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer aggregator.Close()
+
+	l := s.buildHTTPListener(c)
+	l.accessLog = newAccessLogger("router-job", func() []string {
+		return []string{aggregator.Addr().String()}
+	})
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		ParentRef: "controller/apps/app1",
+		Domain:    "example.com",
+		Service:   "test",
+		AccessLog: &router.AccessLog{},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	conn, err := aggregator.Accept()
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	scanner.Split(rfc6587.Split)
+	c.Assert(scanner.Scan(), Equals, true)
+
+	msg, cursor, err := utils.ParseMessage(scanner.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(cursor.Seq, Equals, uint64(1))
+	c.Assert(string(msg.Hostname), Equals, "router-job")
+	c.Assert(string(msg.AppName), Equals, "app1")
+	c.Assert(string(msg.ProcID), Equals, "router.router-job")
+	c.Assert(utils.StreamType(msg), Equals, logagg.StreamTypeRouter)
+	for _, field := range []string{
+		"method=GET",
+		"host=example.com",
+		"path=/",
+		"status=200",
+		"client_ip=127.0.0.1",
+		"backend=" + srv.Listener.Addr().String(),
+	} {
+		c.Assert(strings.Contains(string(msg.Msg), field), Equals, true, Commentf("missing %q in %q", field, msg.Msg))
+	}
+}
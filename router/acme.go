@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultACMEDirectoryURL is the ACME directory used to obtain
+	// certificates if ACME_DIRECTORY_URL is not set
+	defaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	// acmeRenewBefore is how long before a certificate expires that it is
+	// renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+
+	// acmeCheckInterval is how often routes are checked for certificates
+	// which need obtaining or renewing
+	acmeCheckInterval = time.Hour
+
+	// acmeRetryInterval is how long to wait before retrying a domain after
+	// failing to obtain a certificate for it
+	acmeRetryInterval = 10 * time.Minute
+
+	// acmeChallengePath is the path prefix of HTTP-01 challenge requests
+	acmeChallengePath = "/.well-known/acme-challenge/"
+)
+
+// acmeDataStore is the data the acmeManager needs access to, which is
+// implemented by the HTTP route pgDataStore
+type acmeDataStore interface {
+	acmeStore
+	List() ([]*router.Route, error)
+	AddCert(*router.Certificate) error
+}
+
+// acmeManager obtains and renews certificates for routes with AutoTLS enabled
+// using the ACME HTTP-01 challenge.
+//
+// Every router serves challenge responses from the data store, but only the
+// router API leader requests certificates so that multiple orders are not
+// placed for the same domain. Issued certificates are added to the
+// certificates table, which causes all routers to update the route.
+type acmeManager struct {
+	DirectoryURL string
+	Email        string
+	HTTPClient   *http.Client
+
+	ds acmeDataStore
+
+	renewBefore   time.Duration
+	checkInterval time.Duration
+	retryInterval time.Duration
+
+	mtx      sync.Mutex
+	client   *acme.Client
+	leader   bool
+	failures map[string]time.Time
+
+	trigger  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newACMEManager(directoryURL, email string, ds acmeDataStore) *acmeManager {
+	if directoryURL == "" {
+		directoryURL = defaultACMEDirectoryURL
+	}
+	return &acmeManager{
+		DirectoryURL:  directoryURL,
+		Email:         email,
+		ds:            ds,
+		renewBefore:   acmeRenewBefore,
+		checkInterval: acmeCheckInterval,
+		retryInterval: acmeRetryInterval,
+		failures:      make(map[string]time.Time),
+		trigger:       make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start starts checking routes in a goroutine (Start, Stop and Trigger are
+// safe to call on a nil acmeManager so that routers without ACME configured
+// can call them unconditionally)
+func (m *acmeManager) Start() {
+	if m == nil {
+		return
+	}
+	go m.run()
+}
+
+func (m *acmeManager) Stop() {
+	if m == nil {
+		return
+	}
+	m.stopOnce.Do(func() { close(m.stop) })
+}
+
+// Trigger causes routes to be checked straight away rather than waiting for
+// the next check interval, for example when an AutoTLS route is added
+func (m *acmeManager) Trigger() {
+	if m == nil {
+		return
+	}
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// SetLeader sets whether this router is responsible for requesting
+// certificates, triggering a check if it has just become the leader
+func (m *acmeManager) SetLeader(leader bool) {
+	m.mtx.Lock()
+	prev := m.leader
+	m.leader = leader
+	m.mtx.Unlock()
+	if leader && !prev {
+		m.Trigger()
+	}
+}
+
+func (m *acmeManager) isLeader() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.leader
+}
+
+func (m *acmeManager) run() {
+	ticker := time.NewTicker(m.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		case <-m.trigger:
+		}
+		if m.isLeader() {
+			m.checkRoutes()
+		}
+	}
+}
+
+// ServeChallenge responds to HTTP-01 challenge requests for pending
+// challenges, returning false if the request is not for a known challenge so
+// that it can be routed normally
+func (m *acmeManager) ServeChallenge(w http.ResponseWriter, req *http.Request) bool {
+	if m == nil || !strings.HasPrefix(req.URL.Path, acmeChallengePath) {
+		return false
+	}
+	token := strings.TrimPrefix(req.URL.Path, acmeChallengePath)
+	keyAuth, err := m.ds.GetACMEChallenge(token)
+	if err == ErrNotFound {
+		return false
+	} else if err != nil {
+		logger.Error("error getting ACME challenge", "token", token, "err", err)
+		fail(w, 500)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
+
+// checkRoutes obtains certificates for AutoTLS routes which either have no
+// certificate, have a certificate which does not cover their domain or have a
+// certificate which is due to be renewed
+func (m *acmeManager) checkRoutes() {
+	log := logger.New("fn", "acme.checkRoutes")
+	routes, err := m.ds.List()
+	if err != nil {
+		log.Error("error listing routes", "err", err)
+		return
+	}
+	for _, route := range routes {
+		if !route.AutoTLS || route.Path != "/" || !m.needsCert(route) {
+			continue
+		}
+		domain := strings.ToLower(route.Domain)
+		if t, ok := m.failures[domain]; ok && time.Since(t) < m.retryInterval {
+			continue
+		}
+		log := log.New("route", route.FormattedID(), "domain", domain)
+		log.Info("obtaining certificate")
+		if err := m.issue(route); err != nil {
+			log.Error("error obtaining certificate", "err", err)
+			m.failures[domain] = time.Now()
+			continue
+		}
+		delete(m.failures, domain)
+		log.Info("obtained certificate")
+	}
+}
+
+func (m *acmeManager) needsCert(route *router.Route) bool {
+	if route.Certificate == nil || route.Certificate.Cert == "" {
+		return true
+	}
+	block, _ := pem.Decode([]byte(route.Certificate.Cert))
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	if cert.VerifyHostname(route.Domain) != nil {
+		return true
+	}
+	return time.Now().Add(m.renewBefore).After(cert.NotAfter)
+}
+
+// getClient returns an ACME client for the account registered with the
+// directory, registering a new account if one does not exist
+func (m *acmeManager) getClient(ctx context.Context) (*acme.Client, error) {
+	if m.client != nil {
+		return m.client, nil
+	}
+	keyPEM, err := m.ds.GetACMEAccount(m.DirectoryURL)
+	if err == ErrNotFound {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		client := m.newClient(key)
+		account := &acme.Account{}
+		if m.Email != "" {
+			account.Contact = []string{"mailto:" + m.Email}
+		}
+		if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+			return nil, err
+		}
+		keyPEM, err = encodeECKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.ds.AddACMEAccount(m.DirectoryURL, keyPEM); err != nil {
+			return nil, err
+		}
+		// read the key back in case another router stored one first
+		if keyPEM, err = m.ds.GetACMEAccount(m.DirectoryURL); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("router: invalid ACME account key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	m.client = m.newClient(key)
+	return m.client, nil
+}
+
+func (m *acmeManager) newClient(key *ecdsa.PrivateKey) *acme.Client {
+	return &acme.Client{
+		Key:          key,
+		DirectoryURL: m.DirectoryURL,
+		HTTPClient:   m.HTTPClient,
+		UserAgent:    "flynn-router",
+	}
+}
+
+// issue obtains a certificate for the route's domain and adds it to the data
+// store
+func (m *acmeManager) issue(route *router.Route) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	client, err := m.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	domain := strings.ToLower(route.Domain)
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		return err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := m.authorize(ctx, client, url); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return err
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return err
+	}
+
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+	keyPEM, err := encodeECKey(key)
+	if err != nil {
+		return err
+	}
+	return m.ds.AddCert(&router.Certificate{
+		Cert:   string(certPEM),
+		Key:    keyPEM,
+		Routes: []string{route.ID},
+	})
+}
+
+// authorize completes the HTTP-01 challenge of the given authorization if it
+// is still pending
+func (m *acmeManager) authorize(ctx context.Context, client *acme.Client, url string) error {
+	authz, err := client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("router: no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+	keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	if err := m.ds.AddACMEChallenge(chal.Token, keyAuth); err != nil {
+		return err
+	}
+	defer m.ds.RemoveACMEChallenge(chal.Token)
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+func encodeECKey(key *ecdsa.PrivateKey) (string, error) {
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})), nil
+}
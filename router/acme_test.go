@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/testutil"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/pkg/tlscert"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestAutoTLSValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, r := range []*router.Route{
+		router.HTTPRoute{Domain: "*.example.com", Service: "test", AutoTLS: true}.ToRoute(),
+		router.HTTPRoute{Domain: "example.com", Path: "/foo/", Service: "test", AutoTLS: true}.ToRoute(),
+	} {
+		err := l.AddRoute(r)
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
+
+func (s *S) TestACMEServeChallenge(c *C) {
+	l := s.buildHTTPListener(c)
+	ds := NewPostgresDataStore("http", s.pgx)
+	l.acme = newACMEManager("", "", ds)
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	c.Assert(ds.AddACMEChallenge("token1", "token1.thumbprint"), IsNil)
+
+	res, err := http.Get("http://" + l.Addr + acmeChallengePath + "token1")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(string(body), Equals, "token1.thumbprint")
+
+	// unknown tokens are routed normally
+	c.Assert(ds.RemoveACMEChallenge("token1"), IsNil)
+	res, err = http.Get("http://" + l.Addr + acmeChallengePath + "token1")
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+// pebble is a Pebble ACME test server run by the tests
+type pebble struct {
+	directoryURL string
+	httpPort     string
+	domain       string
+	stop         func()
+}
+
+// runPebble starts a Pebble ACME test server from the pebble binary in PATH,
+// configured to validate HTTP-01 challenges on a random port of localhost.
+//
+// An already running server can be used instead by setting
+// PEBBLE_DIRECTORY_URL, with the server configured to validate HTTP-01
+// challenges on PEBBLE_HTTP_PORT (defaults to 5002) of the domain
+// PEBBLE_DOMAIN (defaults to localhost).
+func runPebble(c *C) *pebble {
+	if directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL"); directoryURL != "" {
+		p := &pebble{
+			directoryURL: directoryURL,
+			httpPort:     os.Getenv("PEBBLE_HTTP_PORT"),
+			domain:       os.Getenv("PEBBLE_DOMAIN"),
+			stop:         func() {},
+		}
+		if p.httpPort == "" {
+			p.httpPort = "5002"
+		}
+		if p.domain == "" {
+			p.domain = "localhost"
+		}
+		return p
+	}
+
+	bin, err := exec.LookPath("pebble")
+	if err != nil {
+		c.Skip("pebble not found in PATH and PEBBLE_DIRECTORY_URL not set")
+	}
+	dir, err := ioutil.TempDir("", "pebble-")
+	c.Assert(err, IsNil)
+	cert, err := tlscert.Generate([]string{"127.0.0.1", "localhost"})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "cert.pem"), []byte(cert.Cert), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "key.pem"), []byte(cert.PrivateKey), 0600), IsNil)
+
+	var ports [3]string
+	for i := range ports {
+		ports[i], err = testutil.RandomPort()
+		c.Assert(err, IsNil)
+	}
+	httpPort, _ := strconv.Atoi(ports[1])
+	tlsPort, _ := strconv.Atoi(ports[2])
+	addr := net.JoinHostPort("127.0.0.1", ports[0])
+	config, err := json.Marshal(map[string]interface{}{
+		"pebble": map[string]interface{}{
+			"listenAddress": addr,
+			"certificate":   filepath.Join(dir, "cert.pem"),
+			"privateKey":    filepath.Join(dir, "key.pem"),
+			"httpPort":      httpPort,
+			"tlsPort":       tlsPort,
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "pebble.json"), config, 0644), IsNil)
+
+	cmd := exec.Command(bin, "-config", filepath.Join(dir, "pebble.json"))
+	// disable the random delays and nonce rejections which Pebble uses
+	// to exercise ACME clients, as they just slow the tests down
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	if os.Getenv("DEBUG") != "" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	c.Assert(cmd.Start(), IsNil)
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+	}
+
+	// wait for Pebble to start listening
+	timeout := time.After(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-timeout:
+			stop()
+			c.Fatal("timed out waiting for pebble to start")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return &pebble{
+		directoryURL: "https://" + addr + "/dir",
+		httpPort:     ports[1],
+		domain:       "localhost",
+		stop:         stop,
+	}
+}
+
+// TestACMEAutoTLS obtains a certificate from a Pebble ACME test server
+func (s *S) TestACMEAutoTLS(c *C) {
+	p := runPebble(c)
+	defer p.stop()
+
+	l := s.buildHTTPListener(c)
+	l.Addr = net.JoinHostPort("127.0.0.1", p.httpPort)
+	l.acme = newACMEManager(p.directoryURL, "test@example.com", NewPostgresDataStore("http", s.pgx))
+	// Pebble uses a self-signed certificate for its API
+	l.acme.HTTPClient = &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	l.acme.SetLeader(true)
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{Domain: p.domain, Service: "test", AutoTLS: true}.ToRoute())
+
+	timeout := time.After(time.Minute)
+	for {
+		if r := l.findRoute(p.domain, "/"); r != nil && r.keypair != nil {
+			break
+		}
+		select {
+		case <-timeout:
+			c.Fatal("timed out waiting for certificate")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	conn, err := tls.Dial("tcp", l.TLSAddr, &tls.Config{ServerName: p.domain, InsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	cert := conn.ConnectionState().PeerCertificates[0]
+	c.Assert(cert.VerifyHostname(p.domain), IsNil)
+
+	// the stored certificate should not need renewing
+	routes, err := l.ds.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 1)
+	c.Assert(l.acme.needsCert(routes[0]), Equals, false)
+}
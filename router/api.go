@@ -31,12 +31,16 @@ func apiHandler(rtr *Router) http.Handler {
 	r.GET("/routes", httphelper.WrapHandler(api.GetRoutes))
 	r.GET("/routes/:route_type/:id", httphelper.WrapHandler(api.GetRoute))
 	r.DELETE("/routes/:route_type/:id", httphelper.WrapHandler(api.DeleteRoute))
+	r.DELETE("/routes/:route_type/:id/cache", httphelper.WrapHandler(api.PurgeCache))
+	r.GET("/routes/:route_type/:id/circuit-breakers", httphelper.WrapHandler(api.GetCircuitBreakers))
 	r.POST("/certificates", httphelper.WrapHandler(api.CreateCert))
 	r.GET("/certificates/:id", httphelper.WrapHandler(api.GetCert))
 	r.GET("/certificates/:id/routes", httphelper.WrapHandler(api.GetCertRoutes))
 	r.DELETE("/certificates/:id", httphelper.WrapHandler(api.DeleteCert))
 	r.GET("/certificates", httphelper.WrapHandler(api.GetCerts))
 	r.GET("/events", httphelper.WrapHandler(api.StreamEvents))
+	r.GET("/services/:service/requests", httphelper.WrapHandler(api.GetServiceRequests))
+	r.Handler("GET", "/metrics", rtr.Metrics)
 
 	r.HandlerFunc("GET", "/debug/*path", pprof.Handler.ServeHTTP)
 
@@ -140,6 +144,20 @@ func (api *API) GetRoutes(ctx context.Context, w http.ResponseWriter, req *http.
 		return
 	}
 	routes = append(routes, tcpRoutes...)
+	tlsRoutes, err := api.router.TLS.List()
+	if err != nil {
+		log.Error(err.Error())
+		httphelper.Error(w, err)
+		return
+	}
+	routes = append(routes, tlsRoutes...)
+	udpRoutes, err := api.router.UDP.List()
+	if err != nil {
+		log.Error(err.Error())
+		httphelper.Error(w, err)
+		return
+	}
+	routes = append(routes, udpRoutes...)
 
 	if ref := req.URL.Query().Get("parent_ref"); ref != "" {
 		filtered := make([]*router.Route, 0)
@@ -210,6 +228,71 @@ func (api *API) DeleteRoute(ctx context.Context, w http.ResponseWriter, req *htt
 	w.WriteHeader(200)
 }
 
+// cachePurger is implemented by listeners whose routes cache responses
+type cachePurger interface {
+	Listener
+	PurgeCache(*router.CachePurge) error
+}
+
+func (api *API) PurgeCache(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log, _ := ctxhelper.LoggerFromContext(ctx)
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l, ok := api.router.ListenerFor(params.ByName("route_type")).(cachePurger)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	id := params.ByName("id")
+	if _, err := l.Get(id); err != nil {
+		if err == ErrNotFound {
+			w.WriteHeader(404)
+			return
+		}
+		log.Error(err.Error())
+		httphelper.Error(w, err)
+		return
+	}
+
+	purge := &router.CachePurge{RouteID: id, Prefix: req.URL.Query().Get("prefix")}
+	if err := l.PurgeCache(purge); err != nil {
+		log.Error(err.Error())
+		httphelper.Error(w, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// circuitBreakerLister is implemented by listeners whose routes have circuit
+// breakers
+type circuitBreakerLister interface {
+	Listener
+	CircuitBreakers(id string) ([]*router.CircuitBreakerState, error)
+}
+
+func (api *API) GetCircuitBreakers(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log, _ := ctxhelper.LoggerFromContext(ctx)
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l, ok := api.router.ListenerFor(params.ByName("route_type")).(circuitBreakerLister)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+
+	states, err := l.CircuitBreakers(params.ByName("id"))
+	if err == ErrNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		log.Error(err.Error())
+		httphelper.Error(w, err)
+		return
+	}
+	httphelper.JSON(w, 200, states)
+}
+
 func (api *API) CreateCert(ctx context.Context, w http.ResponseWriter, req *http.Request) {
 	var cert *router.Certificate
 	if err := json.NewDecoder(req.Body).Decode(&cert); err != nil {
@@ -298,14 +381,22 @@ func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *ht
 
 	httpListener := api.router.ListenerFor("http")
 	tcpListener := api.router.ListenerFor("tcp")
+	tlsListener := api.router.ListenerFor("tls")
+	udpListener := api.router.ListenerFor("udp")
 
 	httpEvents := make(chan *router.Event)
 	tcpEvents := make(chan *router.Event)
+	tlsEvents := make(chan *router.Event)
+	udpEvents := make(chan *router.Event)
 	sseEvents := make(chan *router.StreamEvent)
 	go httpListener.Watch(httpEvents, true)
 	go tcpListener.Watch(tcpEvents, true)
+	go tlsListener.Watch(tlsEvents, true)
+	go udpListener.Watch(udpEvents, true)
 	defer httpListener.Unwatch(httpEvents)
 	defer tcpListener.Unwatch(tcpEvents)
+	defer tlsListener.Unwatch(tlsEvents)
+	defer udpListener.Unwatch(udpEvents)
 
 	reqTypes := strings.Split(req.URL.Query().Get("types"), ",")
 	eventTypes := make(map[router.EventType]struct{}, len(reqTypes))
@@ -332,5 +423,14 @@ func (api *API) StreamEvents(ctx context.Context, w http.ResponseWriter, req *ht
 	}
 	go sendEvents(httpEvents)
 	go sendEvents(tcpEvents)
+	go sendEvents(tlsEvents)
+	go sendEvents(udpEvents)
 	sse.ServeStream(w, sseEvents, log)
 }
+
+func (api *API) GetServiceRequests(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	params, _ := ctxhelper.ParamsFromContext(ctx)
+
+	l := api.router.HTTP.(*HTTPListener)
+	httphelper.JSON(w, 200, l.ServiceRequests(params.ByName("service")))
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"strings"
 	"time"
@@ -14,13 +16,17 @@ import (
 func (s *S) newTestAPIServer(t testutil.TestingT) *testAPIServer {
 	httpListener := s.newHTTPListener(t)
 	tcpListener := s.newTCPListener(t)
+	tlsListener := s.newTLSListener(t)
+	udpListener := s.newUDPListener(t)
 	r := &Router{
 		HTTP: httpListener,
 		TCP:  tcpListener,
+		TLS:  tlsListener,
+		UDP:  udpListener,
 	}
 	ts := &testAPIServer{
 		Server:    httptest.NewServer(apiHandler(r)),
-		listeners: []Listener{r.HTTP, r.TCP},
+		listeners: []Listener{r.HTTP, r.TCP, r.TLS, r.UDP},
 	}
 
 	ts.Client = client.NewWithAddr(ts.Listener.Addr().String())
@@ -110,6 +116,45 @@ func (s *S) TestAPIAddHTTPRoute(c *C) {
 	c.Assert(err, Equals, client.ErrNotFound)
 }
 
+func (s *S) TestAPIHealthCheckDurations(c *C) {
+	srv := s.newTestAPIServer(c)
+	defer srv.Close()
+
+	r := router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		HealthCheck: &router.HealthCheck{
+			Interval: 5 * time.Second,
+			Timeout:  500 * time.Millisecond,
+		},
+	}.ToRoute()
+	c.Assert(srv.CreateRoute(r), IsNil)
+
+	// the durations are encoded as strings rather than nanoseconds
+	res, err := http.Get(srv.URL + "/routes/" + r.FormattedID())
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	var data struct {
+		HealthCheck map[string]interface{} `json:"health_check"`
+	}
+	c.Assert(json.NewDecoder(res.Body).Decode(&data), IsNil)
+	c.Assert(data.HealthCheck["interval"], Equals, "5s")
+	c.Assert(data.HealthCheck["timeout"], Equals, "500ms")
+
+	route, err := srv.GetRoute("http", r.ID)
+	c.Assert(err, IsNil)
+	c.Assert(route.HealthCheck.Interval, Equals, 5*time.Second)
+	c.Assert(route.HealthCheck.Timeout, Equals, 500*time.Millisecond)
+
+	// numbers are not accepted
+	req, err := http.NewRequest("PUT", srv.URL+"/routes/"+r.FormattedID(), strings.NewReader(`{"type":"http","domain":"example.com","service":"test","health_check":{"interval":5000000000}}`))
+	c.Assert(err, IsNil)
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *S) TestAPIAddDuplicateRoute(c *C) {
 	srv := s.newTestAPIServer(c)
 	defer srv.Close()
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	defaultCacheMaxMemory     = 32 << 20
+	defaultCacheMaxObjectSize = 1 << 20
+
+	// cacheStatusHeader tells clients whether a response was served from
+	// the cache
+	cacheStatusHeader = "X-Cache"
+	cacheHit          = "HIT"
+	cacheMiss         = "MISS"
+	cacheBypass       = "BYPASS"
+)
+
+// cacheableStatus are the status codes of responses which are cached if they
+// have an explicit freshness lifetime
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// cacheLimits returns the max memory and max object size of the given cache
+// config with defaults applied
+func cacheLimits(c *router.Cache) (maxMemory, maxObjectSize int64) {
+	maxMemory, maxObjectSize = c.MaxMemory, c.MaxObjectSize
+	if maxMemory == 0 {
+		maxMemory = defaultCacheMaxMemory
+	}
+	if maxObjectSize == 0 {
+		maxObjectSize = defaultCacheMaxObjectSize
+		if maxObjectSize > maxMemory {
+			maxObjectSize = maxMemory
+		}
+	}
+	return
+}
+
+// responseCache caches the responses of a route which are cacheable according
+// to their Cache-Control, Expires and Vary headers.
+//
+// Recently used responses are kept in memory, and when the memory limit is
+// reached the least recently used ones are moved to disk if the cache has a
+// directory, or dropped if not. Responses are dropped from disk when the disk
+// limit is reached. Response headers are always kept in memory.
+//
+// Responses are keyed by the host and request URI of the request, along with
+// the values of the request headers named in the Vary header of the most
+// recent response to a request for the same URI.
+//
+// A nil *responseCache caches nothing.
+type responseCache struct {
+	maxMemory     int64
+	maxDisk       int64
+	maxObjectSize int64
+	dir           string
+
+	mtx        sync.Mutex
+	entries    map[string]*list.Element
+	variants   map[string]*cacheVariants
+	memory     *list.List
+	disk       *list.List
+	memorySize int64
+	diskSize   int64
+}
+
+// cacheVariants are the request headers which select between the cached
+// responses for a URI, and the number of cached responses for it
+type cacheVariants struct {
+	vary  []string
+	count int
+}
+
+type cacheEntry struct {
+	key  string
+	uri  string
+	path string
+
+	status int
+	header http.Header
+	size   int64
+
+	// body is the response body if the entry is in memory, and file is
+	// the path of the file containing it if the entry is on disk
+	body []byte
+	file string
+
+	stored  time.Time
+	age     time.Duration
+	expires time.Time
+}
+
+// newResponseCache returns a cache with the given config, storing responses
+// on disk in dir if it is not empty and the config has a disk limit
+func newResponseCache(config *router.Cache, dir string) *responseCache {
+	c := &responseCache{
+		maxDisk:  config.MaxDisk,
+		entries:  make(map[string]*list.Element),
+		variants: make(map[string]*cacheVariants),
+		memory:   list.New(),
+		disk:     list.New(),
+	}
+	c.maxMemory, c.maxObjectSize = cacheLimits(config)
+	if dir != "" && c.maxDisk > 0 {
+		// remove responses left on disk by a previous router process
+		// since their headers were only kept in memory
+		os.RemoveAll(dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			logger.Error("error creating cache directory, caching in memory only", "fn", "newResponseCache", "dir", dir, "err", err)
+		} else {
+			c.dir = dir
+		}
+	}
+	return c
+}
+
+// Serve writes the cached response for req if there is a fresh one, returning
+// its status code, the number of body bytes written and whether it did.
+//
+// If there is no cached response, the X-Cache header is set to indicate
+// whether the response to the request may be cached.
+func (c *responseCache) Serve(w http.ResponseWriter, req *http.Request) (int, int64, bool) {
+	if c == nil {
+		return 0, 0, false
+	}
+	if !cacheableRequest(req) {
+		w.Header().Set(cacheStatusHeader, cacheBypass)
+		return 0, 0, false
+	}
+	w.Header().Set(cacheStatusHeader, cacheMiss)
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-cache"]; ok || req.Header.Get("Pragma") == "no-cache" {
+		return 0, 0, false
+	}
+	if maxAge, ok := reqCC["max-age"]; ok && maxAge == "0" {
+		return 0, 0, false
+	}
+
+	e, body, ok := c.get(req)
+	if !ok {
+		return 0, 0, false
+	}
+	if body != nil {
+		defer body.Close()
+	}
+
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append([]string(nil), v...)
+	}
+	age := e.age + time.Since(e.stored)
+	h.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	h.Set(cacheStatusHeader, cacheHit)
+	w.WriteHeader(e.status)
+	if req.Method == "HEAD" {
+		return e.status, 0, true
+	}
+	var n int64
+	if body != nil {
+		n, _ = io.Copy(w, body)
+	} else {
+		m, _ := w.Write(e.body)
+		n = int64(m)
+	}
+	return e.status, n, true
+}
+
+// get returns the fresh entry for req, along with its body if it is on disk
+func (c *responseCache) get(req *http.Request) (*cacheEntry, io.ReadCloser, bool) {
+	uri := cacheURI(req)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	variants, ok := c.variants[uri]
+	if !ok {
+		return nil, nil, false
+	}
+	el, ok := c.entries[cacheKey(uri, variants.vary, req.Header)]
+	if !ok {
+		return nil, nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !time.Now().Before(e.expires) {
+		c.remove(el)
+		return nil, nil, false
+	}
+	if e.file == "" {
+		c.memory.MoveToFront(el)
+		return e, nil, true
+	}
+	// the file is opened while holding the lock so that it is not removed
+	// before it is read
+	f, err := os.Open(e.file)
+	if err != nil {
+		c.remove(el)
+		return nil, nil, false
+	}
+	c.disk.MoveToFront(el)
+	return e, f, true
+}
+
+// Writer returns a ResponseWriter which caches the response to req if it is
+// cacheable, or nil if the request is not cacheable. Store must be called
+// once the response has been written.
+func (c *responseCache) Writer(w http.ResponseWriter, req *http.Request) *cacheWriter {
+	if c == nil || req.Method != "GET" || !cacheableRequest(req) {
+		return nil
+	}
+	return &cacheWriter{ResponseWriter: w, c: c, req: req}
+}
+
+// Purge removes all cached responses to requests with paths starting with
+// prefix
+func (c *responseCache) Purge(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, l := range []*list.List{c.memory, c.disk} {
+		var next *list.Element
+		for el := l.Front(); el != nil; el = next {
+			next = el.Next()
+			if strings.HasPrefix(el.Value.(*cacheEntry).path, prefix) {
+				c.remove(el)
+			}
+		}
+	}
+}
+
+// Close removes all cached responses
+func (c *responseCache) Close() {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.variants = make(map[string]*cacheVariants)
+	c.memory.Init()
+	c.disk.Init()
+	c.memorySize = 0
+	c.diskSize = 0
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// add adds the given entry, evicting the least recently used entries from
+// memory and disk if they are full
+func (c *responseCache) add(e *cacheEntry, vary []string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+
+	// the most recent response for a URI determines which request headers
+	// select its variants, and variants cached using different headers
+	// become unreachable so are left to be evicted
+	variants, ok := c.variants[e.uri]
+	if !ok {
+		variants = &cacheVariants{}
+		c.variants[e.uri] = variants
+	}
+	variants.vary = vary
+	variants.count++
+	c.entries[e.key] = c.memory.PushFront(e)
+	c.memorySize += e.size
+
+	for c.memorySize > c.maxMemory {
+		el := c.memory.Back()
+		oldest := el.Value.(*cacheEntry)
+		c.memory.Remove(el)
+		c.memorySize -= oldest.size
+		if !c.writeToDisk(oldest) {
+			c.forget(oldest)
+			continue
+		}
+		c.entries[oldest.key] = c.disk.PushFront(oldest)
+		c.diskSize += oldest.size
+		for c.diskSize > c.maxDisk {
+			c.remove(c.disk.Back())
+		}
+	}
+}
+
+// writeToDisk moves the body of the given entry to disk, returning whether
+// it did
+func (c *responseCache) writeToDisk(e *cacheEntry) bool {
+	if c.dir == "" || e.size > c.maxDisk {
+		return false
+	}
+	sum := sha256.Sum256([]byte(e.key))
+	file := filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+	if err := ioutil.WriteFile(file, e.body, 0600); err != nil {
+		logger.Error("error writing cached response to disk", "fn", "responseCache.writeToDisk", "file", file, "err", err)
+		os.Remove(file)
+		return false
+	}
+	e.body = nil
+	e.file = file
+	return true
+}
+
+// remove removes the given element from either the memory or disk list
+func (c *responseCache) remove(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+	if e.file != "" {
+		c.disk.Remove(el)
+		c.diskSize -= e.size
+		os.Remove(e.file)
+	} else {
+		c.memory.Remove(el)
+		c.memorySize -= e.size
+	}
+	c.forget(e)
+}
+
+// forget removes the given entry from the index once it has been removed from
+// the memory or disk list
+func (c *responseCache) forget(e *cacheEntry) {
+	if el, ok := c.entries[e.key]; ok && el.Value.(*cacheEntry) == e {
+		delete(c.entries, e.key)
+	}
+	if variants, ok := c.variants[e.uri]; ok {
+		variants.count--
+		if variants.count <= 0 {
+			delete(c.variants, e.uri)
+		}
+	}
+}
+
+// cacheWriter records a response while writing it so that it can be cached
+type cacheWriter struct {
+	http.ResponseWriter
+
+	c   *responseCache
+	req *http.Request
+
+	status    int
+	header    http.Header
+	cacheable bool
+	age       time.Duration
+	lifetime  time.Duration
+	body      bytes.Buffer
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	w.header = cloneHeader(w.Header())
+	w.header.Del(cacheStatusHeader)
+	w.cacheable, w.age, w.lifetime = w.cacheableResponse()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) cacheableResponse() (bool, time.Duration, time.Duration) {
+	if !cacheableStatus[w.status] {
+		return false, 0, 0
+	}
+	h := w.header
+	cc := parseCacheControl(h)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[directive]; ok {
+			return false, 0, 0
+		}
+	}
+	if len(h["Set-Cookie"]) > 0 || len(h["Trailer"]) > 0 || headerContainsValue(h, "Vary", "*") {
+		return false, 0, 0
+	}
+	if cl, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && cl > w.c.maxObjectSize {
+		return false, 0, 0
+	}
+	var age time.Duration
+	if secs, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && secs > 0 {
+		age = time.Duration(secs) * time.Second
+	}
+	lifetime := freshnessLifetime(h, cc, time.Now())
+	if lifetime <= age {
+		return false, 0, 0
+	}
+	return true, age, lifetime
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.cacheable {
+		if int64(w.body.Len()+len(p)) > w.c.maxObjectSize {
+			w.cacheable = false
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *cacheWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// Store caches the response if it was cacheable and complete
+func (w *cacheWriter) Store() {
+	if !w.cacheable {
+		return
+	}
+	body := w.body.Bytes()
+	if cl, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil && cl != int64(len(body)) {
+		return
+	}
+	now := time.Now()
+	e := &cacheEntry{
+		uri:     cacheURI(w.req),
+		path:    w.req.URL.Path,
+		status:  w.status,
+		header:  w.header,
+		body:    body,
+		stored:  now,
+		age:     w.age,
+		expires: now.Add(w.lifetime - w.age),
+	}
+	e.size = int64(len(body) + len(e.uri) + len(e.path))
+	for k, v := range e.header {
+		e.size += int64(len(k))
+		for _, s := range v {
+			e.size += int64(len(s))
+		}
+	}
+	if e.size > w.c.maxMemory {
+		return
+	}
+	var vary []string
+	for _, v := range w.header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	e.key = cacheKey(e.uri, vary, w.req.Header)
+	w.c.add(e, vary)
+}
+
+// cacheableRequest returns whether the response to req may be served from or
+// stored in the cache
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Range") != "" || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	_, noStore := parseCacheControl(req.Header)["no-store"]
+	return !noStore
+}
+
+func cacheURI(req *http.Request) string {
+	return strings.ToLower(req.Host) + req.URL.RequestURI()
+}
+
+// cacheKey returns the key of the variant of uri selected by the values of
+// the vary headers in h
+func cacheKey(uri string, vary []string, h http.Header) string {
+	if len(vary) == 0 {
+		return uri
+	}
+	var buf bytes.Buffer
+	buf.WriteString(uri)
+	for _, name := range vary {
+		buf.WriteByte(0)
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(strings.Join(h[name], ","))
+	}
+	return buf.String()
+}
+
+// parseCacheControl returns the directives of the Cache-Control header in h
+// mapped to their values
+func parseCacheControl(h http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, v := range h["Cache-Control"] {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value := directive, ""
+			if i := strings.Index(directive, "="); i >= 0 {
+				name, value = directive[:i], strings.Trim(directive[i+1:], `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+		}
+	}
+	return cc
+}
+
+// freshnessLifetime returns how long a response is fresh for, using the
+// s-maxage or max-age directives if present and the Expires header otherwise
+func freshnessLifetime(h http.Header, cc map[string]string, now time.Time) time.Duration {
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			secs, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || secs < 0 {
+				return 0
+			}
+			return time.Duration(secs) * time.Second
+		}
+	}
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0
+	}
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		// invalid Expires values mean the response has already expired
+		return 0
+	}
+	date := now
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+	return t.Sub(date)
+}
+
+// headerContainsValue returns whether the comma separated values of the given
+// header contain the given value
+func headerContainsValue(h http.Header, key, value string) bool {
+	for _, v := range h[key] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.TrimSpace(s) == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
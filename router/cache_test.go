@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/pkg/attempt"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestResponseCacheability(c *C) {
+	now := time.Now()
+	for _, t := range []struct {
+		status    int
+		header    http.Header
+		cacheable bool
+		lifetime  time.Duration
+	}{
+		{status: 200, header: http.Header{}},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}}, cacheable: true, lifetime: time.Minute},
+		{status: 200, header: http.Header{"Cache-Control": {"public, max-age=60, s-maxage=120"}}, cacheable: true, lifetime: 2 * time.Minute},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"10"}}, cacheable: true, lifetime: time.Minute},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Age": {"60"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=0"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"no-store, max-age=60"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"no-cache, max-age=60"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		{status: 200, header: http.Header{"Cache-Control": {"max-age=60"}, "Content-Length": {"2000"}}},
+		{status: 500, header: http.Header{"Cache-Control": {"max-age=60"}}},
+		{status: 404, header: http.Header{"Cache-Control": {"max-age=60"}}, cacheable: true, lifetime: time.Minute},
+		{
+			status: 200,
+			header: http.Header{
+				"Date":    {now.UTC().Format(http.TimeFormat)},
+				"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)},
+			},
+			cacheable: true,
+			lifetime:  time.Hour,
+		},
+		{status: 200, header: http.Header{"Expires": {"0"}}},
+	} {
+		w := &cacheWriter{
+			c:      newResponseCache(&router.Cache{MaxObjectSize: 1000}, ""),
+			status: t.status,
+			header: t.header,
+		}
+		cacheable, _, lifetime := w.cacheableResponse()
+		c.Assert(cacheable, Equals, t.cacheable, Commentf("%d %v", t.status, t.header))
+		if t.cacheable {
+			// allow for the truncation of HTTP dates to seconds
+			c.Assert(lifetime > t.lifetime-time.Second && lifetime <= t.lifetime, Equals, true, Commentf("%v", t.header))
+		}
+	}
+}
+
+func (s *S) TestResponseCacheEviction(c *C) {
+	dir := c.MkDir()
+	cache := newResponseCache(&router.Cache{MaxMemory: 2500, MaxDisk: 2500, MaxObjectSize: 1000}, dir)
+
+	// cache responses which each take up just over 1000 bytes
+	body := make([]byte, 900)
+	store := func(path string) {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		c.Assert(err, IsNil)
+		w := cache.Writer(httptest.NewRecorder(), req)
+		c.Assert(w, NotNil)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(body)
+		w.Store()
+	}
+	cached := func(path string) bool {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		c.Assert(err, IsNil)
+		rec := httptest.NewRecorder()
+		_, n, ok := cache.Serve(rec, req)
+		if ok {
+			c.Assert(n, Equals, int64(len(body)))
+			c.Assert(rec.Header().Get("X-Cache"), Equals, "HIT")
+		}
+		return ok
+	}
+	files := func() int {
+		names, err := ioutil.ReadDir(dir)
+		c.Assert(err, IsNil)
+		return len(names)
+	}
+
+	store("/1")
+	store("/2")
+	c.Assert(files(), Equals, 0)
+
+	// the least recently used response is moved to disk
+	c.Assert(cached("/1"), Equals, true)
+	store("/3")
+	c.Assert(files(), Equals, 1)
+	c.Assert(cached("/2"), Equals, true)
+
+	// the least recently used response on disk is dropped
+	store("/4")
+	store("/5")
+	c.Assert(files(), Equals, 2)
+	c.Assert(cached("/2"), Equals, false)
+	for _, path := range []string{"/1", "/3", "/4", "/5"} {
+		c.Assert(cached(path), Equals, true, Commentf(path))
+	}
+
+	cache.Purge("/3")
+	c.Assert(cached("/3"), Equals, false)
+	c.Assert(cached("/1"), Equals, true)
+
+	cache.Close()
+	c.Assert(cached("/1"), Equals, false)
+	_, err := os.Stat(dir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *S) TestHTTPRouteCache(c *C) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt64(&requests, 1)
+		switch req.URL.Path {
+		case "/static/app.js", "/other":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+		case "/lang":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "%s %s %d", req.URL.Path, req.Header.Get("Accept-Language"), n)
+	}))
+	defer srv.Close()
+
+	l := s.buildHTTPListener(c)
+	l.cacheDir = c.MkDir()
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	route := addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		Cache:   &router.Cache{},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(path string, header http.Header) (string, string) {
+		req := newReq("http://"+l.Addr+path, "example.com")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data), res.Header.Get("X-Cache")
+	}
+	assertGet := func(path string, header http.Header, body, status string) {
+		actualBody, actualStatus := get(path, header)
+		c.Assert(actualBody, Equals, body, Commentf(path))
+		c.Assert(actualStatus, Equals, status, Commentf(path))
+	}
+
+	// cacheable responses are served from the cache
+	assertGet("/static/app.js", nil, "/static/app.js  1", "MISS")
+	assertGet("/static/app.js", nil, "/static/app.js  1", "HIT")
+	assertGet("/other", nil, "/other  2", "MISS")
+
+	// responses without freshness information are not cached
+	assertGet("/dynamic", nil, "/dynamic  3", "MISS")
+	assertGet("/dynamic", nil, "/dynamic  4", "MISS")
+
+	// requests with credentials bypass the cache
+	assertGet("/static/app.js", http.Header{"Authorization": {"Bearer token"}}, "/static/app.js  5", "BYPASS")
+
+	// requests with no-cache fetch a new response
+	assertGet("/other", http.Header{"Cache-Control": {"no-cache"}}, "/other  6", "MISS")
+	assertGet("/other", nil, "/other  6", "HIT")
+
+	// responses are cached for each value of the headers they vary by
+	en := http.Header{"Accept-Language": {"en"}}
+	fr := http.Header{"Accept-Language": {"fr"}}
+	assertGet("/lang", en, "/lang en 7", "MISS")
+	assertGet("/lang", fr, "/lang fr 8", "MISS")
+	assertGet("/lang", en, "/lang en 7", "HIT")
+	assertGet("/lang", fr, "/lang fr 8", "HIT")
+
+	// purging a prefix removes matching responses from the cache
+	c.Assert(l.PurgeCache(&router.CachePurge{RouteID: route.ID, Prefix: "/static/"}), IsNil)
+	err := attempt.Strategy{Total: 5 * time.Second, Delay: 100 * time.Millisecond}.Run(func() error {
+		if _, status := get("/static/app.js", nil); status != "MISS" {
+			return fmt.Errorf("expected X-Cache MISS, got %s", status)
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	assertGet("/other", nil, "/other  6", "HIT")
+
+	// updating the cache config clears the cache
+	route.Cache = &router.Cache{MaxObjectSize: 100}
+	wait := waitForEvent(c, l, "set", "")
+	c.Assert(l.UpdateRoute(route), IsNil)
+	wait()
+	assertGet("/other", nil, "/other  10", "MISS")
+}
+
+func (s *S) TestCacheValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, cache := range []*router.Cache{
+		{MaxMemory: -1},
+		{MaxDisk: -1},
+		{MaxMemory: 1000, MaxObjectSize: 2000},
+	} {
+		err := l.AddRoute(router.HTTPRoute{
+			Domain:  "example.com",
+			Service: "test",
+			Cache:   cache,
+		}.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
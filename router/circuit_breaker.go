@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	defaultCircuitBreakerFailures = 5
+	defaultCircuitBreakerCooldown = 30 * time.Second
+
+	defaultRetryBudgetRatio      = 0.2
+	defaultRetryBudgetMinRetries = 10
+
+	// retryBudgetWindow is the period over which a retry budget counts
+	// requests and retries
+	retryBudgetWindow = 10 * time.Second
+)
+
+// circuitBreakers holds the circuit breakers of a route's backends, opening a
+// backend's breaker after it fails threshold consecutive requests. Once open
+// for cooldown the breaker becomes half-open, letting a single trial request
+// through which closes the breaker if it succeeds and opens it again if it
+// fails.
+//
+// It implements proxy.CircuitBreaker. Only backends which have failed have a
+// breaker, with the breakers of other backends being closed.
+type circuitBreakers struct {
+	route     *router.Route
+	threshold int
+	cooldown  time.Duration
+
+	mtx      sync.Mutex
+	backends map[string]*circuitBreaker
+
+	// now is used to get the current time, and is overridden in tests
+	now func() time.Time
+}
+
+type circuitBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+
+	// trialAt is when the trial request of a half-open breaker was let
+	// through, with another trial being let through after cooldown if
+	// the first one never finishes
+	trialAt time.Time
+}
+
+// newCircuitBreakers returns the circuit breakers for the given route, or nil
+// if the route has no circuit breaker
+func newCircuitBreakers(route *router.Route) *circuitBreakers {
+	config := route.CircuitBreaker
+	if config == nil {
+		return nil
+	}
+	b := &circuitBreakers{
+		route:     route,
+		threshold: config.ConsecutiveFailures,
+		cooldown:  config.Cooldown,
+		backends:  make(map[string]*circuitBreaker),
+		now:       time.Now,
+	}
+	if b.threshold == 0 {
+		b.threshold = defaultCircuitBreakerFailures
+	}
+	if b.cooldown == 0 {
+		b.cooldown = defaultCircuitBreakerCooldown
+	}
+	return b
+}
+
+// Allow returns whether a request can be sent to the given backend, making
+// the backend's breaker half-open if it has been open for the cooldown
+func (b *circuitBreakers) Allow(addr string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	cb, ok := b.backends[addr]
+	if !ok {
+		return true
+	}
+	now := b.now()
+	switch cb.state {
+	case router.CircuitBreakerOpen:
+		if now.Sub(cb.openedAt) < b.cooldown {
+			return false
+		}
+		cb.state = router.CircuitBreakerHalfOpen
+	case router.CircuitBreakerHalfOpen:
+		if now.Sub(cb.trialAt) < b.cooldown {
+			return false
+		}
+	}
+	cb.trialAt = now
+	return true
+}
+
+// Success closes the given backend's breaker
+func (b *circuitBreakers) Success(addr string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	cb, ok := b.backends[addr]
+	if !ok {
+		return
+	}
+	if cb.state != router.CircuitBreakerClosed {
+		logger.Info("closing circuit breaker", "route", b.route.FormattedID(), "backend", addr)
+	}
+	delete(b.backends, addr)
+}
+
+// Failure records a failed request to the given backend, opening its breaker
+// if it is half-open or has reached the threshold of consecutive failures
+func (b *circuitBreakers) Failure(addr string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	cb, ok := b.backends[addr]
+	if !ok {
+		cb = &circuitBreaker{state: router.CircuitBreakerClosed}
+		b.backends[addr] = cb
+	}
+	cb.failures++
+	if cb.state == router.CircuitBreakerHalfOpen || (cb.state == router.CircuitBreakerClosed && cb.failures >= b.threshold) {
+		logger.Warn("opening circuit breaker", "route", b.route.FormattedID(), "backend", addr, "failures", cb.failures)
+		cb.state = router.CircuitBreakerOpen
+		cb.openedAt = b.now()
+	}
+}
+
+// States returns the state of the breakers of the given backends, sorted by
+// backend
+func (b *circuitBreakers) States(addrs []string) []*router.CircuitBreakerState {
+	states := make([]*router.CircuitBreakerState, 0, len(addrs))
+	if b == nil {
+		return states
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		state := &router.CircuitBreakerState{Backend: addr, State: router.CircuitBreakerClosed}
+		if cb, ok := b.backends[addr]; ok {
+			state.State = cb.state
+			state.Failures = cb.failures
+			if cb.state != router.CircuitBreakerClosed {
+				openedAt := cb.openedAt
+				state.OpenedAt = &openedAt
+			}
+		}
+		states = append(states, state)
+	}
+	sort.Sort(sortedStates(states))
+	return states
+}
+
+type sortedStates []*router.CircuitBreakerState
+
+func (p sortedStates) Len() int           { return len(p) }
+func (p sortedStates) Less(i, j int) bool { return p[i].Backend < p[j].Backend }
+func (p sortedStates) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// retryBudget limits the retries of a route's requests to minRetries per
+// window plus ratio of the requests in the window.
+//
+// It implements proxy.RetryBudget.
+type retryBudget struct {
+	ratio      float64
+	minRetries float64
+
+	mtx         sync.Mutex
+	windowStart time.Time
+	requests    float64
+	retries     float64
+
+	// now is used to get the current time, and is overridden in tests
+	now func() time.Time
+}
+
+// newRetryBudget returns the retry budget for the given route, or nil if the
+// route has no retry budget
+func newRetryBudget(route *router.Route) *retryBudget {
+	config := route.RetryBudget
+	if config == nil {
+		return nil
+	}
+	b := &retryBudget{
+		ratio:      config.Ratio,
+		minRetries: float64(config.MinRetriesPerSecond),
+		now:        time.Now,
+	}
+	if b.ratio == 0 {
+		b.ratio = defaultRetryBudgetRatio
+	}
+	if config.MinRetriesPerSecond == 0 {
+		b.minRetries = defaultRetryBudgetMinRetries
+	}
+	b.minRetries *= retryBudgetWindow.Seconds()
+	b.windowStart = b.now()
+	return b
+}
+
+func (b *retryBudget) Request() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.roll()
+	b.requests++
+}
+
+func (b *retryBudget) Retry() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.roll()
+	if b.retries >= b.minRetries+b.ratio*b.requests {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// roll starts a new window if the current one has ended (it must be called
+// with b.mtx held)
+func (b *retryBudget) roll() {
+	if now := b.now(); now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.requests = 0
+		b.retries = 0
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestCircuitBreakers(c *C) {
+	now := time.Now()
+	b := newCircuitBreakers(router.HTTPRoute{
+		CircuitBreaker: &router.CircuitBreaker{ConsecutiveFailures: 2, Cooldown: time.Minute},
+	}.ToRoute())
+	b.now = func() time.Time { return now }
+	const addr = "10.0.0.1:80"
+
+	// a success resets the consecutive failures
+	c.Assert(b.Allow(addr), Equals, true)
+	b.Failure(addr)
+	b.Success(addr)
+	b.Failure(addr)
+	c.Assert(b.Allow(addr), Equals, true)
+
+	// reaching the threshold opens the breaker
+	b.Failure(addr)
+	c.Assert(b.Allow(addr), Equals, false)
+	c.Assert(b.Allow("10.0.0.2:80"), Equals, true)
+	states := b.States([]string{addr, "10.0.0.2:80"})
+	c.Assert(states, HasLen, 2)
+	c.Assert(states[0].State, Equals, router.CircuitBreakerOpen)
+	c.Assert(states[0].Failures, Equals, 2)
+	c.Assert(*states[0].OpenedAt, Equals, now)
+	c.Assert(states[1].State, Equals, router.CircuitBreakerClosed)
+
+	// after the cooldown a single trial request is let through
+	now = now.Add(time.Minute)
+	c.Assert(b.Allow(addr), Equals, true)
+	c.Assert(b.Allow(addr), Equals, false)
+	c.Assert(b.States([]string{addr})[0].State, Equals, router.CircuitBreakerHalfOpen)
+
+	// a failed trial opens the breaker again
+	b.Failure(addr)
+	c.Assert(b.Allow(addr), Equals, false)
+	now = now.Add(time.Minute)
+	c.Assert(b.Allow(addr), Equals, true)
+
+	// a successful trial closes the breaker
+	b.Success(addr)
+	c.Assert(b.Allow(addr), Equals, true)
+	c.Assert(b.States([]string{addr})[0], DeepEquals, &router.CircuitBreakerState{
+		Backend: addr,
+		State:   router.CircuitBreakerClosed,
+	})
+}
+
+func (s *S) TestRetryBudget(c *C) {
+	b := newRetryBudget(router.HTTPRoute{
+		RetryBudget: &router.RetryBudget{Ratio: 0.5},
+	}.ToRoute())
+	c.Assert(b.minRetries, Equals, defaultRetryBudgetMinRetries*retryBudgetWindow.Seconds())
+	now := b.windowStart
+	b.now = func() time.Time { return now }
+	b.minRetries = 1
+
+	// the minimum retries are allowed without any requests
+	c.Assert(b.Retry(), Equals, true)
+	c.Assert(b.Retry(), Equals, false)
+
+	// each request adds to the budget in proportion to the ratio
+	for i := 0; i < 4; i++ {
+		b.Request()
+	}
+	c.Assert(b.Retry(), Equals, true)
+	c.Assert(b.Retry(), Equals, true)
+	c.Assert(b.Retry(), Equals, false)
+
+	// the budget is reset after the window
+	now = now.Add(retryBudgetWindow)
+	c.Assert(b.Retry(), Equals, true)
+	c.Assert(b.Retry(), Equals, false)
+}
+
+func (s *S) TestHTTPRouteCircuitBreaker(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	route := addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		CircuitBreaker: &router.CircuitBreaker{
+			ConsecutiveFailures: 1,
+			Cooldown:            time.Hour,
+		},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	// requests are sent to both backends until the failing one's breaker
+	// opens
+	failures := 0
+	for i := 0; i < 20; i++ {
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		if res.StatusCode == 500 {
+			failures++
+		}
+	}
+	c.Assert(failures, Equals, 1)
+
+	states, err := l.CircuitBreakers(route.ID)
+	c.Assert(err, IsNil)
+	c.Assert(states, HasLen, 2)
+	for _, state := range states {
+		if state.Backend == srv2.Listener.Addr().String() {
+			c.Assert(state.State, Equals, router.CircuitBreakerOpen)
+		} else {
+			c.Assert(state.State, Equals, router.CircuitBreakerClosed)
+		}
+	}
+}
+
+func (s *S) TestHTTPRouteUpstreamTimeout(c *C) {
+	done := make(chan struct{})
+	defer close(done)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		UpstreamTimeout: 100 * time.Millisecond,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusGatewayTimeout)
+}
+
+func (s *S) TestHTTPRouteRetryBudget(c *C) {
+	done := make(chan struct{})
+	defer close(done)
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		UpstreamTimeout: 100 * time.Millisecond,
+		RetryBudget:     &router.RetryBudget{},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	// GET requests which time out are retried on the other backend
+	for i := 0; i < 5; i++ {
+		assertGet(c, "http://"+l.Addr, "example.com", "1")
+	}
+
+	// POST requests are not retried
+	timeouts := 0
+	for i := 0; i < 10; i++ {
+		req := newReq("http://"+l.Addr, "example.com")
+		req.Method = "POST"
+		res, err := newHTTPClient("example.com").Do(req)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		if res.StatusCode == http.StatusGatewayTimeout {
+			timeouts++
+		} else {
+			c.Assert(string(data), Equals, "1")
+		}
+	}
+	c.Assert(timeouts > 0, Equals, true)
+}
+
+func (s *S) TestHTTPRouteResilienceValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, r := range []router.HTTPRoute{
+		{UpstreamTimeout: -time.Second},
+		{CircuitBreaker: &router.CircuitBreaker{ConsecutiveFailures: -1}},
+		{RetryBudget: &router.RetryBudget{Ratio: -0.5}},
+	} {
+		r.Domain = "example.com"
+		r.Service = "test"
+		err := l.AddRoute(r.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
@@ -65,6 +65,17 @@ type Client interface {
 	ListRoutes(parentRef string) ([]*router.Route, error)
 	// StreamEvents streams router events with the given options
 	StreamEvents(opts *router.StreamEventsOptions, output chan *router.StreamEvent) (stream.Stream, error)
+	// GetServiceRequests returns the number of in-flight HTTP requests to
+	// each backend of the specified service, keyed by backend address.
+	GetServiceRequests(service string) (map[string]int64, error)
+	// PurgeCache removes the cached responses of the HTTP route with the
+	// specified id from all routers, limited to requests with paths
+	// starting with prefix if it is not empty.
+	PurgeCache(id, prefix string) error
+	// GetCircuitBreakers returns the state of the circuit breakers of the
+	// current backends of the HTTP route with the specified id on the
+	// router the client is connected to.
+	GetCircuitBreakers(id string) ([]*router.CircuitBreakerState, error)
 
 	// CreateCert creates a new route certificate.
 	CreateCert(*router.Certificate) error
@@ -121,6 +132,32 @@ func (c *client) StreamEvents(opts *router.StreamEventsOptions, output chan *rou
 	return c.ResumingStream("GET", "/events?types="+strings.Join(types, ","), output)
 }
 
+func (c *client) GetServiceRequests(service string) (map[string]int64, error) {
+	if strings.Contains(service, "/") {
+		return nil, fmt.Errorf("router: invalid service name %q", service)
+	}
+	path := (&url.URL{Path: "/services/" + service + "/requests"}).EscapedPath()
+	var res map[string]int64
+	err := c.Get(path, &res)
+	return res, err
+}
+
+func (c *client) PurgeCache(id, prefix string) error {
+	path := "/routes/http/" + id + "/cache"
+	if prefix != "" {
+		q := make(url.Values)
+		q.Set("prefix", prefix)
+		path += "?" + q.Encode()
+	}
+	return c.Delete(path)
+}
+
+func (c *client) GetCircuitBreakers(id string) ([]*router.CircuitBreakerState, error) {
+	var res []*router.CircuitBreakerState
+	err := c.Get("/routes/http/"+id+"/circuit-breakers", &res)
+	return res, err
+}
+
 func (c *client) CreateCert(cert *router.Certificate) error {
 	return c.Post("/certificates", cert, cert)
 }
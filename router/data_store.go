@@ -3,8 +3,11 @@ package main
 import (
 	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
+	"net/http"
 	"strings"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/router/types"
 	"github.com/jackc/pgx"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 )
 
@@ -56,8 +60,12 @@ type pgDataStore struct {
 const (
 	routeTypeHTTP = "http"
 	routeTypeTCP  = "tcp"
+	routeTypeTLS  = "tls"
+	routeTypeUDP  = "udp"
 	tableNameHTTP = "http_routes"
 	tableNameTCP  = "tcp_routes"
+	tableNameTLS  = "tls_routes"
+	tableNameUDP  = "udp_routes"
 )
 
 // NewPostgresDataStore returns a DataStore that stores route information in a
@@ -70,6 +78,10 @@ func NewPostgresDataStore(routeType string, pgx *pgx.ConnPool) *pgDataStore {
 		tableName = tableNameHTTP
 	case routeTypeTCP:
 		tableName = tableNameTCP
+	case routeTypeTLS:
+		tableName = tableNameTLS
+	case routeTypeUDP:
+		tableName = tableNameUDP
 	default:
 		panic(fmt.Sprintf("unknown routeType: %q", routeType))
 	}
@@ -86,11 +98,21 @@ func (d *pgDataStore) Ping() error {
 }
 
 func (d *pgDataStore) Add(r *router.Route) (err error) {
+	if err := validateLimits(r); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(r); err != nil {
+		return err
+	}
 	switch d.tableName {
 	case tableNameHTTP:
 		err = d.addHTTP(r)
 	case tableNameTCP:
 		err = d.addTCP(r)
+	case tableNameTLS:
+		err = d.addTLS(r)
+	case tableNameUDP:
+		err = d.addUDP(r)
 	}
 	r.Type = d.routeType
 	if err != nil {
@@ -105,6 +127,39 @@ func (d *pgDataStore) Add(r *router.Route) (err error) {
 }
 
 func (d *pgDataStore) addHTTP(r *router.Route) error {
+	if err := validateHTTPServices(r); err != nil {
+		return err
+	}
+	if err := validateAutoTLS(r); err != nil {
+		return err
+	}
+	if err := validateBackendProtocol(r); err != nil {
+		return err
+	}
+	if err := validateAccessLog(r); err != nil {
+		return err
+	}
+	if err := validateRewrites(r); err != nil {
+		return err
+	}
+	if err := validateAccessControl(r); err != nil {
+		return err
+	}
+	if err := validateCache(r); err != nil {
+		return err
+	}
+	if err := validateCompression(r); err != nil {
+		return err
+	}
+	if err := validateResilience(r); err != nil {
+		return err
+	}
+	if err := validateLoadBalancer(r); err != nil {
+		return err
+	}
+	if err := validateMirror(r); err != nil {
+		return err
+	}
 	tx, err := d.pgx.Begin()
 	if err != nil {
 		return err
@@ -118,6 +173,30 @@ func (d *pgDataStore) addHTTP(r *router.Route) error {
 		r.Domain,
 		r.Sticky,
 		r.Path,
+		r.ReleaseID,
+		r.Services,
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+		r.AutoTLS,
+		r.BackendProtocol,
+		r.AccessLog,
+		r.RequestHeaders,
+		r.ResponseHeaders,
+		r.HTTPSRedirect,
+		r.Redirect,
+		r.StripPrefix,
+		r.AllowIPs,
+		r.DenyIPs,
+		r.BasicAuth,
+		r.Cache,
+		r.Compression,
+		r.UpstreamTimeout,
+		r.CircuitBreaker,
+		r.RetryBudget,
+		r.LoadBalancer,
+		r.Mirror,
 	).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt); err != nil {
 		tx.Rollback()
 		return err
@@ -129,7 +208,387 @@ func (d *pgDataStore) addHTTP(r *router.Route) error {
 	return tx.Commit()
 }
 
+// validateHTTPServices checks the weighted services of an HTTP route, and
+// sets the route's service to the first of them if it is not set
+func validateHTTPServices(r *router.Route) error {
+	if len(r.Services) == 0 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(r.Services))
+	for _, s := range r.Services {
+		if s == nil || s.Service == "" {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Weighted service name must be set",
+			}
+		}
+		if s.Weight < 1 {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Weight of service %q must be at least 1", s.Service),
+			}
+		}
+		if _, ok := seen[s.Service]; ok {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Service %q is listed more than once", s.Service),
+			}
+		}
+		seen[s.Service] = struct{}{}
+	}
+	if r.Service == "" {
+		r.Service = r.Services[0].Service
+	}
+	return nil
+}
+
+// validateAutoTLS checks that automatic TLS is only enabled on routes whose
+// domain can be validated with an ACME HTTP-01 challenge
+func validateAutoTLS(r *router.Route) error {
+	if !r.AutoTLS {
+		return nil
+	}
+	if strings.HasPrefix(r.Domain, "*.") {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Automatic TLS cannot be used with wildcard domains",
+		}
+	}
+	if r.Path != "" && r.Path != "/" {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Automatic TLS can only be enabled on the default route of a domain",
+		}
+	}
+	return nil
+}
+
+// validateBackendProtocol checks that the route uses a supported protocol to
+// proxy requests to its backends
+func validateBackendProtocol(r *router.Route) error {
+	switch r.BackendProtocol {
+	case "", router.BackendProtocolHTTP1, router.BackendProtocolH2C:
+		return nil
+	default:
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: fmt.Sprintf("Backend protocol must be either %q or %q", router.BackendProtocolHTTP1, router.BackendProtocolH2C),
+		}
+	}
+}
+
+// validateAccessLog checks the access log configuration of an HTTP route
+func validateAccessLog(r *router.Route) error {
+	if r.AccessLog == nil {
+		return nil
+	}
+	if r.AccessLog.SampleRate < 0 || r.AccessLog.SampleRate > 1 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Access log sample rate must be between 0 and 1",
+		}
+	}
+	return nil
+}
+
+// validateRewrites checks the header rules, redirects and prefix stripping of
+// an HTTP route
+func validateRewrites(r *router.Route) error {
+	for _, rules := range []*router.HeaderRules{r.RequestHeaders, r.ResponseHeaders} {
+		if rules == nil {
+			continue
+		}
+		names := make([]string, 0, len(rules.Set)+len(rules.Add)+len(rules.Remove))
+		for name := range rules.Set {
+			names = append(names, name)
+		}
+		for name := range rules.Add {
+			names = append(names, name)
+		}
+		names = append(names, rules.Remove...)
+		for _, name := range names {
+			if !validHeaderName(name) {
+				return httphelper.JSONError{
+					Code:    httphelper.ValidationErrorCode,
+					Message: fmt.Sprintf("Invalid header name %q", name),
+				}
+			}
+		}
+	}
+	if rd := r.Redirect; rd != nil {
+		if rd.Domain == "" || strings.ContainsAny(rd.Domain, "/?# ") {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Redirect domain must be a domain name",
+			}
+		}
+		if rd.Status != 0 && rd.Status != http.StatusMovedPermanently && rd.Status != http.StatusFound {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Redirect status must be either 301 or 302",
+			}
+		}
+	}
+	if r.StripPrefix && (r.Path == "" || r.Path == "/") {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Strip prefix can only be enabled on routes with a path",
+		}
+	}
+	return nil
+}
+
+// validateAccessControl checks the IP lists and basic auth credentials of an
+// HTTP route
+func validateAccessControl(r *router.Route) error {
+	for _, ips := range [][]string{r.AllowIPs, r.DenyIPs} {
+		if _, err := parseIPNets(ips); err != nil {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: err.Error(),
+			}
+		}
+	}
+	if r.BasicAuth == nil {
+		return nil
+	}
+	if len(r.BasicAuth.Users) == 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Basic auth requires at least one user",
+		}
+	}
+	for user, hash := range r.BasicAuth.Users {
+		if user == "" || strings.Contains(user, ":") {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Invalid basic auth username %q", user),
+			}
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Basic auth password of user %q must be a bcrypt hash", user),
+			}
+		}
+	}
+	return nil
+}
+
+// validateCache checks the size limits of an HTTP route's response cache
+func validateCache(r *router.Route) error {
+	c := r.Cache
+	if c == nil {
+		return nil
+	}
+	if c.MaxMemory < 0 || c.MaxDisk < 0 || c.MaxObjectSize < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Cache sizes must not be negative",
+		}
+	}
+	maxMemory, maxObjectSize := cacheLimits(c)
+	if maxObjectSize > maxMemory {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Cache max object size must not be greater than its max memory",
+		}
+	}
+	return nil
+}
+
+// validateCompression checks the response compression config of an HTTP route
+func validateCompression(r *router.Route) error {
+	c := r.Compression
+	if c == nil {
+		return nil
+	}
+	if c.MinSize < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Compression min size must not be negative",
+		}
+	}
+	for _, t := range c.Types {
+		if !validContentType(t) {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Invalid compression content type %q", t),
+			}
+		}
+	}
+	return nil
+}
+
+// validateResilience checks the upstream timeout, circuit breaker and retry
+// budget of an HTTP route
+func validateResilience(r *router.Route) error {
+	if r.UpstreamTimeout < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Upstream timeout must not be negative",
+		}
+	}
+	if cb := r.CircuitBreaker; cb != nil && (cb.ConsecutiveFailures < 0 || cb.Cooldown < 0) {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Circuit breaker failures and cooldown must not be negative",
+		}
+	}
+	if rb := r.RetryBudget; rb != nil && (rb.Ratio < 0 || rb.MinRetriesPerSecond < 0) {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Retry budget ratio and minimum retries must not be negative",
+		}
+	}
+	return nil
+}
+
+// validateLoadBalancer checks the load balancing algorithm of an HTTP route
+// and that only hashing routes have a hash key
+func validateLoadBalancer(r *router.Route) error {
+	lb := r.LoadBalancer
+	if lb == nil {
+		return nil
+	}
+	switch lb.Algorithm {
+	case router.LoadBalancerRandom, router.LoadBalancerRoundRobin, router.LoadBalancerLeastRequests:
+		if lb.HashHeader != "" || lb.HashCookie != "" {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Hash header and cookie can only be set with the %q load balancer", router.LoadBalancerHash),
+			}
+		}
+	case router.LoadBalancerHash:
+		if (lb.HashHeader == "") == (lb.HashCookie == "") {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: "Hash load balancer requires either a hash header or a hash cookie",
+			}
+		}
+		if lb.HashHeader != "" && !validHeaderName(lb.HashHeader) {
+			return httphelper.JSONError{
+				Code:    httphelper.ValidationErrorCode,
+				Message: fmt.Sprintf("Invalid header name %q", lb.HashHeader),
+			}
+		}
+	default:
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: fmt.Sprintf("Load balancer must be one of %q, %q, %q or %q", router.LoadBalancerRandom, router.LoadBalancerRoundRobin, router.LoadBalancerLeastRequests, router.LoadBalancerHash),
+		}
+	}
+	return nil
+}
+
+// validateMirror checks the request mirroring of an HTTP route
+func validateMirror(r *router.Route) error {
+	m := r.Mirror
+	if m == nil {
+		return nil
+	}
+	if m.Service == "" {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Mirror service must be set",
+		}
+	}
+	if m.Percentage < 0 || m.Percentage > 100 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Mirror percentage must be between 0 and 100",
+		}
+	}
+	return nil
+}
+
+// validContentType returns whether t is a media type without parameters,
+// allowing a wildcard subtype
+func validContentType(t string) bool {
+	parts := strings.Split(t, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+		return false
+	}
+	if parts[1] == "*" {
+		t = parts[0] + "/x"
+	}
+	mediaType, params, err := mime.ParseMediaType(t)
+	return err == nil && len(params) == 0 && mediaType == strings.ToLower(t)
+}
+
+// validHeaderName returns whether name is a valid HTTP header field name
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateLimits checks the rate and connection limits of a route
+func validateLimits(r *router.Route) error {
+	if r.RateLimit < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Rate limit must not be negative",
+		}
+	}
+	if r.RateLimitBurst < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Rate limit burst must not be negative",
+		}
+	}
+	if r.RateLimitBurst > 0 && r.RateLimit == 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Rate limit burst requires a rate limit",
+		}
+	}
+	if r.MaxConns < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Max connections must not be negative",
+		}
+	}
+	return nil
+}
+
+// validateHealthCheck checks the active health check of a route
+func validateHealthCheck(r *router.Route) error {
+	hc := r.HealthCheck
+	if hc == nil {
+		return nil
+	}
+	if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Health check path must start with a /",
+		}
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Health check interval and timeout must not be negative",
+		}
+	}
+	if hc.UnhealthyThreshold < 0 || hc.HealthyThreshold < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Health check thresholds must not be negative",
+		}
+	}
+	return nil
+}
+
 func (d *pgDataStore) addTCP(r *router.Route) error {
+	if err := validateProxyProtocol(r); err != nil {
+		return err
+	}
 	return d.pgx.QueryRow(
 		"insert_tcp_route",
 		r.ParentRef,
@@ -137,9 +596,90 @@ func (d *pgDataStore) addTCP(r *router.Route) error {
 		r.Leader,
 		r.DrainBackends,
 		r.Port,
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+		r.ProxyProtocol,
 	).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
 }
 
+// validateProxyProtocol checks that the route sends a supported version of
+// the PROXY protocol to its backends
+func validateProxyProtocol(r *router.Route) error {
+	switch r.ProxyProtocol {
+	case "", router.ProxyProtocolV1, router.ProxyProtocolV2:
+		return nil
+	default:
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: fmt.Sprintf("PROXY protocol version must be either %q or %q", router.ProxyProtocolV1, router.ProxyProtocolV2),
+		}
+	}
+}
+
+func (d *pgDataStore) addTLS(r *router.Route) error {
+	if err := validateTLSDomain(r); err != nil {
+		return err
+	}
+	r.Domain = strings.ToLower(r.Domain)
+	return d.pgx.QueryRow(
+		"insert_tls_route",
+		r.ParentRef,
+		r.Service,
+		r.Leader,
+		r.DrainBackends,
+		r.Domain,
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+	).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
+}
+
+func (d *pgDataStore) addUDP(r *router.Route) error {
+	if err := validateIdleTimeout(r); err != nil {
+		return err
+	}
+	return d.pgx.QueryRow(
+		"insert_udp_route",
+		r.ParentRef,
+		r.Service,
+		r.Leader,
+		r.Port,
+		r.IdleTimeout,
+	).Scan(&r.ID, &r.CreatedAt, &r.UpdatedAt)
+}
+
+// validateIdleTimeout checks the session idle timeout of a UDP route
+func validateIdleTimeout(r *router.Route) error {
+	if r.IdleTimeout < 0 {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Idle timeout must not be negative",
+		}
+	}
+	return nil
+}
+
+// validateTLSDomain checks the domain of a TLS route is a host name which can
+// be matched against the server name sent by clients
+func validateTLSDomain(r *router.Route) error {
+	if r.Domain == "" {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: "Domain must be set",
+		}
+	}
+	if strings.ContainsAny(r.Domain, "/: ") {
+		return httphelper.JSONError{
+			Code:    httphelper.ValidationErrorCode,
+			Message: fmt.Sprintf("Invalid domain %q, TLS routes cannot have a path or port", r.Domain),
+		}
+	}
+	return nil
+}
+
 func (d *pgDataStore) AddCert(c *router.Certificate) error {
 	tx, err := d.pgx.Begin()
 	if err != nil {
@@ -269,14 +809,128 @@ func (d *pgDataStore) RemoveCert(id string) error {
 	return tx.Commit()
 }
 
+// acmeStore stores the ACME account keys and pending HTTP-01 challenges used
+// to automatically obtain certificates for routes with AutoTLS enabled
+type acmeStore interface {
+	GetACMEAccount(directoryURL string) (string, error)
+	AddACMEAccount(directoryURL, key string) error
+	GetACMEChallenge(token string) (string, error)
+	AddACMEChallenge(token, keyAuth string) error
+	RemoveACMEChallenge(token string) error
+}
+
+// GetACMEAccount returns the PEM encoded key of the account registered with
+// the given ACME directory, or ErrNotFound if there is no account
+func (d *pgDataStore) GetACMEAccount(directoryURL string) (string, error) {
+	var key string
+	err := d.pgx.QueryRow("select_acme_account", directoryURL).Scan(&key)
+	if err == pgx.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return key, err
+}
+
+// AddACMEAccount stores the account key for the given ACME directory, leaving
+// any existing key in place so that concurrent routers agree on the account
+func (d *pgDataStore) AddACMEAccount(directoryURL, key string) error {
+	_, err := d.pgx.Exec("insert_acme_account", directoryURL, key)
+	return err
+}
+
+// GetACMEChallenge returns the key authorization for the given HTTP-01
+// challenge token, or ErrNotFound if there is no pending challenge
+func (d *pgDataStore) GetACMEChallenge(token string) (string, error) {
+	var keyAuth string
+	err := d.pgx.QueryRow("select_acme_challenge", token).Scan(&keyAuth)
+	if err == pgx.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return keyAuth, err
+}
+
+func (d *pgDataStore) AddACMEChallenge(token, keyAuth string) error {
+	_, err := d.pgx.Exec("insert_acme_challenge", token, keyAuth)
+	return err
+}
+
+func (d *pgDataStore) RemoveACMEChallenge(token string) error {
+	_, err := d.pgx.Exec("delete_acme_challenge", token)
+	return err
+}
+
+// cachePurgeChannel is the channel used to notify all routers of cache purges
+const cachePurgeChannel = "http_route_cache_purges"
+
+// cacheStore propagates cache purges to all routers, since each router has
+// its own response cache
+type cacheStore interface {
+	PurgeCache(purge *router.CachePurge) error
+	WatchCachePurges(ctx context.Context, f func(*router.CachePurge)) error
+}
+
+// PurgeCache notifies all routers watching cache purges of the given purge
+func (d *pgDataStore) PurgeCache(purge *router.CachePurge) error {
+	data, err := json.Marshal(purge)
+	if err != nil {
+		return err
+	}
+	_, err = d.pgx.Exec("notify_cache_purge", string(data))
+	return err
+}
+
+// WatchCachePurges calls f with each cache purge until either the context is
+// done, in which case it returns nil, or the notification connection fails
+func (d *pgDataStore) WatchCachePurges(ctx context.Context, f func(*router.CachePurge)) error {
+	conn, err := d.pgx.Acquire()
+	if err != nil {
+		return err
+	}
+	if err := conn.Listen(cachePurgeChannel); err != nil {
+		d.pgx.Release(conn)
+		return err
+	}
+	defer unlistenAndRelease(d.pgx, conn, cachePurgeChannel)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		notification, err := conn.WaitForNotification(time.Second)
+		if err == pgx.ErrNotificationTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		purge := &router.CachePurge{}
+		if err := json.Unmarshal([]byte(notification.Payload), purge); err != nil {
+			logger.Error("error decoding cache purge", "fn", "WatchCachePurges", "err", err)
+			continue
+		}
+		f(purge)
+	}
+}
+
 func (d *pgDataStore) Update(r *router.Route) error {
-	var err error
+	if err := validateLimits(r); err != nil {
+		return err
+	}
+	if err := validateHealthCheck(r); err != nil {
+		return err
+	}
 
+	var err error
 	switch d.tableName {
 	case tableNameHTTP:
 		err = d.updateHTTP(r)
 	case tableNameTCP:
 		err = d.updateTCP(r)
+	case tableNameTLS:
+		err = d.updateTLS(r)
+	case tableNameUDP:
+		err = d.updateUDP(r)
 	}
 	if err == pgx.ErrNoRows {
 		return ErrNotFound
@@ -285,6 +939,39 @@ func (d *pgDataStore) Update(r *router.Route) error {
 }
 
 func (d *pgDataStore) updateHTTP(r *router.Route) error {
+	if err := validateHTTPServices(r); err != nil {
+		return err
+	}
+	if err := validateAutoTLS(r); err != nil {
+		return err
+	}
+	if err := validateBackendProtocol(r); err != nil {
+		return err
+	}
+	if err := validateAccessLog(r); err != nil {
+		return err
+	}
+	if err := validateRewrites(r); err != nil {
+		return err
+	}
+	if err := validateAccessControl(r); err != nil {
+		return err
+	}
+	if err := validateCache(r); err != nil {
+		return err
+	}
+	if err := validateCompression(r); err != nil {
+		return err
+	}
+	if err := validateResilience(r); err != nil {
+		return err
+	}
+	if err := validateLoadBalancer(r); err != nil {
+		return err
+	}
+	if err := validateMirror(r); err != nil {
+		return err
+	}
 	tx, err := d.pgx.Begin()
 	if err != nil {
 		return err
@@ -298,6 +985,30 @@ func (d *pgDataStore) updateHTTP(r *router.Route) error {
 		r.Path,
 		r.ID,
 		r.Domain,
+		r.ReleaseID,
+		r.Services,
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+		r.AutoTLS,
+		r.BackendProtocol,
+		r.AccessLog,
+		r.RequestHeaders,
+		r.ResponseHeaders,
+		r.HTTPSRedirect,
+		r.Redirect,
+		r.StripPrefix,
+		r.AllowIPs,
+		r.DenyIPs,
+		r.BasicAuth,
+		r.Cache,
+		r.Compression,
+		r.UpstreamTimeout,
+		r.CircuitBreaker,
+		r.RetryBudget,
+		r.LoadBalancer,
+		r.Mirror,
 	)); err != nil {
 		tx.Rollback()
 		return err
@@ -310,6 +1021,9 @@ func (d *pgDataStore) updateHTTP(r *router.Route) error {
 }
 
 func (d *pgDataStore) updateTCP(r *router.Route) error {
+	if err := validateProxyProtocol(r); err != nil {
+		return err
+	}
 	return d.scanRoute(r, d.pgx.QueryRow(
 		"update_tcp_route",
 		r.ParentRef,
@@ -317,6 +1031,41 @@ func (d *pgDataStore) updateTCP(r *router.Route) error {
 		r.Leader,
 		r.ID,
 		r.Port,
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+		r.ProxyProtocol,
+	))
+}
+
+func (d *pgDataStore) updateTLS(r *router.Route) error {
+	return d.scanRoute(r, d.pgx.QueryRow(
+		"update_tls_route",
+		r.ParentRef,
+		r.Service,
+		r.Leader,
+		r.ID,
+		strings.ToLower(r.Domain),
+		r.RateLimit,
+		r.RateLimitBurst,
+		r.MaxConns,
+		r.HealthCheck,
+	))
+}
+
+func (d *pgDataStore) updateUDP(r *router.Route) error {
+	if err := validateIdleTimeout(r); err != nil {
+		return err
+	}
+	return d.scanRoute(r, d.pgx.QueryRow(
+		"update_udp_route",
+		r.ParentRef,
+		r.Service,
+		r.Leader,
+		r.ID,
+		r.Port,
+		r.IdleTimeout,
 	))
 }
 
@@ -327,6 +1076,10 @@ func (d *pgDataStore) Remove(id string) error {
 		query = "delete_tcp_route"
 	case tableNameHTTP:
 		query = "delete_http_route"
+	case tableNameTLS:
+		query = "delete_tls_route"
+	case tableNameUDP:
+		query = "delete_udp_route"
 	}
 	_, err := d.pgx.Exec(query, id)
 	if postgres.IsPostgresCode(err, postgres.RaiseException) {
@@ -346,6 +1099,10 @@ func (d *pgDataStore) Get(id string) (*router.Route, error) {
 		query = "select_http_route"
 	case tableNameTCP:
 		query = "select_tcp_route"
+	case tableNameTLS:
+		query = "select_tls_route"
+	case tableNameUDP:
+		query = "select_udp_route"
 	}
 	row := d.pgx.QueryRow(query, id)
 
@@ -368,6 +1125,10 @@ func (d *pgDataStore) List() ([]*router.Route, error) {
 		query = "list_http_routes"
 	case tableNameTCP:
 		query = "list_tcp_routes"
+	case tableNameTLS:
+		query = "list_tls_routes"
+	case tableNameUDP:
+		query = "list_udp_routes"
 	}
 	rows, err := d.pgx.Query(query)
 	if err != nil {
@@ -512,6 +1273,30 @@ func (d *pgDataStore) scanRouteWithoutCert(route *router.Route, s scannable) err
 			&route.Domain,
 			&route.Sticky,
 			&route.Path,
+			&route.ReleaseID,
+			&route.Services,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.AutoTLS,
+			&route.BackendProtocol,
+			&route.AccessLog,
+			&route.RequestHeaders,
+			&route.ResponseHeaders,
+			&route.HTTPSRedirect,
+			&route.Redirect,
+			&route.StripPrefix,
+			&route.AllowIPs,
+			&route.DenyIPs,
+			&route.BasicAuth,
+			&route.Cache,
+			&route.Compression,
+			&route.UpstreamTimeout,
+			&route.CircuitBreaker,
+			&route.RetryBudget,
+			&route.LoadBalancer,
+			&route.Mirror,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
@@ -523,6 +1308,39 @@ func (d *pgDataStore) scanRouteWithoutCert(route *router.Route, s scannable) err
 			&route.Leader,
 			&route.DrainBackends,
 			&route.Port,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.ProxyProtocol,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+
+	case tableNameTLS:
+		return s.Scan(
+			&route.ID,
+			&route.ParentRef,
+			&route.Service,
+			&route.Leader,
+			&route.DrainBackends,
+			&route.Domain,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+
+	case tableNameUDP:
+		return s.Scan(
+			&route.ID,
+			&route.ParentRef,
+			&route.Service,
+			&route.Leader,
+			&route.Port,
+			&route.IdleTimeout,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
@@ -545,6 +1363,30 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 			&route.Domain,
 			&route.Sticky,
 			&route.Path,
+			&route.ReleaseID,
+			&route.Services,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.AutoTLS,
+			&route.BackendProtocol,
+			&route.AccessLog,
+			&route.RequestHeaders,
+			&route.ResponseHeaders,
+			&route.HTTPSRedirect,
+			&route.Redirect,
+			&route.StripPrefix,
+			&route.AllowIPs,
+			&route.DenyIPs,
+			&route.BasicAuth,
+			&route.Cache,
+			&route.Compression,
+			&route.UpstreamTimeout,
+			&route.CircuitBreaker,
+			&route.RetryBudget,
+			&route.LoadBalancer,
+			&route.Mirror,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 			&certID,
@@ -573,6 +1415,39 @@ func (d *pgDataStore) scanRoute(route *router.Route, s scannable) error {
 			&route.Leader,
 			&route.DrainBackends,
 			&route.Port,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.ProxyProtocol,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+
+	case tableNameTLS:
+		return s.Scan(
+			&route.ID,
+			&route.ParentRef,
+			&route.Service,
+			&route.Leader,
+			&route.DrainBackends,
+			&route.Domain,
+			&route.RateLimit,
+			&route.RateLimitBurst,
+			&route.MaxConns,
+			&route.HealthCheck,
+			&route.CreatedAt,
+			&route.UpdatedAt,
+		)
+
+	case tableNameUDP:
+		return s.Scan(
+			&route.ID,
+			&route.ParentRef,
+			&route.Service,
+			&route.Leader,
+			&route.Port,
+			&route.IdleTimeout,
 			&route.CreatedAt,
 			&route.UpdatedAt,
 		)
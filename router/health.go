@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/health"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	defaultHealthCheckInterval  = 5 * time.Second
+	defaultHealthCheckThreshold = 2
+)
+
+// healthCheckTarget is a service whose backends are checked by a
+// healthChecker, along with a function which lists the route's backends in
+// the service
+type healthCheckTarget struct {
+	service  *service
+	backends proxy.BackendListFunc
+}
+
+// healthChecker actively checks the health of a route's backends, ejecting
+// backends which fail UnhealthyThreshold consecutive checks until they pass
+// HealthyThreshold consecutive checks. Ejections are sent to the watch manager
+// as backend-ejected and backend-restored events.
+//
+// It implements proxy.BackendHealth so that the route's proxy can skip ejected
+// backends.
+type healthChecker struct {
+	route   *router.Route
+	targets []healthCheckTarget
+	wm      *WatchManager
+
+	interval           time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+
+	// newCheck returns the health check for the backend with the given
+	// address
+	newCheck func(addr string) health.Check
+
+	mtx      sync.RWMutex
+	backends map[string]*backendHealth
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type backendHealth struct {
+	backend   *router.Backend
+	ejected   bool
+	successes int
+	failures  int
+}
+
+func newHealthChecker(route *router.Route, targets []healthCheckTarget, wm *WatchManager, newCheck func(string) health.Check) *healthChecker {
+	config := route.HealthCheck
+	h := &healthChecker{
+		route:              route,
+		targets:            targets,
+		wm:                 wm,
+		interval:           config.Interval,
+		unhealthyThreshold: config.UnhealthyThreshold,
+		healthyThreshold:   config.HealthyThreshold,
+		newCheck:           newCheck,
+		backends:           make(map[string]*backendHealth),
+		stop:               make(chan struct{}),
+	}
+	if h.interval == 0 {
+		h.interval = defaultHealthCheckInterval
+	}
+	if h.unhealthyThreshold == 0 {
+		h.unhealthyThreshold = defaultHealthCheckThreshold
+	}
+	if h.healthyThreshold == 0 {
+		h.healthyThreshold = defaultHealthCheckThreshold
+	}
+	return h
+}
+
+// newHTTPHealthChecker returns a healthChecker which checks backends by
+// requesting the configured path using the route's domain as the Host header
+func newHTTPHealthChecker(route *router.Route, targets []healthCheckTarget, wm *WatchManager) *healthChecker {
+	path := route.HealthCheck.Path
+	if path == "" {
+		path = "/"
+	}
+	timeout := route.HealthCheck.Timeout
+	return newHealthChecker(route, targets, wm, func(addr string) health.Check {
+		return &health.HTTPCheck{
+			URL:     "http://" + addr + path,
+			Host:    route.Domain,
+			Timeout: timeout,
+		}
+	})
+}
+
+// newTCPHealthChecker returns a healthChecker which checks backends by
+// connecting to them
+func newTCPHealthChecker(route *router.Route, targets []healthCheckTarget, wm *WatchManager) *healthChecker {
+	timeout := route.HealthCheck.Timeout
+	return newHealthChecker(route, targets, wm, func(addr string) health.Check {
+		return &health.TCPCheck{Addr: addr, Timeout: timeout}
+	})
+}
+
+// Start starts checking backends in a goroutine (Start and Stop are safe to
+// call on a nil healthChecker so routes without a health check can call them
+// unconditionally)
+func (h *healthChecker) Start() {
+	if h == nil {
+		return
+	}
+	go h.run()
+}
+
+func (h *healthChecker) Stop() {
+	if h == nil {
+		return
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// Healthy returns whether the given backend is healthy, with backends which
+// have not been checked yet considered healthy since discoverd only
+// registers instances which are passing their own health checks
+func (h *healthChecker) Healthy(addr string) bool {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	b, ok := h.backends[addr]
+	return !ok || !b.ejected
+}
+
+func (h *healthChecker) run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkBackends()
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkBackends checks all the route's current backends concurrently, then
+// updates their health and sends events for any which have been ejected or
+// restored
+func (h *healthChecker) checkBackends() {
+	backends := make(map[string]*router.Backend)
+	for _, t := range h.targets {
+		jobIDs := make(map[string]string)
+		for _, inst := range t.service.sc.Instances() {
+			jobIDs[inst.Addr] = inst.Meta["FLYNN_JOB_ID"]
+		}
+		for _, addr := range t.backends() {
+			backends[addr] = &router.Backend{
+				Service: t.service.name,
+				Addr:    addr,
+				JobID:   jobIDs[addr],
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	var resultsMtx sync.Mutex
+	results := make(map[string]error, len(backends))
+	for addr := range backends {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := h.newCheck(addr).Check()
+			resultsMtx.Lock()
+			results[addr] = err
+			resultsMtx.Unlock()
+		}(addr)
+	}
+	wg.Wait()
+
+	select {
+	case <-h.stop:
+		return
+	default:
+	}
+
+	var events []*router.Event
+	h.mtx.Lock()
+	for addr := range h.backends {
+		if _, ok := backends[addr]; !ok {
+			delete(h.backends, addr)
+		}
+	}
+	for addr, err := range results {
+		b, ok := h.backends[addr]
+		if !ok {
+			b = &backendHealth{backend: backends[addr]}
+			h.backends[addr] = b
+		}
+		if err != nil {
+			b.successes = 0
+			b.failures++
+			if !b.ejected && b.failures >= h.unhealthyThreshold {
+				b.ejected = true
+				logger.Warn("ejecting unhealthy backend", "route", h.route.FormattedID(), "service", b.backend.Service, "backend", addr, "err", err)
+				events = append(events, h.event(router.EventTypeBackendEjected, b.backend))
+			}
+		} else {
+			b.failures = 0
+			b.successes++
+			if b.ejected && b.successes >= h.healthyThreshold {
+				b.ejected = false
+				logger.Info("restoring healthy backend", "route", h.route.FormattedID(), "service", b.backend.Service, "backend", addr)
+				events = append(events, h.event(router.EventTypeBackendRestored, b.backend))
+			}
+		}
+	}
+	h.mtx.Unlock()
+
+	for _, e := range events {
+		h.wm.Send(e)
+	}
+}
+
+func (h *healthChecker) event(typ router.EventType, backend *router.Backend) *router.Event {
+	return &router.Event{
+		Event:   typ,
+		ID:      h.route.ID,
+		Route:   h.route,
+		Backend: backend,
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -50,6 +51,26 @@ type HTTPListener struct {
 	keypair       tls.Certificate
 	proxyProtocol bool
 
+	// acme obtains certificates for routes with AutoTLS enabled, it is nil
+	// if automatic TLS is not configured
+	acme *acmeManager
+
+	metrics *Metrics
+
+	// accessLog sends the access logs of routes with them enabled to the
+	// logs of their apps, it is nil if access logs are not configured
+	accessLog *accessLogger
+
+	// cacheDir is the directory which routes with caching enabled store
+	// responses in, with responses only being cached in memory if it is
+	// empty
+	cacheDir string
+
+	// passthrough serves the TLS passthrough routes which connections to
+	// TLSAddr are forwarded to rather than being terminated, it is nil if
+	// TLS passthrough is not configured
+	passthrough *TLSListener
+
 	preSync  func()
 	postSync func(<-chan struct{})
 }
@@ -66,6 +87,12 @@ func (s *HTTPListener) Close() error {
 		return nil
 	}
 	s.stopSync()
+	s.acme.Stop()
+	s.accessLog.Stop()
+	for _, r := range s.routes {
+		r.health.Stop()
+		r.cache.Close()
+	}
 	for _, service := range s.services {
 		service.sc.Close()
 	}
@@ -114,6 +141,13 @@ func (s *HTTPListener) Start() error {
 		return err
 	}
 
+	if store, ok := s.ds.(cacheStore); ok {
+		go s.watchCachePurges(ctx, store)
+	}
+
+	s.acme.Start()
+	s.accessLog.Start()
+
 	return nil
 }
 
@@ -178,6 +212,42 @@ func (s *HTTPListener) startListen() error {
 	return nil
 }
 
+// watchCachePurges purges the caches of routes when notified by the data
+// store until the context is done
+func (s *HTTPListener) watchCachePurges(ctx context.Context, store cacheStore) {
+	for {
+		err := store.WatchCachePurges(ctx, s.purgeCache)
+		if err == nil {
+			return
+		}
+		log.Printf("router: error watching cache purges: %s", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (s *HTTPListener) purgeCache(purge *router.CachePurge) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if r, ok := s.routes[purge.RouteID]; ok {
+		r.cache.Purge(purge.Prefix)
+	}
+}
+
+// PurgeCache removes cached responses of a route from the caches of all
+// routers
+func (s *HTTPListener) PurgeCache(purge *router.CachePurge) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	store, ok := s.ds.(cacheStore)
+	if !ok {
+		return errors.New("router: data store does not support cache purges")
+	}
+	return store.PurgeCache(purge)
+}
+
 var ErrClosed = errors.New("router: listener has been closed")
 
 func (s *HTTPListener) AddRoute(r *router.Route) error {
@@ -273,7 +343,15 @@ func (h *httpSyncHandler) Current() map[string]struct{} {
 
 func (h *httpSyncHandler) Set(data *router.Route) error {
 	route := data.HTTPRoute()
-	r := &httpRoute{HTTPRoute: route}
+	access, err := newRouteAccessControl(route)
+	if err != nil {
+		return err
+	}
+	r := &httpRoute{
+		HTTPRoute: route,
+		limiter:   newRouteLimiter(route.RateLimit, route.RateLimitBurst, route.MaxConns),
+		access:    access,
+	}
 	cert := r.Certificate
 
 	if cert != nil && cert.Cert != "" && cert.Key != "" {
@@ -291,33 +369,133 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		return nil
 	}
 
-	service := h.l.services[r.Service]
-	if service != nil && service.name != r.Service {
-		service.refs--
-		if service.refs <= 0 {
-			service.Close()
-			delete(h.l.services, service.name)
+	names := []string{r.Service}
+	if len(r.Services) > 0 {
+		names = make([]string, len(r.Services))
+		for i, s := range r.Services {
+			names[i] = s.Service
+		}
+	}
+	services := make([]*service, 0, len(names))
+	for _, name := range names {
+		service, err := h.l.acquireService(name, r.DrainBackends)
+		if err != nil {
+			for _, s := range services {
+				h.l.releaseService(s)
+			}
+			return err
 		}
-		service = nil
+		services = append(services, service)
 	}
-	if service == nil {
-		sc, err := cache.New(h.l.discoverd.Service(r.Service))
+	if r.Mirror != nil {
+		mirror, err := h.l.acquireService(r.Mirror.Service, false)
 		if err != nil {
+			for _, s := range services {
+				h.l.releaseService(s)
+			}
 			return err
 		}
+		r.mirror = mirror
+	}
 
-		service = newService(r.Service, sc, h.l.wm, r.DrainBackends)
-		h.l.services[r.Service] = service
+	// release the services of the route being replaced now that the new
+	// ones have been acquired so that any shared services stay open, and
+	// keep its cache if the cache config has not changed
+	prev, ok := h.l.routes[data.ID]
+	if ok {
+		for _, s := range prev.services {
+			h.l.releaseService(s)
+		}
+		if prev.mirror != nil {
+			h.l.releaseService(prev.mirror)
+		}
+		prev.health.Stop()
+		if prev.Cache != nil && r.Cache != nil && *prev.Cache == *r.Cache {
+			r.cache = prev.cache
+		} else {
+			prev.cache.Close()
+		}
 	}
-	service.refs++
-	var bf proxy.BackendListFunc
-	if r.Leader {
-		bf = service.sc.LeaderAddr
+	if r.Cache != nil && r.cache == nil {
+		var dir string
+		if h.l.cacheDir != "" {
+			dir = filepath.Join(h.l.cacheDir, data.ID)
+		}
+		r.cache = newResponseCache(r.Cache, dir)
+	}
+
+	r.service = services[0]
+	r.services = services
+	if len(r.Services) > 0 {
+		backends := make([]proxy.WeightedBackendList, len(services))
+		for i, s := range services {
+			backends[i] = proxy.WeightedBackendList{
+				Backends: r.backendListFunc(s),
+				Weight:   r.Services[i].Weight,
+			}
+		}
+		tracker := newServiceGroup(services)
+		r.rp = proxy.NewWeightedReverseProxy(backends, h.l.cookieKey, r.Sticky, tracker, logger)
 	} else {
-		bf = service.sc.Addrs
+		r.rp = proxy.NewReverseProxy(r.backendListFunc(r.service), h.l.cookieKey, r.Sticky, r.service, logger)
+	}
+	if r.BackendProtocol == router.BackendProtocolH2C {
+		r.rp.UseH2C()
+	}
+	if lb := newLoadBalancer(data, services); lb != nil {
+		r.rp.SetLoadBalancer(lb)
+	}
+	if r.mirror != nil {
+		percentage := r.Mirror.Percentage
+		if percentage == 0 {
+			percentage = 100
+		}
+		r.rp.SetMirror(r.mirror.sc.Addrs, percentage)
+	}
+	if r.RequestHeaders != nil || r.ResponseHeaders != nil || r.StripPrefix {
+		rewrite := &proxy.Rewrite{
+			RequestHeaders:  r.RequestHeaders,
+			ResponseHeaders: r.ResponseHeaders,
+		}
+		if r.StripPrefix {
+			rewrite.StripPrefix = r.Path
+		}
+		r.rp.SetRewrite(rewrite)
+	}
+	if r.Compression != nil {
+		r.rp.SetCompression(r.Compression)
+	}
+	serviceAddrs := make([]proxy.BackendListFunc, len(services))
+	for i, s := range services {
+		serviceAddrs[i] = s.sc.Addrs
+	}
+	if m := h.l.metrics.Route(data, serviceAddrs...); m != nil {
+		r.observers = append(r.observers, m)
+	}
+	if a := h.l.accessLog.Route(data); a != nil {
+		r.observers = append(r.observers, a)
+	}
+	if len(r.observers) > 0 {
+		r.rp.SetObserver(r.observers)
+	}
+	if r.breakers = newCircuitBreakers(data); r.breakers != nil {
+		r.rp.SetCircuitBreaker(r.breakers)
+	}
+	if budget := newRetryBudget(data); budget != nil {
+		r.rp.SetRetryBudget(budget)
+	}
+	if r.UpstreamTimeout > 0 {
+		r.rp.SetUpstreamTimeout(r.UpstreamTimeout)
+	}
+	if r.HealthCheck != nil {
+		targets := make([]healthCheckTarget, len(services))
+		for i, s := range services {
+			targets[i] = healthCheckTarget{service: s, backends: r.backendListFunc(s)}
+		}
+		r.health = newHTTPHealthChecker(r.ToRoute(), targets, h.l.wm)
+		r.rp.SetBackendHealth(r.health)
+		r.health.Start()
 	}
-	r.rp = proxy.NewReverseProxy(bf, h.l.cookieKey, r.Sticky, service, logger)
-	r.service = service
 	h.l.routes[data.ID] = r
 	if data.Path == "/" {
 		if tree, ok := h.l.domains[strings.ToLower(r.Domain)]; ok {
@@ -333,6 +511,10 @@ func (h *httpSyncHandler) Set(data *router.Route) error {
 		}
 	}
 
+	if r.AutoTLS && r.keypair == nil {
+		h.l.acme.Trigger()
+	}
+
 	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: r.Domain, Route: r.ToRoute()})
 	return nil
 }
@@ -348,11 +530,15 @@ func (h *httpSyncHandler) Remove(id string) error {
 		return ErrNotFound
 	}
 
-	r.service.refs--
-	if r.service.refs <= 0 {
-		r.service.sc.Close()
-		delete(h.l.services, r.service.name)
+	for _, s := range r.services {
+		h.l.releaseService(s)
+	}
+	if r.mirror != nil {
+		h.l.releaseService(r.mirror)
 	}
+	r.health.Stop()
+	r.cache.Close()
+	h.l.metrics.RemoveRoute(r.ToRoute())
 
 	delete(h.l.routes, id)
 	if tree, ok := h.l.domains[r.Domain]; ok {
@@ -366,6 +552,34 @@ func (h *httpSyncHandler) Remove(id string) error {
 	return nil
 }
 
+// acquireService returns the service with the given name, creating it if it
+// does not exist, and increments its reference count (it must be called with
+// s.mtx held)
+func (s *HTTPListener) acquireService(name string, drainBackends bool) (*service, error) {
+	service, ok := s.services[name]
+	if !ok {
+		sc, err := cache.New(s.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
+		service = newService(name, sc, s.wm, drainBackends)
+		s.services[name] = service
+	}
+	service.refs++
+	return service, nil
+}
+
+// releaseService decrements the reference count of the given service,
+// closing it if it is no longer referenced by any routes (it must be called
+// with s.mtx held)
+func (s *HTTPListener) releaseService(service *service) {
+	service.refs--
+	if service.refs <= 0 {
+		service.Close()
+		delete(s.services, service.name)
+	}
+}
+
 func (s *HTTPListener) listenAndServe() error {
 	var err error
 	s.listener, err = listenFunc("tcp4", s.Addr)
@@ -413,6 +627,9 @@ func (s *HTTPListener) listenAndServeTLS() error {
 	if s.proxyProtocol {
 		l = proxyproto.Listener{l}
 	}
+	if s.passthrough != nil {
+		l = newSNIListener(l, s.passthrough)
+	}
 	s.tlsListener = tls.NewListener(l, tlsConfig)
 
 	handler := fwdProtoHandler{
@@ -442,6 +659,35 @@ func (s *HTTPListener) listenAndServeTLS() error {
 	return nil
 }
 
+// ServiceRequests returns the number of in-flight requests to each backend of
+// the given service
+func (s *HTTPListener) ServiceRequests(name string) map[string]int64 {
+	s.mtx.RLock()
+	service, ok := s.services[name]
+	s.mtx.RUnlock()
+	if !ok {
+		return map[string]int64{}
+	}
+	return service.Requests()
+}
+
+// CircuitBreakers returns the state of the circuit breakers of the current
+// backends of the route with the given ID, which is empty if the route has no
+// circuit breaker
+func (s *HTTPListener) CircuitBreakers(id string) ([]*router.CircuitBreakerState, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	r, ok := s.routes[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var backends []string
+	for _, service := range r.services {
+		backends = append(backends, r.backendListFunc(service)()...)
+	}
+	return r.breakers.States(backends), nil
+}
+
 func (s *HTTPListener) findRoute(host string, path string) *httpRoute {
 	host = strings.ToLower(host)
 	if strings.Contains(host, ":") {
@@ -471,14 +717,29 @@ func fail(w http.ResponseWriter, code int) {
 }
 
 func (s *HTTPListener) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
 	ctx := context.Background()
-	ctx = ctxhelper.NewContextStartTime(ctx, time.Now())
+	ctx = ctxhelper.NewContextStartTime(ctx, start)
+	if s.acme.ServeChallenge(w, req) {
+		return
+	}
 	r := s.findRoute(req.Host, req.URL.Path)
 	if r == nil {
 		fail(w, 404)
 		return
 	}
 
+	// redirects are applied before access control so that credentials
+	// are not requested over plain HTTP or for the wrong domain
+	if status, ok := r.redirect(w, req); ok {
+		r.observers.ObserveRequest(req, "", status, time.Since(start), 0, 0)
+		return
+	}
+	if status := r.access.Check(w, req); status != 0 {
+		r.observers.ObserveRequest(req, "", status, time.Since(start), 0, 0)
+		return
+	}
+
 	r.ServeHTTP(ctx, w, req)
 }
 
@@ -490,6 +751,125 @@ type httpRoute struct {
 	keypair *tls.Certificate
 	service *service
 	rp      *proxy.ReverseProxy
+
+	// services contains all the services the route sends traffic to,
+	// which is just service unless the route has weighted services
+	services []*service
+
+	// mirror is the service requests are mirrored to, nil if the route
+	// does not mirror requests
+	mirror *service
+
+	limiter   *routeLimiter
+	access    *routeAccessControl
+	health    *healthChecker
+	breakers  *circuitBreakers
+	cache     *responseCache
+	observers routeObservers
+}
+
+// routeObservers notifies each of a route's observers of its proxied
+// requests, such as its metrics and access log
+type routeObservers []proxy.Observer
+
+func (o routeObservers) ObserveRequest(req *http.Request, backend string, status int, duration time.Duration, bytesIn, bytesOut int64) {
+	for _, observer := range o {
+		observer.ObserveRequest(req, backend, status, duration, bytesIn, bytesOut)
+	}
+}
+
+func (o routeObservers) ObserveConn(backend string, bytesIn, bytesOut int64) {
+	for _, observer := range o {
+		observer.ObserveConn(backend, bytesIn, bytesOut)
+	}
+}
+
+func (o routeObservers) ObserveDialError(backend string) {
+	for _, observer := range o {
+		observer.ObserveDialError(backend)
+	}
+}
+
+// backendListFunc returns a function which lists the route's backends in the
+// given service
+func (r *httpRoute) backendListFunc(s *service) proxy.BackendListFunc {
+	if r.Leader {
+		return s.sc.LeaderAddr
+	}
+	if r.ReleaseID != "" {
+		releaseID := r.ReleaseID
+		return func() []string {
+			return s.sc.AddrsWithMeta("FLYNN_RELEASE_ID", releaseID)
+		}
+	}
+	return s.sc.Addrs
+}
+
+// serviceGroup tracks requests to the backends of several services, passing
+// them on to the service each backend belongs to
+type serviceGroup struct {
+	services []*service
+
+	mtx      sync.Mutex
+	backends map[string]*serviceGroupBackend
+}
+
+type serviceGroupBackend struct {
+	service *service
+	reqs    int64
+}
+
+func newServiceGroup(services []*service) *serviceGroup {
+	return &serviceGroup{
+		services: services,
+		backends: make(map[string]*serviceGroupBackend),
+	}
+}
+
+func (g *serviceGroup) TrackRequestStart(backend string) {
+	g.mtx.Lock()
+	b, ok := g.backends[backend]
+	if !ok {
+		s := g.lookup(backend)
+		if s == nil {
+			g.mtx.Unlock()
+			return
+		}
+		b = &serviceGroupBackend{service: s}
+		g.backends[backend] = b
+	}
+	b.reqs++
+	g.mtx.Unlock()
+	b.service.TrackRequestStart(backend)
+}
+
+func (g *serviceGroup) TrackRequestDone(backend string) {
+	g.mtx.Lock()
+	b, ok := g.backends[backend]
+	if !ok {
+		g.mtx.Unlock()
+		return
+	}
+	b.reqs--
+	if b.reqs == 0 {
+		delete(g.backends, backend)
+	}
+	g.mtx.Unlock()
+	b.service.TrackRequestDone(backend)
+}
+
+// lookup returns the service which has the given backend (the result is kept
+// in g.backends whilst the backend has in-flight requests so that requests
+// finishing after the backend has gone down are still tracked)
+func (g *serviceGroup) lookup(backend string) *service {
+	for _, s := range g.services {
+		for _, addr := range s.sc.Addrs() {
+			if addr == backend {
+				return s
+			}
+		}
+	}
+	return nil
 }
 
 // A service definition: name, and set of backends.
@@ -508,33 +888,48 @@ func newService(name string, sc *cache.ServiceCache, wm *WatchManager, trackBack
 		name: name,
 		sc:   sc,
 		wm:   wm,
+		reqs: make(map[string]int64),
+		cond: sync.NewCond(&sync.Mutex{}),
 	}
 	if trackBackends {
 		events := make(chan *discoverd.Event)
 		s.stream = sc.Watch(events, true)
-		s.reqs = make(map[string]int64)
-		s.cond = sync.NewCond(&sync.Mutex{})
 		go s.watchBackends(events)
 	}
 	return s
 }
 
-func (s *service) TrackRequestStart(backend string) {
-	if s.reqs == nil {
-		return
+// Requests returns the number of in-flight requests to each backend of the
+// service which currently has any
+func (s *service) Requests() map[string]int64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	reqs := make(map[string]int64, len(s.reqs))
+	for backend, n := range s.reqs {
+		reqs[backend] = n
 	}
+	return reqs
+}
+
+// RequestCount returns the number of in-flight requests to the given backend
+// of the service
+func (s *service) RequestCount(backend string) int64 {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+	return s.reqs[backend]
+}
+
+func (s *service) TrackRequestStart(backend string) {
 	s.cond.L.Lock()
 	s.reqs[backend]++
 	s.cond.L.Unlock()
 }
 
 func (s *service) TrackRequestDone(backend string) {
-	if s.reqs == nil {
-		return
-	}
 	s.cond.L.Lock()
 	s.reqs[backend]--
 	if s.reqs[backend] == 0 {
+		delete(s.reqs, backend)
 		s.cond.Broadcast()
 	}
 	s.cond.L.Unlock()
@@ -593,9 +988,61 @@ func (r *httpRoute) ServeHTTP(ctx context.Context, w http.ResponseWriter, req *h
 	req.Header.Set("X-Request-Start", strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10))
 	req.Header.Set("X-Request-Id", random.UUID())
 
+	if !r.limiter.Allow(req.RemoteAddr) {
+		w.Header().Set("Retry-After", "1")
+		fail(w, http.StatusTooManyRequests)
+		r.observers.ObserveRequest(req, "", http.StatusTooManyRequests, time.Since(start), 0, 0)
+		return
+	}
+	if status, n, ok := r.cache.Serve(w, req); ok {
+		r.observers.ObserveRequest(req, "", status, time.Since(start), 0, n)
+		return
+	}
+	if !r.limiter.AcquireConn() {
+		// the route rather than the client is over its limit, so
+		// respond as unavailable rather than rate limited
+		w.Header().Set("Retry-After", "1")
+		fail(w, http.StatusServiceUnavailable)
+		r.observers.ObserveRequest(req, "", http.StatusServiceUnavailable, time.Since(start), 0, 0)
+		return
+	}
+	defer r.limiter.ReleaseConn()
+
+	if cw := r.cache.Writer(w, req); cw != nil {
+		r.rp.ServeHTTP(ctx, cw, req)
+		cw.Store()
+		return
+	}
 	r.rp.ServeHTTP(ctx, w, req)
 }
 
+// redirect responds with a redirect if the route redirects requests to another
+// domain or requests made without TLS to HTTPS, returning the status code and
+// whether it did
+func (r *httpRoute) redirect(w http.ResponseWriter, req *http.Request) (int, bool) {
+	if rd := r.Redirect; rd != nil {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		status := rd.Status
+		if status == 0 {
+			status = http.StatusMovedPermanently
+		}
+		http.Redirect(w, req, scheme+"://"+rd.Domain+req.URL.RequestURI(), status)
+		return status, true
+	}
+	if r.HTTPSRedirect && req.TLS == nil {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusMovedPermanently)
+		return http.StatusMovedPermanently, true
+	}
+	return 0, false
+}
+
 func mustPortFromAddr(addr string) string {
 	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
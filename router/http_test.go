@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -14,17 +16,20 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/testutil"
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/pkg/tlscert"
 	"github.com/flynn/flynn/router/schema"
 	"github.com/flynn/flynn/router/types"
 	. "github.com/flynn/go-check"
 	"github.com/jackc/pgx"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/websocket"
 )
@@ -577,6 +582,45 @@ func (s *S) TestLeaderRouting(c *C) {
 	assertGet(c, "http://"+l.Addr, "foo.bar", "2")
 }
 
+func (s *S) TestReleaseRouting(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	route := addRoute(c, l, router.HTTPRoute{
+		Domain:    "foo.bar",
+		Service:   "release-routing-http",
+		ReleaseID: "release1",
+	}.ToRoute())
+
+	discoverdRegisterHTTPInstance(c, l, "release-routing-http", &discoverd.Instance{
+		Addr: srv1.Listener.Addr().String(),
+		Meta: map[string]string{"FLYNN_RELEASE_ID": "release1"},
+	})
+	discoverdRegisterHTTPInstance(c, l, "release-routing-http", &discoverd.Instance{
+		Addr: srv2.Listener.Addr().String(),
+		Meta: map[string]string{"FLYNN_RELEASE_ID": "release2"},
+	})
+
+	// only the instance of the route's release should get requests
+	for i := 0; i < 10; i++ {
+		assertGet(c, "http://"+l.Addr, "foo.bar", "1")
+	}
+
+	// switch the route to the other release
+	route.ReleaseID = "release2"
+	wait := waitForEvent(c, l, "set", "")
+	c.Assert(l.UpdateRoute(route), IsNil)
+	wait()
+	for i := 0; i < 10; i++ {
+		assertGet(c, "http://"+l.Addr, "foo.bar", "2")
+	}
+}
+
 func (s *S) TestPathRouting(c *C) {
 	srv1 := httptest.NewServer(httpTestHandler("1"))
 	srv2 := httptest.NewServer(httpTestHandler("2"))
@@ -1146,6 +1190,64 @@ func (s *S) TestStickyHTTPRoute(c *C) {
 	}
 }
 
+func (s *S) TestWeightedHTTPRoute(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain: "example.com",
+		Services: []*router.WeightedService{
+			{Service: "weighted-1", Weight: 1},
+			{Service: "weighted-2", Weight: 3},
+		},
+		Sticky: true,
+	}.ToRoute())
+
+	unregister := discoverdRegisterHTTPService(c, l, "weighted-1", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "weighted-2", srv2.Listener.Addr().String())
+
+	// requests should be split between the services by weight
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		counts[string(data)]++
+	}
+	c.Assert(counts["1"] > 0, Equals, true)
+	c.Assert(counts["2"] > counts["1"], Equals, true)
+
+	// sticky sessions should be respected across services
+	var cookies []*http.Cookie
+	for len(cookies) == 0 {
+		req := newReq("http://"+l.Addr, "example.com")
+		res, err := newHTTPClient("example.com").Do(req)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		if string(data) == "1" {
+			cookies = res.Cookies()
+		}
+	}
+	for i := 0; i < 10; i++ {
+		assertGetCookies(c, "http://"+l.Addr, "example.com", "1", cookies)
+	}
+
+	// requests should fall back to the other service if one has no backends
+	unregister()
+	for i := 0; i < 10; i++ {
+		assertGetCookies(c, "http://"+l.Addr, "example.com", "2", cookies)
+	}
+}
+
 func wsHandshakeTestHandler(id string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
@@ -1754,3 +1856,487 @@ func (s *S) TestHTTPProxyProtocol(c *C) {
 		c.Assert(string(data), Equals, "1.1.1.123")
 	}
 }
+
+func (s *S) TestHTTPRouteRateLimit(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:         "example.com",
+		Service:        "test",
+		RateLimit:      0.01,
+		RateLimitBurst: 2,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	// the burst should be allowed, then further requests limited
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+	res, err := httpClient.Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 429)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "1")
+}
+
+func (s *S) TestHTTPRouteMaxConns(c *C) {
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/block" {
+			started <- struct{}{}
+			<-unblock
+		}
+		w.Write([]byte("1"))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:   "example.com",
+		Service:  "test",
+		MaxConns: 1,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr+"/block", "example.com"))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+	}()
+	<-started
+
+	// a second concurrent request should be rejected
+	res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 503)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "1")
+
+	// once the first request finishes, requests should be allowed again
+	close(unblock)
+	<-done
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+}
+
+func (s *S) TestHTTPRouteHealthCheck(c *C) {
+	var unhealthy atomic.Value
+	unhealthy.Store(true)
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" && unhealthy.Load().(bool) {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte("2"))
+	}))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		HealthCheck: &router.HealthCheck{
+			Path:               "/health",
+			Interval:           50 * time.Millisecond,
+			UnhealthyThreshold: 1,
+			HealthyThreshold:   1,
+		},
+	}.ToRoute())
+
+	// the failing backend should be ejected
+	wait := waitForEvent(c, l, router.EventTypeBackendEjected, "")
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+	e := wait()
+	c.Assert(e.Backend.Addr, Equals, srv2.Listener.Addr().String())
+	for i := 0; i < 10; i++ {
+		httpClient.Transport.(*http.Transport).CloseIdleConnections()
+		assertGet(c, "http://"+l.Addr, "example.com", "1")
+	}
+
+	// once passing the health check it should be restored
+	wait = waitForEvent(c, l, router.EventTypeBackendRestored, "")
+	unhealthy.Store(false)
+	e = wait()
+	c.Assert(e.Backend.Addr, Equals, srv2.Listener.Addr().String())
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		counts[string(data)]++
+	}
+	c.Assert(counts["2"] > 0, Equals, true)
+}
+
+func (s *S) TestHTTPRouteH2CBackend(c *C) {
+	// start a backend which only speaks HTTP/2 with prior knowledge, like
+	// a gRPC server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	h2s := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || req.Header.Get("Te") != "trailers" {
+			w.WriteHeader(400)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go h2s.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		}
+	}()
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	domain := "grpc.example.org"
+	addHTTPRouteForDomain(domain, c, l)
+	addRoute(c, l, router.HTTPRoute{
+		Domain:          domain,
+		Path:            "/test.Echo/",
+		Service:         "test-grpc",
+		BackendProtocol: router.BackendProtocolH2C,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-grpc", ln.Addr().String())
+
+	// requests to the path are proxied to the h2c backend with the
+	// trailers preserved
+	req, err := http.NewRequest("POST", "https://"+l.TLSAddr+"/test.Echo/Echo", strings.NewReader("ping"))
+	c.Assert(err, IsNil)
+	req.Host = domain
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	res, err := newHTTP2Client(domain).Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "ping")
+	c.Assert(res.Trailer.Get("Grpc-Status"), Equals, "0")
+
+	// other requests still go to the default HTTP/1.1 backend
+	assertGet(c, "https://"+l.TLSAddr, domain, "1")
+}
+
+func (s *S) TestHTTPRouteInvalidBackendProtocol(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute(router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		BackendProtocol: "spdy",
+	}.ToRoute())
+	c.Assert(err, NotNil)
+}
+
+func (s *S) TestHTTPRouteMetrics(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.buildHTTPListener(c)
+	l.metrics = NewMetrics()
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	r := addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+
+	rec := httptest.NewRecorder()
+	l.metrics.ServeHTTP(rec, nil)
+	c.Assert(rec.Header().Get("Content-Type"), Equals, metricsContentType)
+	expected := fmt.Sprintf(`router_http_requests_total{route="%s",parent_ref="",backend="%s",code="2xx"} 1`, r.FormattedID(), srv.Listener.Addr().String())
+	c.Assert(strings.Contains(rec.Body.String(), expected), Equals, true, Commentf("missing %q in:\n%s", expected, rec.Body.String()))
+}
+
+func (s *S) TestHTTPRouteHeaderRules(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Powered-By", "test")
+		fmt.Fprintf(w, "%s %s %s %s", req.Host, req.Header.Get("X-Env"), req.Header["X-Tag"], req.Header.Get("Cookie"))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		RequestHeaders: &router.HeaderRules{
+			Set:    map[string]string{"X-Env": "staging", "Host": "internal.example.com"},
+			Add:    map[string]string{"X-Tag": "router"},
+			Remove: []string{"Cookie"},
+		},
+		ResponseHeaders: &router.HeaderRules{
+			Set:    map[string]string{"Server": "flynn"},
+			Remove: []string{"X-Powered-By"},
+		},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("X-Env", "production")
+	req.Header.Set("X-Tag", "client")
+	req.Header.Set("Cookie", "a=b")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "internal.example.com staging [client router] ")
+	c.Assert(res.Header.Get("Server"), Equals, "flynn")
+	c.Assert(res.Header.Get("X-Powered-By"), Equals, "")
+}
+
+func (s *S) TestHTTPRouteRedirects(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	// requests are redirected before basic auth credentials are requested
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	addRoute(c, l, router.HTTPRoute{
+		Domain:        "secure.example.com",
+		Service:       "test",
+		HTTPSRedirect: true,
+		BasicAuth:     &router.BasicAuth{Users: map[string]string{"user": string(hash)}},
+	}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:   "www.example.com",
+		Service:  "test",
+		Redirect: &router.Redirect{Domain: "example.com", Status: http.StatusFound},
+	}.ToRoute())
+
+	for _, t := range []struct {
+		host     string
+		status   int
+		location string
+	}{
+		{"secure.example.com", http.StatusMovedPermanently, "https://secure.example.com/foo?bar=baz"},
+		{"www.example.com", http.StatusFound, "http://example.com/foo?bar=baz"},
+	} {
+		res, err := http.DefaultTransport.RoundTrip(newReq("http://"+l.Addr+"/foo?bar=baz", t.host))
+		c.Assert(err, IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, t.status)
+		c.Assert(res.Header.Get("Location"), Equals, t.location)
+	}
+}
+
+func (s *S) TestHTTPRouteStripPrefix(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.RequestURI()))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{Domain: "example.com", Service: "default"}.ToRoute())
+	addRoute(c, l, router.HTTPRoute{
+		Domain:      "example.com",
+		Path:        "/api/",
+		Service:     "test",
+		StripPrefix: true,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addr+"/api/users?id=1", "example.com", "/users?id=1")
+	assertGet(c, "http://"+l.Addr+"/api", "example.com", "/")
+}
+
+func (s *S) TestHTTPRouteInvalidRewrites(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, r := range []router.HTTPRoute{
+		{Domain: "example.com", Service: "test", RequestHeaders: &router.HeaderRules{Set: map[string]string{"X Bad": "1"}}},
+		{Domain: "example.com", Service: "test", ResponseHeaders: &router.HeaderRules{Remove: []string{""}}},
+		{Domain: "example.com", Service: "test", Redirect: &router.Redirect{}},
+		{Domain: "example.com", Service: "test", Redirect: &router.Redirect{Domain: "example.org", Status: 307}},
+		{Domain: "example.com", Service: "test", StripPrefix: true},
+	} {
+		err := l.AddRoute(r.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
+
+func (s *S) TestHTTPRouteCompression(c *C) {
+	body := strings.Repeat("compress me ", 200)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "small")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, body)
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "identity")
+			io.WriteString(w, body)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Etag", `"abc"`)
+			io.WriteString(w, body)
+		}
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Compression: &router.Compression{},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(path, accept string) (*http.Response, []byte) {
+		req := newReq("http://"+l.Addr+path, "example.com")
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return res, data
+	}
+
+	res, data := get("/", "gzip, deflate")
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(res.Header.Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(res.Header.Get("Etag"), Equals, `W/"abc"`)
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	decoded, err := ioutil.ReadAll(gr)
+	c.Assert(err, IsNil)
+	c.Assert(string(decoded), Equals, body)
+
+	// gzip is only used if it is accepted, possibly by a wildcard
+	res, _ = get("/", "br, *;q=0.5")
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+
+	// responses are not compressed for clients which don't accept it, or
+	// if they are small, have other content types or are already encoded,
+	// but responses which could be compressed for other clients still vary
+	// by Accept-Encoding
+	for _, t := range []struct {
+		path, accept string
+		vary         bool
+	}{
+		{"/", "", true},
+		{"/", "br", true},
+		{"/", "gzip;q=0, *", true},
+		{"/small", "gzip", false},
+		{"/image", "gzip", false},
+		{"/encoded", "gzip", false},
+	} {
+		res, data = get(t.path, t.accept)
+		c.Assert(res.Header.Get("Content-Encoding") == "gzip", Equals, false, Commentf("%s %s", t.path, t.accept))
+		c.Assert(bytes.HasPrefix(data, []byte("small")) || bytes.HasPrefix(data, []byte("compress me")), Equals, true, Commentf("%s %s", t.path, t.accept))
+		c.Assert(res.Header.Get("Vary") == "Accept-Encoding", Equals, t.vary, Commentf("%s %s", t.path, t.accept))
+	}
+}
+
+func (s *S) TestHTTPRouteCompressionStreaming(c *C) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:      "example.com",
+		Service:     "test",
+		Compression: &router.Compression{Types: []string{"text/event-stream"}},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addr, "example.com")
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.Header.Get("Content-Encoding"), Equals, "gzip")
+
+	// the compressed data is flushed before the response is complete
+	lines := make(chan string)
+	go func() {
+		gr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(gr).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		c.Assert(line, Equals, "data: hello\n")
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for compressed data to be flushed")
+	}
+}
+
+func (s *S) TestCompressionValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, compression := range []*router.Compression{
+		{MinSize: -1},
+		{Types: []string{"text"}},
+		{Types: []string{"text/html; charset=utf-8"}},
+		{Types: []string{"*/*"}},
+	} {
+		err := l.AddRoute(router.HTTPRoute{
+			Domain:      "example.com",
+			Service:     "test",
+			Compression: compression,
+		}.ToRoute())
+		c.Assert(err, NotNil, Commentf("%v", compression))
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
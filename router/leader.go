@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	"github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// watchLeader calls setLeader with whether the instance registered with the
+// given heartbeater is the leader of the service each time the leader
+// changes, reconnecting the leader stream if it is disconnected
+func watchLeader(service string, hb discoverd.Heartbeater, setLeader func(bool)) error {
+	log := logger.New("fn", "watchLeader", "service", service, "self.addr", hb.Addr())
+
+	s := discoverd.NewService(service)
+	var leaders chan *discoverd.Instance
+	var stream stream.Stream
+	connect := func() (err error) {
+		log.Info("connecting service leader stream")
+		leaders = make(chan *discoverd.Instance)
+		stream, err = s.Leaders(leaders)
+		if err != nil {
+			log.Error("error connecting service leader stream", "err", err)
+		}
+		return
+	}
+	if err := connect(); err != nil {
+		return err
+	}
+
+	go func() {
+	outer:
+		for {
+			for leader := range leaders {
+				if leader == nil {
+					// a nil leader indicates there are no instances for
+					// the service, ignore and wait for an actual leader
+					continue
+				}
+				log.Info("received leader event", "leader.addr", leader.Addr)
+				setLeader(leader.Addr == hb.Addr())
+			}
+			log.Warn("service leader stream disconnected", "err", stream.Err())
+			for {
+				if err := connect(); err == nil {
+					continue outer
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}()
+	return nil
+}
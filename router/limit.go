@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often idle clients are removed from a route
+// limiter
+const rateLimitSweepInterval = time.Minute
+
+// routeLimiter enforces the rate limit and connection limit of a route.
+//
+// The rate limit is applied per client IP using a token bucket which holds up
+// to burst tokens and refills at rate tokens per second, with each request or
+// connection taking a token. The connection limit is applied to the route as a
+// whole.
+//
+// A nil *routeLimiter allows everything.
+type routeLimiter struct {
+	rate  float64
+	burst float64
+
+	mtx       sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+
+	// conns is a semaphore of upstream connections, nil if there is no
+	// connection limit
+	conns chan struct{}
+
+	// now is used to get the current time, and is overridden in tests
+	now func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRouteLimiter returns a limiter for the given limits, or nil if the route
+// has no limits
+func newRouteLimiter(rate float64, burst, maxConns int) *routeLimiter {
+	if rate <= 0 && maxConns <= 0 {
+		return nil
+	}
+	l := &routeLimiter{now: time.Now}
+	if rate > 0 {
+		l.rate = rate
+		l.burst = float64(burst)
+		if burst <= 0 {
+			l.burst = math.Max(math.Ceil(rate), 1)
+		}
+		l.clients = make(map[string]*tokenBucket)
+		l.lastSweep = l.now()
+	}
+	if maxConns > 0 {
+		l.conns = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// Allow takes a token from the bucket of the client with the given address,
+// returning false if the client is over the rate limit
+func (l *routeLimiter) Allow(addr string) bool {
+	if l == nil || l.rate == 0 {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.clients[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst}
+		l.clients[ip] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets of clients which have been idle long enough for
+// their bucket to be full, so they are not kept around forever (the lock must
+// be held)
+func (l *routeLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, b := range l.clients {
+		if now.Sub(b.last) >= full {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// AcquireConn reserves an upstream connection, returning false if the route
+// is at its connection limit. If true is returned, ReleaseConn must be called
+// once the connection is finished with.
+func (l *routeLimiter) AcquireConn() bool {
+	if l == nil || l.conns == nil {
+		return true
+	}
+	select {
+	case l.conns <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// ReleaseConn releases a connection reserved with AcquireConn
+func (l *routeLimiter) ReleaseConn() {
+	if l == nil || l.conns == nil {
+		return
+	}
+	<-l.conns
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"time"
+
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestRouteLimiterRate(c *C) {
+	now := time.Now()
+	l := newRouteLimiter(2, 3, 0)
+	l.now = func() time.Time { return now }
+
+	// the burst is allowed straight away
+	for i := 0; i < 3; i++ {
+		c.Assert(l.Allow("10.0.0.1:1234"), Equals, true)
+	}
+	c.Assert(l.Allow("10.0.0.1:1235"), Equals, false)
+
+	// other clients have their own bucket
+	c.Assert(l.Allow("10.0.0.2:1234"), Equals, true)
+
+	// tokens are refilled at the rate
+	now = now.Add(500 * time.Millisecond)
+	c.Assert(l.Allow("10.0.0.1:1234"), Equals, true)
+	c.Assert(l.Allow("10.0.0.1:1234"), Equals, false)
+
+	// buckets don't refill past the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Assert(l.Allow("10.0.0.1:1234"), Equals, true)
+	}
+	c.Assert(l.Allow("10.0.0.1:1234"), Equals, false)
+
+	// idle clients are removed
+	now = now.Add(rateLimitSweepInterval)
+	c.Assert(l.Allow("10.0.0.3:1234"), Equals, true)
+	c.Assert(l.clients, HasLen, 1)
+}
+
+func (s *S) TestRouteLimiterDefaultBurst(c *C) {
+	l := newRouteLimiter(1.5, 0, 0)
+	c.Assert(l.burst, Equals, float64(2))
+	l = newRouteLimiter(0.5, 0, 0)
+	c.Assert(l.burst, Equals, float64(1))
+}
+
+func (s *S) TestRouteLimiterConns(c *C) {
+	l := newRouteLimiter(0, 0, 2)
+	c.Assert(l.Allow("10.0.0.1:1234"), Equals, true)
+	c.Assert(l.AcquireConn(), Equals, true)
+	c.Assert(l.AcquireConn(), Equals, true)
+	c.Assert(l.AcquireConn(), Equals, false)
+	l.ReleaseConn()
+	c.Assert(l.AcquireConn(), Equals, true)
+}
+
+func (s *S) TestRouteLimiterNoLimits(c *C) {
+	l := newRouteLimiter(0, 0, 0)
+	c.Assert(l, IsNil)
+	c.Assert(l.Allow("10.0.0.1:1234"), Equals, true)
+	c.Assert(l.AcquireConn(), Equals, true)
+	l.ReleaseConn()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"github.com/flynn/flynn/pkg/random"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+// newLoadBalancer returns the load balancer of the given route, which sends
+// requests to the given services, or nil if the route's backends are chosen
+// at random
+func newLoadBalancer(route *router.Route, services []*service) proxy.LoadBalancer {
+	lb := route.LoadBalancer
+	if lb == nil {
+		return nil
+	}
+	switch lb.Algorithm {
+	case router.LoadBalancerRoundRobin:
+		return &roundRobinBalancer{}
+	case router.LoadBalancerLeastRequests:
+		return &leastRequestsBalancer{services: services}
+	case router.LoadBalancerHash:
+		return &hashBalancer{header: lb.HashHeader, cookie: lb.HashCookie}
+	default:
+		return nil
+	}
+}
+
+// roundRobinBalancer sends requests to each backend in turn, sorting the
+// backends first so that their order is stable as backends come and go
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) Order(_ *http.Request, backends []string) {
+	if len(backends) == 0 {
+		return
+	}
+	sort.Strings(backends)
+	n := int((atomic.AddUint64(&b.next, 1) - 1) % uint64(len(backends)))
+	rotated := make([]string, 0, len(backends))
+	rotated = append(rotated, backends[n:]...)
+	rotated = append(rotated, backends[:n]...)
+	copy(backends, rotated)
+}
+
+// leastRequestsBalancer sends requests to the backends with the fewest
+// in-flight requests, using the request tracking of the route's services so
+// that requests from other routes to the same backends are also counted, and
+// choosing at random between backends with the same number of requests
+type leastRequestsBalancer struct {
+	services []*service
+}
+
+func (b *leastRequestsBalancer) Order(_ *http.Request, backends []string) {
+	shuffleBackends(backends)
+	reqs := make(map[string]int64, len(backends))
+	for _, addr := range backends {
+		for _, s := range b.services {
+			reqs[addr] += s.RequestCount(addr)
+		}
+	}
+	sort.Stable(backendsByRequests{backends, reqs})
+}
+
+// backendsByRequests sorts backends by ascending request count
+type backendsByRequests struct {
+	backends []string
+	reqs     map[string]int64
+}
+
+func (p backendsByRequests) Len() int { return len(p.backends) }
+func (p backendsByRequests) Less(i, j int) bool {
+	return p.reqs[p.backends[i]] < p.reqs[p.backends[j]]
+}
+func (p backendsByRequests) Swap(i, j int) {
+	p.backends[i], p.backends[j] = p.backends[j], p.backends[i]
+}
+
+// hashBalancer consistently sends requests with the same value of a header or
+// cookie to the same backend using rendezvous hashing, which orders backends
+// by the hash of the value and the backend's address so that only requests
+// which were sent to a backend move when it goes away. Requests without the
+// header or cookie are sent to random backends.
+type hashBalancer struct {
+	header string
+	cookie string
+}
+
+func (b *hashBalancer) Order(req *http.Request, backends []string) {
+	key := b.key(req)
+	if key == "" {
+		shuffleBackends(backends)
+		return
+	}
+	scores := make(map[string]uint64, len(backends))
+	for _, addr := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(addr))
+		scores[addr] = mix64(h.Sum64())
+	}
+	sort.Sort(backendsByScore{backends, scores})
+}
+
+// backendsByScore sorts backends by descending hash score
+type backendsByScore struct {
+	backends []string
+	scores   map[string]uint64
+}
+
+func (p backendsByScore) Len() int { return len(p.backends) }
+func (p backendsByScore) Less(i, j int) bool {
+	return p.scores[p.backends[i]] > p.scores[p.backends[j]]
+}
+func (p backendsByScore) Swap(i, j int) {
+	p.backends[i], p.backends[j] = p.backends[j], p.backends[i]
+}
+
+// key returns the value of the request's header or cookie which is hashed
+func (b *hashBalancer) key(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+	if b.header != "" {
+		return req.Header.Get(b.header)
+	}
+	cookie, err := req.Cookie(b.cookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// mix64 is the finalizer of SplitMix64, which spreads the differences in the
+// FNV hashes of keys which only differ in their last few bytes, such as the
+// ports of backends, across all the bits of the score
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func shuffleBackends(backends []string) {
+	for i := len(backends) - 1; i > 0; i-- {
+		j := random.Math.Intn(i + 1)
+		backends[i], backends[j] = backends[j], backends[i]
+	}
+}
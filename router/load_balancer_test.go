@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestRoundRobinBalancer(c *C) {
+	b := &roundRobinBalancer{}
+	for _, first := range []string{"a", "b", "c", "a"} {
+		backends := []string{"c", "a", "b"}
+		b.Order(nil, backends)
+		c.Assert(backends[0], Equals, first)
+		c.Assert(backends, HasLen, 3)
+	}
+}
+
+func (s *S) TestLeastRequestsBalancer(c *C) {
+	srv1 := newService("test1", nil, nil, false)
+	srv2 := newService("test2", nil, nil, false)
+	srv1.TrackRequestStart("a")
+	srv1.TrackRequestStart("a")
+	srv1.TrackRequestStart("b")
+	srv2.TrackRequestStart("c")
+	srv2.TrackRequestStart("c")
+	srv2.TrackRequestStart("c")
+
+	b := &leastRequestsBalancer{services: []*service{srv1, srv2}}
+	for i := 0; i < 10; i++ {
+		backends := []string{"a", "b", "c", "d"}
+		b.Order(nil, backends)
+		c.Assert(backends, DeepEquals, []string{"d", "b", "a", "c"})
+	}
+}
+
+func (s *S) TestHashBalancer(c *C) {
+	b := &hashBalancer{header: "X-User"}
+	backends := []string{"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80", "10.0.0.4:80"}
+
+	order := func(user string, backends []string) []string {
+		req, _ := http.NewRequest("GET", "http://example.com", nil)
+		req.Header.Set("X-User", user)
+		ordered := append([]string{}, backends...)
+		b.Order(req, ordered)
+		return ordered
+	}
+
+	// requests with the same key are sent to the same backend, and keys
+	// are spread across backends
+	firsts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := order(user, backends)[0]
+		c.Assert(order(user, backends)[0], Equals, first)
+		firsts[first]++
+
+		// removing a different backend doesn't move the key
+		for j, backend := range backends {
+			if backend != first {
+				remaining := append(append([]string{}, backends[:j]...), backends[j+1:]...)
+				c.Assert(order(user, remaining)[0], Equals, first)
+				break
+			}
+		}
+	}
+	c.Assert(firsts, HasLen, len(backends))
+
+	// the key can be a cookie
+	b = &hashBalancer{cookie: "session"}
+	req, _ := http.NewRequest("GET", "http://example.com", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "foo"})
+	c.Assert(b.key(req), Equals, "foo")
+	c.Assert(b.key(nil), Equals, "")
+}
+
+func (s *S) TestHTTPRouteHashLoadBalancer(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		LoadBalancer: &router.LoadBalancer{
+			Algorithm:  router.LoadBalancerHash,
+			HashHeader: "X-User",
+		},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	get := func(user string) string {
+		req := newReq("http://"+l.Addr, "example.com")
+		req.Header.Set("X-User", user)
+		res, err := newHTTPClient("example.com").Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	backends := make(map[string]struct{})
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		backend := get(user)
+		for j := 0; j < 5; j++ {
+			c.Assert(get(user), Equals, backend)
+		}
+		backends[backend] = struct{}{}
+	}
+	c.Assert(backends, HasLen, 2)
+}
+
+func (s *S) TestHTTPRouteRoundRobinLoadBalancer(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		LoadBalancer: &router.LoadBalancer{Algorithm: router.LoadBalancerRoundRobin},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	counts := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		res, err := newHTTPClient("example.com").Do(newReq("http://"+l.Addr, "example.com"))
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		counts[string(data)]++
+	}
+	c.Assert(counts, DeepEquals, map[string]int{"1": 5, "2": 5})
+}
+
+func (s *S) TestLoadBalancerValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, lb := range []*router.LoadBalancer{
+		{Algorithm: "fastest"},
+		{Algorithm: router.LoadBalancerHash},
+		{Algorithm: router.LoadBalancerHash, HashHeader: "X-User", HashCookie: "session"},
+		{Algorithm: router.LoadBalancerHash, HashHeader: "X User"},
+		{Algorithm: router.LoadBalancerRoundRobin, HashHeader: "X-User"},
+	} {
+		err := l.AddRoute(router.HTTPRoute{
+			Domain:       "example.com",
+			Service:      "test",
+			LoadBalancer: lb,
+		}.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+)
+
+// metricsContentType is the content type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4"
+
+// defaultLatencyBuckets are the upper bounds in seconds of the request
+// latency histogram buckets
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects metrics about the requests and connections proxied by the
+// router which are exposed in the Prometheus text format on the router API.
+//
+// All metrics have route and parent_ref labels as their first labels so that
+// they can be aggregated by app, and the series of a route are removed when
+// the route is removed. The series of a route's backends are removed once the
+// backends are no longer instances of the route's services.
+//
+// Each metric has its own lock which is only held exclusively to add or
+// remove series, with observations updating existing series atomically.
+//
+// A nil *Metrics collects nothing so that listeners without metrics
+// configured can use it unconditionally.
+type Metrics struct {
+	vecs []*metricVec
+
+	routesMtx sync.Mutex
+	routes    map[string]*routeMetrics
+
+	httpRequests      *metricVec
+	httpDuration      *metricVec
+	httpRequestBytes  *metricVec
+	httpResponseBytes *metricVec
+
+	tcpActive        *metricVec
+	tcpConns         *metricVec
+	tcpReceivedBytes *metricVec
+	tcpSentBytes     *metricVec
+
+	udpActive        *metricVec
+	udpSessions      *metricVec
+	udpReceivedBytes *metricVec
+	udpSentBytes     *metricVec
+
+	dialFailures *metricVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{routes: make(map[string]*routeMetrics)}
+	m.httpRequests = m.newVec("router_http_requests_total", "Total number of HTTP requests by backend and status code class.", "counter", "backend", "code")
+	m.httpDuration = m.newVec("router_http_request_duration_seconds", "Duration of HTTP requests in seconds.", "histogram")
+	m.httpRequestBytes = m.newVec("router_http_request_bytes_total", "Total number of HTTP request body bytes received from clients.", "counter")
+	m.httpResponseBytes = m.newVec("router_http_response_bytes_total", "Total number of HTTP response body bytes sent to clients.", "counter")
+	m.tcpActive = m.newVec("router_tcp_connections_active", "Number of TCP connections currently being proxied.", "gauge")
+	m.tcpConns = m.newVec("router_tcp_connections_total", "Total number of proxied TCP connections by backend.", "counter", "backend")
+	m.tcpReceivedBytes = m.newVec("router_tcp_received_bytes_total", "Total number of bytes received from TCP clients.", "counter")
+	m.tcpSentBytes = m.newVec("router_tcp_sent_bytes_total", "Total number of bytes sent to TCP clients.", "counter")
+	m.udpActive = m.newVec("router_udp_sessions_active", "Number of UDP client sessions currently being proxied.", "gauge")
+	m.udpSessions = m.newVec("router_udp_sessions_total", "Total number of proxied UDP client sessions by backend.", "counter", "backend")
+	m.udpReceivedBytes = m.newVec("router_udp_received_bytes_total", "Total number of bytes received from UDP clients.", "counter")
+	m.udpSentBytes = m.newVec("router_udp_sent_bytes_total", "Total number of bytes sent to UDP clients.", "counter")
+	m.dialFailures = m.newVec("router_backend_dial_failures_total", "Total number of failed attempts to connect to backends.", "counter", "backend")
+	return m
+}
+
+func (m *Metrics) newVec(name, help, typ string, labels ...string) *metricVec {
+	v := &metricVec{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  append([]string{"route", "parent_ref"}, labels...),
+		backend: -1,
+		series:  make(map[string]*series),
+	}
+	for i, label := range v.labels {
+		if label == "backend" {
+			v.backend = i
+		}
+	}
+	m.vecs = append(m.vecs, v)
+	return v
+}
+
+// Route returns the routeMetrics used to record metrics for the given route,
+// or nil if m is nil.
+//
+// The given functions return the instances of the route's services, and the
+// series of backends which none of them return are removed.
+func (m *Metrics) Route(r *router.Route, backends ...proxy.BackendListFunc) *routeMetrics {
+	if m == nil {
+		return nil
+	}
+	rm := &routeMetrics{m: m, route: r.FormattedID(), parentRef: r.ParentRef, backends: backends}
+	m.routesMtx.Lock()
+	m.routes[rm.route] = rm
+	m.routesMtx.Unlock()
+	return rm
+}
+
+// RemoveRoute removes all the series of the given route
+func (m *Metrics) RemoveRoute(r *router.Route) {
+	if m == nil {
+		return
+	}
+	id := r.FormattedID()
+	m.routesMtx.Lock()
+	delete(m.routes, id)
+	m.routesMtx.Unlock()
+	for _, v := range m.vecs {
+		v.remove(func(s *series) bool { return s.labels[0] == id })
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	m.WriteText(bw)
+	bw.Flush()
+}
+
+// WriteText writes all metrics in the Prometheus text format
+func (m *Metrics) WriteText(w io.Writer) {
+	if m == nil {
+		return
+	}
+	m.routesMtx.Lock()
+	routes := make([]*routeMetrics, 0, len(m.routes))
+	for _, r := range m.routes {
+		routes = append(routes, r)
+	}
+	m.routesMtx.Unlock()
+	for _, r := range routes {
+		r.pruneBackends()
+	}
+	for _, v := range m.vecs {
+		v.writeTo(w)
+	}
+}
+
+// metricVec is a metric with a series for each combination of label values.
+//
+// mtx guards the series map, with the values of existing series being
+// updated atomically whilst holding a read lock.
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	// backend is the index of the backend label, or -1 if the metric
+	// doesn't have one
+	backend int
+
+	mtx    sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	// value holds the bits of the float64 value of a counter or gauge, or
+	// the sum of a histogram
+	value uint64
+
+	// count and buckets are the total and cumulative bucket counts of a
+	// histogram
+	count   uint64
+	buckets []uint64
+
+	labels []string
+}
+
+// add adds delta to the series with the given labels, returning whether the
+// series was created
+func (v *metricVec) add(delta float64, labels ...string) bool {
+	return v.update(labels, func(s *series) {
+		s.add(delta)
+	})
+}
+
+// observe records value in the histogram series with the given labels
+func (v *metricVec) observe(value float64, labels ...string) {
+	v.update(labels, func(s *series) {
+		for i, le := range defaultLatencyBuckets {
+			if value <= le {
+				atomic.AddUint64(&s.buckets[i], 1)
+			}
+		}
+		atomic.AddUint64(&s.count, 1)
+		s.add(value)
+	})
+}
+
+// update calls f with the series with the given labels, creating it if it
+// doesn't exist, and returns whether it was created
+func (v *metricVec) update(labels []string, f func(*series)) bool {
+	key := strings.Join(labels, "\xff")
+	v.mtx.RLock()
+	s, ok := v.series[key]
+	if ok {
+		f(s)
+		v.mtx.RUnlock()
+		return false
+	}
+	v.mtx.RUnlock()
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	s, ok = v.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if v.typ == "histogram" {
+			s.buckets = make([]uint64, len(defaultLatencyBuckets))
+		}
+		v.series[key] = s
+	}
+	f(s)
+	return !ok
+}
+
+// dec decrements the gauge series with the given labels, removing it if it
+// becomes negative
+func (v *metricVec) dec(labels ...string) {
+	key := strings.Join(labels, "\xff")
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		return
+	}
+	s.add(-1)
+	if s.load() < 0 {
+		delete(v.series, key)
+	}
+}
+
+// remove removes the series which the given function matches
+func (v *metricVec) remove(match func(*series) bool) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for key, s := range v.series {
+		if match(s) {
+			delete(v.series, key)
+		}
+	}
+}
+
+func (s *series) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&s.value)
+		v := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&s.value, old, v) {
+			return
+		}
+	}
+}
+
+func (s *series) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.value))
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+	v.mtx.RLock()
+	defer v.mtx.RUnlock()
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := v.series[key]
+		labels := v.formatLabels(s.labels)
+		if v.typ != "histogram" {
+			fmt.Fprintf(w, "%s{%s} %s\n", v.name, labels, formatFloat(s.load()))
+			continue
+		}
+		for i, le := range defaultLatencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", v.name, labels, formatFloat(le), atomic.LoadUint64(&s.buckets[i]))
+		}
+		count := atomic.LoadUint64(&s.count)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", v.name, labels, count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", v.name, labels, formatFloat(s.load()))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", v.name, labels, count)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (v *metricVec) formatLabels(values []string) string {
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, v.labels[i], labelValueEscaper.Replace(value))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// statusClass returns the class of the given status code, for example "5xx"
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// routeMetrics records the metrics of a route, implementing proxy.Observer.
+//
+// A nil *routeMetrics records nothing.
+type routeMetrics struct {
+	m         *Metrics
+	route     string
+	parentRef string
+
+	// backends return the instances of the route's services
+	backends []proxy.BackendListFunc
+}
+
+func (r *routeMetrics) ObserveRequest(req *http.Request, backend string, status int, duration time.Duration, bytesIn, bytesOut int64) {
+	if r == nil {
+		return
+	}
+	if r.m.httpRequests.add(1, r.route, r.parentRef, backend, statusClass(status)) {
+		r.pruneBackends()
+	}
+	r.m.httpDuration.observe(duration.Seconds(), r.route, r.parentRef)
+	r.m.httpRequestBytes.add(float64(bytesIn), r.route, r.parentRef)
+	r.m.httpResponseBytes.add(float64(bytesOut), r.route, r.parentRef)
+}
+
+func (r *routeMetrics) ObserveConn(backend string, bytesIn, bytesOut int64) {
+	if r == nil {
+		return
+	}
+	if r.m.tcpConns.add(1, r.route, r.parentRef, backend) {
+		r.pruneBackends()
+	}
+	r.m.tcpReceivedBytes.add(float64(bytesIn), r.route, r.parentRef)
+	r.m.tcpSentBytes.add(float64(bytesOut), r.route, r.parentRef)
+}
+
+func (r *routeMetrics) ObserveDialError(backend string) {
+	if r == nil {
+		return
+	}
+	if r.m.dialFailures.add(1, r.route, r.parentRef, backend) {
+		r.pruneBackends()
+	}
+}
+
+// ConnStarted and ConnFinished track the number of active TCP connections
+func (r *routeMetrics) ConnStarted() {
+	if r == nil {
+		return
+	}
+	r.m.tcpActive.add(1, r.route, r.parentRef)
+}
+
+func (r *routeMetrics) ConnFinished() {
+	if r == nil {
+		return
+	}
+	// the route's series are removed when it is removed, so dec doesn't
+	// recreate them for connections which outlive the route
+	r.m.tcpActive.dec(r.route, r.parentRef)
+}
+
+// SessionStarted and SessionFinished track the number of active UDP client
+// sessions, with SessionFinished also recording the session's traffic
+func (r *routeMetrics) SessionStarted() {
+	if r == nil {
+		return
+	}
+	r.m.udpActive.add(1, r.route, r.parentRef)
+}
+
+func (r *routeMetrics) SessionFinished(backend string, bytesIn, bytesOut int64) {
+	if r == nil {
+		return
+	}
+	if r.m.udpSessions.add(1, r.route, r.parentRef, backend) {
+		r.pruneBackends()
+	}
+	r.m.udpReceivedBytes.add(float64(bytesIn), r.route, r.parentRef)
+	r.m.udpSentBytes.add(float64(bytesOut), r.route, r.parentRef)
+	r.m.udpActive.dec(r.route, r.parentRef)
+}
+
+// pruneBackends removes the route's series of backends which are no longer
+// instances of its services.
+//
+// It is called when a backend series is created and before metrics are
+// written, so the series of a long-lived route don't grow with each deploy.
+func (r *routeMetrics) pruneBackends() {
+	if len(r.backends) == 0 {
+		return
+	}
+	live := make(map[string]struct{})
+	for _, f := range r.backends {
+		for _, addr := range f() {
+			live[addr] = struct{}{}
+		}
+	}
+	for _, v := range r.m.vecs {
+		if v.backend < 0 {
+			continue
+		}
+		v.remove(func(s *series) bool {
+			if s.labels[0] != r.route || s.labels[v.backend] == "" {
+				return false
+			}
+			_, ok := live[s.labels[v.backend]]
+			return !ok
+		})
+	}
+}
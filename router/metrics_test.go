@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) TestMetricsText(c *C) {
+	m := NewMetrics()
+	r := m.Route(&router.Route{Type: "http", ID: "1", ParentRef: "controller/apps/1"})
+	r.ObserveRequest(nil, "10.0.0.1:80", http.StatusOK, 20*time.Millisecond, 10, 100)
+	r.ObserveRequest(nil, "10.0.0.1:80", http.StatusBadGateway, 2*time.Second, 0, 5)
+	r.ObserveRequest(nil, "", http.StatusTooManyRequests, 0, 0, 0)
+	r.ObserveDialError("10.0.0.2:80")
+
+	t := m.Route(&router.Route{Type: "tcp", ID: "2"})
+	t.ConnStarted()
+	t.ConnStarted()
+	t.ObserveConn("10.0.0.3:80", 3, 4)
+	t.ConnFinished()
+
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	text := buf.String()
+	for _, line := range []string{
+		"# TYPE router_http_requests_total counter",
+		`router_http_requests_total{route="http/1",parent_ref="controller/apps/1",backend="10.0.0.1:80",code="2xx"} 1`,
+		`router_http_requests_total{route="http/1",parent_ref="controller/apps/1",backend="10.0.0.1:80",code="5xx"} 1`,
+		`router_http_requests_total{route="http/1",parent_ref="controller/apps/1",backend="",code="4xx"} 1`,
+		"# TYPE router_http_request_duration_seconds histogram",
+		`router_http_request_duration_seconds_bucket{route="http/1",parent_ref="controller/apps/1",le="0.025"} 2`,
+		`router_http_request_duration_seconds_bucket{route="http/1",parent_ref="controller/apps/1",le="2.5"} 3`,
+		`router_http_request_duration_seconds_bucket{route="http/1",parent_ref="controller/apps/1",le="+Inf"} 3`,
+		`router_http_request_duration_seconds_sum{route="http/1",parent_ref="controller/apps/1"} 2.02`,
+		`router_http_request_duration_seconds_count{route="http/1",parent_ref="controller/apps/1"} 3`,
+		`router_http_request_bytes_total{route="http/1",parent_ref="controller/apps/1"} 10`,
+		`router_http_response_bytes_total{route="http/1",parent_ref="controller/apps/1"} 105`,
+		`router_backend_dial_failures_total{route="http/1",parent_ref="controller/apps/1",backend="10.0.0.2:80"} 1`,
+		`router_tcp_connections_active{route="tcp/2",parent_ref=""} 1`,
+		`router_tcp_connections_total{route="tcp/2",parent_ref="",backend="10.0.0.3:80"} 1`,
+		`router_tcp_received_bytes_total{route="tcp/2",parent_ref=""} 3`,
+		`router_tcp_sent_bytes_total{route="tcp/2",parent_ref=""} 4`,
+	} {
+		c.Assert(strings.Contains(text, line+"\n"), Equals, true, Commentf("missing %q in:\n%s", line, text))
+	}
+
+	// removing a route removes its series
+	m.RemoveRoute(&router.Route{Type: "http", ID: "1"})
+	buf.Reset()
+	m.WriteText(&buf)
+	c.Assert(strings.Contains(buf.String(), `route="http/1"`), Equals, false)
+	c.Assert(strings.Contains(buf.String(), `route="tcp/2"`), Equals, true)
+}
+
+func (s *S) TestMetricsPruneBackends(c *C) {
+	m := NewMetrics()
+	backends := []string{"10.0.0.1:80", "10.0.0.2:80"}
+	r := m.Route(&router.Route{Type: "http", ID: "1"}, func() []string { return backends })
+	r.ObserveRequest(nil, "10.0.0.1:80", http.StatusOK, 0, 0, 0)
+	r.ObserveRequest(nil, "10.0.0.2:80", http.StatusOK, 0, 0, 0)
+	r.ObserveRequest(nil, "", http.StatusServiceUnavailable, 0, 0, 0)
+	r.ObserveDialError("10.0.0.2:80")
+
+	// the series of backends which leave the service are removed
+	backends = []string{"10.0.0.1:80"}
+	var buf bytes.Buffer
+	m.WriteText(&buf)
+	text := buf.String()
+	c.Assert(strings.Contains(text, `backend="10.0.0.1:80",code="2xx"} 1`+"\n"), Equals, true)
+	c.Assert(strings.Contains(text, `backend="",code="5xx"} 1`+"\n"), Equals, true)
+	c.Assert(strings.Contains(text, `backend="10.0.0.2:80"`), Equals, false, Commentf("unexpected backend in:\n%s", text))
+
+	// as are those of previous backends when new backends are observed
+	backends = []string{"10.0.0.3:80"}
+	r.ObserveRequest(nil, "10.0.0.3:80", http.StatusOK, 0, 0, 0)
+	m.httpRequests.mtx.RLock()
+	c.Assert(m.httpRequests.series, HasLen, 2)
+	m.httpRequests.mtx.RUnlock()
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/flynn/flynn/pkg/postgres"
 	"github.com/flynn/flynn/pkg/testutils/postgres"
@@ -180,3 +181,25 @@ func (MigrateSuite) TestMigrateTLSObject(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(count, Equals, int64(nRoutes-1)) // the last route doesn't have a cert
 }
+
+func (MigrateSuite) TestMigrateHealthCheckDurations(c *C) {
+	db := setupTestDB(c, "routertest_health_check_duration_migration")
+	m := &testMigrator{c: c, db: db}
+	m.migrateTo(23)
+
+	var id string
+	err := db.QueryRow(`
+		INSERT INTO http_routes (parent_ref, service, domain, health_check)
+		VALUES ($1, $2, $3, $4) RETURNING id`,
+		"some/parent/ref",
+		"healthcheck.example.org",
+		"healthcheck.example.org",
+		`{"path": "/health", "interval": 5000000000, "timeout": 500000000}`).Scan(&id)
+	c.Assert(err, IsNil)
+
+	m.migrateTo(24)
+
+	var hc *router.HealthCheck
+	c.Assert(db.QueryRow(`SELECT health_check FROM http_routes WHERE id = $1`, id).Scan(&hc), IsNil)
+	c.Assert(hc, DeepEquals, &router.HealthCheck{Path: "/health", Interval: 5 * time.Second, Timeout: 500 * time.Millisecond})
+}
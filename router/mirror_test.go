@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+type mirroredRequest struct {
+	method string
+	path   string
+	host   string
+	body   string
+}
+
+func (s *S) TestHTTPRouteMirror(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	// the mirror responds slowly with an error, which must not affect
+	// the response to the client
+	mirrored := make(chan *mirroredRequest, 10)
+	mirrorSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mirrored <- &mirroredRequest{
+			method: req.Method,
+			path:   req.URL.Path,
+			host:   req.Host,
+			body:   string(body),
+		}
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(500)
+	}))
+	defer mirrorSrv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		Mirror:  &router.Mirror{Service: "test-mirror"},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "test-mirror", mirrorSrv.Listener.Addr().String())
+
+	req, err := http.NewRequest("POST", "http://"+l.Addr+"/foo", bytes.NewReader([]byte("data")))
+	c.Assert(err, IsNil)
+	req.Host = "example.com"
+	res, err := newHTTPClient("example.com").Do(req)
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(string(data), Equals, "1")
+
+	select {
+	case r := <-mirrored:
+		c.Assert(r, DeepEquals, &mirroredRequest{
+			method: "POST",
+			path:   "/foo",
+			host:   "example.com",
+			body:   "data",
+		})
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for mirrored request")
+	}
+
+	// requests with bodies of unknown size are proxied without being
+	// mirrored
+	pr, pw := io.Pipe()
+	req, err = http.NewRequest("POST", "http://"+l.Addr+"/stream", pr)
+	c.Assert(err, IsNil)
+	req.Host = "example.com"
+	go func() {
+		pw.Write([]byte("data"))
+		pw.Close()
+	}()
+	res, err = newHTTPClient("example.com").Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	select {
+	case r := <-mirrored:
+		c.Fatalf("unexpected mirrored request: %+v", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the client is unaffected when the mirror is down
+	mirrorSrv.Close()
+	assertGet(c, "http://"+l.Addr, "example.com", "1")
+}
+
+func (s *S) TestMirrorValidation(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	for _, m := range []*router.Mirror{
+		{},
+		{Service: "test-mirror", Percentage: -1},
+		{Service: "test-mirror", Percentage: 101},
+	} {
+		err := l.AddRoute(router.HTTPRoute{
+			Domain:  "example.com",
+			Service: "test",
+			Mirror:  m,
+		}.ToRoute())
+		c.Assert(err, NotNil)
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+const (
+	// DefaultCompressMinSize is the default minimum size in bytes of
+	// responses which are compressed
+	DefaultCompressMinSize = 1024
+
+	encodingGzip = "gzip"
+)
+
+// DefaultCompressTypes are the content types which are compressed by default
+var DefaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// SetCompression sets the compression config used to compress responses,
+// and must be called before the proxy is used.
+func (p *ReverseProxy) SetCompression(c *router.Compression) {
+	p.compression = c
+}
+
+// compressEncoding returns the encoding to compress the response to req with,
+// or an empty string if the response should not be compressed, and whether
+// the response is compressible and so would be compressed for requests which
+// accept a supported encoding
+func compressEncoding(c *router.Compression, req *http.Request, res *http.Response) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	switch {
+	case res.StatusCode < 200,
+		res.StatusCode == http.StatusNoContent,
+		res.StatusCode == http.StatusPartialContent,
+		res.StatusCode == http.StatusNotModified:
+		return "", false
+	}
+	h := res.Header
+	// never compress responses which are already encoded or are not
+	// allowed to be transformed
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || headerContainsToken(h, "Cache-Control", "no-transform") {
+		return "", false
+	}
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressMinSize
+	}
+	if res.ContentLength >= 0 && res.ContentLength < minSize {
+		return "", false
+	}
+	types := c.Types
+	if len(types) == 0 {
+		types = DefaultCompressTypes
+	}
+	if !matchContentType(h.Get("Content-Type"), types) {
+		return "", false
+	}
+	if req.Method == "HEAD" {
+		return "", true
+	}
+	return negotiateEncoding(req.Header["Accept-Encoding"]), true
+}
+
+// matchContentType returns whether the media type of contentType matches any
+// of the given types, which may have a wildcard subtype such as "text/*"
+func matchContentType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if strings.HasSuffix(t, "/*") {
+			if strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*")) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding returns gzip if the given Accept-Encoding header values
+// accept it, or an empty string otherwise
+func negotiateEncoding(accept []string) string {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, v := range accept {
+		for _, part := range strings.Split(v, ",") {
+			params := strings.Split(part, ";")
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					var err error
+					if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+						q = 0
+					}
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(params[0])) {
+			case encodingGzip:
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if gzipQ > 0 {
+		return encodingGzip
+	}
+	return ""
+}
+
+// addVaryAcceptEncoding adds Accept-Encoding to the Vary header of a
+// compressible response, so that caches don't serve a response compressed
+// for one client to another which doesn't accept the encoding, or an
+// uncompressed response to clients which do
+func addVaryAcceptEncoding(h http.Header) {
+	if !headerContainsToken(h, "Vary", "Accept-Encoding") {
+		h.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// prepareCompressedHeaders updates the headers of a response which is being
+// compressed with the given encoding
+func prepareCompressedHeaders(h http.Header, encoding string) {
+	h.Set("Content-Encoding", encoding)
+	h.Del("Content-Length")
+	// the compressed body is not byte for byte identical to the original
+	if etag := h.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("Etag", "W/"+etag)
+	}
+}
+
+var gzipWriterPool sync.Pool
+
+// compressWriter compresses the data written to it, flushing the compressed
+// data to the underlying ResponseWriter when it is flushed so that streaming
+// responses are still sent to clients as they are received
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	gw       *gzip.Writer
+}
+
+func newCompressWriter(rw http.ResponseWriter, encoding string) *compressWriter {
+	w := &compressWriter{ResponseWriter: rw, encoding: encoding}
+	if gw, ok := gzipWriterPool.Get().(*gzip.Writer); ok {
+		gw.Reset(rw)
+		w.gw = gw
+	} else {
+		w.gw = gzip.NewWriter(rw)
+	}
+	return w
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.gw.Write(p)
+}
+
+func (w *compressWriter) Flush() {
+	w.gw.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes any remaining compressed data and returns the gzip writer to
+// its pool
+func (w *compressWriter) Close() error {
+	err := w.gw.Close()
+	w.gw.Reset(nil)
+	gzipWriterPool.Put(w.gw)
+	return err
+}
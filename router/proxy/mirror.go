@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/flynn/flynn/pkg/random"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	// maxMirrorBodySize is the maximum size of the bodies of requests
+	// which are mirrored, with requests with larger bodies or bodies of
+	// unknown size not being mirrored
+	maxMirrorBodySize = 1 << 20
+
+	// maxMirrorRequests is the maximum number of in-flight mirrored
+	// requests of a route, with requests over the limit not being mirrored
+	maxMirrorRequests = 100
+
+	// mirrorTimeout is the maximum duration of a mirrored request
+	mirrorTimeout = 30 * time.Second
+)
+
+// mirror sends copies of a proportion of requests to the backends of another
+// service, discarding their responses.
+//
+// A nil *mirror mirrors nothing.
+type mirror struct {
+	backends   BackendListFunc
+	percentage float64
+
+	// sem is a semaphore of in-flight mirrored requests
+	sem chan struct{}
+}
+
+func newMirror(backends BackendListFunc, percentage float64) *mirror {
+	return &mirror{
+		backends:   backends,
+		percentage: percentage,
+		sem:        make(chan struct{}, maxMirrorRequests),
+	}
+}
+
+// prepare returns a copy of the request to send to the mirror, or nil if the
+// request is not mirrored. The request's body is buffered so that both the
+// request and the copy can read it, so only requests with a known body size
+// of at most maxMirrorBodySize are mirrored to avoid delaying streamed
+// request bodies.
+func (m *mirror) prepare(req *http.Request) *http.Request {
+	if m == nil || random.Math.Float64()*100 >= m.percentage {
+		return nil
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxMirrorBodySize {
+		return nil
+	}
+	select {
+	case m.sem <- struct{}{}:
+	default:
+		return nil
+	}
+
+	var body []byte
+	if req.ContentLength > 0 && req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+		req.Body = &multiReadCloser{
+			Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+			Closer: req.Body,
+		}
+		if err != nil || int64(len(body)) != req.ContentLength {
+			<-m.sem
+			return nil
+		}
+	}
+
+	mreq := new(http.Request)
+	*mreq = *req
+	u := *req.URL
+	mreq.URL = &u
+	mreq.Header = make(http.Header, len(req.Header))
+	copyHeader(mreq.Header, req.Header)
+	mreq.Body = nil
+	if len(body) > 0 {
+		mreq.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	mreq.ContentLength = int64(len(body))
+	mreq.TransferEncoding = nil
+	mreq.Trailer = nil
+	return mreq
+}
+
+// send sends a request returned by prepare to a random backend of the mirror
+// in a goroutine, so that the mirror does not affect the response to the
+// client
+func (m *mirror) send(req *http.Request, roundTripper http.RoundTripper, l log15.Logger) {
+	if req == nil {
+		return
+	}
+	backends := m.backends()
+	if len(backends) == 0 {
+		<-m.sem
+		return
+	}
+	req.URL.Host = backends[random.Math.Intn(len(backends))]
+
+	go func() {
+		defer func() { <-m.sem }()
+		cancel := make(chan struct{})
+		timer := time.AfterFunc(mirrorTimeout, func() { close(cancel) })
+		defer timer.Stop()
+		req.Cancel = cancel
+
+		res, err := roundTripper.RoundTrip(req)
+		if err != nil {
+			l.Debug("mirror request failed", "backend", req.URL.Host, "err", err)
+			return
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -7,13 +7,16 @@
 package proxy
 
 import (
+	"bufio"
 	"io"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/flynn/flynn/router/types"
 	"golang.org/x/net/context"
 	"gopkg.in/inconshreveable/log15.v2"
 )
@@ -37,6 +40,7 @@ var (
 	}
 
 	serviceUnavailable = []byte("Service Unavailable\n")
+	gatewayTimeout     = []byte("Gateway Timeout\n")
 )
 
 // ReverseProxy is an HTTP Handler that takes an incoming request and
@@ -54,6 +58,18 @@ type ReverseProxy struct {
 
 	RequestTracker RequestTracker
 
+	// rewrite modifies requests and responses, it is nil if the route has
+	// no rewrite rules
+	rewrite *Rewrite
+
+	// compression configures the compression of responses, it is nil if
+	// the route does not compress responses
+	compression *router.Compression
+
+	// mirror sends copies of requests to another service, it is nil if
+	// the route does not mirror requests
+	mirror *mirror
+
 	// Logger is the logger for the proxy.
 	Logger log15.Logger
 }
@@ -79,6 +95,73 @@ func NewReverseProxy(bf BackendListFunc, stickyKey *[32]byte, sticky bool, rt Re
 	}
 }
 
+// NewWeightedReverseProxy initializes a new ReverseProxy which distributes
+// requests between several lists of backends in proportion to their weights.
+// When sticky sessions are enabled, requests are sent to the sticky backend
+// regardless of which list it is in.
+func NewWeightedReverseProxy(backends []WeightedBackendList, stickyKey *[32]byte, sticky bool, rt RequestTracker, l log15.Logger) *ReverseProxy {
+	return &ReverseProxy{
+		transport: &transport{
+			weightedBackends:  backends,
+			stickyCookieKey:   stickyKey,
+			useStickySessions: sticky,
+		},
+		FlushInterval:  10 * time.Millisecond,
+		RequestTracker: rt,
+		Logger:         l,
+	}
+}
+
+// SetBackendHealth sets the BackendHealth used to eject unhealthy backends,
+// and must be called before the proxy is used.
+func (p *ReverseProxy) SetBackendHealth(h BackendHealth) {
+	p.transport.health = h
+}
+
+// UseH2C makes the proxy send requests to backends using HTTP/2 without TLS
+// (h2c) rather than HTTP/1.1, and must be called before the proxy is used.
+func (p *ReverseProxy) UseH2C() {
+	p.transport.h2c = true
+}
+
+// SetObserver sets the Observer which is notified of proxied requests and
+// connections, and must be called before the proxy is used.
+func (p *ReverseProxy) SetObserver(o Observer) {
+	p.transport.observer = o
+}
+
+// SetLoadBalancer sets the LoadBalancer which chooses the backends requests
+// are sent to, and must be called before the proxy is used.
+func (p *ReverseProxy) SetLoadBalancer(b LoadBalancer) {
+	p.transport.balancer = b
+}
+
+// SetMirror makes the proxy send copies of the given percentage of requests to
+// a random backend returned by backends, discarding the responses. It must be
+// called before the proxy is used.
+func (p *ReverseProxy) SetMirror(backends BackendListFunc, percentage float64) {
+	p.mirror = newMirror(backends, percentage)
+}
+
+// SetCircuitBreaker sets the CircuitBreaker used to stop requests being sent
+// to failing backends, and must be called before the proxy is used.
+func (p *ReverseProxy) SetCircuitBreaker(b CircuitBreaker) {
+	p.transport.breaker = b
+}
+
+// SetRetryBudget sets the RetryBudget which limits retries of failed
+// requests, and enables retrying idempotent requests after errors and
+// timeouts. It must be called before the proxy is used.
+func (p *ReverseProxy) SetRetryBudget(b RetryBudget) {
+	p.transport.retryBudget = b
+}
+
+// SetUpstreamTimeout sets the maximum time to wait for a backend to send
+// response headers, and must be called before the proxy is used.
+func (p *ReverseProxy) SetUpstreamTimeout(timeout time.Duration) {
+	p.transport.upstreamTimeout = timeout
+}
+
 // ServeHTTP implements http.Handler.
 func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, req *http.Request) {
 	transport := p.transport
@@ -87,6 +170,19 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, re
 	}
 
 	outreq := prepareRequest(req)
+	p.rewrite.rewriteRequest(outreq)
+
+	if o := transport.observer; o != nil {
+		rec := &responseRecorder{ResponseWriter: rw}
+		rw = rec
+		if outreq.Body != nil && outreq.ContentLength != 0 {
+			outreq.Body = &countingReadCloser{ReadCloser: outreq.Body, n: &rec.read}
+		}
+		start := time.Now()
+		defer func() {
+			o.ObserveRequest(req, rec.backend, rec.status, time.Since(start), atomic.LoadInt64(&rec.read), rec.written)
+		}()
+	}
 
 	l := p.Logger.New("request_id", req.Header.Get("X-Request-Id"), "client_addr", req.RemoteAddr, "host", req.Host, "path", req.URL.Path, "method", req.Method)
 
@@ -95,6 +191,8 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, re
 		return
 	}
 
+	p.mirror.send(p.mirror.prepare(outreq), transport.roundTripper(), l)
+
 	ctx = context.WithValue(ctx, ctxKeyRequestTracker, p.RequestTracker)
 
 	// CloseNotify can trigger early with HTTP/1.1 pipelined requests. Since
@@ -128,16 +226,22 @@ func (p *ReverseProxy) ServeHTTP(ctx context.Context, rw http.ResponseWriter, re
 	}
 
 	res, backend, err := transport.RoundTrip(ctx, outreq, l)
-	if err != nil {
+	if err == errUpstreamTimeout {
+		rw.WriteHeader(http.StatusGatewayTimeout)
+		rw.Write(gatewayTimeout)
+		return
+	} else if err != nil {
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		rw.Write(serviceUnavailable)
 		return
 	}
 	defer res.Body.Close()
 	defer p.RequestTracker.TrackRequestDone(backend)
+	recordBackend(rw, backend)
 
 	prepareResponseHeaders(res)
-	p.writeResponse(rw, res)
+	p.rewrite.rewriteResponse(res)
+	p.writeResponse(rw, req, res)
 }
 
 // ServeConn takes an inbound conn and proxies it to a backend.
@@ -162,13 +266,16 @@ func (p *ReverseProxy) ServeConn(ctx context.Context, dconn net.Conn) {
 
 	l := p.Logger.New("client_addr", dconn.RemoteAddr(), "host_addr", dconn.LocalAddr(), "proxy", "tcp")
 
-	uconn, err := transport.Connect(ctx, l)
+	uconn, backend, err := transport.Connect(ctx, l)
 	if err != nil {
 		return
 	}
 	defer uconn.Close()
 
-	joinConns(uconn, dconn)
+	in, out := joinConns(uconn, dconn)
+	if transport.observer != nil {
+		transport.observer.ObserveConn(backend, in, out)
+	}
 }
 
 func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, l log15.Logger, req *http.Request) {
@@ -177,18 +284,20 @@ func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, l log15.Logger, req
 		panic("router: nil transport for proxy")
 	}
 
-	res, uconn, err := transport.UpgradeHTTP(req, l)
+	res, uconn, backend, err := transport.UpgradeHTTP(req, l)
 	if err != nil {
 		rw.WriteHeader(http.StatusServiceUnavailable)
 		rw.Write(serviceUnavailable)
 		return
 	}
 	defer uconn.Close()
+	recordBackend(rw, backend)
 
 	prepareResponseHeaders(res)
+	p.rewrite.rewriteResponse(res)
 	if res.StatusCode != 101 {
 		res.Header.Set("Connection", "close")
-		p.writeResponse(rw, res)
+		p.writeResponse(rw, req, res)
 		return
 	}
 
@@ -201,11 +310,18 @@ func (p *ReverseProxy) serveUpgrade(rw http.ResponseWriter, l log15.Logger, req
 	}
 	defer dconn.Close()
 
+	if rec, ok := rw.(*responseRecorder); ok {
+		rec.status = res.StatusCode
+	}
 	if err := res.Write(dconn); err != nil {
 		l.Error("error proxying response to client", "err", err)
 		return
 	}
-	joinConns(uconn, &streamConn{bufrw.Reader, dconn})
+	in, out := joinConns(uconn, &streamConn{bufrw.Reader, dconn})
+	if rec, ok := rw.(*responseRecorder); ok {
+		atomic.AddInt64(&rec.read, in)
+		rec.written += out
+	}
 }
 
 func prepareResponseHeaders(res *http.Response) {
@@ -234,17 +350,51 @@ func prepareResponseHeaders(res *http.Response) {
 	}
 }
 
-func (p *ReverseProxy) writeResponse(rw http.ResponseWriter, res *http.Response) {
+func (p *ReverseProxy) writeResponse(rw http.ResponseWriter, req *http.Request, res *http.Response) {
+	encoding, compressible := compressEncoding(p.compression, req, res)
+	if compressible {
+		addVaryAcceptEncoding(res.Header)
+	}
+	if encoding != "" {
+		prepareCompressedHeaders(res.Header, encoding)
+	}
 	copyHeader(rw.Header(), res.Header)
 
+	// announce the trailers so they can be sent after the body, which is
+	// required for gRPC responses (backends must declare them in the
+	// Trailer header, since trailers which weren't announced before the
+	// response headers were written can't be sent)
+	if len(res.Trailer) > 0 {
+		keys := make([]string, 0, len(res.Trailer))
+		for k := range res.Trailer {
+			keys = append(keys, k)
+		}
+		rw.Header().Add("Trailer", strings.Join(keys, ", "))
+	}
+
 	rw.WriteHeader(res.StatusCode)
-	p.copyResponse(rw, res.Body)
+	if encoding != "" {
+		cw := newCompressWriter(rw, encoding)
+		p.copyResponse(cw, res.Body)
+		cw.Close()
+	} else {
+		p.copyResponse(rw, res.Body)
+	}
+	copyHeader(rw.Header(), res.Trailer)
 }
 
 func isConnectionUpgrade(h http.Header) bool {
-	for _, token := range strings.Split(h.Get("Connection"), ",") {
-		if v := strings.ToLower(strings.TrimSpace(token)); v == "upgrade" {
-			return true
+	return headerContainsToken(h, "Connection", "upgrade")
+}
+
+// headerContainsToken returns whether the comma separated values of the given
+// header contain the given token
+func headerContainsToken(h http.Header, key, token string) bool {
+	for _, v := range h[key] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
 		}
 	}
 	return false
@@ -287,18 +437,22 @@ func closeWrite(conn net.Conn) {
 	}
 }
 
-func joinConns(uconn, dconn net.Conn) {
+// joinConns copies data between the upstream and downstream connections until
+// both directions are closed, returning the number of bytes received from
+// and sent to the downstream connection
+func joinConns(uconn, dconn net.Conn) (in, out int64) {
 	done := make(chan struct{})
 
 	go func() {
-		io.Copy(uconn, dconn)
+		in, _ = io.Copy(uconn, dconn)
 		closeWrite(uconn)
 		done <- struct{}{}
 	}()
 
-	io.Copy(dconn, uconn)
+	out, _ = io.Copy(dconn, uconn)
 	closeWrite(dconn)
 	<-done
+	return
 }
 
 func prepareRequest(req *http.Request) *http.Request {
@@ -333,6 +487,12 @@ func prepareRequest(req *http.Request) *http.Request {
 		outreq.Header.Del(h)
 	}
 
+	// keep "TE: trailers" since it indicates that the client supports
+	// trailers, and gRPC servers require it
+	if headerContainsToken(req.Header, "Te", "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+
 	// remove the Upgrade header and headers referenced in the Connection
 	// header if HTTP < 1.1 or if Connection header didn't contain "upgrade":
 	// https://tools.ietf.org/html/rfc7230#section-6.7
@@ -396,3 +556,65 @@ func (m *maxLatencyWriter) flushLoop() {
 }
 
 func (m *maxLatencyWriter) stop() { m.done <- true }
+
+// responseRecorder wraps a ResponseWriter to record the backend, status code
+// and number of body bytes of a request for an Observer
+type responseRecorder struct {
+	http.ResponseWriter
+	backend string
+	status  int
+	written int64
+
+	// read is the number of request body bytes, which is updated
+	// atomically as the body may be read by the transport in another
+	// goroutine
+	read int64
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *responseRecorder) CloseNotify() <-chan bool {
+	return r.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func recordBackend(rw http.ResponseWriter, backend string) {
+	if rec, ok := rw.(*responseRecorder); ok {
+		rec.backend = backend
+	}
+}
+
+// countingReadCloser counts the bytes read from a request body
+type countingReadCloser struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/flynn/flynn/router/types"
+)
+
+// Rewrite modifies requests before they are proxied to backends and responses
+// before they are sent to clients.
+type Rewrite struct {
+	// RequestHeaders and ResponseHeaders modify the headers of requests
+	// and responses.
+	RequestHeaders  *router.HeaderRules
+	ResponseHeaders *router.HeaderRules
+
+	// StripPrefix is removed from the start of request paths, keeping the
+	// leading slash.
+	StripPrefix string
+}
+
+// SetRewrite sets the Rewrite which is applied to proxied requests and their
+// responses, and must be called before the proxy is used.
+func (p *ReverseProxy) SetRewrite(r *Rewrite) {
+	p.rewrite = r
+}
+
+func (r *Rewrite) rewriteRequest(req *http.Request) {
+	if r == nil {
+		return
+	}
+	if prefix := strings.TrimSuffix(r.StripPrefix, "/"); prefix != "" {
+		// copy the URL since it is shared with the client's request
+		u := *req.URL
+		req.URL = &u
+		req.URL.Path = stripPathPrefix(req.URL.Path, prefix)
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = stripPathPrefix(req.URL.RawPath, prefix)
+		}
+		if req.URL.Opaque != "" {
+			req.URL.Opaque = stripPathPrefix(req.URL.Opaque, prefix)
+		}
+	}
+	if rules := r.RequestHeaders; rules != nil {
+		applyHeaderRules(req.Header, rules)
+		// the Host header is sent from the request's Host field
+		// rather than its headers
+		if host := req.Header.Get("Host"); host != "" {
+			req.Host = host
+			req.Header.Del("Host")
+		}
+	}
+}
+
+func (r *Rewrite) rewriteResponse(res *http.Response) {
+	if r == nil || r.ResponseHeaders == nil {
+		return
+	}
+	applyHeaderRules(res.Header, r.ResponseHeaders)
+}
+
+// stripPathPrefix removes prefix from the start of path if it is followed by
+// either a slash or the end of the path
+func stripPathPrefix(path, prefix string) string {
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+	rest := path[len(prefix):]
+	if rest == "" {
+		return "/"
+	}
+	if rest[0] != '/' {
+		return path
+	}
+	return rest
+}
+
+// applyHeaderRules removes, then sets, then adds headers
+func applyHeaderRules(h http.Header, rules *router.HeaderRules) {
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+	for name, value := range rules.Set {
+		h.Set(name, value)
+	}
+	for name, value := range rules.Add {
+		h.Add(name, value)
+	}
+}
@@ -3,16 +3,20 @@ package proxy
 import (
 	"bufio"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flynn/flynn/pkg/random"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
@@ -21,8 +25,9 @@ type backendDialer interface {
 }
 
 var (
-	errNoBackends = errors.New("router: no backends available")
-	errCanceled   = errors.New("router: backend connection canceled")
+	errNoBackends      = errors.New("router: no backends available")
+	errCanceled        = errors.New("router: backend connection canceled")
+	errUpstreamTimeout = errors.New("router: backend response timeout")
 
 	httpTransport = &http.Transport{
 		Dial: customDial,
@@ -33,6 +38,16 @@ var (
 		TLSHandshakeTimeout:   10 * time.Second, // unused, but safer to leave default in place
 	}
 
+	// h2cTransport sends requests to backends using HTTP/2 over plain TCP
+	// connections (h2c) with prior knowledge, which is required to proxy
+	// gRPC requests
+	h2cTransport = &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return customDial(network, addr)
+		},
+	}
+
 	dialer backendDialer = &net.Dialer{
 		Timeout:   1 * time.Second,
 		KeepAlive: 30 * time.Second,
@@ -42,16 +57,99 @@ var (
 // BackendListFunc returns a slice of backend hosts (hostname:port).
 type BackendListFunc func() []string
 
+// WeightedBackendList is a list of backends which receives a proportion of
+// requests in relation to its weight.
+type WeightedBackendList struct {
+	Backends BackendListFunc
+	Weight   int
+}
+
+// BackendHealth reports the health of backends so that unhealthy backends
+// can be ejected from the backends requests are sent to.
+type BackendHealth interface {
+	Healthy(backend string) bool
+}
+
+// LoadBalancer chooses the backends requests are sent to.
+type LoadBalancer interface {
+	// Order sorts the given backends into the order they are tried for
+	// the request, which is nil for TCP connections.
+	Order(req *http.Request, backends []string)
+}
+
+// CircuitBreaker stops requests being sent to failing backends, and is
+// notified of the result of each request which it allows.
+type CircuitBreaker interface {
+	// Allow returns whether a request can be sent to the backend.
+	Allow(backend string) bool
+
+	// Success is called when a backend responds to a request.
+	Success(backend string)
+
+	// Failure is called when a request to a backend fails or times out,
+	// or the backend responds with a 5xx status.
+	Failure(backend string)
+}
+
+// RetryBudget limits the number of failed requests which are retried.
+type RetryBudget interface {
+	// Request is called for each request received by the proxy.
+	Request()
+
+	// Retry returns whether a failed request can be retried, counting the
+	// retry against the budget if so.
+	Retry() bool
+}
+
+// Observer is notified of proxied requests and connections so that metrics
+// and access logs can be collected for them.
+type Observer interface {
+	// ObserveRequest is called once a request has been proxied with the
+	// request received from the client, the backend it was sent to (empty
+	// if no backend was reached), the status code sent to the client, the
+	// duration of the request and the number of request and response body
+	// bytes.
+	ObserveRequest(req *http.Request, backend string, status int, duration time.Duration, bytesIn, bytesOut int64)
+
+	// ObserveConn is called once a proxied connection has finished with the
+	// number of bytes received from the client and sent to the client.
+	ObserveConn(backend string, bytesIn, bytesOut int64)
+
+	// ObserveDialError is called when connecting to a backend fails.
+	ObserveDialError(backend string)
+}
+
 type transport struct {
-	getBackends BackendListFunc
+	getBackends      BackendListFunc
+	weightedBackends []WeightedBackendList
+	health           BackendHealth
+	observer         Observer
+	breaker          CircuitBreaker
+	retryBudget      RetryBudget
+	balancer         LoadBalancer
+
+	// upstreamTimeout is the maximum time to wait for the response
+	// headers of a request, with zero meaning the default of
+	// httpTransport
+	upstreamTimeout time.Duration
+
+	// h2c is whether to send requests to backends using h2c rather than
+	// HTTP/1.1
+	h2c bool
 
 	stickyCookieKey   *[32]byte
 	useStickySessions bool
 }
 
-func (t *transport) getOrderedBackends(stickyBackend string) []string {
-	backends := t.getBackends()
-	shuffle(backends)
+func (t *transport) getOrderedBackends(req *http.Request, stickyBackend string) []string {
+	var backends []string
+	if len(t.weightedBackends) > 0 {
+		backends = t.getWeightedBackends(req)
+	} else {
+		backends = t.getBackends()
+		t.order(req, backends)
+	}
+	backends = t.ejectUnhealthy(backends)
 
 	if stickyBackend != "" {
 		swapToFront(backends, stickyBackend)
@@ -59,6 +157,72 @@ func (t *transport) getOrderedBackends(stickyBackend string) []string {
 	return backends
 }
 
+// order sorts the backends into the order they are tried for the request using
+// the load balancer, shuffling them if there is no load balancer
+func (t *transport) order(req *http.Request, backends []string) {
+	if t.balancer == nil {
+		shuffle(backends)
+		return
+	}
+	t.balancer.Order(req, backends)
+}
+
+// ejectUnhealthy removes unhealthy backends from the given list, keeping the
+// list as it is if none of the backends are healthy so that requests are
+// still attempted rather than failing outright
+func (t *transport) ejectUnhealthy(backends []string) []string {
+	if t.health == nil {
+		return backends
+	}
+	healthy := make([]string, 0, len(backends))
+	for _, b := range backends {
+		if t.health.Healthy(b) {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return backends
+	}
+	return healthy
+}
+
+// getWeightedBackends returns the backends of all the weighted backend lists,
+// with the lists ordered using a weighted random selection so that each list
+// comes first in proportion to its weight and the rest are used as fallbacks.
+// The backends of each list are ordered for the request.
+func (t *transport) getWeightedBackends(req *http.Request) []string {
+	lists := make([]WeightedBackendList, len(t.weightedBackends))
+	copy(lists, t.weightedBackends)
+	total := 0
+	for _, l := range lists {
+		total += l.Weight
+	}
+	var backends []string
+	for len(lists) > 0 {
+		i := pickWeighted(lists, total)
+		list := lists[i].Backends()
+		t.order(req, list)
+		backends = append(backends, list...)
+		total -= lists[i].Weight
+		lists = append(lists[:i], lists[i+1:]...)
+	}
+	return backends
+}
+
+func pickWeighted(lists []WeightedBackendList, total int) int {
+	if total < 1 {
+		return 0
+	}
+	n := random.Math.Intn(total)
+	for i, l := range lists {
+		if n < l.Weight {
+			return i
+		}
+		n -= l.Weight
+	}
+	return len(lists) - 1
+}
+
 func (t *transport) getStickyBackend(req *http.Request) string {
 	if t.useStickySessions {
 		return getStickyCookieBackend(req, *t.stickyCookieKey)
@@ -76,51 +240,147 @@ func (t *transport) setStickyBackend(res *http.Response, originalStickyBackend s
 }
 
 func (t *transport) RoundTrip(ctx context.Context, req *http.Request, l log15.Logger) (*http.Response, string, error) {
+	// requests which are safe to send more than once can be retried after
+	// they fail, as long as they have no body which has been consumed
+	retryRequest := t.retryBudget != nil && isIdempotent(req.Method) && (req.Body == nil || req.ContentLength == 0)
+
 	// http.Transport closes the request body on a failed dial, issue #875
 	req.Body = &fakeCloseReadCloser{req.Body}
 	defer req.Body.(*fakeCloseReadCloser).RealClose()
 
-	// hook up CloseNotify to cancel the request
-	req.Cancel = ctx.Done()
+	roundTripper := t.roundTripper()
+	if t.retryBudget != nil {
+		t.retryBudget.Request()
+	}
 
 	rt := ctx.Value(ctxKeyRequestTracker).(RequestTracker)
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
+	backends := t.getOrderedBackends(req, stickyBackend)
+	var attempts int
+	var lastErr error
+	// retrying is set after a request error, and failing over to another
+	// backend after a dial error is free as the request was never sent
+	var retrying bool
 	for i, backend := range backends {
+		if !t.allow(backend) {
+			continue
+		}
+		if retrying && !t.retryBudget.Retry() {
+			l.Error("retry budget exhausted", "backend", backend, "attempt", i)
+			break
+		}
+		attempts++
 		req.URL.Host = backend
 		rt.TrackRequestStart(backend)
-		res, err := httpTransport.RoundTrip(req)
+		res, err := t.roundTrip(ctx, roundTripper, req)
 		if err == nil {
+			if res.StatusCode >= 500 {
+				t.failure(backend)
+			} else {
+				t.success(backend)
+			}
 			t.setStickyBackend(res, stickyBackend)
 			return res, backend, nil
 		}
 		rt.TrackRequestDone(backend)
-		if _, ok := err.(dialErr); !ok {
+		lastErr = err
+		if _, ok := err.(dialErr); ok {
+			t.failure(backend)
+			t.observeDialError(backend)
+			l.Error("retriable dial error", "backend", backend, "err", err, "attempt", i)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			// the client went away, so the backend has not failed
+			l.Error("request canceled", "backend", backend, "err", err, "attempt", i)
+			return nil, "", err
+		default:
+		}
+		t.failure(backend)
+		if !retryRequest {
 			l.Error("unretriable request error", "backend", backend, "err", err, "attempt", i)
 			return nil, "", err
 		}
-		l.Error("retriable dial error", "backend", backend, "err", err, "attempt", i)
+		l.Error("retriable request error", "backend", backend, "err", err, "attempt", i)
+		retrying = true
+	}
+	l.Error("request failed", "status", "503", "num_backends", len(backends), "attempts", attempts)
+	if lastErr == errUpstreamTimeout {
+		return nil, "", lastErr
 	}
-	l.Error("request failed", "status", "503", "num_backends", len(backends))
 	return nil, "", errNoBackends
 }
 
-func (t *transport) Connect(ctx context.Context, l log15.Logger) (net.Conn, error) {
-	backends := t.getOrderedBackends("")
-	conn, _, err := dialTCP(ctx, l, backends)
+// roundTripper returns the http.RoundTripper used to send requests to
+// backends
+func (t *transport) roundTripper() http.RoundTripper {
+	if t.h2c {
+		return h2cTransport
+	}
+	return httpTransport
+}
+
+// roundTrip sends the request to the backend it is addressed to, canceling it
+// if the client goes away or if the backend does not send response headers
+// within the upstream timeout
+func (t *transport) roundTrip(ctx context.Context, roundTripper http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if t.upstreamTimeout == 0 {
+		// hook up CloseNotify to cancel the request
+		req.Cancel = ctx.Done()
+		return roundTripper.RoundTrip(req)
+	}
+
+	cancel := make(chan struct{})
+	var cancelOnce sync.Once
+	doCancel := func() { cancelOnce.Do(func() { close(cancel) }) }
+	var timedOut int32
+	timer := time.AfterFunc(t.upstreamTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		doCancel()
+	})
+
+	// cancel the request if the client goes away until the response body
+	// is closed
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			doCancel()
+		case <-done:
+		}
+	}()
+
+	req.Cancel = cancel
+	res, err := roundTripper.RoundTrip(req)
+	timer.Stop()
+	if err != nil {
+		close(done)
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, errUpstreamTimeout
+		}
+		return nil, err
+	}
+	res.Body = &notifyCloseReadCloser{ReadCloser: res.Body, done: done}
+	return res, nil
+}
+
+func (t *transport) Connect(ctx context.Context, l log15.Logger) (net.Conn, string, error) {
+	backends := t.getOrderedBackends(nil, "")
+	conn, addr, err := t.dialTCP(ctx, l, backends)
 	if err != nil {
 		l.Error("connection failed", "num_backends", len(backends))
 	}
-	return conn, err
+	return conn, addr, err
 }
 
-func (t *transport) UpgradeHTTP(req *http.Request, l log15.Logger) (*http.Response, net.Conn, error) {
+func (t *transport) UpgradeHTTP(req *http.Request, l log15.Logger) (*http.Response, net.Conn, string, error) {
 	stickyBackend := t.getStickyBackend(req)
-	backends := t.getOrderedBackends(stickyBackend)
-	upconn, addr, err := dialTCP(context.Background(), l, backends)
+	backends := t.getOrderedBackends(req, stickyBackend)
+	upconn, addr, err := t.dialTCP(context.Background(), l, backends)
 	if err != nil {
 		l.Error("dial failed", "status", "503", "num_backends", len(backends))
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	conn := &streamConn{bufio.NewReader(upconn), upconn}
 	req.URL.Host = addr
@@ -128,19 +388,41 @@ func (t *transport) UpgradeHTTP(req *http.Request, l log15.Logger) (*http.Respon
 	if err := req.Write(conn); err != nil {
 		conn.Close()
 		l.Error("error writing request", "err", err, "backend", addr)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	res, err := http.ReadResponse(conn.Reader, req)
 	if err != nil {
 		conn.Close()
 		l.Error("error reading response", "err", err, "backend", addr)
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	t.setStickyBackend(res, stickyBackend)
-	return res, conn, nil
+	return res, conn, addr, nil
 }
 
-func dialTCP(ctx context.Context, l log15.Logger, addrs []string) (net.Conn, string, error) {
+func (t *transport) allow(backend string) bool {
+	return t.breaker == nil || t.breaker.Allow(backend)
+}
+
+func (t *transport) success(backend string) {
+	if t.breaker != nil {
+		t.breaker.Success(backend)
+	}
+}
+
+func (t *transport) failure(backend string) {
+	if t.breaker != nil {
+		t.breaker.Failure(backend)
+	}
+}
+
+func (t *transport) observeDialError(backend string) {
+	if t.observer != nil {
+		t.observer.ObserveDialError(backend)
+	}
+}
+
+func (t *transport) dialTCP(ctx context.Context, l log15.Logger, addrs []string) (net.Conn, string, error) {
 	donec := ctx.Done()
 	for i, addr := range addrs {
 		select {
@@ -148,10 +430,16 @@ func dialTCP(ctx context.Context, l log15.Logger, addrs []string) (net.Conn, str
 			return nil, "", errCanceled
 		default:
 		}
+		if !t.allow(addr) {
+			continue
+		}
 		conn, err := dialer.Dial("tcp", addr)
 		if err == nil {
+			t.success(addr)
 			return conn, addr, nil
 		}
+		t.failure(addr)
+		t.observeDialError(addr)
 		l.Error("retriable dial error", "backend", addr, "err", err, "attempt", i)
 	}
 	return nil, "", errNoBackends
@@ -184,6 +472,29 @@ func (w *fakeCloseReadCloser) RealClose() error {
 	return w.ReadCloser.Close()
 }
 
+// notifyCloseReadCloser closes done when it is closed
+type notifyCloseReadCloser struct {
+	io.ReadCloser
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (r *notifyCloseReadCloser) Close() error {
+	r.closeOnce.Do(func() { close(r.done) })
+	return r.ReadCloser.Close()
+}
+
+// isIdempotent returns whether requests with the given method can be sent
+// more than once with the same effect as sending them once
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	default:
+		return false
+	}
+}
+
 func shuffle(s []string) {
 	for i := len(s) - 1; i > 0; i-- {
 		j := random.Math.Intn(i + 1)
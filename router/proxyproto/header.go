@@ -0,0 +1,77 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Versions of the PROXY protocol supported by Header
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+// v2Signature is the start of every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header returns a PROXY protocol header of the given version which tells the
+// receiver that the connection it precedes is from src to dst.
+//
+// If either address is not a TCP address, the header tells the receiver to
+// use the addresses of the connection itself.
+func Header(version int, src, dst net.Addr) ([]byte, error) {
+	s, srcOK := src.(*net.TCPAddr)
+	d, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	ipv4 := known && s.IP.To4() != nil && d.IP.To4() != nil
+
+	switch version {
+	case Version1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", formatIPv6(s.IP), formatIPv6(d.IP), s.Port, d.Port)), nil
+	case Version2:
+		header := append([]byte{}, v2Signature...)
+		if !known {
+			// the LOCAL command with an unspecified address family
+			return append(header, 0x20, 0x00, 0x00, 0x00), nil
+		}
+		var srcIP, dstIP net.IP
+		if ipv4 {
+			// the PROXY command with TCP over IPv4
+			header = append(header, 0x21, 0x11)
+			srcIP, dstIP = s.IP.To4(), d.IP.To4()
+		} else {
+			// the PROXY command with TCP over IPv6
+			header = append(header, 0x21, 0x21)
+			srcIP, dstIP = s.IP.To16(), d.IP.To16()
+		}
+		header = appendUint16(header, uint16(2*len(srcIP)+4))
+		header = append(header, srcIP...)
+		header = append(header, dstIP...)
+		header = appendUint16(header, uint16(s.Port))
+		return appendUint16(header, uint16(d.Port)), nil
+	default:
+		return nil, fmt.Errorf("proxyproto: unsupported version %d", version)
+	}
+}
+
+// formatIPv6 formats ip as an IPv6 address, including IPv4 addresses which
+// net.IP.String would format as IPv4 addresses
+func formatIPv6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
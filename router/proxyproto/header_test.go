@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestHeader_v1(t *testing.T) {
+	for _, test := range []struct {
+		src, dst net.Addr
+		header   string
+	}{
+		{
+			src:    &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			dst:    &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			header: "PROXY TCP4 10.1.1.1 20.2.2.2 1000 2000\r\n",
+		},
+		{
+			src:    &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1000},
+			dst:    &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			header: "PROXY TCP6 fe80::1 ::ffff:20.2.2.2 1000 2000\r\n",
+		},
+		{
+			src:    &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			dst:    &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			header: "PROXY UNKNOWN\r\n",
+		},
+	} {
+		header, err := Header(Version1, test.src, test.dst)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if string(header) != test.header {
+			t.Fatalf("bad: %q", header)
+		}
+	}
+}
+
+func TestHeader_v1RoundTrip(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pl := &Listener{Listener: l}
+	defer pl.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000}
+	header, err := Header(Version1, src, l.Addr())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go func() {
+		conn, err := net.Dial("tcp", pl.Addr().String())
+		if err != nil {
+			t.Errorf("err: %v", err)
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(header, "ping"...))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	recv := make([]byte, 4)
+	if _, err := conn.Read(recv); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(recv, []byte("ping")) {
+		t.Fatalf("bad: %v", recv)
+	}
+	if addr := conn.RemoteAddr().String(); addr != src.String() {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestHeader_v2(t *testing.T) {
+	for _, test := range []struct {
+		src, dst net.Addr
+		header   []byte
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 1000},
+			dst: &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			header: append(append([]byte{}, v2Signature...),
+				0x21, 0x11, 0x00, 0x0c,
+				10, 1, 1, 1,
+				20, 2, 2, 2,
+				0x03, 0xe8,
+				0x07, 0xd0,
+			),
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 1000},
+			dst: &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 2000},
+			header: append(append([]byte{}, v2Signature...),
+				0x21, 0x21, 0x00, 0x24,
+				0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+				0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+				0x03, 0xe8,
+				0x07, 0xd0,
+			),
+		},
+		{
+			src:    &net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			dst:    &net.TCPAddr{IP: net.ParseIP("20.2.2.2"), Port: 2000},
+			header: append(append([]byte{}, v2Signature...), 0x20, 0x00, 0x00, 0x00),
+		},
+	} {
+		header, err := Header(Version2, test.src, test.dst)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if !bytes.Equal(header, test.header) {
+			t.Fatalf("bad: %x", header)
+		}
+	}
+
+	if _, err := Header(3, nil, nil); err == nil {
+		t.Fatal("expected error for unsupported version")
+	}
+}
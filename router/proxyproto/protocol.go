@@ -1,6 +1,7 @@
 // Derived from https://github.com/bradfitz/go-proxyproto
 
-// Package proxyproto implements a net.Listener supporting HAProxy PROXY protocol.
+// Package proxyproto implements a net.Listener supporting HAProxy PROXY protocol,
+// along with the headers sent by proxies which use the protocol.
 //
 // See http://www.haproxy.org/download/1.5/doc/proxy-protocol.txt for details.
 package proxyproto
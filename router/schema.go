@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/flynn/flynn/pkg/postgres"
 )
 
@@ -215,6 +217,161 @@ CREATE TRIGGER notify_route_certificates_update
 		`ALTER TABLE http_routes ADD COLUMN drain_backends boolean NOT NULL DEFAULT TRUE`,
 		`UPDATE http_routes SET drain_backends = false WHERE service = 'controller'`,
 	)
+	migrations.Add(7,
+		`ALTER TABLE http_routes ADD COLUMN release_id varchar(255) NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(8,
+		`ALTER TABLE http_routes ADD COLUMN services jsonb`,
+	)
+	migrations.Add(9,
+		`ALTER TABLE http_routes ADD COLUMN rate_limit double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN rate_limit_burst integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN max_conns integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE tcp_routes ADD COLUMN rate_limit double precision NOT NULL DEFAULT 0`,
+		`ALTER TABLE tcp_routes ADD COLUMN rate_limit_burst integer NOT NULL DEFAULT 0`,
+		`ALTER TABLE tcp_routes ADD COLUMN max_conns integer NOT NULL DEFAULT 0`,
+	)
+	migrations.Add(10,
+		`ALTER TABLE http_routes ADD COLUMN health_check jsonb`,
+		`ALTER TABLE tcp_routes ADD COLUMN health_check jsonb`,
+	)
+	migrations.Add(11,
+		`ALTER TABLE http_routes ADD COLUMN auto_tls boolean NOT NULL DEFAULT false`,
+		`
+CREATE TABLE acme_accounts (
+	directory_url text PRIMARY KEY,
+	key text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`
+CREATE TABLE acme_challenges (
+	token text PRIMARY KEY,
+	key_authorization text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`,
+	)
+	migrations.Add(12,
+		`ALTER TABLE http_routes ADD COLUMN backend_protocol varchar(255) NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(13,
+		`ALTER TABLE http_routes ADD COLUMN access_log jsonb`,
+	)
+	migrations.Add(14,
+		`ALTER TABLE http_routes ADD COLUMN request_headers jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN response_headers jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN https_redirect boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE http_routes ADD COLUMN redirect jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN strip_prefix boolean NOT NULL DEFAULT false`,
+	)
+	migrations.Add(15,
+		`ALTER TABLE http_routes ADD COLUMN allow_ips jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN deny_ips jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN basic_auth jsonb`,
+	)
+	migrations.Add(16,
+		`ALTER TABLE http_routes ADD COLUMN cache jsonb`,
+	)
+	migrations.Add(17,
+		`ALTER TABLE http_routes ADD COLUMN compression jsonb`,
+	)
+	migrations.Add(18,
+		`
+CREATE TABLE tls_routes (
+	id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+	parent_ref varchar(255) NOT NULL,
+	service varchar(255) NOT NULL CHECK (service <> ''),
+	domain varchar(255) NOT NULL CHECK (domain <> ''),
+	leader boolean NOT NULL DEFAULT FALSE,
+	drain_backends boolean NOT NULL DEFAULT TRUE,
+	rate_limit double precision NOT NULL DEFAULT 0,
+	rate_limit_burst integer NOT NULL DEFAULT 0,
+	max_conns integer NOT NULL DEFAULT 0,
+	health_check jsonb,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+)`,
+		`
+CREATE UNIQUE INDEX tls_routes_domain_key ON tls_routes
+	USING btree (domain) WHERE deleted_at IS NULL`,
+		`
+CREATE TRIGGER set_updated_at_tls_routes
+	BEFORE UPDATE ON tls_routes FOR EACH ROW
+	EXECUTE PROCEDURE set_updated_at_column()`,
+		`
+CREATE OR REPLACE FUNCTION notify_tls_route_update() RETURNS TRIGGER AS $$
+BEGIN
+	PERFORM pg_notify('tls_routes', NEW.id::varchar);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+		`
+CREATE TRIGGER notify_tls_route_update
+	AFTER INSERT OR UPDATE OR DELETE ON tls_routes
+	FOR EACH ROW EXECUTE PROCEDURE notify_tls_route_update()`,
+	)
+	migrations.Add(19,
+		`
+CREATE TABLE udp_routes (
+	id uuid PRIMARY KEY DEFAULT uuid_generate_v4(),
+	parent_ref varchar(255) NOT NULL,
+	service varchar(255) NOT NULL CHECK (service <> ''),
+	leader boolean NOT NULL DEFAULT FALSE,
+	port integer NOT NULL CHECK (port > 0 AND port < 65535),
+	idle_timeout bigint NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT now(),
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	deleted_at timestamptz
+)`,
+		`
+CREATE UNIQUE INDEX udp_routes_port_key ON udp_routes
+	USING btree (port) WHERE deleted_at IS NULL`,
+		`
+CREATE TRIGGER set_updated_at_udp_routes
+	BEFORE UPDATE ON udp_routes FOR EACH ROW
+	EXECUTE PROCEDURE set_updated_at_column()`,
+		`
+CREATE OR REPLACE FUNCTION notify_udp_route_update() RETURNS TRIGGER AS $$
+BEGIN
+	PERFORM pg_notify('udp_routes', NEW.id::varchar);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+		`
+CREATE TRIGGER notify_udp_route_update
+	AFTER INSERT OR UPDATE OR DELETE ON udp_routes
+	FOR EACH ROW EXECUTE PROCEDURE notify_udp_route_update()`,
+	)
+	migrations.Add(20,
+		`ALTER TABLE tcp_routes ADD COLUMN proxy_protocol varchar(255) NOT NULL DEFAULT ''`,
+	)
+	migrations.Add(21,
+		`ALTER TABLE http_routes ADD COLUMN upstream_timeout bigint NOT NULL DEFAULT 0`,
+		`ALTER TABLE http_routes ADD COLUMN circuit_breaker jsonb`,
+		`ALTER TABLE http_routes ADD COLUMN retry_budget jsonb`,
+	)
+	migrations.Add(22,
+		`ALTER TABLE http_routes ADD COLUMN load_balancer jsonb`,
+	)
+	migrations.Add(23,
+		`ALTER TABLE http_routes ADD COLUMN mirror jsonb`,
+	)
+	migrations.Add(24, healthCheckDurationMigrations()...)
+}
+
+// healthCheckDurationMigrations returns statements which convert the interval
+// and timeout of stored health checks from numbers of nanoseconds to duration
+// strings
+func healthCheckDurationMigrations() []string {
+	var stmts []string
+	for _, table := range []string{"http_routes", "tcp_routes", "tls_routes"} {
+		for _, key := range []string{"interval", "timeout"} {
+			stmts = append(stmts, fmt.Sprintf(`
+UPDATE %[1]s SET health_check = health_check || jsonb_build_object('%[2]s', (health_check->>'%[2]s') || 'ns')
+	WHERE jsonb_typeof(health_check->'%[2]s') = 'number'`, table, key))
+		}
+	}
+	return stmts
 }
 
 func migrateDB(db *postgres.DB) error {
@@ -15,6 +15,20 @@ var preparedStatements = map[string]string{
 	"update_tcp_route": updateTcpRoute,
 	"delete_tcp_route": deleteTcpRoute,
 
+	// tls
+	"insert_tls_route": insertTlsRoute,
+	"list_tls_routes":  listTlsRoutes,
+	"select_tls_route": selectTlsRoute,
+	"update_tls_route": updateTlsRoute,
+	"delete_tls_route": deleteTlsRoute,
+
+	// udp
+	"insert_udp_route": insertUdpRoute,
+	"list_udp_routes":  listUdpRoutes,
+	"select_udp_route": selectUdpRoute,
+	"update_udp_route": updateUdpRoute,
+	"delete_udp_route": deleteUdpRoute,
+
 	// http
 	"insert_http_route": insertHttpRoute,
 	"list_http_routes":  listHttpRoutes,
@@ -32,6 +46,16 @@ var preparedStatements = map[string]string{
 	"insert_route_certificate":                   insertRouteCertificate,
 	"delete_route_certificate_by_route_id":       deleteRouteCertificateByRouteId,
 	"delete_route_certificate_by_certificate_id": deleteRouteCertificateByCertificateId,
+
+	// acme
+	"select_acme_account":   selectACMEAccount,
+	"insert_acme_account":   insertACMEAccount,
+	"select_acme_challenge": selectACMEChallenge,
+	"insert_acme_challenge": insertACMEChallenge,
+	"delete_acme_challenge": deleteACMEChallenge,
+
+	// cache
+	"notify_cache_purge": notifyCachePurge,
 }
 
 func PrepareStatements(conn *pgx.Conn) error {
@@ -49,49 +73,92 @@ const (
 
 	// tcp
 	insertTcpRoute = `
-	INSERT INTO tcp_routes (parent_ref, service, leader, drain_backends, port)
-	VALUES ($1, $2, $3, $4, $5)
+	INSERT INTO tcp_routes (parent_ref, service, leader, drain_backends, port, rate_limit, rate_limit_burst, max_conns, health_check, proxy_protocol)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	RETURNING id, created_at, updated_at`
 
 	selectTcpRoute = `
-	SELECT id, parent_ref, service, leader, drain_backends, port, created_at, updated_at FROM tcp_routes
+	SELECT id, parent_ref, service, leader, drain_backends, port, rate_limit, rate_limit_burst, max_conns, health_check, proxy_protocol, created_at, updated_at FROM tcp_routes
 	WHERE id = $1 AND deleted_at IS NULL`
 
 	updateTcpRoute = `
-	UPDATE tcp_routes SET parent_ref = $1, service = $2, leader = $3
+	UPDATE tcp_routes SET parent_ref = $1, service = $2, leader = $3, rate_limit = $6, rate_limit_burst = $7, max_conns = $8, health_check = $9, proxy_protocol = $10
 	WHERE id = $4 AND port = $5 AND deleted_at IS NULL
-	RETURNING id, parent_ref, service, leader, drain_backends, port, created_at, updated_at`
+	RETURNING id, parent_ref, service, leader, drain_backends, port, rate_limit, rate_limit_burst, max_conns, health_check, proxy_protocol, created_at, updated_at`
 
 	deleteTcpRoute = `
 	UPDATE tcp_routes SET deleted_at = now() 
 	WHERE id = $1`
 
 	listTcpRoutes = `
-	SELECT id, parent_ref, service, leader, drain_backends, port, created_at, updated_at FROM tcp_routes
+	SELECT id, parent_ref, service, leader, drain_backends, port, rate_limit, rate_limit_burst, max_conns, health_check, proxy_protocol, created_at, updated_at FROM tcp_routes
+	WHERE deleted_at IS NULL`
+
+	// tls
+	insertTlsRoute = `
+	INSERT INTO tls_routes (parent_ref, service, leader, drain_backends, domain, rate_limit, rate_limit_burst, max_conns, health_check)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING id, created_at, updated_at`
+
+	selectTlsRoute = `
+	SELECT id, parent_ref, service, leader, drain_backends, domain, rate_limit, rate_limit_burst, max_conns, health_check, created_at, updated_at FROM tls_routes
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	updateTlsRoute = `
+	UPDATE tls_routes SET parent_ref = $1, service = $2, leader = $3, rate_limit = $6, rate_limit_burst = $7, max_conns = $8, health_check = $9
+	WHERE id = $4 AND domain = $5 AND deleted_at IS NULL
+	RETURNING id, parent_ref, service, leader, drain_backends, domain, rate_limit, rate_limit_burst, max_conns, health_check, created_at, updated_at`
+
+	deleteTlsRoute = `UPDATE tls_routes SET deleted_at = now() WHERE id = $1`
+
+	listTlsRoutes = `
+	SELECT id, parent_ref, service, leader, drain_backends, domain, rate_limit, rate_limit_burst, max_conns, health_check, created_at, updated_at FROM tls_routes
+	WHERE deleted_at IS NULL
+	ORDER BY domain`
+
+	// udp
+	insertUdpRoute = `
+	INSERT INTO udp_routes (parent_ref, service, leader, port, idle_timeout)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at, updated_at`
+
+	selectUdpRoute = `
+	SELECT id, parent_ref, service, leader, port, idle_timeout, created_at, updated_at FROM udp_routes
+	WHERE id = $1 AND deleted_at IS NULL`
+
+	updateUdpRoute = `
+	UPDATE udp_routes SET parent_ref = $1, service = $2, leader = $3, idle_timeout = $6
+	WHERE id = $4 AND port = $5 AND deleted_at IS NULL
+	RETURNING id, parent_ref, service, leader, port, idle_timeout, created_at, updated_at`
+
+	deleteUdpRoute = `UPDATE udp_routes SET deleted_at = now() WHERE id = $1`
+
+	listUdpRoutes = `
+	SELECT id, parent_ref, service, leader, port, idle_timeout, created_at, updated_at FROM udp_routes
 	WHERE deleted_at IS NULL`
 
 	// http
 	insertHttpRoute = `
-	INSERT INTO http_routes (parent_ref, service, leader, drain_backends, domain, sticky, path)
-	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	INSERT INTO http_routes (parent_ref, service, leader, drain_backends, domain, sticky, path, release_id, services, rate_limit, rate_limit_burst, max_conns, health_check, auto_tls, backend_protocol, access_log, request_headers, response_headers, https_redirect, redirect, strip_prefix, allow_ips, deny_ips, basic_auth, cache, compression, upstream_timeout, circuit_breaker, retry_budget, load_balancer, mirror)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31)
 	RETURNING id, created_at, updated_at`
 
 	selectHttpRoute = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.release_id, r.services, r.rate_limit, r.rate_limit_burst, r.max_conns, r.health_check, r.auto_tls, r.backend_protocol, r.access_log, r.request_headers, r.response_headers, r.https_redirect, r.redirect, r.strip_prefix, r.allow_ips, r.deny_ips, r.basic_auth, r.cache, r.compression, r.upstream_timeout, r.circuit_breaker, r.retry_budget, r.load_balancer, r.mirror, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
 	LEFT OUTER JOIN route_certificates AS rc on r.id = rc.http_route_id
 	LEFT OUTER JOIN certificates AS c ON c.id = rc.certificate_id
 	WHERE r.id = $1 AND r.deleted_at IS NULL`
 
 	updateHttpRoute = `
 	UPDATE http_routes as r
-	SET parent_ref = $1, service = $2, leader = $3, sticky = $4, path = $5
+	SET parent_ref = $1, service = $2, leader = $3, sticky = $4, path = $5, release_id = $8, services = $9, rate_limit = $10, rate_limit_burst = $11, max_conns = $12, health_check = $13, auto_tls = $14, backend_protocol = $15, access_log = $16, request_headers = $17, response_headers = $18, https_redirect = $19, redirect = $20, strip_prefix = $21, allow_ips = $22, deny_ips = $23, basic_auth = $24, cache = $25, compression = $26, upstream_timeout = $27, circuit_breaker = $28, retry_budget = $29, load_balancer = $30, mirror = $31
 	WHERE id = $6 AND domain = $7 AND deleted_at IS NULL
-	RETURNING r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at`
+	RETURNING r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.release_id, r.services, r.rate_limit, r.rate_limit_burst, r.max_conns, r.health_check, r.auto_tls, r.backend_protocol, r.access_log, r.request_headers, r.response_headers, r.https_redirect, r.redirect, r.strip_prefix, r.allow_ips, r.deny_ips, r.basic_auth, r.cache, r.compression, r.upstream_timeout, r.circuit_breaker, r.retry_budget, r.load_balancer, r.mirror, r.created_at, r.updated_at`
 
 	deleteHttpRoute = `UPDATE http_routes SET deleted_at = now() WHERE id = $1`
 
 	listHttpRoutes = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.release_id, r.services, r.rate_limit, r.rate_limit_burst, r.max_conns, r.health_check, r.auto_tls, r.backend_protocol, r.access_log, r.request_headers, r.response_headers, r.https_redirect, r.redirect, r.strip_prefix, r.allow_ips, r.deny_ips, r.basic_auth, r.cache, r.compression, r.upstream_timeout, r.circuit_breaker, r.retry_budget, r.load_balancer, r.mirror, r.created_at, r.updated_at, c.id, c.cert, c.key, c.created_at, c.updated_at FROM http_routes as r
 	LEFT OUTER JOIN route_certificates AS rc on r.id = rc.http_route_id
 	LEFT OUTER JOIN certificates AS c ON c.id = rc.certificate_id
 	WHERE r.deleted_at IS NULL
@@ -115,7 +182,7 @@ const (
 	) FROM certificates AS c`
 
 	listCertificateRoutes = `
-	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.created_at, r.updated_at FROM http_routes AS r
+	SELECT r.id, r.parent_ref, r.service, r.leader, r.drain_backends, r.domain, r.sticky, r.path, r.release_id, r.services, r.rate_limit, r.rate_limit_burst, r.max_conns, r.health_check, r.auto_tls, r.backend_protocol, r.access_log, r.request_headers, r.response_headers, r.https_redirect, r.redirect, r.strip_prefix, r.allow_ips, r.deny_ips, r.basic_auth, r.cache, r.compression, r.upstream_timeout, r.circuit_breaker, r.retry_budget, r.load_balancer, r.mirror, r.created_at, r.updated_at FROM http_routes AS r
 	INNER JOIN route_certificates AS rc ON rc.http_route_id = r.id AND rc.certificate_id = $1`
 
 	insertCertificate = `
@@ -136,4 +203,24 @@ const (
 	deleteRouteCertificateByRouteId = `
 	DELETE FROM route_certificates
 	WHERE http_route_id = $1`
+
+	// acme
+	selectACMEAccount = `SELECT key FROM acme_accounts WHERE directory_url = $1`
+
+	insertACMEAccount = `
+	INSERT INTO acme_accounts (directory_url, key)
+	VALUES ($1, $2)
+	ON CONFLICT (directory_url) DO NOTHING`
+
+	selectACMEChallenge = `SELECT key_authorization FROM acme_challenges WHERE token = $1`
+
+	insertACMEChallenge = `
+	INSERT INTO acme_challenges (token, key_authorization)
+	VALUES ($1, $2)
+	ON CONFLICT (token) DO UPDATE SET key_authorization = $2`
+
+	deleteACMEChallenge = `DELETE FROM acme_challenges WHERE token = $1`
+
+	// cache
+	notifyCachePurge = `SELECT pg_notify('http_route_cache_purges', $1)`
 )
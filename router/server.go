@@ -8,8 +8,10 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 
+	"github.com/flynn/flynn/discoverd/cache"
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/pkg/keepalive"
 	"github.com/flynn/flynn/pkg/postgres"
@@ -32,8 +34,11 @@ type Listener interface {
 }
 
 type Router struct {
-	HTTP Listener
-	TCP  Listener
+	HTTP    Listener
+	TCP     Listener
+	TLS     Listener
+	UDP     Listener
+	Metrics *Metrics
 }
 
 func (s *Router) ListenerFor(typ string) Listener {
@@ -42,6 +47,10 @@ func (s *Router) ListenerFor(typ string) Listener {
 		return s.HTTP
 	case "tcp":
 		return s.TCP
+	case "tls":
+		return s.TLS
+	case "udp":
+		return s.UDP
 	default:
 		return nil
 	}
@@ -49,15 +58,32 @@ func (s *Router) ListenerFor(typ string) Listener {
 
 func (s *Router) Start() error {
 	log := logger.New("fn", "Start")
+	// start the TLS listener first so that its routes are synced before
+	// the HTTP listener starts forwarding connections to them
+	log.Info("starting TLS listener")
+	if err := s.TLS.Start(); err != nil {
+		log.Error("error starting TLS listener", "err", err)
+		return err
+	}
 	log.Info("starting HTTP listener")
 	if err := s.HTTP.Start(); err != nil {
 		log.Error("error starting HTTP listener", "err", err)
+		s.TLS.Close()
 		return err
 	}
 	log.Info("starting TCP listener")
 	if err := s.TCP.Start(); err != nil {
 		log.Error("error starting TCP listener", "err", err)
 		s.HTTP.Close()
+		s.TLS.Close()
+		return err
+	}
+	log.Info("starting UDP listener")
+	if err := s.UDP.Start(); err != nil {
+		log.Error("error starting UDP listener", "err", err)
+		s.HTTP.Close()
+		s.TLS.Close()
+		s.TCP.Close()
 		return err
 	}
 	return nil
@@ -66,10 +92,14 @@ func (s *Router) Start() error {
 func (s *Router) Close() {
 	s.HTTP.Close()
 	s.TCP.Close()
+	s.TLS.Close()
+	s.UDP.Close()
 }
 
 var listenFunc = keepalive.ReusableListen
 
+var listenPacketFunc = net.ListenPacket
+
 func main() {
 	defer shutdown.Exit()
 
@@ -91,12 +121,16 @@ func main() {
 	}
 
 	proxyProtocol := os.Getenv("PROXY_PROTOCOL") == "true"
+	acmeDirectoryURL := os.Getenv("ACME_DIRECTORY_URL")
+	acmeEmail := os.Getenv("ACME_EMAIL")
 
 	httpPort := flag.Int("http-port", 8080, "http listen port")
 	httpsPort := flag.Int("https-port", 4433, "https listen port")
 	tcpIP := flag.String("tcp-ip", os.Getenv("LISTEN_IP"), "tcp router listen ip")
 	tcpRangeStart := flag.Int("tcp-range-start", 3000, "tcp port range start")
 	tcpRangeEnd := flag.Int("tcp-range-end", 3500, "tcp port range end")
+	udpRangeStart := flag.Int("udp-range-start", 3000, "udp port range start")
+	udpRangeEnd := flag.Int("udp-range-end", 3500, "udp port range end")
 	certFile := flag.String("tls-cert", "", "TLS (SSL) cert file in pem format")
 	keyFile := flag.String("tls-key", "", "TLS (SSL) key file in pem format")
 	apiPort := flag.String("api-port", "", "api listen port")
@@ -140,8 +174,39 @@ func main() {
 
 	shutdown.BeforeExit(func() { db.Close() })
 
+	httpDS := NewPostgresDataStore("http", db.ConnPool)
+	acme := newACMEManager(acmeDirectoryURL, acmeEmail, httpDS)
+	metrics := NewMetrics()
+
+	// access logs are sent to all log aggregator instances, and are
+	// disabled if they cannot be watched rather than stopping the router
+	// from starting
+	var accessLog *accessLogger
+	log.Info("watching log aggregator instances")
+	if aggregators, err := cache.New(discoverd.NewService("logaggregator")); err == nil {
+		jobID := os.Getenv("FLYNN_JOB_ID")
+		if jobID == "" {
+			jobID, _ = os.Hostname()
+		}
+		accessLog = newAccessLogger(jobID, aggregators.Addrs)
+	} else {
+		log.Error("error watching log aggregator instances, access logs are disabled", "err", err)
+	}
+
+	// responses of routes with caching enabled are stored on disk in
+	// CACHE_DIR once they no longer fit in memory
+	cacheDir := os.Getenv("CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "router-cache")
+	}
+
 	httpAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpPort))
 	httpsAddr := net.JoinHostPort(os.Getenv("LISTEN_IP"), strconv.Itoa(*httpsPort))
+	tlsListener := &TLSListener{
+		ds:        NewPostgresDataStore("tls", db.ConnPool),
+		discoverd: discoverd.DefaultClient,
+		metrics:   metrics,
+	}
 	r := Router{
 		TCP: &TCPListener{
 			IP:            *tcpIP,
@@ -150,16 +215,32 @@ func main() {
 			ds:            NewPostgresDataStore("tcp", db.ConnPool),
 			discoverd:     discoverd.DefaultClient,
 			reservedPorts: []int{*httpPort, *httpsPort},
+			metrics:       metrics,
 		},
 		HTTP: &HTTPListener{
 			Addr:          httpAddr,
 			TLSAddr:       httpsAddr,
 			cookieKey:     cookieKey,
 			keypair:       keypair,
-			ds:            NewPostgresDataStore("http", db.ConnPool),
+			ds:            httpDS,
 			discoverd:     discoverd.DefaultClient,
 			proxyProtocol: proxyProtocol,
+			acme:          acme,
+			metrics:       metrics,
+			accessLog:     accessLog,
+			cacheDir:      cacheDir,
+			passthrough:   tlsListener,
+		},
+		TLS: tlsListener,
+		UDP: &UDPListener{
+			IP:        *tcpIP,
+			startPort: *udpRangeStart,
+			endPort:   *udpRangeEnd,
+			ds:        NewPostgresDataStore("udp", db.ConnPool),
+			discoverd: discoverd.DefaultClient,
+			metrics:   metrics,
 		},
+		Metrics: metrics,
 	}
 
 	if err := r.Start(); err != nil {
@@ -187,6 +268,14 @@ func main() {
 			shutdown.Fatal(err)
 		}
 		shutdown.BeforeExit(func() { hb.Close() })
+
+		// the router API leader is responsible for obtaining ACME
+		// certificates
+		if service == "router-api" {
+			if err := watchLeader(service, hb, acme.SetLeader); err != nil {
+				shutdown.Fatal(err)
+			}
+		}
 	}
 
 	log.Info("serving API requests")
@@ -26,6 +26,7 @@ func init() {
 type discoverdClient interface {
 	DiscoverdClient
 	AddServiceAndRegister(string, string) (discoverd.Heartbeater, error)
+	AddServiceAndRegisterInstance(string, *discoverd.Instance) (discoverd.Heartbeater, error)
 }
 
 // discoverdWrapper wraps a discoverd client to expose Close method that closes
@@ -44,6 +45,15 @@ func (d *discoverdWrapper) AddServiceAndRegister(service, addr string) (discover
 	return hb, nil
 }
 
+func (d *discoverdWrapper) AddServiceAndRegisterInstance(service string, inst *discoverd.Instance) (discoverd.Heartbeater, error) {
+	hb, err := d.discoverdClient.AddServiceAndRegisterInstance(service, inst)
+	if err != nil {
+		return nil, err
+	}
+	d.hbs = append(d.hbs, hb)
+	return hb, nil
+}
+
 func (d *discoverdWrapper) Cleanup() {
 	for _, hb := range d.hbs {
 		hb.Close()
@@ -153,6 +163,18 @@ func discoverdRegisterTCPService(c *C, l *TCPListener, name, addr string) func()
 	return discoverdRegister(c, dc, sc, name, addr)
 }
 
+func discoverdRegisterTLSService(c *C, l *TLSListener, name, addr string) func() {
+	dc := l.discoverd.(discoverdClient)
+	sc := l.services[name].sc
+	return discoverdRegister(c, dc, sc, name, addr)
+}
+
+func discoverdRegisterUDPService(c *C, l *UDPListener, name, addr string) func() {
+	dc := l.discoverd.(discoverdClient)
+	sc := l.services[name].sc
+	return discoverdRegister(c, dc, sc, name, addr)
+}
+
 func discoverdRegisterHTTP(c *C, l *HTTPListener, addr string) func() {
 	return discoverdRegisterHTTPService(c, l, "test", addr)
 }
@@ -163,6 +185,12 @@ func discoverdRegisterHTTPService(c *C, l *HTTPListener, name, addr string) func
 	return discoverdRegister(c, dc, sc, name, addr)
 }
 
+func discoverdRegisterHTTPInstance(c *C, l *HTTPListener, name string, inst *discoverd.Instance) func() {
+	dc := l.discoverd.(discoverdClient)
+	sc := l.services[name].sc
+	return discoverdRegisterInstance(c, dc, sc, name, inst)
+}
+
 func discoverdSetLeaderHTTP(c *C, l *HTTPListener, name, id string) {
 	dc := l.discoverd.(discoverdClient)
 	sc := l.services[name].sc
@@ -198,6 +226,11 @@ func discoverdSetLeader(c *C, dc discoverdClient, sc *cache.ServiceCache, name,
 }
 
 func discoverdRegister(c *C, dc discoverdClient, sc *cache.ServiceCache, name, addr string) func() {
+	return discoverdRegisterInstance(c, dc, sc, name, &discoverd.Instance{Addr: addr})
+}
+
+func discoverdRegisterInstance(c *C, dc discoverdClient, sc *cache.ServiceCache, name string, inst *discoverd.Instance) func() {
+	addr := inst.Addr
 	done := make(chan struct{})
 	go func() {
 		events := make(chan *discoverd.Event)
@@ -210,7 +243,7 @@ func discoverdRegister(c *C, dc discoverdClient, sc *cache.ServiceCache, name, a
 			}
 		}
 	}()
-	hb, err := dc.AddServiceAndRegister(name, addr)
+	hb, err := dc.AddServiceAndRegisterInstance(name, inst)
 	c.Assert(err, IsNil)
 	select {
 	case <-done:
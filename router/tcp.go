@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -12,6 +14,7 @@ import (
 	"github.com/flynn/flynn/discoverd/cache"
 	"github.com/flynn/flynn/pkg/connutil"
 	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/proxyproto"
 	"github.com/flynn/flynn/router/types"
 	"golang.org/x/net/context"
 )
@@ -26,6 +29,7 @@ type TCPListener struct {
 	ds        DataStore
 	wm        *WatchManager
 	stopSync  func()
+	metrics   *Metrics
 
 	startPort     int
 	endPort       int
@@ -214,6 +218,7 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		TCPRoute: route,
 		addr:     h.l.IP + ":" + strconv.Itoa(route.Port),
 		parent:   h.l,
+		limiter:  newRouteLimiter(route.RateLimit, route.RateLimitBurst, route.MaxConns),
 	}
 
 	h.l.mtx.Lock()
@@ -248,6 +253,14 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		bf = service.sc.Addrs
 	}
 	r.rp = proxy.NewReverseProxy(bf, nil, false, service, logger)
+	if r.metrics = h.l.metrics.Route(data, service.sc.Addrs); r.metrics != nil {
+		r.rp.SetObserver(r.metrics)
+	}
+	if r.HealthCheck != nil {
+		targets := []healthCheckTarget{{service: service, backends: bf}}
+		r.health = newTCPHealthChecker(r.ToRoute(), targets, h.l.wm)
+		r.rp.SetBackendHealth(r.health)
+	}
 	if listener, ok := h.l.listeners[r.Port]; ok {
 		r.l = listener
 		delete(h.l.listeners, r.Port)
@@ -261,6 +274,10 @@ func (h *tcpSyncHandler) Set(data *router.Route) error {
 		return err
 	}
 	service.refs++
+	if prev, ok := h.l.routes[data.ID]; ok {
+		prev.health.Stop()
+	}
+	r.health.Start()
 	h.l.routes[data.ID] = r
 	h.l.ports[r.Port] = r
 
@@ -279,6 +296,7 @@ func (h *tcpSyncHandler) Remove(id string) error {
 		return ErrNotFound
 	}
 	r.Close()
+	h.l.metrics.RemoveRoute(r.ToRoute())
 
 	r.service.refs--
 	if r.service.refs <= 0 {
@@ -299,6 +317,9 @@ type tcpRoute struct {
 	addr    string
 	service *service
 	rp      *proxy.ReverseProxy
+	limiter *routeLimiter
+	health  *healthChecker
+	metrics *routeMetrics
 }
 
 func (r *tcpRoute) Serve(started chan<- error) {
@@ -324,6 +345,7 @@ func (r *tcpRoute) Serve(started chan<- error) {
 }
 
 func (r *tcpRoute) Close() {
+	r.health.Stop()
 	if r.Port >= r.parent.startPort && r.Port <= r.parent.endPort {
 		// make a copy of the fd and create a new listener with it
 		fd, err := r.l.(*net.TCPListener).File()
@@ -342,5 +364,27 @@ func (r *tcpRoute) Close() {
 }
 
 func (r *tcpRoute) ServeConn(conn net.Conn) {
+	if !r.limiter.Allow(conn.RemoteAddr().String()) || !r.limiter.AcquireConn() {
+		conn.Close()
+		return
+	}
+	defer r.limiter.ReleaseConn()
+	r.metrics.ConnStarted()
+	defer r.metrics.ConnFinished()
+	if r.ProxyProtocol != "" {
+		// send the PROXY protocol header to the backend ahead of the
+		// data read from the client
+		header, err := proxyproto.Header(proxyProtocolVersions[r.ProxyProtocol], conn.RemoteAddr(), conn.LocalAddr())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		conn = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(header), conn)}
+	}
 	r.rp.ServeConn(context.Background(), connutil.CloseNotifyConn(conn))
 }
+
+var proxyProtocolVersions = map[string]int{
+	router.ProxyProtocolV1: proxyproto.Version1,
+	router.ProxyProtocolV2: proxyproto.Version2,
+}
@@ -6,9 +6,11 @@ import (
 	"io/ioutil"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/testutil"
+	"github.com/flynn/flynn/pkg/httphelper"
 	"github.com/flynn/flynn/router/types"
 	. "github.com/flynn/go-check"
 )
@@ -217,3 +219,117 @@ func (s *S) TestTCPPortAllocation(c *C) {
 		}
 	}
 }
+
+func (s *S) TestTCPRouteRateLimit(c *C) {
+	portInt := allocatePort()
+	addr := "127.0.0.1:" + strconv.Itoa(portInt)
+
+	srv := NewTCPTestServer("1")
+	defer srv.Close()
+
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.TCPRoute{
+		Service:        "test",
+		Port:           portInt,
+		RateLimit:      0.01,
+		RateLimitBurst: 2,
+	}.ToRoute())
+	discoverdRegisterTCP(c, l, srv.Addr)
+
+	assertTCPConn(c, addr, "1")
+	assertTCPConn(c, addr, "1")
+	assertTCPConnRefused(c, addr)
+}
+
+func (s *S) TestTCPRouteMaxConns(c *C) {
+	portInt := allocatePort()
+	addr := "127.0.0.1:" + strconv.Itoa(portInt)
+
+	srv := NewTCPTestServer("1")
+	defer srv.Close()
+
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.TCPRoute{
+		Service:  "test",
+		Port:     portInt,
+		MaxConns: 1,
+	}.ToRoute())
+	discoverdRegisterTCP(c, l, srv.Addr)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write([]byte("asdf"))
+
+	// wait for the connection to be proxied before checking that a
+	// second connection is over the limit
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, IsNil)
+	assertTCPConnRefused(c, addr)
+
+	conn.(*net.TCPConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf)+string(res), Equals, "1asdf")
+}
+
+func (s *S) TestTCPRouteProxyProtocol(c *C) {
+	portInt := allocatePort()
+	addr := "127.0.0.1:" + strconv.Itoa(portInt)
+
+	// the backend echoes the PROXY header back along with the data
+	srv := NewTCPTestServer("")
+	defer srv.Close()
+
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	addRoute(c, l, router.TCPRoute{
+		Service:       "test",
+		Port:          portInt,
+		ProxyProtocol: router.ProxyProtocolV1,
+	}.ToRoute())
+	discoverdRegisterTCP(c, l, srv.Addr)
+
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Write([]byte("asdf"))
+	conn.(*net.TCPConn).CloseWrite()
+	res, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+
+	client := conn.LocalAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\nasdf", client.Port, portInt)
+	c.Assert(string(res), Equals, expected)
+}
+
+func (s *S) TestTCPRouteProxyProtocolValidation(c *C) {
+	l := s.newTCPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute(router.TCPRoute{
+		Service:       "test",
+		Port:          allocatePort(),
+		ProxyProtocol: "v3",
+	}.ToRoute())
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+}
+
+// assertTCPConnRefused asserts that the router closes a connection to the
+// given address without proxying it
+func assertTCPConnRefused(c *C, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(res, HasLen, 0)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/pkg/connutil"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+// TLSListener serves TLS passthrough routes, which receive the connections
+// to the HTTPS port of the HTTP listener with a matching server name in their
+// TLS ClientHello. The connections are forwarded to backends as they are,
+// without being terminated, so apps which must own their certificates (for
+// example to authenticate clients with mutual TLS) can share the HTTPS port.
+type TLSListener struct {
+	Watcher
+	DataStoreReader
+
+	discoverd DiscoverdClient
+	ds        DataStore
+	wm        *WatchManager
+	stopSync  func()
+	metrics   *Metrics
+
+	mtx      sync.RWMutex
+	services map[string]*service
+	routes   map[string]*tlsRoute
+	domains  map[string]*tlsRoute
+	closed   bool
+}
+
+func (l *TLSListener) AddRoute(route *router.Route) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.ds.Add(route)
+}
+
+func (l *TLSListener) UpdateRoute(route *router.Route) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.ds.Update(route)
+}
+
+func (l *TLSListener) RemoveRoute(id string) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.ds.Remove(id)
+}
+
+func (l *TLSListener) Start() error {
+	ctx := context.Background()
+	ctx, l.stopSync = context.WithCancel(ctx)
+
+	if l.Watcher != nil {
+		return errors.New("router: tls listener already started")
+	}
+	if l.wm == nil {
+		l.wm = NewWatchManager()
+	}
+	l.Watcher = l.wm
+
+	if l.ds == nil {
+		return errors.New("router: tls listener missing data store")
+	}
+	l.DataStoreReader = l.ds
+
+	l.services = make(map[string]*service)
+	l.routes = make(map[string]*tlsRoute)
+	l.domains = make(map[string]*tlsRoute)
+
+	if err := l.startSync(ctx); err != nil {
+		l.Close()
+		return err
+	}
+	return nil
+}
+
+func (l *TLSListener) startSync(ctx context.Context) error {
+	errc := make(chan error)
+	startc := l.doSync(ctx, errc)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-startc:
+		go l.runSync(ctx, errc)
+		return nil
+	}
+}
+
+func (l *TLSListener) runSync(ctx context.Context, errc chan error) {
+	err := <-errc
+
+	for {
+		if err == nil {
+			return
+		}
+		log.Printf("router: tls sync error: %s", err)
+
+		time.Sleep(2 * time.Second)
+
+		l.doSync(ctx, errc)
+
+		err = <-errc
+	}
+}
+
+func (l *TLSListener) doSync(ctx context.Context, errc chan<- error) <-chan struct{} {
+	startc := make(chan struct{})
+
+	go func() { errc <- l.ds.Sync(ctx, &tlsSyncHandler{l: l}, startc) }()
+
+	return startc
+}
+
+func (l *TLSListener) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.stopSync()
+	for _, r := range l.routes {
+		r.health.Stop()
+	}
+	for _, service := range l.services {
+		service.Close()
+	}
+	l.closed = true
+	return nil
+}
+
+// findRoute returns the route for the given server name, or nil if there is
+// no route for it (it is safe to call on a nil listener)
+func (l *TLSListener) findRoute(serverName string) *tlsRoute {
+	if l == nil || serverName == "" {
+		return nil
+	}
+	serverName = strings.ToLower(serverName)
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if r, ok := l.domains[serverName]; ok {
+		return r
+	}
+	// handle wildcard domains up to 5 subdomains deep, from most-specific to
+	// least-specific
+	d := strings.SplitN(serverName, ".", 5)
+	for i := len(d); i > 0; i-- {
+		if r, ok := l.domains["*."+strings.Join(d[len(d)-i:], ".")]; ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// hasRoutes returns whether there are any routes, so that connections do not
+// need to be inspected when there are not (it is safe to call on a nil
+// listener)
+func (l *TLSListener) hasRoutes() bool {
+	if l == nil {
+		return false
+	}
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	return len(l.domains) > 0
+}
+
+// acquireService returns the service with the given name, creating it if it
+// does not exist, and increments its reference count (it must be called with
+// l.mtx held)
+func (l *TLSListener) acquireService(name string, drainBackends bool) (*service, error) {
+	service, ok := l.services[name]
+	if !ok {
+		sc, err := cache.New(l.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
+		service = newService(name, sc, l.wm, drainBackends)
+		l.services[name] = service
+	}
+	service.refs++
+	return service, nil
+}
+
+// releaseService decrements the reference count of the given service,
+// closing it if it is no longer referenced by any routes (it must be called
+// with l.mtx held)
+func (l *TLSListener) releaseService(service *service) {
+	service.refs--
+	if service.refs <= 0 {
+		service.Close()
+		delete(l.services, service.name)
+	}
+}
+
+type tlsSyncHandler struct {
+	l *TLSListener
+}
+
+func (h *tlsSyncHandler) Current() map[string]struct{} {
+	h.l.mtx.RLock()
+	defer h.l.mtx.RUnlock()
+	ids := make(map[string]struct{}, len(h.l.routes))
+	for id := range h.l.routes {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (h *tlsSyncHandler) Set(data *router.Route) error {
+	route := data.TLSRoute()
+	route.Domain = strings.ToLower(route.Domain)
+	r := &tlsRoute{
+		TLSRoute: route,
+		limiter:  newRouteLimiter(route.RateLimit, route.RateLimitBurst, route.MaxConns),
+	}
+
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+
+	service, err := h.l.acquireService(r.Service, r.DrainBackends)
+	if err != nil {
+		return err
+	}
+	r.service = service
+	var bf proxy.BackendListFunc
+	if r.Leader {
+		bf = service.sc.LeaderAddr
+	} else {
+		bf = service.sc.Addrs
+	}
+	r.rp = proxy.NewReverseProxy(bf, nil, false, service, logger)
+	if r.metrics = h.l.metrics.Route(data, service.sc.Addrs); r.metrics != nil {
+		r.rp.SetObserver(r.metrics)
+	}
+	if r.HealthCheck != nil {
+		targets := []healthCheckTarget{{service: service, backends: bf}}
+		r.health = newTCPHealthChecker(r.ToRoute(), targets, h.l.wm)
+		r.rp.SetBackendHealth(r.health)
+	}
+
+	if prev, ok := h.l.routes[data.ID]; ok {
+		prev.health.Stop()
+		h.l.releaseService(prev.service)
+		delete(h.l.domains, prev.Domain)
+	}
+	r.health.Start()
+	h.l.routes[data.ID] = r
+	h.l.domains[r.Domain] = r
+
+	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: data.ID, Route: r.ToRoute()})
+	return nil
+}
+
+func (h *tlsSyncHandler) Remove(id string) error {
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+	r, ok := h.l.routes[id]
+	if !ok {
+		return ErrNotFound
+	}
+	r.health.Stop()
+	h.l.metrics.RemoveRoute(r.ToRoute())
+	h.l.releaseService(r.service)
+
+	delete(h.l.routes, id)
+	delete(h.l.domains, r.Domain)
+	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
+	return nil
+}
+
+type tlsRoute struct {
+	*router.TLSRoute
+	service *service
+	rp      *proxy.ReverseProxy
+	limiter *routeLimiter
+	health  *healthChecker
+	metrics *routeMetrics
+}
+
+func (r *tlsRoute) ServeConn(conn net.Conn) {
+	if !r.limiter.Allow(conn.RemoteAddr().String()) || !r.limiter.AcquireConn() {
+		conn.Close()
+		return
+	}
+	defer r.limiter.ReleaseConn()
+	r.metrics.ConnStarted()
+	defer r.metrics.ConnFinished()
+	r.rp.ServeConn(context.Background(), connutil.CloseNotifyConn(conn))
+}
+
+// clientHelloTimeout is the maximum time to wait for a client to send its TLS
+// ClientHello before it is handed to the HTTPS server
+const clientHelloTimeout = 10 * time.Second
+
+// sniListener wraps the listener of the HTTPS port, reading the TLS
+// ClientHello of each accepted connection and forwarding connections with a
+// server name matching a TLS passthrough route to it. Other connections are
+// returned from Accept to be served by the HTTPS server, with the ClientHello
+// replayed so that the handshake can be completed as usual.
+type sniListener struct {
+	net.Listener
+	passthrough *TLSListener
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSNIListener(l net.Listener, passthrough *TLSListener) *sniListener {
+	s := &sniListener{
+		Listener:    l,
+		passthrough: passthrough,
+		conns:       make(chan net.Conn),
+		errs:        make(chan error),
+		done:        make(chan struct{}),
+	}
+	go s.acceptLoop()
+	return s
+}
+
+func (l *sniListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			// the HTTP server retries temporary errors
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		if !l.passthrough.hasRoutes() {
+			l.accept(conn)
+			continue
+		}
+		go l.route(conn)
+	}
+}
+
+// route reads the ClientHello of the given connection and either forwards it
+// to the matching TLS route or returns it from Accept
+func (l *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, hello := readClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+
+	conn = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)}
+	if r := l.passthrough.findRoute(serverName); r != nil {
+		r.ServeConn(conn)
+		return
+	}
+	l.accept(conn)
+}
+
+func (l *sniListener) accept(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("router: listener closed")
+	}
+}
+
+func (l *sniListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+var errClientHelloRead = errors.New("router: ClientHello read")
+
+// readClientHello reads the TLS ClientHello from r, returning the server name
+// it contains (which is empty if the client did not send a valid ClientHello)
+// along with all the data which was read
+func readClientHello(r io.Reader) (string, []byte) {
+	var buf bytes.Buffer
+	var serverName string
+	// parse the ClientHello by starting a handshake with a connection
+	// which records what is read and discards what is written, aborting
+	// the handshake once a certificate is requested for the ClientHello
+	tls.Server(readOnlyConn{io.TeeReader(r, &buf)}, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	return serverName, buf.Bytes()
+}
+
+// readOnlyConn is a net.Conn which reads from an io.Reader and fails to
+// write
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// prefixConn is a net.Conn which reads from r, which returns some prefix,
+// such as data already read from the underlying connection, before reading
+// the rest of it
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/flynn/flynn/discoverd/testutil"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) newTLSListener(t testutil.TestingT) *TLSListener {
+	l := &TLSListener{
+		ds:        NewPostgresDataStore("tls", s.pgx),
+		discoverd: s.discoverd,
+	}
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func (s *S) TestReadClientHello(c *C) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: "Example.com", InsecureSkipVerify: true}).Handshake()
+
+	serverName, hello := readClientHello(server)
+	c.Assert(serverName, Equals, "Example.com")
+	c.Assert(len(hello) > 0, Equals, true)
+
+	// the data which was read is enough to read the ClientHello again
+	serverName, _ = readClientHello(strings.NewReader(string(hello)))
+	c.Assert(serverName, Equals, "Example.com")
+
+	// data which is not a ClientHello has no server name
+	req := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	serverName, data := readClientHello(strings.NewReader(req))
+	c.Assert(serverName, Equals, "")
+	c.Assert(strings.HasPrefix(req, string(data)), Equals, true)
+}
+
+func (s *S) TestTLSPassthroughRoute(c *C) {
+	const domain = "secure.example.org"
+
+	// start a backend which terminates TLS with its own certificate
+	cert := tlsConfigForDomain(domain)
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	c.Assert(err, IsNil)
+	backend := httptest.NewUnstartedServer(httpTestHandler("backend"))
+	backend.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	backend.StartTLS()
+	defer backend.Close()
+
+	srv := httptest.NewServer(httpTestHandler("router"))
+	defer srv.Close()
+
+	tl := s.newTLSListener(c)
+	defer tl.Close()
+	l := s.buildHTTPListener(c)
+	l.passthrough = tl
+	c.Assert(l.Start(), IsNil)
+	defer l.Close()
+
+	addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	route := addRoute(c, tl, router.TLSRoute{
+		Domain:  strings.ToUpper(domain),
+		Service: "tls-test",
+	}.ToRoute())
+	c.Assert(route.Domain, Equals, domain)
+	discoverdRegisterTLSService(c, tl, "tls-test", backend.Listener.Addr().String())
+
+	get := func(serverName string) string {
+		res, err := newHTTPClient(serverName).Do(newReq("https://"+l.TLSAddr, serverName))
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// connections for the TLS route are terminated by the backend
+	c.Assert(get(domain), Equals, "backend")
+
+	// other connections are still terminated by the router
+	c.Assert(get("example.com"), Equals, "router")
+
+	// once the route is removed the router terminates connections for the
+	// domain, which it has no certificate for
+	removeRoute(c, tl, route.ID)
+	conn, err := tls.Dial("tcp", l.TLSAddr, &tls.Config{ServerName: domain, InsecureSkipVerify: true})
+	if err == nil {
+		cert := conn.ConnectionState().PeerCertificates[0]
+		c.Assert(cert.VerifyHostname(domain), NotNil)
+		conn.Close()
+	}
+}
+
+func (s *S) TestTLSRouteValidation(c *C) {
+	l := s.newTLSListener(c)
+	defer l.Close()
+
+	for _, domain := range []string{"", "example.com/path", "example.com:443"} {
+		err := l.AddRoute(router.TLSRoute{
+			Domain:  domain,
+			Service: "test",
+		}.ToRoute())
+		c.Assert(err, NotNil, Commentf(domain))
+		c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+	}
+}
@@ -2,6 +2,8 @@ package router
 
 import (
 	"encoding/json"
+	"fmt"
+	"reflect"
 	"time"
 )
 
@@ -21,10 +23,10 @@ type Certificate struct {
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 }
 
-// Route is a struct that combines the fields of HTTPRoute and TCPRoute
-// for easy JSON marshaling.
+// Route is a struct that combines the fields of HTTPRoute, TCPRoute,
+// TLSRoute and UDPRoute for easy JSON marshaling.
 type Route struct {
-	// Type is the type of Route, either "http" or "tcp".
+	// Type is the type of Route, either "http", "tcp", "tls" or "udp".
 	Type string `json:"type"`
 	// ID is the unique ID of this route.
 	ID string `json:"id,omitempty"`
@@ -33,6 +35,10 @@ type Route struct {
 	ParentRef string `json:"parent_ref,omitempty"`
 	// Service is the ID of the service.
 	Service string `json:"service"`
+	// Services is an optional list of services to split traffic between in
+	// proportion to their weights. If set, Service is ignored when routing
+	// requests. It is only used for HTTP routes.
+	Services []*WeightedService `json:"services,omitempty"`
 	// Leader is whether or not traffic should only be routed to the leader or
 	// all instances
 	Leader bool `json:"leader"`
@@ -41,7 +47,8 @@ type Route struct {
 	// UpdatedAt is the time this Route was last updated.
 	UpdatedAt time.Time `json:"updated_at,omitempty"`
 
-	// Domain is the domain name of this Route. It is only used for HTTP routes.
+	// Domain is the domain name of this Route. It is only used for HTTP and
+	// TLS routes.
 	Domain string `json:"domain,omitempty"`
 
 	// Certificate contains TLSCert and TLSKey
@@ -59,14 +66,391 @@ type Route struct {
 	// and no Path already exists in the route table.
 	Path string `json:"path,omitempty"`
 
-	// Port is the TCP port to listen on for TCP Routes.
+	// ReleaseID is the optional ID of a release to restrict the backends of
+	// this route to (i.e. only service instances with a matching
+	// FLYNN_RELEASE_ID will receive traffic). It is only used for HTTP routes,
+	// and is used by blue/green deployments to switch traffic between
+	// releases.
+	ReleaseID string `json:"release_id,omitempty"`
+
+	// AutoTLS is whether the router should automatically obtain and renew a
+	// certificate for the route's domain using ACME. It is only used for
+	// HTTP routes without a path, and cannot be used with wildcard domains.
+	AutoTLS bool `json:"auto_tls,omitempty"`
+
+	// BackendProtocol is the protocol used to proxy requests to the
+	// backends of an HTTP route, either BackendProtocolHTTP1 (the default)
+	// or BackendProtocolH2C for backends which serve HTTP/2 without TLS,
+	// such as gRPC servers.
+	BackendProtocol string `json:"backend_protocol,omitempty"`
+
+	// Port is the port to listen on for TCP and UDP Routes.
 	Port int32 `json:"port,omitempty"`
 
+	// ProxyProtocol is the version of the PROXY protocol, either
+	// ProxyProtocolV1 or ProxyProtocolV2, used to send the addresses of
+	// clients to backends at the start of each connection. It is only used
+	// for TCP routes, with no header being sent if it is empty.
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+
+	// IdleTimeout is how long a UDP client's session, which forwards its
+	// datagrams to the same backend, is kept after its last datagram. It is
+	// only used for UDP routes.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
 	// DrainBackends is whether or not to track requests and trigger
 	// drain events on backend shutdown when all requests have completed
 	// (used by the scheduler to only stop jobs once all requests have
 	// completed).
 	DrainBackends bool `json:"drain_backends,omitempty"`
+
+	// RateLimit is the maximum number of requests (or connections for TCP
+	// routes) per second accepted from each client IP, with zero meaning
+	// no limit. HTTP requests over the limit get a 429 response and TCP
+	// connections over the limit are closed.
+	RateLimit float64 `json:"rate_limit,omitempty"`
+	// RateLimitBurst is the number of requests a client can make at once
+	// before RateLimit applies, defaulting to RateLimit rounded up.
+	RateLimitBurst int `json:"rate_limit_burst,omitempty"`
+	// MaxConns is the maximum number of concurrent upstream connections
+	// for the route, with zero meaning no limit. HTTP requests over the
+	// limit get a 503 response with a Retry-After header.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// HealthCheck is an optional active health check of the route's
+	// backends, with backends which fail it not receiving traffic until
+	// they pass it again.
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+
+	// AccessLog optionally enables access logs for the requests proxied by
+	// an HTTP route, which are sent to the logs of the app identified by
+	// the route's ParentRef.
+	AccessLog *AccessLog `json:"access_log,omitempty"`
+
+	// RequestHeaders and ResponseHeaders are optional rules which modify
+	// the headers of requests before they are proxied to backends and of
+	// responses before they are sent to clients. They are only used for
+	// HTTP routes.
+	RequestHeaders  *HeaderRules `json:"request_headers,omitempty"`
+	ResponseHeaders *HeaderRules `json:"response_headers,omitempty"`
+	// HTTPSRedirect is whether requests made without TLS are redirected to
+	// HTTPS rather than being proxied. It is only used for HTTP routes.
+	HTTPSRedirect bool `json:"https_redirect,omitempty"`
+	// Redirect optionally redirects requests to another domain rather
+	// than proxying them. It is only used for HTTP routes.
+	Redirect *Redirect `json:"redirect,omitempty"`
+	// StripPrefix is whether the route's path is removed from the start of
+	// request paths before they are proxied, so that backends receive
+	// requests for example.com/api/users as /users. It is only used for
+	// HTTP routes with a path.
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// AllowIPs and DenyIPs are optional lists of IP addresses and CIDR
+	// ranges which restrict the clients which can make requests to an
+	// HTTP route. Clients in DenyIPs are always rejected, and if AllowIPs
+	// is set only clients in it are accepted.
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	DenyIPs  []string `json:"deny_ips,omitempty"`
+	// BasicAuth optionally requires clients to authenticate with HTTP
+	// basic auth. It is only used for HTTP routes.
+	BasicAuth *BasicAuth `json:"basic_auth,omitempty"`
+
+	// Cache optionally enables caching of responses which are cacheable
+	// according to their Cache-Control, Expires and Vary headers. It is
+	// only used for HTTP routes.
+	Cache *Cache `json:"cache,omitempty"`
+
+	// Compression optionally enables compressing responses with gzip for
+	// clients which accept it. It is only used for HTTP routes.
+	Compression *Compression `json:"compression,omitempty"`
+
+	// UpstreamTimeout is the maximum time to wait for a backend to respond
+	// to a request with its response headers, after which the request
+	// fails with a 504 response. It is only used for HTTP routes, and
+	// defaults to ten minutes.
+	UpstreamTimeout time.Duration `json:"upstream_timeout,omitempty"`
+	// CircuitBreaker optionally stops requests being sent to backends
+	// which are failing. It is only used for HTTP routes.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+	// RetryBudget optionally retries idempotent requests on other backends
+	// when they fail or time out, and limits the number of retries. It is
+	// only used for HTTP routes.
+	RetryBudget *RetryBudget `json:"retry_budget,omitempty"`
+
+	// LoadBalancer optionally configures how the backends requests are
+	// sent to are chosen, which is at random by default. It is only used
+	// for HTTP routes.
+	LoadBalancer *LoadBalancer `json:"load_balancer,omitempty"`
+
+	// Mirror optionally sends copies of a proportion of requests to
+	// another service, for example to test a new version of a service
+	// with production traffic. It is only used for HTTP routes.
+	Mirror *Mirror `json:"mirror,omitempty"`
+}
+
+// Mirror is the request mirroring configuration of a route. Mirrored requests
+// are sent to a random backend of the service alongside the original request,
+// with their responses being discarded so that the mirror cannot affect
+// clients. Requests with bodies larger than 1MiB and upgrade requests, such as
+// WebSocket requests, are not mirrored.
+type Mirror struct {
+	// Service is the name of the discoverd service requests are mirrored
+	// to.
+	Service string `json:"service"`
+	// Percentage is the percentage of requests which are mirrored,
+	// between 0 and 100. It defaults to 100.
+	Percentage float64 `json:"percentage,omitempty"`
+}
+
+// LoadBalancer is the load balancing configuration of a route. Backends which
+// are unavailable are skipped in favour of the next backend the algorithm
+// chooses, and the backends of routes with weighted services are chosen from
+// the service picked by weight.
+type LoadBalancer struct {
+	// Algorithm is the algorithm used to choose backends, one of
+	// LoadBalancerRandom, LoadBalancerRoundRobin, LoadBalancerLeastRequests
+	// or LoadBalancerHash.
+	Algorithm string `json:"algorithm"`
+	// HashHeader and HashCookie are the request header or cookie whose
+	// value is hashed to choose a backend when Algorithm is
+	// LoadBalancerHash, one of which must be set. Requests without the
+	// header or cookie are sent to random backends.
+	HashHeader string `json:"hash_header,omitempty"`
+	HashCookie string `json:"hash_cookie,omitempty"`
+}
+
+// Algorithms which HTTP routes can use to choose the backends requests are
+// sent to
+const (
+	// LoadBalancerRandom chooses backends at random.
+	LoadBalancerRandom = "random"
+	// LoadBalancerRoundRobin chooses each backend in turn.
+	LoadBalancerRoundRobin = "round-robin"
+	// LoadBalancerLeastRequests chooses the backend with the fewest
+	// in-flight requests.
+	LoadBalancerLeastRequests = "least-requests"
+	// LoadBalancerHash consistently chooses the same backend for requests
+	// with the same value of a header or cookie.
+	LoadBalancerHash = "hash"
+)
+
+// CircuitBreaker is the circuit breaker configuration of a route. Each
+// router has a breaker for each of the route's backends, which opens after
+// the backend fails consecutive requests, stopping requests being sent to
+// it. Once the breaker has been open for its cooldown it becomes half-open,
+// letting a single request through which closes the breaker if it succeeds
+// and opens it again if it fails.
+type CircuitBreaker struct {
+	// ConsecutiveFailures is the number of consecutive failed requests
+	// (connection errors, timeouts and 5xx responses) which open a
+	// backend's breaker. It defaults to 5.
+	ConsecutiveFailures int `json:"consecutive_failures,omitempty"`
+	// Cooldown is how long a breaker stays open before it becomes
+	// half-open. It defaults to thirty seconds.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+}
+
+// RetryBudget is the retry budget of a route, which limits the retries of
+// failed requests made by each router to a proportion of its requests.
+// Requests which fail to connect to a backend are always retried within the
+// budget, and idempotent requests without a body are also retried after
+// errors and timeouts.
+type RetryBudget struct {
+	// Ratio is the maximum number of retries as a proportion of requests
+	// over the last ten seconds. It defaults to 0.2.
+	Ratio float64 `json:"ratio,omitempty"`
+	// MinRetriesPerSecond is the number of retries which are allowed
+	// regardless of Ratio, so that routes with few requests can still
+	// retry them. It defaults to 10.
+	MinRetriesPerSecond int `json:"min_retries_per_second,omitempty"`
+}
+
+// States of a route's circuit breaker for a backend
+const (
+	CircuitBreakerClosed   = "closed"
+	CircuitBreakerOpen     = "open"
+	CircuitBreakerHalfOpen = "half-open"
+)
+
+// CircuitBreakerState is the state of a route's circuit breaker for one of
+// its backends.
+type CircuitBreakerState struct {
+	Backend string `json:"backend"`
+	State   string `json:"state"`
+	// Failures is the number of consecutive failed requests sent to the
+	// backend.
+	Failures int `json:"failures"`
+	// OpenedAt is when the breaker last opened, and is only set if it is
+	// open or half-open.
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// Compression is the response compression configuration of a route.
+// Responses which already have a Content-Encoding are never compressed.
+type Compression struct {
+	// MinSize is the minimum size in bytes of responses which are
+	// compressed, defaulting to 1024. Responses of unknown size are always
+	// compressed.
+	MinSize int64 `json:"min_size,omitempty"`
+	// Types are the content types of responses which are compressed, which
+	// may have a wildcard subtype such as "text/*". It defaults to common
+	// text based types.
+	Types []string `json:"types,omitempty"`
+}
+
+// Cache is the response cache configuration of a route. Each router caches
+// responses independently, keeping recently used responses in memory and
+// moving others to disk if the router has a cache directory configured.
+type Cache struct {
+	// MaxMemory is the maximum number of bytes of responses cached in
+	// memory, defaulting to 32MiB.
+	MaxMemory int64 `json:"max_memory,omitempty"`
+	// MaxDisk is the maximum number of bytes of responses cached on disk,
+	// with responses only being cached in memory if it is zero.
+	MaxDisk int64 `json:"max_disk,omitempty"`
+	// MaxObjectSize is the maximum size in bytes of a cached response
+	// body, defaulting to 1MiB.
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+}
+
+// CachePurge is sent to routers to remove cached responses.
+type CachePurge struct {
+	// RouteID is the ID of the route whose cache is purged.
+	RouteID string `json:"route_id"`
+	// Prefix limits the purge to responses to requests with paths starting
+	// with it, purging all responses if it is empty.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// BasicAuth is the HTTP basic auth configuration of a route.
+type BasicAuth struct {
+	// Realm is sent to clients in the WWW-Authenticate header, defaulting
+	// to "Restricted".
+	Realm string `json:"realm,omitempty"`
+	// Users maps usernames to bcrypt hashes of their passwords.
+	Users map[string]string `json:"users"`
+}
+
+// HeaderRules modify the headers of a request or response. Headers are
+// removed first, then set, then added.
+type HeaderRules struct {
+	// Set contains headers which are set, replacing any existing values.
+	Set map[string]string `json:"set,omitempty"`
+	// Add contains headers which are added alongside any existing values.
+	Add map[string]string `json:"add,omitempty"`
+	// Remove contains the names of headers which are removed.
+	Remove []string `json:"remove,omitempty"`
+}
+
+// Redirect redirects the requests of an HTTP route to another domain.
+type Redirect struct {
+	// Domain is the domain requests are redirected to, keeping their path
+	// and query.
+	Domain string `json:"domain"`
+	// Status is the status code of redirect responses, either 301 (the
+	// default) or 302.
+	Status int `json:"status,omitempty"`
+}
+
+// AccessLog configures the access logs of an HTTP route.
+type AccessLog struct {
+	// SampleRate is the proportion of requests which are logged, between
+	// 0 and 1. It defaults to 1 (every request is logged).
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// HealthCheck is an active health check of a route's backends. Backends of
+// HTTP routes are checked with an HTTP request, and backends of TCP routes by
+// connecting to them.
+type HealthCheck struct {
+	// Path is the path requested from backends of HTTP routes, which must
+	// respond with a 200 status to pass the check. It defaults to "/".
+	Path string `json:"path,omitempty"`
+	// Interval is the time between checks, encoded in JSON as a duration
+	// string such as "5s". It defaults to five seconds.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Timeout is the maximum duration of a check, encoded in JSON as a
+	// duration string such as "2s". It defaults to two seconds.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// UnhealthyThreshold is the number of consecutive failed checks before
+	// a backend is ejected. It defaults to 2.
+	UnhealthyThreshold int `json:"unhealthy_threshold,omitempty"`
+	// HealthyThreshold is the number of consecutive passed checks before an
+	// ejected backend receives traffic again. It defaults to 2.
+	HealthyThreshold int `json:"healthy_threshold,omitempty"`
+}
+
+// healthCheck has the fields of HealthCheck but not its JSON methods
+type healthCheck HealthCheck
+
+// healthCheckJSON is the JSON encoding of a HealthCheck, with the interval and
+// timeout fields shadowing those of the embedded healthCheck
+type healthCheckJSON struct {
+	*healthCheck
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+func (h HealthCheck) MarshalJSON() ([]byte, error) {
+	v := &healthCheckJSON{healthCheck: (*healthCheck)(&h)}
+	if h.Interval != 0 {
+		v.Interval = h.Interval.String()
+	}
+	if h.Timeout != 0 {
+		v.Timeout = h.Timeout.String()
+	}
+	return json.Marshal(v)
+}
+
+func (h *HealthCheck) UnmarshalJSON(data []byte) error {
+	v := &healthCheckJSON{healthCheck: (*healthCheck)(h)}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	for _, d := range []struct {
+		name  string
+		s     string
+		value *time.Duration
+	}{
+		{"interval", v.Interval, &h.Interval},
+		{"timeout", v.Timeout, &h.Timeout},
+	} {
+		if d.s == "" {
+			continue
+		}
+		value, err := time.ParseDuration(d.s)
+		if err != nil {
+			return &json.UnmarshalTypeError{
+				Value: fmt.Sprintf("health check %s %q", d.name, d.s),
+				Type:  reflect.TypeOf(value),
+			}
+		}
+		*d.value = value
+	}
+	return nil
+}
+
+// Protocols which HTTP routes can use to proxy requests to their backends
+const (
+	BackendProtocolHTTP1 = "http1"
+	BackendProtocolH2C   = "h2c"
+)
+
+// Versions of the PROXY protocol which TCP routes can send to their backends
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// WeightedService is a service which receives a proportion of an HTTP route's
+// traffic
+type WeightedService struct {
+	// Service is the ID of the service.
+	Service string `json:"service"`
+	// Weight is the relative weight of the service, for example a service
+	// with weight 3 receives three times as many requests as a service with
+	// weight 1.
+	Weight int `json:"weight"`
 }
 
 func (r Route) FormattedID() string {
@@ -89,6 +473,37 @@ func (r Route) HTTPRoute() *HTTPRoute {
 		LegacyTLSKey:  r.LegacyTLSKey,
 		Sticky:        r.Sticky,
 		Path:          r.Path,
+		ReleaseID:     r.ReleaseID,
+		Services:      r.Services,
+		AutoTLS:       r.AutoTLS,
+
+		BackendProtocol: r.BackendProtocol,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+
+		AccessLog: r.AccessLog,
+
+		RequestHeaders:  r.RequestHeaders,
+		ResponseHeaders: r.ResponseHeaders,
+		HTTPSRedirect:   r.HTTPSRedirect,
+		Redirect:        r.Redirect,
+		StripPrefix:     r.StripPrefix,
+
+		AllowIPs:  r.AllowIPs,
+		DenyIPs:   r.DenyIPs,
+		BasicAuth: r.BasicAuth,
+
+		Cache:       r.Cache,
+		Compression: r.Compression,
+
+		UpstreamTimeout: r.UpstreamTimeout,
+		CircuitBreaker:  r.CircuitBreaker,
+		RetryBudget:     r.RetryBudget,
+		LoadBalancer:    r.LoadBalancer,
+		Mirror:          r.Mirror,
 	}
 }
 
@@ -102,7 +517,46 @@ func (r Route) TCPRoute() *TCPRoute {
 		CreatedAt:     r.CreatedAt,
 		UpdatedAt:     r.UpdatedAt,
 
-		Port: int(r.Port),
+		Port:          int(r.Port),
+		ProxyProtocol: r.ProxyProtocol,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+	}
+}
+
+func (r Route) TLSRoute() *TLSRoute {
+	return &TLSRoute{
+		ID:            r.ID,
+		ParentRef:     r.ParentRef,
+		Service:       r.Service,
+		Leader:        r.Leader,
+		DrainBackends: r.DrainBackends,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+
+		Domain: r.Domain,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+	}
+}
+
+func (r Route) UDPRoute() *UDPRoute {
+	return &UDPRoute{
+		ID:        r.ID,
+		ParentRef: r.ParentRef,
+		Service:   r.Service,
+		Leader:    r.Leader,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+
+		Port:        int(r.Port),
+		IdleTimeout: r.IdleTimeout,
 	}
 }
 
@@ -122,6 +576,37 @@ type HTTPRoute struct {
 	LegacyTLSKey  string       `json:"tls_key,omitempty"`
 	Sticky        bool
 	Path          string
+	ReleaseID     string
+	Services      []*WeightedService
+	AutoTLS       bool
+
+	BackendProtocol string
+
+	RateLimit      float64
+	RateLimitBurst int
+	MaxConns       int
+	HealthCheck    *HealthCheck
+
+	AccessLog *AccessLog
+
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+	HTTPSRedirect   bool
+	Redirect        *Redirect
+	StripPrefix     bool
+
+	AllowIPs  []string
+	DenyIPs   []string
+	BasicAuth *BasicAuth
+
+	Cache       *Cache
+	Compression *Compression
+
+	UpstreamTimeout time.Duration
+	CircuitBreaker  *CircuitBreaker
+	RetryBudget     *RetryBudget
+	LoadBalancer    *LoadBalancer
+	Mirror          *Mirror
 }
 
 func (r HTTPRoute) FormattedID() string {
@@ -151,6 +636,37 @@ func (r HTTPRoute) ToRoute() *Route {
 		LegacyTLSKey:  r.LegacyTLSKey,
 		Sticky:        r.Sticky,
 		Path:          r.Path,
+		ReleaseID:     r.ReleaseID,
+		Services:      r.Services,
+		AutoTLS:       r.AutoTLS,
+
+		BackendProtocol: r.BackendProtocol,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+
+		AccessLog: r.AccessLog,
+
+		RequestHeaders:  r.RequestHeaders,
+		ResponseHeaders: r.ResponseHeaders,
+		HTTPSRedirect:   r.HTTPSRedirect,
+		Redirect:        r.Redirect,
+		StripPrefix:     r.StripPrefix,
+
+		AllowIPs:  r.AllowIPs,
+		DenyIPs:   r.DenyIPs,
+		BasicAuth: r.BasicAuth,
+
+		Cache:       r.Cache,
+		Compression: r.Compression,
+
+		UpstreamTimeout: r.UpstreamTimeout,
+		CircuitBreaker:  r.CircuitBreaker,
+		RetryBudget:     r.RetryBudget,
+		LoadBalancer:    r.LoadBalancer,
+		Mirror:          r.Mirror,
 	}
 }
 
@@ -164,7 +680,13 @@ type TCPRoute struct {
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 
-	Port int
+	Port          int
+	ProxyProtocol string
+
+	RateLimit      float64
+	RateLimitBurst int
+	MaxConns       int
+	HealthCheck    *HealthCheck
 }
 
 func (r TCPRoute) FormattedID() string {
@@ -186,7 +708,97 @@ func (r TCPRoute) ToRoute() *Route {
 		CreatedAt:     r.CreatedAt,
 		UpdatedAt:     r.UpdatedAt,
 
-		Port: int32(r.Port),
+		Port:          int32(r.Port),
+		ProxyProtocol: r.ProxyProtocol,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+	}
+}
+
+// TLSRoute is a TLS passthrough Route, which routes connections to the shared
+// HTTPS port by the server name sent in their TLS ClientHello and forwards
+// them to backends without terminating TLS.
+type TLSRoute struct {
+	ID            string
+	ParentRef     string
+	Service       string
+	Leader        bool
+	DrainBackends bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+
+	Domain string
+
+	RateLimit      float64
+	RateLimitBurst int
+	MaxConns       int
+	HealthCheck    *HealthCheck
+}
+
+func (r TLSRoute) FormattedID() string {
+	return "tls/" + r.ID
+}
+
+func (r TLSRoute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.ToRoute())
+}
+
+func (r TLSRoute) ToRoute() *Route {
+	return &Route{
+		Type:          "tls",
+		ID:            r.ID,
+		ParentRef:     r.ParentRef,
+		Service:       r.Service,
+		Leader:        r.Leader,
+		DrainBackends: r.DrainBackends,
+		CreatedAt:     r.CreatedAt,
+		UpdatedAt:     r.UpdatedAt,
+
+		Domain: r.Domain,
+
+		RateLimit:      r.RateLimit,
+		RateLimitBurst: r.RateLimitBurst,
+		MaxConns:       r.MaxConns,
+		HealthCheck:    r.HealthCheck,
+	}
+}
+
+// UDPRoute is a UDP Route.
+type UDPRoute struct {
+	ID        string
+	ParentRef string
+	Service   string
+	Leader    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	Port        int
+	IdleTimeout time.Duration
+}
+
+func (r UDPRoute) FormattedID() string {
+	return "udp/" + r.ID
+}
+
+func (r UDPRoute) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.ToRoute())
+}
+
+func (r UDPRoute) ToRoute() *Route {
+	return &Route{
+		Type:      "udp",
+		ID:        r.ID,
+		ParentRef: r.ParentRef,
+		Service:   r.Service,
+		Leader:    r.Leader,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+
+		Port:        int32(r.Port),
+		IdleTimeout: r.IdleTimeout,
 	}
 }
 
@@ -198,6 +810,11 @@ const (
 	EventTypeBackendUp      EventType = "backend-up"
 	EventTypeBackendDown    EventType = "backend-down"
 	EventTypeBackendDrained EventType = "backend-drained"
+
+	// EventTypeBackendEjected and EventTypeBackendRestored are sent when a
+	// backend fails or passes a route's active health check
+	EventTypeBackendEjected  EventType = "backend-ejected"
+	EventTypeBackendRestored EventType = "backend-restored"
 )
 
 type Event struct {
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/cache"
+	"github.com/flynn/flynn/router/proxy"
+	"github.com/flynn/flynn/router/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultUDPIdleTimeout is how long the session of a UDP client is kept
+	// after its last datagram if the route does not set an idle timeout
+	defaultUDPIdleTimeout = time.Minute
+
+	// maxDatagramSize is the maximum size of a UDP datagram
+	maxDatagramSize = 65535
+)
+
+// maxUDPSessions is the maximum number of sessions of a UDP route, with
+// datagrams from new clients being dropped once it is reached so that a flood
+// of datagrams from spoofed addresses can't exhaust the router's sockets
+var maxUDPSessions = 10000
+
+// UDPListener serves UDP routes, forwarding the datagrams received on each
+// route's port to the backends of its service.
+//
+// The datagrams of each client address are forwarded to the same backend
+// through a session with its own socket, so that replies from the backend can
+// be sent back to the client. Sessions are closed once they have been idle
+// for the route's idle timeout.
+type UDPListener struct {
+	Watcher
+	DataStoreReader
+
+	IP string
+
+	discoverd DiscoverdClient
+	ds        DataStore
+	wm        *WatchManager
+	stopSync  func()
+	metrics   *Metrics
+
+	startPort     int
+	endPort       int
+	reservedPorts []int
+	conns         map[int]net.PacketConn
+
+	mtx      sync.RWMutex
+	services map[string]*service
+	routes   map[string]*udpRoute
+	ports    map[int]*udpRoute
+	closed   bool
+}
+
+func (l *UDPListener) AddRoute(route *router.Route) error {
+	r := route.UDPRoute()
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	for _, port := range l.reservedPorts {
+		if r.Port == port {
+			return fmt.Errorf("cannot bind to reserved port %d", port)
+		}
+	}
+	if r.Port == 0 {
+		return l.addWithAllocatedPort(route)
+	}
+	return l.ds.Add(route)
+}
+
+func (l *UDPListener) UpdateRoute(route *router.Route) error {
+	r := route.UDPRoute()
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if r.Port == 0 {
+		return errors.New("router: a port number needs to be specified")
+	}
+	return l.ds.Update(route)
+}
+
+// addWithAllocatedPort adds the route using the first free port in the port
+// range which is not taken by another route (it must be called with l.mtx
+// held)
+func (l *UDPListener) addWithAllocatedPort(route *router.Route) error {
+	r := route.UDPRoute()
+	for r.Port = range l.conns {
+		tempRoute := r.ToRoute()
+		if err := l.ds.Add(tempRoute); err == nil {
+			*route = *tempRoute
+			return nil
+		}
+	}
+	return ErrNoPorts
+}
+
+func (l *UDPListener) RemoveRoute(id string) error {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	return l.ds.Remove(id)
+}
+
+func (l *UDPListener) Start() error {
+	ctx := context.Background()
+	ctx, l.stopSync = context.WithCancel(ctx)
+
+	if l.Watcher != nil {
+		return errors.New("router: udp listener already started")
+	}
+	if l.wm == nil {
+		l.wm = NewWatchManager()
+	}
+	l.Watcher = l.wm
+
+	if l.ds == nil {
+		return errors.New("router: udp listener missing data store")
+	}
+	l.DataStoreReader = l.ds
+
+	l.services = make(map[string]*service)
+	l.routes = make(map[string]*udpRoute)
+	l.ports = make(map[int]*udpRoute)
+	l.conns = make(map[int]net.PacketConn)
+
+	if l.startPort != 0 && l.endPort != 0 {
+		for i := l.startPort; i <= l.endPort; i++ {
+			addr := fmt.Sprintf("%s:%d", l.IP, i)
+			conn, err := listenPacketFunc("udp4", addr)
+			if err != nil {
+				l.Close()
+				return listenErr{addr, err}
+			}
+			l.conns[i] = conn
+		}
+	}
+
+	if err := l.startSync(ctx); err != nil {
+		l.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (l *UDPListener) startSync(ctx context.Context) error {
+	errc := make(chan error)
+	startc := l.doSync(ctx, errc)
+
+	select {
+	case err := <-errc:
+		return err
+	case <-startc:
+		go l.runSync(ctx, errc)
+		return nil
+	}
+}
+
+func (l *UDPListener) runSync(ctx context.Context, errc chan error) {
+	err := <-errc
+
+	for {
+		if err == nil {
+			return
+		}
+		log.Printf("router: udp sync error: %s", err)
+
+		time.Sleep(2 * time.Second)
+
+		l.doSync(ctx, errc)
+
+		err = <-errc
+	}
+}
+
+func (l *UDPListener) doSync(ctx context.Context, errc chan<- error) <-chan struct{} {
+	startc := make(chan struct{})
+
+	go func() { errc <- l.ds.Sync(ctx, &udpSyncHandler{l: l}, startc) }()
+
+	return startc
+}
+
+func (l *UDPListener) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.stopSync()
+	for _, r := range l.routes {
+		r.Stop().Close()
+	}
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+	for _, service := range l.services {
+		service.Close()
+	}
+	l.closed = true
+	return nil
+}
+
+// releasePort either keeps the socket of a port in the port range so that it
+// can be allocated to another route, or closes it (it must be called with
+// l.mtx held)
+func (l *UDPListener) releasePort(port int, conn net.PacketConn) {
+	if port >= l.startPort && port <= l.endPort {
+		l.conns[port] = conn
+		return
+	}
+	conn.Close()
+}
+
+// acquireService returns the service with the given name, creating it if it
+// does not exist, and increments its reference count (it must be called with
+// l.mtx held)
+func (l *UDPListener) acquireService(name string) (*service, error) {
+	service, ok := l.services[name]
+	if !ok {
+		sc, err := cache.New(l.discoverd.Service(name))
+		if err != nil {
+			return nil, err
+		}
+		service = newService(name, sc, l.wm, false)
+		l.services[name] = service
+	}
+	service.refs++
+	return service, nil
+}
+
+// releaseService decrements the reference count of the given service,
+// closing it if it is no longer referenced by any routes (it must be called
+// with l.mtx held)
+func (l *UDPListener) releaseService(service *service) {
+	service.refs--
+	if service.refs <= 0 {
+		service.Close()
+		delete(l.services, service.name)
+	}
+}
+
+type udpSyncHandler struct {
+	l *UDPListener
+}
+
+func (h *udpSyncHandler) Current() map[string]struct{} {
+	h.l.mtx.RLock()
+	defer h.l.mtx.RUnlock()
+	ids := make(map[string]struct{}, len(h.l.routes))
+	for id := range h.l.routes {
+		ids[id] = struct{}{}
+	}
+	return ids
+}
+
+func (h *udpSyncHandler) Set(data *router.Route) error {
+	route := data.UDPRoute()
+	r := &udpRoute{
+		UDPRoute: route,
+		addr:     h.l.IP + ":" + strconv.Itoa(route.Port),
+		sessions: make(map[string]*udpSession),
+		done:     make(chan struct{}),
+	}
+
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+
+	service, err := h.l.acquireService(r.Service)
+	if err != nil {
+		return err
+	}
+	r.service = service
+	if r.Leader {
+		r.backends = service.sc.LeaderAddr
+	} else {
+		r.backends = service.sc.Addrs
+	}
+	r.metrics = h.l.metrics.Route(data, service.sc.Addrs)
+
+	// the port of a route cannot be updated, so an updated route takes
+	// over the socket of the previous version
+	if prev, ok := h.l.routes[data.ID]; ok {
+		r.conn = prev.Stop()
+		h.l.releaseService(prev.service)
+	} else if conn, ok := h.l.conns[r.Port]; ok {
+		r.conn = conn
+		delete(h.l.conns, r.Port)
+	} else {
+		conn, err := listenPacketFunc("udp4", r.addr)
+		if err != nil {
+			h.l.releaseService(service)
+			return listenErr{r.addr, err}
+		}
+		r.conn = conn
+	}
+	go r.Serve()
+	h.l.routes[data.ID] = r
+	h.l.ports[r.Port] = r
+
+	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteSet, ID: data.ID, Route: r.ToRoute()})
+	return nil
+}
+
+func (h *udpSyncHandler) Remove(id string) error {
+	h.l.mtx.Lock()
+	defer h.l.mtx.Unlock()
+	if h.l.closed {
+		return nil
+	}
+	r, ok := h.l.routes[id]
+	if !ok {
+		return ErrNotFound
+	}
+	h.l.releasePort(r.Port, r.Stop())
+	h.l.metrics.RemoveRoute(r.ToRoute())
+	h.l.releaseService(r.service)
+
+	delete(h.l.routes, id)
+	delete(h.l.ports, r.Port)
+	go h.l.wm.Send(&router.Event{Event: router.EventTypeRouteRemove, ID: id, Route: r.ToRoute()})
+	return nil
+}
+
+type udpRoute struct {
+	*router.UDPRoute
+	addr     string
+	conn     net.PacketConn
+	service  *service
+	backends proxy.BackendListFunc
+	metrics  *routeMetrics
+
+	mtx      sync.Mutex
+	sessions map[string]*udpSession
+	stopped  bool
+
+	// done is closed when Serve returns
+	done chan struct{}
+}
+
+func (r *udpRoute) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+// Serve forwards datagrams received from clients to their sessions until the
+// route is stopped
+func (r *udpRoute) Serve() {
+	defer close(r.done)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			r.mtx.Lock()
+			stopped := r.stopped
+			r.mtx.Unlock()
+			if stopped {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Printf("router: error reading from %s: %s", r.addr, err)
+			return
+		}
+		if s := r.session(addr); s != nil {
+			s.Write(buf[:n])
+		}
+	}
+}
+
+// Stop stops serving the route and closes its sessions, returning its socket
+// so that it can either be closed or used by another route
+func (r *udpRoute) Stop() net.PacketConn {
+	r.mtx.Lock()
+	r.stopped = true
+	sessions := make([]*udpSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mtx.Unlock()
+
+	// unblock ReadFrom by setting a deadline in the past
+	r.conn.SetReadDeadline(time.Unix(1, 0))
+	<-r.done
+	r.conn.SetReadDeadline(time.Time{})
+
+	for _, s := range sessions {
+		s.conn.Close()
+	}
+	return r.conn
+}
+
+// session returns the session of the given client address, starting a new
+// session with a random backend if it does not have one, or nil if there are
+// no backends available or the route has the maximum number of sessions
+func (r *udpRoute) session(client net.Addr) *udpSession {
+	key := client.String()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if s, ok := r.sessions[key]; ok {
+		return s
+	}
+	if r.stopped || len(r.sessions) >= maxUDPSessions {
+		return nil
+	}
+	backends := r.backends()
+	if len(backends) == 0 {
+		return nil
+	}
+	backend := backends[rand.Intn(len(backends))]
+	conn, err := net.Dial("udp", backend)
+	if err != nil {
+		r.metrics.ObserveDialError(backend)
+		return nil
+	}
+	s := &udpSession{
+		route:   r,
+		key:     key,
+		client:  client,
+		backend: backend,
+		conn:    conn,
+	}
+	s.touch()
+	r.sessions[key] = s
+	r.metrics.SessionStarted()
+	go s.serveReplies()
+	return s
+}
+
+// udpSession forwards the datagrams of a client to a backend through a
+// socket connected to the backend, and the replies received on that socket
+// back to the client
+type udpSession struct {
+	route   *udpRoute
+	key     string
+	client  net.Addr
+	backend string
+	conn    net.Conn
+
+	// lastActive is the time of the session's last datagram in
+	// nanoseconds since the Unix epoch, and is accessed atomically along
+	// with the byte counts
+	lastActive int64
+	bytesIn    int64
+	bytesOut   int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+// Write forwards a datagram from the client to the backend
+func (s *udpSession) Write(p []byte) {
+	s.touch()
+	if n, err := s.conn.Write(p); err == nil {
+		atomic.AddInt64(&s.bytesIn, int64(n))
+	}
+}
+
+// serveReplies forwards datagrams from the backend to the client until the
+// session is idle for the route's idle timeout or its socket is closed
+func (s *udpSession) serveReplies() {
+	defer s.close()
+	timeout := s.route.idleTimeout()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		s.conn.SetReadDeadline(s.idleSince().Add(timeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			// datagrams from the client may have been forwarded since
+			// the deadline was set
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(s.idleSince()) < timeout {
+				continue
+			}
+			return
+		}
+		s.touch()
+		if n, err := s.route.conn.WriteTo(buf[:n], s.client); err == nil {
+			atomic.AddInt64(&s.bytesOut, int64(n))
+		}
+	}
+}
+
+func (s *udpSession) close() {
+	s.conn.Close()
+	r := s.route
+	r.mtx.Lock()
+	if r.sessions[s.key] == s {
+		delete(r.sessions, s.key)
+	}
+	r.mtx.Unlock()
+	r.metrics.SessionFinished(s.backend, atomic.LoadInt64(&s.bytesIn), atomic.LoadInt64(&s.bytesOut))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/flynn/flynn/discoverd/testutil"
+	"github.com/flynn/flynn/pkg/attempt"
+	"github.com/flynn/flynn/pkg/httphelper"
+	"github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func (s *S) newUDPListener(t testutil.TestingT) *UDPListener {
+	l := &UDPListener{
+		IP:        "127.0.0.1",
+		ds:        NewPostgresDataStore("udp", s.pgx),
+		discoverd: s.discoverd,
+	}
+	l.startPort, l.endPort = allocatePortRange(10)
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// newUDPEchoServer starts a UDP server which replies to each datagram with
+// the given prefix followed by the datagram
+func newUDPEchoServer(c *C, prefix string) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(prefix), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+func assertUDPEcho(c *C, conn net.Conn, prefix string) {
+	_, err := conn.Write([]byte("asdf"))
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(waitTimeout))
+	buf := make([]byte, maxDatagramSize)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf[:n]), Equals, prefix+"asdf")
+}
+
+func (s *S) TestAddUDPRoute(c *C) {
+	l := s.newUDPListener(c)
+	defer l.Close()
+
+	route := addRoute(c, l, router.UDPRoute{Service: "test"}.ToRoute())
+	port := route.UDPRoute().Port
+	c.Assert(port >= l.startPort && port <= l.endPort, Equals, true)
+
+	srv1 := newUDPEchoServer(c, "1")
+	defer srv1.Close()
+	discoverdRegisterUDPService(c, l, "test", srv1.LocalAddr().String())
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	c.Assert(err, IsNil)
+	defer client.Close()
+	assertUDPEcho(c, client, "1")
+
+	// datagrams from the same client keep being forwarded to the same
+	// backend once another backend is added
+	srv2 := newUDPEchoServer(c, "2")
+	defer srv2.Close()
+	discoverdRegisterUDPService(c, l, "test", srv2.LocalAddr().String())
+	for i := 0; i < 10; i++ {
+		assertUDPEcho(c, client, "1")
+	}
+
+	// the port is released for other routes once the route is removed
+	removeRoute(c, l, route.ID)
+	l.mtx.RLock()
+	_, ok := l.conns[port]
+	l.mtx.RUnlock()
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestUDPSessionIdleTimeout(c *C) {
+	l := s.newUDPListener(c)
+	defer l.Close()
+
+	route := addRoute(c, l, router.UDPRoute{Service: "test", IdleTimeout: 100 * time.Millisecond}.ToRoute())
+	srv := newUDPEchoServer(c, "1")
+	defer srv.Close()
+	discoverdRegisterUDPService(c, l, "test", srv.LocalAddr().String())
+
+	client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: route.UDPRoute().Port})
+	c.Assert(err, IsNil)
+	defer client.Close()
+	assertUDPEcho(c, client, "1")
+
+	sessions := func() int {
+		l.mtx.RLock()
+		r := l.routes[route.ID]
+		l.mtx.RUnlock()
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		return len(r.sessions)
+	}
+	c.Assert(sessions(), Equals, 1)
+
+	// the session is closed once it is idle
+	err = attempt.Strategy{Total: 5 * time.Second, Delay: 50 * time.Millisecond}.Run(func() error {
+		if sessions() != 0 {
+			return errors.New("session not closed")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+
+	// a new session is started for the next datagram
+	assertUDPEcho(c, client, "1")
+	c.Assert(sessions(), Equals, 1)
+}
+
+func (s *S) TestUDPSessionLimit(c *C) {
+	defer func(max int) { maxUDPSessions = max }(maxUDPSessions)
+	maxUDPSessions = 2
+
+	l := s.newUDPListener(c)
+	defer l.Close()
+
+	route := addRoute(c, l, router.UDPRoute{Service: "test", IdleTimeout: 500 * time.Millisecond}.ToRoute())
+	srv := newUDPEchoServer(c, "1")
+	defer srv.Close()
+	discoverdRegisterUDPService(c, l, "test", srv.LocalAddr().String())
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: route.UDPRoute().Port}
+	clients := make([]*net.UDPConn, 3)
+	for i := range clients {
+		client, err := net.DialUDP("udp4", nil, addr)
+		c.Assert(err, IsNil)
+		defer client.Close()
+		clients[i] = client
+	}
+	assertUDPEcho(c, clients[0], "1")
+	assertUDPEcho(c, clients[1], "1")
+
+	// datagrams from new clients are dropped once the route has the
+	// maximum number of sessions
+	_, err := clients[2].Write([]byte("asdf"))
+	c.Assert(err, IsNil)
+	clients[2].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = clients[2].Read(make([]byte, maxDatagramSize))
+	c.Assert(err, NotNil)
+
+	// but existing clients are unaffected, and new clients are served
+	// once other sessions have closed
+	assertUDPEcho(c, clients[0], "1")
+	err = attempt.Strategy{Total: 5 * time.Second, Delay: 100 * time.Millisecond}.Run(func() error {
+		if _, err := clients[2].Write([]byte("asdf")); err != nil {
+			return err
+		}
+		clients[2].SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := clients[2].Read(make([]byte, maxDatagramSize))
+		return err
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestUDPRouteValidation(c *C) {
+	l := s.newUDPListener(c)
+	defer l.Close()
+
+	err := l.AddRoute(router.UDPRoute{Service: "test", IdleTimeout: -time.Second}.ToRoute())
+	c.Assert(err, NotNil)
+	c.Assert(err.(httphelper.JSONError).Code, Equals, httphelper.ValidationErrorCode)
+}
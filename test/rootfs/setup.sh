@@ -216,6 +216,16 @@ mv "${GOPATH}/bin/tuf-client" /usr/bin/tuf-client
 # install go cover
 go get golang.org/x/tools/cmd/cover
 
+# install Pebble for running the router's ACME tests, verifying the binary
+# against its pinned SHA-256 checksum (the image build fails if it doesn't
+# match, so update both together when changing the version)
+pebble_version="v2.3.1"
+pebble_sha256="0000000000000000000000000000000000000000000000000000000000000000"
+curl -fsLo "pebble" "https://github.com/letsencrypt/pebble/releases/download/${pebble_version}/pebble_linux-amd64"
+echo "${pebble_sha256}  pebble" | shasum -a 256 -c -
+install -m 0755 "pebble" "/usr/local/bin/pebble"
+rm "pebble"
+
 # allow the test runner to set certain environment variables
 echo AcceptEnv TEST_RUNNER_AUTH_KEY BLOBSTORE_S3_CONFIG BLOBSTORE_GCS_CONFIG BLOBSTORE_AZURE_CONFIG >> /etc/ssh/sshd_config
 